@@ -30,11 +30,21 @@ func (pc ProjectConfig) Build(cfg *ConfigBuilder.Config) error {
 		EnvironmentID string `env:"FLAGS_ENVIRONMENT_ID" envDefault:"orchestrator"`
 	}
 
+	// APIKeys are the keys api keys are signed with, comma separated id:algorithm:base64 key entries, and the id
+	// of the one new keys are signed with when it isn't the first. LegacySecret is the plain HS256 secret keys
+	// issued before the ring were signed with, they carry no kid
+	type APIKeys struct {
+		SigningKeys  string `env:"API_KEY_SIGNING_KEYS"`
+		SigningKeyID string `env:"API_KEY_SIGNING_KEY_ID"`
+		LegacySecret string `env:"API_KEY_LEGACY_SECRET"`
+	}
+
 	type PC struct {
 		StripeSecret string `env:"STRIPE_SECRET" envDefault:"stripe_secret"`
 		RailwayPort  string `env:"PORT" envDefault:"3000"`
 		OnRailway    bool   `env:"ON_RAILWAY" envDefault:"false"`
 		Flags        FlagsService
+		APIKeys      APIKeys
 	}
 	p := PC{}
 
@@ -52,6 +62,10 @@ func (pc ProjectConfig) Build(cfg *ConfigBuilder.Config) error {
 	cfg.ProjectProperties["flags_environment"] = p.Flags.EnvironmentID
 	cfg.ProjectProperties["flags_project"] = p.Flags.ProjectID
 
+	cfg.ProjectProperties["api_key_signing_keys"] = p.APIKeys.SigningKeys
+	cfg.ProjectProperties["api_key_signing_key_id"] = p.APIKeys.SigningKeyID
+	cfg.ProjectProperties["api_key_legacy_secret"] = p.APIKeys.LegacySecret
+
 	return nil
 }
 
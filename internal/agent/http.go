@@ -7,9 +7,10 @@ import (
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/flags-gg/orchestrator/internal/authz"
 	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/environment"
-	ConfigBuilder "github.com/keloran/go-config"
 )
 
 type Details struct {
@@ -20,12 +21,12 @@ type Details struct {
 }
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -57,7 +58,7 @@ func (s *System) GetAgentsRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -97,7 +98,7 @@ func (s *System) GetProjectAgents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -108,6 +109,10 @@ func (s *System) GetProjectAgents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, r.PathValue("projectId")) {
+		return
+	}
+
 	projectId := r.PathValue("projectId")
 	agents, err := s.GetAgentsForProject(ctx, companyId, projectId)
 	if err != nil {
@@ -134,7 +139,7 @@ func (s *System) GetAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -144,6 +149,10 @@ func (s *System) GetAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
 	agentId := r.PathValue("agentId")
 	details, err := s.GetAgentDetails(ctx, agentId, companyId)
 	if err != nil {
@@ -167,7 +176,7 @@ func (s *System) UpdateAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -178,6 +187,10 @@ func (s *System) UpdateAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
 	agentId := r.PathValue("agentId")
 	agent := Agent{}
 	if err := json.NewDecoder(r.Body).Decode(&agent); err != nil {
@@ -205,7 +218,7 @@ func (s *System) DeleteAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -216,8 +229,12 @@ func (s *System) DeleteAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
 	agentId := r.PathValue("agentId")
-	if err := environment.NewSystem(s.Config).DeleteAllEnvironmentsForAgent(ctx, agentId); err != nil {
+	if err := environment.NewSystem(s.Container).DeleteAllEnvironmentsForAgent(ctx, agentId); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -239,7 +256,7 @@ func (s *System) CreateAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -250,6 +267,10 @@ func (s *System) CreateAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, r.PathValue("projectId")) {
+		return
+	}
+
 	projectId := r.PathValue("projectId")
 	agent := Agent{}
 	if err := json.NewDecoder(r.Body).Decode(&agent); err != nil {
@@ -263,7 +284,7 @@ func (s *System) CreateAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = environment.NewSystem(s.Config).CreateEnvironmentInDB(ctx, "Default Env", agentId)
+	_, err = environment.NewSystem(s.Container).CreateEnvironmentInDB(ctx, "Default Env", agentId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
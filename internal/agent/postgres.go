@@ -3,9 +3,8 @@ package agent
 import (
 	"context"
 	"errors"
-	"strings"
 
-	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/flags-gg/orchestrator/internal/bus"
 	"github.com/flags-gg/orchestrator/internal/environment"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -28,22 +27,9 @@ type Agent struct {
 }
 
 func (s *System) CreateAgentForProject(ctx context.Context, name, projectId string) (string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", nil
-		}
-		return "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	agentId := uuid.New().String()
 
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     INSERT INTO public.agent (
         project_id,
         agent_id,
@@ -55,29 +41,18 @@ func (s *System) CreateAgentForProject(ctx context.Context, name, projectId stri
     ), $2, $3)`, projectId, agentId, name); err != nil {
 		return "", s.Config.Bugfixes.Logger.Errorf("Failed to insert agent into database: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionCreated, agentId)
 
 	return agentId, nil
 }
 
 func (s *System) GetAgentDetails(ctx context.Context, agentId, companyId string) (*Agent, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
+	var err error
 	agent := &Agent{
 		AgentId:     agentId,
 		ProjectInfo: &ProjectInfo{},
 	}
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
       agent.id,
       agent.name AS AgentName,
@@ -109,7 +84,7 @@ func (s *System) GetAgentDetails(ctx context.Context, agentId, companyId string)
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 	}
 
-	agent.Environments, err = environment.NewSystem(s.Config).GetAgentEnvironmentsFromDB(ctx, agentId, companyId)
+	agent.Environments, err = environment.NewSystem(s.Container).GetAgentEnvironmentsFromDB(ctx, agentId, companyId)
 	if err != nil {
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to get agent environments: %v", err)
 	}
@@ -118,20 +93,7 @@ func (s *System) GetAgentDetails(ctx context.Context, agentId, companyId string)
 }
 
 func (s *System) GetAgents(ctx context.Context, companyId string) ([]*Agent, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
       agent.id,
       agent.name AS AgentName,
@@ -164,7 +126,7 @@ func (s *System) GetAgents(ctx context.Context, companyId string) ([]*Agent, err
 			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan database rows: %v", err)
 		}
 
-		//envs, err := environment.NewSystem(s.Config).SetContext(s.Context).GetAgentEnvironmentsFromDB(agent.AgentId, companyId)
+		//envs, err := environment.NewSystem(s.Container).SetContext(s.Context).GetAgentEnvironmentsFromDB(agent.AgentId, companyId)
 		//if err != nil {
 		//	return nil, s.Config.Bugfixes.Logger.Errorf("Failed to get agent environments: %v", err)
 		//}
@@ -178,20 +140,7 @@ func (s *System) GetAgents(ctx context.Context, companyId string) ([]*Agent, err
 }
 
 func (s *System) GetAgentsForProject(ctx context.Context, companyId, projectId string) ([]*Agent, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
       agent.id,
       agent.name AS AgentName,
@@ -298,20 +247,7 @@ func (s *System) GetAgentsForProject(ctx context.Context, companyId, projectId s
 func (s *System) ValidateAgentWithEnvironment(ctx context.Context, agentId, projectId, environmentId string) (bool, error) {
 	valid := false
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return false, nil
-		}
-		return false, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT TRUE
     FROM public.agent
       JOIN public.environment AS pa ON pa.agent_id = agent.id
@@ -334,20 +270,7 @@ func (s *System) ValidateAgentWithEnvironment(ctx context.Context, agentId, proj
 func (s *System) ValidateAgentWithoutEnvironment(ctx context.Context, agentId, projectId string) (bool, error) {
 	valid := false
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return false, nil
-		}
-		return false, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT TRUE
     FROM public.agent
       JOIN project ON project.id = agent.project_id
@@ -366,23 +289,10 @@ func (s *System) ValidateAgentWithoutEnvironment(ctx context.Context, agentId, p
 }
 
 func (s *System) CreateAgentInDB(ctx context.Context, name, projectId string) (*Agent, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	agentId := uuid.New().String()
 	var insertedAgentId string
 
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
       INSERT INTO public.agent (
           project_id,
           agent_id,
@@ -395,6 +305,7 @@ func (s *System) CreateAgentInDB(ctx context.Context, name, projectId string) (*
       RETURNING agent.id`, projectId, agentId, name).Scan(&insertedAgentId); err != nil {
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to insert agent into database: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionCreated, agentId)
 
 	return &Agent{
 		Id:      insertedAgentId,
@@ -404,70 +315,42 @@ func (s *System) CreateAgentInDB(ctx context.Context, name, projectId string) (*
 }
 
 func (s *System) UpdateAgentDetails(ctx context.Context, agent Agent) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	_, err = client.Exec(ctx, `
+	_, err := s.DB.Exec(ctx, `
     UPDATE public.agent
     SET name = $1, enabled = $2
     WHERE agent_id = $3`, agent.Name, agent.Enabled, agent.AgentId)
 	if err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update agent details: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionUpdated, agent.AgentId)
 
 	return nil
 }
 
 func (s *System) DeleteAgentFromDB(ctx context.Context, agentId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	_, err = client.Exec(ctx, `
+	_, err := s.DB.Exec(ctx, `
     DELETE FROM public.agent
     WHERE agent_id = $1`, agentId)
 	if err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to delete agent: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionDeleted, agentId)
 
 	return nil
 }
 
-func (s *System) DeleteAllAgentsForProject(ctx context.Context, projectId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
+// publishChange tells every environment of the agent it changed, the bus logs its own failures
+func (s *System) publishChange(ctx context.Context, action bus.Action, agentId string) {
+	_ = bus.Publish(ctx, bus.Event{
+		Kind:    bus.KindAgent,
+		Action:  action,
+		AgentID: agentId,
+	})
+}
 
+func (s *System) DeleteAllAgentsForProject(ctx context.Context, projectId string) error {
 	var agents []*Agent
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT agent_id
     FROM public.agent
     WHERE project_id = (
@@ -493,7 +376,7 @@ func (s *System) DeleteAllAgentsForProject(ctx context.Context, projectId string
 	}
 
 	for _, agent := range agents {
-		if err := environment.NewSystem(s.Config).DeleteAllEnvironmentsForAgent(ctx, agent.AgentId); err != nil {
+		if err := environment.NewSystem(s.Container).DeleteAllEnvironmentsForAgent(ctx, agent.AgentId); err != nil {
 			return s.Config.Bugfixes.Logger.Errorf("Failed to delete agent environments: %v", err)
 		}
 
@@ -50,14 +50,14 @@ func (s *Service) ValidateAgent(w http.ResponseWriter, r *http.Request) bool {
 		// validate agent
 		if environmentId != "" {
 			// validate environment
-			v, err := agent.NewSystem(s.Config).ValidateAgentWithEnvironment(ctx, agentId, projectId, environmentId)
+			v, err := agent.NewSystem(s.Container).ValidateAgentWithEnvironment(ctx, agentId, projectId, environmentId)
 			if err != nil {
 				return false
 			}
 			validAgent = v
 		}
 
-		v, err := agent.NewSystem(s.Config).ValidateAgentWithoutEnvironment(ctx, agentId, projectId)
+		v, err := agent.NewSystem(s.Container).ValidateAgentWithoutEnvironment(ctx, agentId, projectId)
 		if err != nil {
 			return validAgent
 		}
@@ -0,0 +1,135 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/jackc/pgx/v5"
+)
+
+// Kind is a resource a company owns, named by the id it's addressed with in the api
+type Kind string
+
+const (
+	Project     Kind = "project"
+	Agent       Kind = "agent"
+	Environment Kind = "environment"
+	Flag        Kind = "flag"
+	SecretMenu  Kind = "secret menu"
+)
+
+var (
+	ErrNotFound    = errors.New("resource not found")
+	ErrUnknownKind = errors.New("unknown resource kind")
+)
+
+// owners resolves the company of each kind of resource, all of them hang off a project
+var owners = map[Kind]string{
+	Project: `
+    SELECT company.company_id
+    FROM public.project
+      JOIN public.company ON company.id = project.company_id
+    WHERE project.project_id = $1`,
+	Agent: `
+    SELECT company.company_id
+    FROM public.agent
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE agent.agent_id = $1`,
+	Environment: `
+    SELECT company.company_id
+    FROM public.environment AS env
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE env.env_id = $1`,
+	Flag: `
+    SELECT company.company_id
+    FROM public.flag
+      JOIN public.environment AS env ON env.id = flag.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE flag.id = $1`,
+	SecretMenu: `
+    SELECT company.company_id
+    FROM public.secret_menu AS menu
+      JOIN public.environment AS env ON env.id = menu.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE menu.menu_id = $1`,
+}
+
+type System struct {
+	*container.Container
+}
+
+func NewSystem(c *container.Container) *System {
+	return &System{
+		Container: c,
+	}
+}
+
+// CompanyOf returns the company that owns the resource, or ErrNotFound when there's no such resource
+func (s *System) CompanyOf(ctx context.Context, kind Kind, id string) (string, error) {
+	query, ok := owners[kind]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+	if id == "" {
+		return "", ErrNotFound
+	}
+
+	var arg interface{} = id
+	if kind == Flag {
+		// flags are addressed by their serial id, anything else can't be one
+		flagId, err := strconv.Atoi(id)
+		if err != nil {
+			return "", ErrNotFound
+		}
+		arg = flagId
+	}
+
+	var companyId string
+	if err := s.DB.QueryRow(ctx, query, arg).Scan(&companyId); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", s.Config.Bugfixes.Logger.Errorf("Failed to get %s company: %v", kind, err)
+	}
+
+	return companyId, nil
+}
+
+// Check returns ErrNotFound unless the company owns the resource, another company's resource is one that doesn't
+// exist as far as the caller can tell
+func (s *System) Check(ctx context.Context, companyId string, kind Kind, id string) error {
+	owner, err := s.CompanyOf(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if companyId == "" || owner != companyId {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Allow checks the company owns the resource, when it doesn't the response is written and the handler returns
+func (s *System) Allow(w http.ResponseWriter, r *http.Request, companyId string, kind Kind, id string) bool {
+	if err := s.Check(r.Context(), companyId, kind, id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,272 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/docker/go-connections/nat"
+	"github.com/flags-gg/orchestrator/internal/container"
+	ConfigBuilder "github.com/keloran/go-config"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+type testContainer struct {
+	container testcontainers.Container
+	uri       string
+}
+
+func setupTestDatabase(c context.Context) (*testContainer, error) {
+	req := testcontainers.ContainerRequest{
+		Image:        "postgres:14-alpine",
+		ExposedPorts: []string{"5432/tcp"},
+		WaitingFor: wait.ForAll(
+			wait.ForLog("database system is ready to accept connections"),
+			wait.ForSQL("5432/tcp", "postgres", func(host string, port nat.Port) string {
+				return fmt.Sprintf("postgres://test:test@%s:%s/testdb?sslmode=disable", host, port.Port())
+			}),
+		).WithDeadline(time.Minute * 2),
+		Env: map[string]string{
+			"POSTGRES_DB":       "testdb",
+			"POSTGRES_USER":     "test",
+			"POSTGRES_PASSWORD": "test",
+		},
+	}
+
+	container, err := testcontainers.GenericContainer(c, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mappedPort, err := container.MappedPort(c, "5432")
+	if err != nil {
+		return nil, err
+	}
+
+	hostIP, err := container.Host(c)
+	if err != nil {
+		return nil, err
+	}
+
+	uri := fmt.Sprintf("postgres://test:test@%s:%s/testdb?sslmode=disable", hostIP, mappedPort.Port())
+	_ = os.Setenv("RDS_HOSTNAME", hostIP)
+	_ = os.Setenv("RDS_PORT", mappedPort.Port())
+	_ = os.Setenv("RDS_USERNAME", "test")
+	_ = os.Setenv("RDS_PASSWORD", "test")
+	_ = os.Setenv("RDS_DB", "testdb")
+
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			_ = logs.Errorf("Failed to close database connection: %v", err)
+		}
+	}()
+
+	// Create the tables a resource's company is resolved through
+	_, err = db.Exec(`
+		CREATE TABLE public.company (
+			id serial PRIMARY KEY,
+			company_id varchar(255) NOT NULL,
+			name varchar(255) NOT NULL
+		);
+
+		CREATE TABLE public.project (
+			id serial PRIMARY KEY,
+			company_id integer REFERENCES public.company(id),
+			project_id varchar(255) NOT NULL
+		);
+
+		CREATE TABLE public.agent (
+			id serial PRIMARY KEY,
+			agent_id varchar(255) NOT NULL,
+			project_id integer REFERENCES public.project(id)
+		);
+
+		CREATE TABLE public.environment (
+			id serial PRIMARY KEY,
+			env_id varchar(255) NOT NULL,
+			agent_id integer REFERENCES public.agent(id)
+		);
+
+		CREATE TABLE public.flag (
+			id serial PRIMARY KEY,
+			agent_id integer REFERENCES public.agent(id),
+			environment_id integer REFERENCES public.environment(id)
+		);
+
+		CREATE TABLE public.secret_menu (
+			id serial PRIMARY KEY,
+			menu_id varchar(255),
+			agent_id integer REFERENCES public.agent(id),
+			environment_id integer REFERENCES public.environment(id)
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert test data, a company each with one of everything
+	_, err = db.Exec(`
+		INSERT INTO public.company (company_id, name)
+		VALUES ('company-1', 'First'), ('company-2', 'Second');
+
+		INSERT INTO public.project (company_id, project_id)
+		VALUES (1, 'project-1'), (2, 'project-2');
+
+		INSERT INTO public.agent (agent_id, project_id)
+		VALUES ('agent-1', 1), ('agent-2', 2);
+
+		INSERT INTO public.environment (env_id, agent_id)
+		VALUES ('env-1', 1), ('env-2', 2);
+
+		INSERT INTO public.flag (agent_id, environment_id)
+		VALUES (1, 1), (2, 2);
+
+		INSERT INTO public.secret_menu (menu_id, agent_id, environment_id)
+		VALUES ('menu-1', 1, 1), ('menu-2', 2, 2)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testContainer{
+		container: container,
+		uri:       uri,
+	}, nil
+}
+
+func setupTestSystem(t *testing.T) *System {
+	c := ConfigBuilder.NewConfigNoVault()
+	if err := c.Build(ConfigBuilder.Database, ConfigBuilder.Bugfixes); err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+
+	cont, err := container.New(context.Background(), c)
+	if err != nil {
+		t.Fatalf("Failed to open database pool: %v", err)
+	}
+	t.Cleanup(cont.Close)
+
+	return NewSystem(cont)
+}
+
+func TestCompanyOfWithoutLookup(t *testing.T) {
+	s := NewSystem(&container.Container{})
+
+	tests := []struct {
+		name string
+		kind Kind
+		id   string
+		err  error
+	}{
+		{name: "Unknown kind", kind: Kind("segment"), id: "segment-1", err: ErrUnknownKind},
+		{name: "No id", kind: Project, id: "", err: ErrNotFound},
+		{name: "Flag id that isn't a number", kind: Flag, id: "1 OR true", err: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.CompanyOf(context.Background(), tt.kind, tt.id)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestCompanyOf(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	s := setupTestSystem(t)
+
+	tests := []struct {
+		kind Kind
+		id   string
+		want string
+	}{
+		{kind: Project, id: "project-1", want: "company-1"},
+		{kind: Project, id: "project-2", want: "company-2"},
+		{kind: Agent, id: "agent-2", want: "company-2"},
+		{kind: Environment, id: "env-2", want: "company-2"},
+		{kind: Flag, id: "2", want: "company-2"},
+		{kind: SecretMenu, id: "menu-2", want: "company-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.kind)+" "+tt.id, func(t *testing.T) {
+			companyId, err := s.CompanyOf(ctx, tt.kind, tt.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, companyId)
+		})
+	}
+
+	_, err = s.CompanyOf(ctx, Agent, "agent-3")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCheckRejectsOtherCompanies(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	s := setupTestSystem(t)
+
+	resources := []struct {
+		kind  Kind
+		own   string
+		other string
+	}{
+		{kind: Project, own: "project-1", other: "project-2"},
+		{kind: Agent, own: "agent-1", other: "agent-2"},
+		{kind: Environment, own: "env-1", other: "env-2"},
+		{kind: Flag, own: "1", other: "2"},
+		{kind: SecretMenu, own: "menu-1", other: "menu-2"},
+	}
+
+	for _, resource := range resources {
+		t.Run(string(resource.kind), func(t *testing.T) {
+			assert.NoError(t, s.Check(ctx, "company-1", resource.kind, resource.own))
+			assert.ErrorIs(t, s.Check(ctx, "company-1", resource.kind, resource.other), ErrNotFound)
+			assert.ErrorIs(t, s.Check(ctx, "", resource.kind, resource.own), ErrNotFound)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			assert.True(t, s.Allow(w, r, "company-1", resource.kind, resource.own))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			w = httptest.NewRecorder()
+			assert.False(t, s.Allow(w, r, "company-1", resource.kind, resource.other))
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		})
+	}
+}
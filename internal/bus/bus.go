@@ -0,0 +1,85 @@
+package bus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Bus carries change events between the packages that make changes and the caches and streams that follow them
+type Bus interface {
+	// Publish sends the event once the change is made
+	Publish(ctx context.Context, event Event) error
+	// PublishTx sends the event when the transaction commits, and not at all if it rolls back
+	PublishTx(ctx context.Context, tx pgx.Tx, event Event) error
+	// Subscribe calls the handler with every event until the returned func is called
+	Subscribe(handler func(Event)) func()
+}
+
+var (
+	mu      sync.RWMutex
+	current Bus = NewMemory()
+)
+
+// Use makes the bus the one every package publishes to, the service sets it up before it starts handling requests
+func Use(b Bus) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = b
+}
+
+func Current() Bus {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func Publish(ctx context.Context, event Event) error {
+	return Current().Publish(ctx, event)
+}
+
+func PublishTx(ctx context.Context, tx pgx.Tx, event Event) error {
+	return Current().PublishTx(ctx, tx, event)
+}
+
+func Subscribe(handler func(Event)) func() {
+	return Current().Subscribe(handler)
+}
+
+// fanout hands events to the in-process subscribers
+type fanout struct {
+	mu       sync.RWMutex
+	next     int
+	handlers map[int]func(Event)
+}
+
+func (f *fanout) Subscribe(handler func(Event)) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handlers == nil {
+		f.handlers = make(map[int]func(Event))
+	}
+	id := f.next
+	f.next++
+	f.handlers[id] = handler
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.handlers, id)
+	}
+}
+
+func (f *fanout) deliver(event Event) {
+	f.mu.RLock()
+	handlers := make([]func(Event), 0, len(f.handlers))
+	for _, handler := range f.handlers {
+		handlers = append(handlers, handler)
+	}
+	f.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
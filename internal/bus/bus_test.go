@@ -0,0 +1,61 @@
+package bus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDeliversToSubscribers(t *testing.T) {
+	b := NewMemory()
+
+	var first, second []Event
+	unsubscribe := b.Subscribe(func(event Event) {
+		first = append(first, event)
+	})
+	b.Subscribe(func(event Event) {
+		second = append(second, event)
+	})
+
+	event := Event{Kind: KindFlag, Action: ActionUpdated, AgentID: "agent", EnvironmentID: "env", FlagID: "1"}
+	assert.NoError(t, b.Publish(context.Background(), event))
+	assert.Equal(t, []Event{event}, first)
+	assert.Equal(t, []Event{event}, second)
+
+	unsubscribe()
+	assert.NoError(t, b.PublishTx(context.Background(), nil, event))
+	assert.Len(t, first, 1)
+	assert.Len(t, second, 2)
+}
+
+func TestEventRoundTrip(t *testing.T) {
+	event := Event{Kind: KindSecretMenu, Action: ActionCreated, AgentID: "agent", EnvironmentID: "env", MenuID: "menu"}
+
+	payload, err := event.encode()
+	assert.NoError(t, err)
+	decoded, err := decode(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, event, decoded)
+}
+
+func TestEventAffects(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    Event
+		affected bool
+	}{
+		{"same environment", Event{AgentID: "agent", EnvironmentID: "env"}, true},
+		{"other environment", Event{AgentID: "agent", EnvironmentID: "other"}, false},
+		{"whole agent", Event{AgentID: "agent"}, true},
+		{"other agent", Event{AgentID: "other"}, false},
+		{"environment only", Event{EnvironmentID: "env"}, true},
+		{"nowhere", Event{FlagID: "1"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.affected, test.event.Affects("agent", "env"))
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package bus
+
+import "encoding/json"
+
+// Channel is the Postgres NOTIFY channel every instance listens on
+const Channel = "flags_gg_changes"
+
+type Kind string
+
+const (
+	KindFlag        Kind = "flag"
+	KindEnvironment Kind = "environment"
+	KindAgent       Kind = "agent"
+	KindSecretMenu  Kind = "secret_menu"
+)
+
+type Action string
+
+const (
+	ActionCreated Action = "created"
+	ActionUpdated Action = "updated"
+	ActionDeleted Action = "deleted"
+)
+
+// Event says something an agent is served has changed, consumers reload what they hold for the agent or environment
+// rather than trusting the event to carry the new state. The ids are the public ones the agents use
+type Event struct {
+	Kind          Kind   `json:"kind"`
+	Action        Action `json:"action"`
+	AgentID       string `json:"agentId,omitempty"`
+	EnvironmentID string `json:"environmentId,omitempty"`
+	FlagID        string `json:"flagId,omitempty"`
+	MenuID        string `json:"menuId,omitempty"`
+}
+
+// Affects reports whether the event changes what the agent's environment is served, an event without an
+// environment reaches every environment of its agent
+func (e Event) Affects(agentId, environmentId string) bool {
+	if e.AgentID != "" && e.AgentID != agentId {
+		return false
+	}
+	if e.EnvironmentID != "" && e.EnvironmentID != environmentId {
+		return false
+	}
+	return e.AgentID != "" || e.EnvironmentID != ""
+}
+
+func (e Event) encode() (string, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+func decode(payload string) (Event, error) {
+	event := Event{}
+	err := json.Unmarshal([]byte(payload), &event)
+	return event, err
+}
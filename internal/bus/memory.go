@@ -0,0 +1,26 @@
+package bus
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Memory delivers events straight to the subscribers of this process, for tests and single instance development.
+// It can't see a transaction commit so PublishTx delivers at once
+type Memory struct {
+	fanout
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Publish(_ context.Context, event Event) error {
+	m.deliver(event)
+	return nil
+}
+
+func (m *Memory) PublishTx(ctx context.Context, _ pgx.Tx, event Event) error {
+	return m.Publish(ctx, event)
+}
@@ -0,0 +1,97 @@
+package bus
+
+import (
+	"context"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/jackc/pgx/v5"
+)
+
+// reconnectDelay is how long the listener waits before listening again after losing its connection
+const reconnectDelay = 5 * time.Second
+
+// Postgres publishes events with NOTIFY so every instance hears them, each instance's Listen hands them
+// to its own subscribers, including the events it published itself
+type Postgres struct {
+	fanout
+	*container.Container
+}
+
+func NewPostgres(c *container.Container) *Postgres {
+	return &Postgres{
+		Container: c,
+	}
+}
+
+func (p *Postgres) Publish(ctx context.Context, event Event) error {
+	payload, err := event.encode()
+	if err != nil {
+		return p.Config.Bugfixes.Logger.Errorf("failed to encode change event: %v", err)
+	}
+
+	if _, err := p.DB.Exec(ctx, `SELECT pg_notify($1, $2)`, Channel, payload); err != nil {
+		return p.Config.Bugfixes.Logger.Errorf("failed to publish change event: %v", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) PublishTx(ctx context.Context, tx pgx.Tx, event Event) error {
+	payload, err := event.encode()
+	if err != nil {
+		return p.Config.Bugfixes.Logger.Errorf("failed to encode change event: %v", err)
+	}
+
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, Channel, payload); err != nil {
+		return p.Config.Bugfixes.Logger.Errorf("failed to publish change event: %v", err)
+	}
+
+	return nil
+}
+
+// Listen subscribes the instance to the channel until the context ends, reconnecting whenever the connection drops.
+// Events sent while it's reconnecting are missed, consumers that can't afford that also poll
+func (p *Postgres) Listen(ctx context.Context) {
+	for {
+		if err := p.listen(ctx); err != nil && ctx.Err() == nil {
+			_ = p.Config.Bugfixes.Logger.Errorf("change event listener stopped: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (p *Postgres) listen(ctx context.Context) error {
+	conn, err := p.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// the listening connection is held for as long as it lives, it leaves the pool rather than starve it
+	client := conn.Hijack()
+	defer func() {
+		_ = client.Close(context.Background())
+	}()
+
+	if _, err := client.Exec(ctx, "LISTEN "+pgx.Identifier{Channel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := client.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		event, err := decode(notification.Payload)
+		if err != nil {
+			_ = p.Config.Bugfixes.Logger.Errorf("failed to decode change event: %v", err)
+			continue
+		}
+		p.deliver(event)
+	}
+}
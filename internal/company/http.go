@@ -11,12 +11,12 @@ import (
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
-	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/resend/resend-go/v2"
 )
 
 type System struct {
-	Config    *ConfigBuilder.Config
+	*container.Container
 	CompanyID string
 }
 
@@ -29,9 +29,9 @@ type Company struct {
 	LogoDB     *sql.NullString
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
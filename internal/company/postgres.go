@@ -4,9 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"strings"
 
-	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/stripe/stripe-go"
@@ -62,20 +60,7 @@ type Details struct {
 func (s *System) GetProjectLimits(ctx context.Context, userSubject string) (*Projects, error) {
 	p := &Projects{}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     WITH user_company AS (
         SELECT c.id AS company_id, c.allowed_projects
         FROM public.company c
@@ -107,20 +92,7 @@ func (s *System) GetUserLimits(ctx context.Context, userSubject string) (*Users,
 		Activated: 1,
 	}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     WITH user_company AS (
         SELECT c.id AS company_id, c.allowed_members
         FROM public.company c
@@ -149,21 +121,8 @@ func (s *System) GetUserLimits(ctx context.Context, userSubject string) (*Users,
 func (s *System) GetAgentLimits(ctx context.Context, companyId string) (*Agents, error) {
 	a := &Agents{}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	// Prepare the query
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     WITH user_company AS (
 		SELECT 
 			c.id AS company_id, 
@@ -222,21 +181,8 @@ func (s *System) GetAgentLimits(ctx context.Context, companyId string) (*Agents,
 }
 
 func (s *System) GetCompanyId(ctx context.Context, userSubject string) (string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", nil
-		}
-		return "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var companyId string
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
       public.company.company_id
     FROM public.company
@@ -265,20 +211,7 @@ func (s *System) GetCompanyInfo(ctx context.Context, userSubject string) (*Detai
 	company := &Company{}
 	paymentPlan := &PlanDetails{}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
 		c.company_id,
   		c.name AS companyName,
@@ -335,21 +268,8 @@ func (s *System) GetCompanyInfo(ctx context.Context, userSubject string) (*Detai
 }
 
 func (s *System) GetCompanyBasedOnDomain(ctx context.Context, domain, inviteCode string) (bool, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return false, nil
-		}
-		return false, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var companyId string
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT company_id
 	FROM company
 	WHERE domain = $1 OR invite_code = $2`, domain, inviteCode).Scan(&companyId); err != nil {
@@ -367,20 +287,7 @@ func (s *System) GetCompanyBasedOnDomain(ctx context.Context, domain, inviteCode
 }
 
 func (s *System) AttachUserToCompanyDB(ctx context.Context, userSubject string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	_, err = client.Exec(ctx, `
+	_, err := s.DB.Exec(ctx, `
     INSERT INTO public.company_user (
         company_id,
         user_id
@@ -392,7 +299,7 @@ func (s *System) AttachUserToCompanyDB(ctx context.Context, userSubject string)
 		return s.Config.Bugfixes.Logger.Errorf("Failed to insert user into database: %v", err)
 	}
 
-	_, err = client.Exec(ctx, `
+	_, err = s.DB.Exec(ctx, `
 		UPDATE public.user
 		SET onboarded = true
 		WHERE subject = $1`, userSubject)
@@ -404,25 +311,12 @@ func (s *System) AttachUserToCompanyDB(ctx context.Context, userSubject string)
 }
 
 func (s *System) CreateCompanyDB(ctx context.Context, name, domain, userSubject string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	companyId := uuid.New().String()
 	inviteCode := uuid.New().String()
 	apiKey := uuid.New().String()
 	apiSecret := uuid.New().String()
 
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     INSERT INTO public.company (
         name,
         domain,
@@ -441,7 +335,7 @@ func (s *System) CreateCompanyDB(ctx context.Context, name, domain, userSubject
 		return s.Config.Bugfixes.Logger.Errorf("Failed to insert company into database: %v", err)
 	}
 
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     INSERT INTO public.company_user (
         company_id,
         user_id
@@ -465,20 +359,7 @@ type User struct {
 func (s *System) GetCompanyUsersFromDB(ctx context.Context, companyId string) ([]User, error) {
 	var users []User
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return users, nil
-		}
-		return users, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
         u.subject,
         u.first_name,
@@ -497,10 +378,7 @@ func (s *System) GetCompanyUsersFromDB(ctx context.Context, companyId string) ([
 		}
 		return users, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 	}
-
-	if err := rows.Err(); err != nil {
-		return users, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
-	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var user User
@@ -510,6 +388,9 @@ func (s *System) GetCompanyUsersFromDB(ctx context.Context, companyId string) ([
 		}
 		users = append(users, user)
 	}
+	if err := rows.Err(); err != nil {
+		return users, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
+	}
 
 	return users, nil
 }
@@ -517,20 +398,7 @@ func (s *System) GetCompanyUsersFromDB(ctx context.Context, companyId string) ([
 func (s *System) GetLimits(ctx context.Context, companyId string) (Limits, error) {
 	var limits Limits
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return limits, nil
-		}
-		return limits, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
 		pp.price,
 		pp.name,
@@ -572,20 +440,7 @@ func (s *System) GetLimits(ctx context.Context, companyId string) (Limits, error
 }
 
 func (s *System) UpdateCompanyImageInDB(ctx context.Context, companyId, image string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `UPDATE public.company
+	if _, err := s.DB.Exec(ctx, `UPDATE public.company
 		SET logo = $1
 		WHERE company_id = $2`, image, companyId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update project in database: %v", err)
@@ -595,21 +450,8 @@ func (s *System) UpdateCompanyImageInDB(ctx context.Context, companyId, image st
 }
 
 func (s *System) GetInviteCodeFromDB(ctx context.Context, companyId string) (string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", nil
-		}
-		return "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var inviteCode sql.NullString
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
       invite_code
     FROM public.company
@@ -620,20 +462,21 @@ func (s *System) GetInviteCodeFromDB(ctx context.Context, companyId string) (str
 	return inviteCode.String, nil
 }
 
-func (s *System) UpgradeCompanyInDB(ctx context.Context, companyId, stripeSessionId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
+func (s *System) GetCompanyTimezone(ctx context.Context, companyId string) (string, error) {
+	var timezone string
+	if err := s.DB.QueryRow(ctx, `
+    SELECT
+      timezone
+    FROM public.company
+    WHERE company_id = $1`, companyId).Scan(&timezone); err != nil {
+		return "", s.Config.Bugfixes.Logger.Errorf("Failed to scan database: %v", err)
 	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
 
+	return timezone, nil
+}
+
+func (s *System) UpgradeCompanyInDB(ctx context.Context, companyId, stripeSessionId string) error {
+	var err error
 	stripe.Key = s.Config.Local.GetValue("STRIPE_SECRET")
 	params := &stripe.CheckoutSessionParams{}
 	result, err := session.Get(stripeSessionId, params)
@@ -646,7 +489,7 @@ func (s *System) UpgradeCompanyInDB(ctx context.Context, companyId, stripeSessio
 		return s.Config.Bugfixes.Logger.Errorf("Failed to get price id from metadata")
 	}
 
-	_, err = client.Exec(ctx, `
+	_, err = s.DB.Exec(ctx, `
     UPDATE public.company
     SET
       payment_plan_id = (
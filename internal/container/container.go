@@ -0,0 +1,146 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caarlos0/env/v8"
+	"github.com/flags-gg/orchestrator/internal/keyring"
+	"github.com/jackc/pgx/v5/pgxpool"
+	ConfigBuilder "github.com/keloran/go-config"
+)
+
+// PoolSettings size the connection pool, they come from the environment
+type PoolSettings struct {
+	MinConns          int32         `env:"DB_POOL_MIN_CONNS" envDefault:"2"`
+	MaxConns          int32         `env:"DB_POOL_MAX_CONNS" envDefault:"20"`
+	HealthCheckPeriod time.Duration `env:"DB_POOL_HEALTH_CHECK_PERIOD" envDefault:"30s"`
+	MaxConnLifetime   time.Duration `env:"DB_POOL_MAX_CONN_LIFETIME" envDefault:"1h"`
+	MaxConnIdleTime   time.Duration `env:"DB_POOL_MAX_CONN_IDLE_TIME" envDefault:"5m"`
+}
+
+// Container is what every System shares for the life of the service, it's built once at startup
+type Container struct {
+	Config *ConfigBuilder.Config
+	DB     *pgxpool.Pool
+	// Keys sign and verify the api keys
+	Keys *keyring.Ring
+
+	mu     sync.Mutex
+	shared map[interface{}]interface{}
+}
+
+// New opens the connection pool, sized by the environment, and checks the database answers
+func New(ctx context.Context, cfg *ConfigBuilder.Config) (*Container, error) {
+	settings := PoolSettings{}
+	if err := env.Parse(&settings); err != nil {
+		return nil, fmt.Errorf("failed to parse pool settings: %w", err)
+	}
+
+	return NewWithSettings(ctx, cfg, settings)
+}
+
+func NewWithSettings(ctx context.Context, cfg *ConfigBuilder.Config, settings PoolSettings) (*Container, error) {
+	poolConfig, err := pgxpool.ParseConfig(connectionString(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database config: %w", err)
+	}
+	poolConfig.MinConns = settings.MinConns
+	poolConfig.MaxConns = settings.MaxConns
+	poolConfig.HealthCheckPeriod = settings.HealthCheckPeriod
+	poolConfig.MaxConnLifetime = settings.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = settings.MaxConnIdleTime
+	if cfg.Database.ConnectionTimeout > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = cfg.Database.ConnectionTimeout
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create database pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to reach database: %w", err)
+	}
+
+	return &Container{
+		Config: cfg,
+		DB:     pool,
+	}, nil
+}
+
+// Shared returns what the packages keep for the life of the container under key, built the first time it's asked
+// for, so caches and hubs belong to the container rather than the process. Build mustn't ask for anything shared
+func (c *Container) Shared(key interface{}, build func() interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.shared == nil {
+		c.shared = make(map[interface{}]interface{})
+	}
+	value, ok := c.shared[key]
+	if !ok {
+		value = build()
+		c.shared[key] = value
+	}
+	return value
+}
+
+// Close stops what's shared, anything with a Close method, before the pool it may still be writing to
+func (c *Container) Close() {
+	c.mu.Lock()
+	shared := c.shared
+	c.shared = nil
+	c.mu.Unlock()
+
+	for _, value := range shared {
+		if closer, ok := value.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+	if c.DB != nil {
+		c.DB.Close()
+	}
+}
+
+// PoolStats is the pool's state, for the health endpoint
+type PoolStats struct {
+	TotalConns        int32  `json:"totalConns"`
+	IdleConns         int32  `json:"idleConns"`
+	AcquiredConns     int32  `json:"acquiredConns"`
+	ConstructingConns int32  `json:"constructingConns"`
+	MaxConns          int32  `json:"maxConns"`
+	AcquireCount      int64  `json:"acquireCount"`
+	EmptyAcquireCount int64  `json:"emptyAcquireCount"`
+	CanceledAcquires  int64  `json:"canceledAcquireCount"`
+	AcquireDuration   string `json:"acquireDuration"`
+}
+
+func (c *Container) PoolStats() PoolStats {
+	stat := c.DB.Stat()
+	return PoolStats{
+		TotalConns:        stat.TotalConns(),
+		IdleConns:         stat.IdleConns(),
+		AcquiredConns:     stat.AcquiredConns(),
+		ConstructingConns: stat.ConstructingConns(),
+		MaxConns:          stat.MaxConns(),
+		AcquireCount:      stat.AcquireCount(),
+		EmptyAcquireCount: stat.EmptyAcquireCount(),
+		CanceledAcquires:  stat.CanceledAcquireCount(),
+		AcquireDuration:   stat.AcquireDuration().String(),
+	}
+}
+
+func connectionString(cfg *ConfigBuilder.Config) string {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.Database.User, cfg.Database.Password),
+		Host:     fmt.Sprintf("%s:%d", cfg.Database.Host, cfg.Database.Port),
+		Path:     cfg.Database.DBName,
+		RawQuery: cfg.Database.ExtraParams,
+	}
+	return dsn.String()
+}
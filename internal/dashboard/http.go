@@ -9,19 +9,19 @@ import (
 
 	"github.com/flags-gg/orchestrator/internal/agent"
 	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/environment"
 	"github.com/flags-gg/orchestrator/internal/flags"
 	"github.com/flags-gg/orchestrator/internal/project"
 	"github.com/flags-gg/orchestrator/internal/stats"
-	ConfigBuilder "github.com/keloran/go-config"
 )
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
-	return &System{Config: cfg}
+func NewSystem(c *container.Container) *System {
+	return &System{Container: c}
 }
 
 type EnvironmentCoverage struct {
@@ -35,6 +35,16 @@ type EnvironmentCoverage struct {
 	EnabledFlags  int    `json:"enabledFlags"`
 }
 
+// EnvironmentStaleFlags counts an environment's flags that haven't been used or changed in flags.DefaultStaleDays
+type EnvironmentStaleFlags struct {
+	Name          string `json:"name"`
+	EnvironmentId string `json:"environment_id"`
+	AgentId       string `json:"agent_id"`
+	AgentName     string `json:"agent_name,omitempty"`
+	ProjectName   string `json:"project_name,omitempty"`
+	StaleFlags    int    `json:"staleFlags"`
+}
+
 type Summary struct {
 	Projects            []project.Project          `json:"projects"`
 	Agents              []*agent.Agent             `json:"agents"`
@@ -44,6 +54,7 @@ type Summary struct {
 	NewestFlag          *flags.CompanyFlagEntry    `json:"newestFlag,omitempty"`
 	RecentFlagChanges   []flags.CompanyFlagEntry   `json:"recentFlagChanges"`
 	EnvironmentCoverage []EnvironmentCoverage      `json:"environmentCoverage"`
+	StaleFlags          []EnvironmentStaleFlags    `json:"staleFlags"`
 	Stats               stats.CompanyOverview      `json:"stats"`
 }
 
@@ -76,7 +87,7 @@ func (s *System) GetSummary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userSubject)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userSubject)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -86,31 +97,34 @@ func (s *System) GetSummary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projects, err := project.NewSystem(s.Config).GetProjectsFromDB(ctx, companyId)
+	projects, err := project.NewSystem(s.Container).GetProjectsFromDB(ctx, companyId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	agents, err := agent.NewSystem(s.Config).GetAgents(ctx, companyId)
+	agents, err := agent.NewSystem(s.Container).GetAgents(ctx, companyId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	environments, err := environment.NewSystem(s.Config).GetEnvironmentsFromDB(ctx, companyId)
+	environments, err := environment.NewSystem(s.Container).GetEnvironmentsFromDB(ctx, companyId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	allFlags, err := flags.NewSystem(s.Config).GetCompanyFlagsFromDB(ctx, companyId)
+	allFlags, err := flags.NewSystem(s.Container).GetCompanyFlagsFromDB(ctx, companyId, flags.FlagFilter{
+		Tag:   r.URL.Query().Get("tag"),
+		Owner: r.URL.Query().Get("owner"),
+	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	overview, err := stats.NewSystem(s.Config).GetCompanyOverview(ctx, companyId)
+	overview, err := stats.NewSystem(s.Container).GetCompanyOverview(ctx, companyId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -119,6 +133,12 @@ func (s *System) GetSummary(w http.ResponseWriter, r *http.Request) {
 		overview = &stats.CompanyOverview{}
 	}
 
+	staleFlags, err := flags.NewSystem(s.Container).GetStaleFlagsFromDB(ctx, companyId, flags.DefaultStaleDays)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	coverageMap := make(map[string]*EnvironmentCoverage, len(environments))
 	for _, env := range environments {
 		coverageMap[env.EnvironmentId] = &EnvironmentCoverage{
@@ -165,6 +185,25 @@ func (s *System) GetSummary(w http.ResponseWriter, r *http.Request) {
 		coverage = coverage[:6]
 	}
 
+	// the stale flags come ordered by environment, so the counts keep that order
+	staleIndex := make(map[string]int)
+	stale := make([]EnvironmentStaleFlags, 0)
+	for _, entry := range staleFlags {
+		i, ok := staleIndex[entry.Environment.EnvironmentId]
+		if !ok {
+			i = len(stale)
+			staleIndex[entry.Environment.EnvironmentId] = i
+			stale = append(stale, EnvironmentStaleFlags{
+				Name:          entry.Environment.Name,
+				EnvironmentId: entry.Environment.EnvironmentId,
+				AgentId:       entry.Environment.AgentId,
+				AgentName:     entry.Environment.AgentName,
+				ProjectName:   entry.Environment.ProjectName,
+			})
+		}
+		stale[i].StaleFlags++
+	}
+
 	sort.Slice(projects, func(i, j int) bool {
 		return projects[i].ID > projects[j].ID
 	})
@@ -206,6 +245,7 @@ func (s *System) GetSummary(w http.ResponseWriter, r *http.Request) {
 		NewestFlag:          newestFlag,
 		RecentFlagChanges:   recentFlagChanges,
 		EnvironmentCoverage: coverage,
+		StaleFlags:          stale,
 		Stats:               *overview,
 	}
 
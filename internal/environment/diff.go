@@ -0,0 +1,211 @@
+package environment
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/flags-gg/orchestrator/internal/flags"
+	"github.com/flags-gg/orchestrator/internal/secretmenu"
+)
+
+// FlagPresence is a flag found in only one of the environments, Promoted says whether it is already in
+// the next environment of the chain after its own
+type FlagPresence struct {
+	Flag     string `json:"flag"`
+	FlagID   string `json:"flagId"`
+	Promoted bool   `json:"promoted"`
+}
+
+// FlagDrift is a flag in both environments whose state differs
+type FlagDrift struct {
+	Flag   string     `json:"flag"`
+	Fields []string   `json:"fields"`
+	From   flags.Flag `json:"from"`
+	To     flags.Flag `json:"to"`
+}
+
+type Diff struct {
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	OnlyInFrom []FlagPresence `json:"onlyInFrom"`
+	OnlyInTo   []FlagPresence `json:"onlyInTo"`
+	Changed    []FlagDrift    `json:"changed"`
+	SecretMenu []string       `json:"secretMenu,omitempty"`
+}
+
+// Drift is the diff of every parent and child pair in an agent's environment chain
+type Drift struct {
+	Pairs []Diff `json:"pairs"`
+}
+
+// environmentState is what an environment's diff is built from
+type environmentState struct {
+	EnvironmentId string
+	Flags         []flags.Flag
+	SecretMenu    secretmenu.SecretMenu
+}
+
+// diffEnvironments compares two environments, flags are matched by name as each environment has its own flag ids
+func diffEnvironments(from, to environmentState) Diff {
+	diff := Diff{
+		From:       from.EnvironmentId,
+		To:         to.EnvironmentId,
+		OnlyInFrom: make([]FlagPresence, 0),
+		OnlyInTo:   make([]FlagPresence, 0),
+		Changed:    make([]FlagDrift, 0),
+		SecretMenu: secretMenuFields(from.SecretMenu, to.SecretMenu),
+	}
+
+	toFlags := make(map[string]flags.Flag, len(to.Flags))
+	for _, flag := range to.Flags {
+		toFlags[flag.Details.Name] = flag
+	}
+
+	seen := make(map[string]bool, len(from.Flags))
+	for _, flag := range from.Flags {
+		seen[flag.Details.Name] = true
+		other, ok := toFlags[flag.Details.Name]
+		if !ok {
+			diff.OnlyInFrom = append(diff.OnlyInFrom, presence(flag))
+			continue
+		}
+		if fields := flags.DriftFields(flag, other); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, FlagDrift{
+				Flag:   flag.Details.Name,
+				Fields: fields,
+				From:   flag,
+				To:     other,
+			})
+		}
+	}
+	for _, flag := range to.Flags {
+		if !seen[flag.Details.Name] {
+			diff.OnlyInTo = append(diff.OnlyInTo, presence(flag))
+		}
+	}
+
+	sortByFlag := func(a, b FlagPresence) int {
+		return strings.Compare(a.Flag, b.Flag)
+	}
+	slices.SortFunc(diff.OnlyInFrom, sortByFlag)
+	slices.SortFunc(diff.OnlyInTo, sortByFlag)
+	slices.SortFunc(diff.Changed, func(a, b FlagDrift) int {
+		return strings.Compare(a.Flag, b.Flag)
+	})
+
+	return diff
+}
+
+func presence(flag flags.Flag) FlagPresence {
+	return FlagPresence{
+		Flag:     flag.Details.Name,
+		FlagID:   flag.Details.ID,
+		Promoted: flag.Details.Promoted,
+	}
+}
+
+// secretMenuFields names what differs between two environments' secret menus, the styles are compared as stored
+func secretMenuFields(from, to secretmenu.SecretMenu) []string {
+	if from.Id == "" && to.Id == "" {
+		return nil
+	}
+	if from.Id == "" || to.Id == "" {
+		return []string{"menu"}
+	}
+
+	fields := make([]string, 0)
+	if from.Enabled != to.Enabled {
+		fields = append(fields, "enabled")
+	}
+	if !slices.Equal(from.Sequence, to.Sequence) {
+		fields = append(fields, "sequence")
+	}
+
+	fromStyle, toStyle := from.CustomStyle, to.CustomStyle
+	if fromStyle.SQLCloseButton != toStyle.SQLCloseButton ||
+		fromStyle.SQLContainer != toStyle.SQLContainer ||
+		fromStyle.SQLResetButton != toStyle.SQLResetButton ||
+		fromStyle.SQLFlag != toStyle.SQLFlag ||
+		fromStyle.SQLButtonEnabled != toStyle.SQLButtonEnabled ||
+		fromStyle.SQLButtonDisabled != toStyle.SQLButtonDisabled ||
+		fromStyle.SQLHeader != toStyle.SQLHeader {
+		fields = append(fields, "style")
+	}
+
+	return fields
+}
+
+// loadEnvironmentState reads an environment's flags, with their promoted state, and its secret menu
+func (s *System) loadEnvironmentState(ctx context.Context, environmentId string) (environmentState, error) {
+	state := environmentState{
+		EnvironmentId: environmentId,
+	}
+
+	envFlags, err := flags.NewSystem(s.Container).GetClientFlagsFromDB(ctx, environmentId)
+	if err != nil {
+		return state, err
+	}
+	state.Flags = envFlags
+
+	menu, err := secretmenu.NewSystem(s.Container).GetEnvironmentSecretMenu(ctx, environmentId)
+	if err != nil {
+		return state, err
+	}
+	state.SecretMenu = menu
+
+	return state, nil
+}
+
+// DiffEnvironmentsFromDB compares two environments of an agent
+func (s *System) DiffEnvironmentsFromDB(ctx context.Context, fromEnvId, toEnvId string) (*Diff, error) {
+	from, err := s.loadEnvironmentState(ctx, fromEnvId)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.loadEnvironmentState(ctx, toEnvId)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := diffEnvironments(from, to)
+	return &diff, nil
+}
+
+// GetChainDriftFromDB diffs each parent in the agent's environment chain against its child
+func (s *System) GetChainDriftFromDB(ctx context.Context, agentId, companyId string) (*Drift, error) {
+	links, err := s.GetEnvironmentChainFromDB(ctx, agentId, companyId)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]environmentState)
+	load := func(environmentId string) (environmentState, error) {
+		if state, ok := states[environmentId]; ok {
+			return state, nil
+		}
+		state, err := s.loadEnvironmentState(ctx, environmentId)
+		if err != nil {
+			return state, err
+		}
+		states[environmentId] = state
+		return state, nil
+	}
+
+	drift := &Drift{
+		Pairs: make([]Diff, 0, len(links)),
+	}
+	for _, link := range links {
+		parent, err := load(link[0])
+		if err != nil {
+			return nil, err
+		}
+		child, err := load(link[1])
+		if err != nil {
+			return nil, err
+		}
+		drift.Pairs = append(drift.Pairs, diffEnvironments(parent, child))
+	}
+
+	return drift, nil
+}
@@ -0,0 +1,68 @@
+package environment
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/flags-gg/orchestrator/internal/flags"
+	"github.com/flags-gg/orchestrator/internal/secretmenu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffEnvironments(t *testing.T) {
+	staging := environmentState{
+		EnvironmentId: "staging",
+		Flags: []flags.Flag{
+			{Enabled: true, Details: flags.Details{ID: "1", Name: "search", Promoted: true}},
+			{Enabled: true, Details: flags.Details{ID: "2", Name: "checkout"}},
+			{Enabled: true, Details: flags.Details{ID: "3", Name: "dark-mode", Promoted: true}},
+		},
+		SecretMenu: secretmenu.SecretMenu{
+			Id:       "menu-1",
+			Enabled:  true,
+			Sequence: []string{"ArrowUp", "ArrowDown"},
+		},
+	}
+	production := environmentState{
+		EnvironmentId: "production",
+		Flags: []flags.Flag{
+			{Enabled: false, Details: flags.Details{ID: "7", Name: "search"}},
+			{Enabled: true, Details: flags.Details{ID: "8", Name: "dark-mode"}},
+			{Enabled: true, Details: flags.Details{ID: "9", Name: "legacy-nav"}},
+		},
+		SecretMenu: secretmenu.SecretMenu{
+			Id:       "menu-2",
+			Enabled:  true,
+			Sequence: []string{"ArrowUp"},
+			CustomStyle: secretmenu.MenuStyle{
+				SQLHeader: sql.NullString{String: `{"color":"red"}`, Valid: true},
+			},
+		},
+	}
+
+	diff := diffEnvironments(staging, production)
+	assert.Equal(t, "staging", diff.From)
+	assert.Equal(t, "production", diff.To)
+	assert.Equal(t, []FlagPresence{{Flag: "checkout", FlagID: "2"}}, diff.OnlyInFrom)
+	assert.Equal(t, []FlagPresence{{Flag: "legacy-nav", FlagID: "9"}}, diff.OnlyInTo)
+	if assert.Len(t, diff.Changed, 1) {
+		assert.Equal(t, "search", diff.Changed[0].Flag)
+		assert.Equal(t, []string{"enabled"}, diff.Changed[0].Fields)
+	}
+	assert.Equal(t, []string{"sequence", "style"}, diff.SecretMenu)
+
+	same := diffEnvironments(staging, staging)
+	assert.Empty(t, same.OnlyInFrom)
+	assert.Empty(t, same.OnlyInTo)
+	assert.Empty(t, same.Changed)
+	assert.Empty(t, same.SecretMenu)
+
+	assert.Equal(t, []string{"menu"}, secretMenuFields(staging.SecretMenu, secretmenu.SecretMenu{}))
+	assert.Nil(t, secretMenuFields(secretmenu.SecretMenu{}, secretmenu.SecretMenu{}))
+}
+
+func TestHasEnvironments(t *testing.T) {
+	environments := []*Environment{{EnvironmentId: "staging"}, {EnvironmentId: "production"}}
+	assert.True(t, hasEnvironments(environments, "staging", "production"))
+	assert.False(t, hasEnvironments(environments, "staging", "other-agent-env"))
+}
@@ -3,38 +3,58 @@ package environment
 import (
 	"encoding/json"
 	"net/http"
+	"slices"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/flags-gg/orchestrator/internal/authz"
 	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/flags"
 	"github.com/flags-gg/orchestrator/internal/secretmenu"
 	"github.com/google/uuid"
-	ConfigBuilder "github.com/keloran/go-config"
 )
 
 type Environment struct {
-	Id            string                 `json:"id"`
-	Name          string                 `json:"name"`
-	EnvironmentId string                 `json:"environment_id"`
-	AgentId       string                 `json:"agent_id"`
-	Enabled       bool                   `json:"enabled"`
-	Level         int                    `json:"level"`
-	CanPromote    bool                   `json:"canPromote"`
-	SecretMenu    *secretmenu.SecretMenu `json:"secret_menu,omitempty"`
-	Flags         []flags.Flag           `json:"flags,omitempty"`
-	ProjectName   string                 `json:"project_name,omitempty"`
-	AgentName     string                 `json:"agent_name,omitempty"`
+	Id                string                 `json:"id"`
+	Name              string                 `json:"name"`
+	EnvironmentId     string                 `json:"environment_id"`
+	AgentId           string                 `json:"agent_id"`
+	Enabled           bool                   `json:"enabled"`
+	Level             int                    `json:"level"`
+	CanPromote        bool                   `json:"canPromote"`
+	RequiresApproval  bool                   `json:"requiresApproval"`
+	RequiredApprovals int                    `json:"requiredApprovals,omitempty"`
+	SecretMenu        *secretmenu.SecretMenu `json:"secret_menu,omitempty"`
+	Flags             []flags.Flag           `json:"flags,omitempty"`
+	ProjectName       string                 `json:"project_name,omitempty"`
+	AgentName         string                 `json:"agent_name,omitempty"`
+}
+
+// Approval is the body of PUT /environment/{environmentId}/approval
+type Approval struct {
+	RequiresApproval  bool `json:"requiresApproval"`
+	RequiredApprovals int  `json:"requiredApprovals"`
+}
+
+const maxRequiredApprovals = 10
+
+// valid reports whether the approval settings can be stored, a missing number of approvals means one
+func (a *Approval) valid() bool {
+	if a.RequiredApprovals == 0 {
+		a.RequiredApprovals = 1
+	}
+	return a.RequiredApprovals >= 1 && a.RequiredApprovals <= maxRequiredApprovals
 }
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -65,7 +85,7 @@ func (s *System) GetAgentEnvironments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -75,6 +95,10 @@ func (s *System) GetAgentEnvironments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
 	agentId := r.PathValue("agentId")
 	environments, err := s.GetAgentEnvironmentsFromDB(ctx, agentId, companyId)
 	if err != nil {
@@ -103,7 +127,7 @@ func (s *System) GetEnvironments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -136,7 +160,7 @@ func (s *System) CreateAgentEnvironment(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -146,6 +170,10 @@ func (s *System) CreateAgentEnvironment(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
 	type envCreate struct {
 		Name string `json:"name"`
 	}
@@ -175,7 +203,7 @@ func (s *System) CloneAgentEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -185,6 +213,12 @@ func (s *System) CloneAgentEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	authorizer := authz.NewSystem(s.Container)
+	if !authorizer.Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) ||
+		!authorizer.Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
 	agentId := r.PathValue("agentId")
 	environmentId := r.PathValue("environmentId")
 
@@ -232,7 +266,7 @@ func (s *System) UpdateEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -242,6 +276,10 @@ func (s *System) UpdateEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
 	environmentId := r.PathValue("environmentId")
 	var env Environment
 	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
@@ -261,6 +299,55 @@ func (s *System) UpdateEnvironment(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (s *System) UpdateEnvironmentApproval(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
+	approval := Approval{}
+	if err := json.NewDecoder(r.Body).Decode(&approval); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !approval.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	found, err := s.UpdateEnvironmentApprovalInDB(ctx, r.PathValue("environmentId"), companyId, approval)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(approval); err != nil {
+		_ = logs.Errorf("Failed to encode response: %v", err)
+	}
+}
+
 func (s *System) DeleteEnvironment(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -270,7 +357,7 @@ func (s *System) DeleteEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -280,8 +367,12 @@ func (s *System) DeleteEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
 	environmentId := r.PathValue("environmentId")
-	if err := flags.NewSystem(s.Config).DeleteAllFlagsForEnv(ctx, environmentId); err != nil {
+	if err := flags.NewSystem(s.Container).DeleteAllFlagsForEnv(ctx, environmentId); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to delete flags: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -304,7 +395,7 @@ func (s *System) GetEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -314,9 +405,13 @@ func (s *System) GetEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
 	environmentId := r.PathValue("environmentId")
 
-	sm, err := secretmenu.NewSystem(s.Config).GetEnvironmentSecretMenu(ctx, environmentId)
+	sm, err := secretmenu.NewSystem(s.Container).GetEnvironmentSecretMenu(ctx, environmentId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -340,3 +435,108 @@ func (s *System) GetEnvironment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// hasEnvironments reports whether every one of the env ids belongs to the agent
+func hasEnvironments(environments []*Environment, envIds ...string) bool {
+	for _, envId := range envIds {
+		if !slices.ContainsFunc(environments, func(environment *Environment) bool {
+			return environment.EnvironmentId == envId
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *System) GetEnvironmentsDiff(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	environments, err := s.GetAgentEnvironmentsFromDB(ctx, r.PathValue("agentId"), companyId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !hasEnvironments(environments, from, to) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	diff, err := s.DiffEnvironmentsFromDB(ctx, from, to)
+	if err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to diff environments: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		_ = logs.Errorf("Failed to encode response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *System) GetEnvironmentsDrift(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Agent, r.PathValue("agentId")) {
+		return
+	}
+
+	drift, err := s.GetChainDriftFromDB(ctx, r.PathValue("agentId"), companyId)
+	if err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to get environment drift: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(drift); err != nil {
+		_ = logs.Errorf("Failed to encode response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -3,9 +3,8 @@ package environment
 import (
 	"context"
 	"errors"
-	"fmt"
-	"strings"
 
+	"github.com/flags-gg/orchestrator/internal/bus"
 	"github.com/flags-gg/orchestrator/internal/flags"
 	"github.com/flags-gg/orchestrator/internal/secretmenu"
 	"github.com/google/uuid"
@@ -13,23 +12,10 @@ import (
 )
 
 func (s *System) CreateEnvironmentInDB(ctx context.Context, name, agentId string) (*Environment, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	envId := uuid.New().String()
 	var insertedEnvId string
 
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
       WITH agent_row AS (
         SELECT id FROM public.agent WHERE agent_id = $1
       ), next_level AS (
@@ -49,6 +35,7 @@ func (s *System) CreateEnvironmentInDB(ctx context.Context, name, agentId string
       RETURNING environment.id`, agentId, envId, name).Scan(&insertedEnvId); err != nil {
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to insert environment into database: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionCreated, agentId, envId)
 
 	return &Environment{
 		Id:            insertedEnvId,
@@ -58,21 +45,8 @@ func (s *System) CreateEnvironmentInDB(ctx context.Context, name, agentId string
 }
 
 func (s *System) GetEnvironmentFromDB(ctx context.Context, envId, companyId string) (*Environment, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	environment := &Environment{}
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
       env.id,
       env.name,
@@ -84,6 +58,8 @@ func (s *System) GetEnvironmentFromDB(ctx context.Context, envId, companyId stri
         SELECT 1 FROM public.environment_chain ec
         WHERE ec.parent_environment_id = env.id AND ec.agent_id = env.agent_id
       ) AS can_promote,
+      env.requires_approval,
+      env.required_approvals,
       agent.name as AgentName,
       project.name as ProjectName
     FROM public.environment AS env
@@ -91,7 +67,7 @@ func (s *System) GetEnvironmentFromDB(ctx context.Context, envId, companyId stri
     	LEFT JOIN public.project ON project.id = agent.project_id
         JOIN public.company ON company.id = project.company_id
     WHERE env.env_id = $1
-      AND company.company_id = $2`, envId, companyId).Scan(&environment.Id, &environment.Name, &environment.EnvironmentId, &environment.Enabled, &environment.Level, &environment.CanPromote, &environment.AgentName, &environment.ProjectName); err != nil {
+      AND company.company_id = $2`, envId, companyId).Scan(&environment.Id, &environment.Name, &environment.EnvironmentId, &environment.Enabled, &environment.Level, &environment.CanPromote, &environment.RequiresApproval, &environment.RequiredApprovals, &environment.AgentName, &environment.ProjectName); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
@@ -105,20 +81,7 @@ func (s *System) GetEnvironmentFromDB(ctx context.Context, envId, companyId stri
 }
 
 func (s *System) GetAgentEnvironmentsFromDB(ctx context.Context, agentId, companyId string) ([]*Environment, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
       env.id,
       env.name,
@@ -128,7 +91,9 @@ func (s *System) GetAgentEnvironmentsFromDB(ctx context.Context, agentId, compan
       EXISTS (
         SELECT 1 FROM public.environment_chain ec
         WHERE ec.parent_environment_id = env.id AND ec.agent_id = env.agent_id
-      ) AS can_promote
+      ) AS can_promote,
+      env.requires_approval,
+      env.required_approvals
     FROM environment AS env
       JOIN agent ON env.agent_id = agent.id
       JOIN project ON project.id = agent.project_id
@@ -150,7 +115,7 @@ func (s *System) GetAgentEnvironmentsFromDB(ctx context.Context, agentId, compan
 	var environments []*Environment
 	for rows.Next() {
 		environment := &Environment{}
-		if err := rows.Scan(&environment.Id, &environment.Name, &environment.EnvironmentId, &environment.Enabled, &environment.Level, &environment.CanPromote); err != nil {
+		if err := rows.Scan(&environment.Id, &environment.Name, &environment.EnvironmentId, &environment.Enabled, &environment.Level, &environment.CanPromote, &environment.RequiresApproval, &environment.RequiredApprovals); err != nil {
 			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan database rows: %v", err)
 		}
 
@@ -161,20 +126,7 @@ func (s *System) GetAgentEnvironmentsFromDB(ctx context.Context, agentId, compan
 }
 
 func (s *System) GetEnvironmentsFromDB(ctx context.Context, companyId string) ([]*Environment, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
         env.id as Id,
 		env.env_id AS EnvId,
@@ -212,51 +164,46 @@ func (s *System) GetEnvironmentsFromDB(ctx context.Context, companyId string) ([
 }
 
 func (s *System) UpdateEnvironmentInDB(ctx context.Context, env Environment) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	_, err = client.Exec(ctx, `
+	_, err := s.DB.Exec(ctx, `
     UPDATE public.environment
     SET name = $1, enabled = $3
     WHERE env_id = $2`, env.Name, env.EnvironmentId, env.Enabled)
 	if err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update environment in database: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionUpdated, "", env.EnvironmentId)
 
 	return nil
 }
 
-func (s *System) CloneEnvironmentInDB(ctx context.Context, envId, newEnvId, agentId, name string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
+// UpdateEnvironmentApprovalInDB changes whether flag changes in the environment need approval, false when the
+// environment isn't the company's
+func (s *System) UpdateEnvironmentApprovalInDB(ctx context.Context, envId, companyId string, approval Approval) (bool, error) {
+	tag, err := s.DB.Exec(ctx, `
+    UPDATE public.environment AS env
+    SET
+      requires_approval = $3,
+      required_approvals = $4
+    FROM public.agent
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE agent.id = env.agent_id
+      AND env.env_id = $1
+      AND company.company_id = $2`, envId, companyId, approval.RequiresApproval, approval.RequiredApprovals)
 	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
+		return false, s.Config.Bugfixes.Logger.Errorf("Failed to update environment approval: %v", err)
 	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	flagsToClone, err := flags.NewSystem(s.Config).GetClientFlagsFromDB(ctx, envId)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("Failed to get flags: %v", err)
+	if tag.RowsAffected() == 0 {
+		return false, nil
 	}
+	s.publishChange(ctx, bus.ActionUpdated, "", envId)
 
+	return true, nil
+}
+
+func (s *System) CloneEnvironmentInDB(ctx context.Context, envId, newEnvId, agentId, name string) error {
 	var agentIdInt int
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT id FROM public.agent WHERE agent_id = $1`, agentId).Scan(&agentIdInt); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return s.Config.Bugfixes.Logger.Errorf("Failed to get agent id: %v", err)
@@ -265,7 +212,7 @@ func (s *System) CloneEnvironmentInDB(ctx context.Context, envId, newEnvId, agen
 	}
 
 	var envIdInt int
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     WITH next_level AS (
       SELECT COALESCE(MAX(level) + 1, 0) AS lvl FROM public.environment WHERE agent_id = $1
     )
@@ -278,115 +225,96 @@ func (s *System) CloneEnvironmentInDB(ctx context.Context, envId, newEnvId, agen
 		return s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 	}
 
-	insertVars := ""
-
-	for _, flag := range flagsToClone {
-		bv := "false"
-		if flag.Enabled {
-			bv = "true"
-		}
-
-		insertVars += fmt.Sprintf(`('%s', %d, %d, %s),`, flag.Details.Name, agentIdInt, envIdInt, bv)
+	// copy every flag, including its variants, targeting and rollout, from the source environment
+	if _, err := s.DB.Exec(ctx, `
+    INSERT INTO public.flag (definition_id, agent_id, environment_id, enabled, default_variant, off_variant, targeting_rules, rollout)
+    SELECT f.definition_id, $1, $2, f.enabled, f.default_variant, f.off_variant, f.targeting_rules, f.rollout
+    FROM public.flag f
+      JOIN public.environment env ON env.id = f.environment_id
+    WHERE env.env_id = $3`, agentIdInt, envIdInt, envId); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to insert flags into database: %v", err)
 	}
-	if insertVars != "" {
-		insertVars = insertVars[:len(insertVars)-1] // Remove last comma
-		_, err := client.Exec(ctx, fmt.Sprintf(`INSERT INTO public.flag (name, agent_id, environment_id, enabled) VALUES %s`, insertVars))
-		if err != nil {
-			return s.Config.Bugfixes.Logger.Errorf("Failed to insert flags into database: %v", err)
-		}
-		return nil
+
+	// prerequisites are between flags of the same environment, so they are matched up by definition in the clone
+	if _, err := s.DB.Exec(ctx, `
+    INSERT INTO public.flag_prerequisite (flag_id, prerequisite_flag_id, variant)
+    SELECT cf.id, cp.id, pre.variant
+    FROM public.flag_prerequisite pre
+      JOIN public.flag f ON f.id = pre.flag_id
+      JOIN public.flag p ON p.id = pre.prerequisite_flag_id
+      JOIN public.environment env ON env.id = f.environment_id
+      JOIN public.flag cf ON cf.environment_id = $1 AND cf.definition_id = f.definition_id
+      JOIN public.flag cp ON cp.environment_id = $1 AND cp.definition_id = p.definition_id
+    WHERE env.env_id = $2`, envIdInt, envId); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to insert prerequisites into database: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionCreated, agentId, newEnvId)
 
 	return nil
 }
 
 func (s *System) LinkChildEnvironmentInDB(ctx context.Context, parentEnvId, childEnvId, agentId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
+	var err error
 	// Resolve IDs
 	var (
 		agentIdInt     int
 		parentEnvIdInt int
 		childEnvIdInt  int
 	)
-	if err := client.QueryRow(ctx, `SELECT id FROM public.agent WHERE agent_id = $1`, agentId).Scan(&agentIdInt); err != nil {
+	if err := s.DB.QueryRow(ctx, `SELECT id FROM public.agent WHERE agent_id = $1`, agentId).Scan(&agentIdInt); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to resolve agent: %v", err)
 	}
-	if err := client.QueryRow(ctx, `SELECT id FROM public.environment WHERE env_id = $1`, parentEnvId).Scan(&parentEnvIdInt); err != nil {
+	if err := s.DB.QueryRow(ctx, `SELECT id FROM public.environment WHERE env_id = $1`, parentEnvId).Scan(&parentEnvIdInt); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to resolve parent environment: %v", err)
 	}
-	if err := client.QueryRow(ctx, `SELECT id FROM public.environment WHERE env_id = $1`, childEnvId).Scan(&childEnvIdInt); err != nil {
+	if err := s.DB.QueryRow(ctx, `SELECT id FROM public.environment WHERE env_id = $1`, childEnvId).Scan(&childEnvIdInt); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to resolve child environment: %v", err)
 	}
 
-	_, err = client.Exec(ctx, `
+	_, err = s.DB.Exec(ctx, `
 		INSERT INTO public.environment_chain (agent_id, parent_environment_id, child_environment_id)
 		VALUES ($1, $2, $3)
 		ON CONFLICT (agent_id, parent_environment_id) DO UPDATE SET child_environment_id = EXCLUDED.child_environment_id`, agentIdInt, parentEnvIdInt, childEnvIdInt)
 	if err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to link child environment: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionUpdated, agentId, parentEnvId)
 	return nil
 }
 
 func (s *System) DeleteEnvironmentFromDB(ctx context.Context, envId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := flags.NewSystem(s.Config).DeleteAllFlagsForEnv(ctx, envId); err != nil {
+	var err error
+	if err := flags.NewSystem(s.Container).DeleteAllFlagsForEnv(ctx, envId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to delete flags: %v", err)
 	}
-	if err := secretmenu.NewSystem(s.Config).DeleteSecretMenuForEnv(ctx, envId); err != nil {
+	if err := secretmenu.NewSystem(s.Container).DeleteSecretMenuForEnv(ctx, envId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to delete secret menus: %v", err)
 	}
 
-	_, err = client.Exec(ctx, `
+	_, err = s.DB.Exec(ctx, `
     DELETE FROM public.environment
     WHERE env_id = $1`, envId)
 	if err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to delete environment from database: %v", err)
 	}
+	s.publishChange(ctx, bus.ActionDeleted, "", envId)
 
 	return nil
 }
 
-func (s *System) DeleteAllEnvironmentsForAgent(ctx context.Context, agentId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
+// publishChange tells the environment's agents it changed, the bus logs its own failures
+func (s *System) publishChange(ctx context.Context, action bus.Action, agentId, envId string) {
+	_ = bus.Publish(ctx, bus.Event{
+		Kind:          bus.KindEnvironment,
+		Action:        action,
+		AgentID:       agentId,
+		EnvironmentID: envId,
+	})
+}
 
+func (s *System) DeleteAllEnvironmentsForAgent(ctx context.Context, agentId string) error {
 	var environmentIds []string
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT env_id
     FROM public.environment
     WHERE agent_id = (
@@ -411,7 +339,7 @@ func (s *System) DeleteAllEnvironmentsForAgent(ctx context.Context, agentId stri
 	}
 
 	for _, envId := range environmentIds {
-		if err := flags.NewSystem(s.Config).DeleteAllFlagsForEnv(ctx, envId); err != nil {
+		if err := flags.NewSystem(s.Container).DeleteAllFlagsForEnv(ctx, envId); err != nil {
 			return s.Config.Bugfixes.Logger.Errorf("Failed to delete flags: %v", err)
 		}
 
@@ -422,3 +350,38 @@ func (s *System) DeleteAllEnvironmentsForAgent(ctx context.Context, agentId stri
 
 	return nil
 }
+
+// GetEnvironmentChainFromDB lists the parent and child env ids of every link in the agent's environment chain, top of the chain first
+func (s *System) GetEnvironmentChainFromDB(ctx context.Context, agentId, companyId string) ([][2]string, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT
+      parent.env_id,
+      child.env_id
+    FROM public.environment_chain ec
+      JOIN public.environment parent ON parent.id = ec.parent_environment_id
+      JOIN public.environment child ON child.id = ec.child_environment_id
+      JOIN public.agent ON agent.id = ec.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE agent.agent_id = $1
+      AND company.company_id = $2
+    ORDER BY parent.level ASC`, agentId, companyId)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
+	}
+	defer rows.Close()
+
+	links := make([][2]string, 0)
+	for rows.Next() {
+		var link [2]string
+		if err := rows.Scan(&link[0], &link[1]); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan database rows: %v", err)
+		}
+		links = append(links, link)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", rows.Err())
+	}
+
+	return links, nil
+}
@@ -2,37 +2,186 @@ package flags
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
-	"math/big"
 	"strings"
 
 	"github.com/jackc/pgx/v5"
 )
 
+// GetAgentFlagsFromDB returns the sdk payload, flags whose prerequisites are off are served as disabled
 func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, environmentId string) (*AgentResponse, error) {
-	res := &AgentResponse{
-		IntervalAllowed: 60,
+	res, err := s.getEnvironmentFlagsFromDB(ctx, projectId, agentId, environmentId)
+	if err != nil || res == nil {
+		return res, err
 	}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		//stats.NewSystem(s.Config).AddAgentError(projectId, agentId, environmentId)
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
+	s.resolveAgentFlags(res)
+	return res, nil
+}
+
+// getAgentFlags is GetAgentFlagsFromDB read through the cache
+func (s *System) getAgentFlags(ctx context.Context, projectId, agentId, environmentId string) (*AgentResponse, error) {
+	res, err := s.environmentFlags(ctx, projectId, agentId, environmentId)
+	if err != nil || res == nil {
+		return res, err
+	}
+
+	s.resolveAgentFlags(res)
+	return res, nil
+}
+
+// resolveAgentFlags turns the stored flags into the sdk payload
+func (s *System) resolveAgentFlags(res *AgentResponse) {
+	// decide every flag before changing any, the checks read the stored state
+	failed := make([]bool, len(res.Flags))
+	for i := range res.Flags {
+		failed[i] = res.Flags[i].FailedPrerequisite() != ""
+	}
+	for i := range res.Flags {
+		if failed[i] {
+			res.Flags[i].Enabled = false
+		}
+		if variant, value, err := res.Flags[i].Resolve(); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to resolve flag %s: %v", res.Flags[i].Details.Name, err)
+		} else {
+			res.Flags[i].Variant = variant
+			res.Flags[i].Value = value
+		}
+	}
+
+	// the sdk isn't given the stored ids
+	for i := range res.Flags {
+		res.Flags[i].Details.ID = publicFlagId(res.Flags[i].Details.ID)
+	}
+}
+
+// changedSince keeps the flags changed after the revision, with the flags depending on them as they may be served
+// differently now
+func changedSince(res *AgentResponse, since int64) {
+	changed := make(map[string]bool)
+	for _, flag := range res.Flags {
+		if flag.revision > since {
+			changed[flag.Details.Name] = true
 		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
 	}
-	defer func() {
-		if client != nil {
-			if err := client.Close(ctx); err != nil {
-				//stats.NewSystem(s.Config).AddAgentError(projectId, agentId, environmentId)
-				_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
+	for grown := true; grown; {
+		grown = false
+		for _, flag := range res.Flags {
+			if changed[flag.Details.Name] {
+				continue
+			}
+			for _, prerequisite := range flag.Prerequisites {
+				if changed[prerequisite.Flag] {
+					changed[flag.Details.Name] = true
+					grown = true
+					break
+				}
 			}
 		}
-	}()
+	}
+
+	flags := make([]Flag, 0, len(changed))
+	for _, flag := range res.Flags {
+		if changed[flag.Details.Name] {
+			flags = append(flags, flag)
+		}
+	}
+	res.Flags = flags
+	res.Partial = true
+}
+
+// agentFlagsSince cuts the payload down to what changed after the client's revision, a client ahead of the
+// environment, one whose deletions can't be read, or one of a disabled environment, gets everything
+func (s *System) agentFlagsSince(ctx context.Context, projectId, agentId, environmentId string, since int64, res *AgentResponse) {
+	if res.Disabled || since > res.Revision {
+		return
+	}
+
+	deleted, err := s.GetDeletedFlagsFromDB(ctx, projectId, agentId, environmentId, since, res.Revision)
+	if err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to get deleted flags: %v", err)
+		return
+	}
+	changedSince(res, since)
+	res.Deleted = deleted
+}
+
+// disableEnvironment serves every flag off for a disabled project, agent or environment, and backs the sdk off.
+// The revision is dropped as switching the environment back on doesn't change it, the next since gets everything
+func disableEnvironment(res *AgentResponse) {
+	res.Disabled = true
+	res.IntervalAllowed = disabledIntervalAllowed
+	res.Revision = 0
+	for i := range res.Flags {
+		res.Flags[i].Enabled = false
+	}
+}
+
+// publicFlagId is the id the sdk knows a stored flag by, the same on every read
+func publicFlagId(flagId string) string {
+	sum := sha256.Sum256([]byte("flag:" + flagId))
+	return hex.EncodeToString(sum[:8])
+}
+
+// environmentFlags is getEnvironmentFlagsFromDB read through the cache, the caller gets its own copy
+func (s *System) environmentFlags(ctx context.Context, projectId, agentId, environmentId string) (*AgentResponse, error) {
+	// the key without an environment is the default environment lookup, an agent without one has no flags
+	if environmentId == "" {
+		return nil, nil
+	}
+
+	key := agentCacheKey{
+		ProjectID:     projectId,
+		AgentID:       agentId,
+		EnvironmentID: environmentId,
+	}
+	return s.agentCache().environment(ctx, key, func(ctx context.Context) (*AgentResponse, error) {
+		return s.getEnvironmentFlagsFromDB(ctx, projectId, agentId, environmentId)
+	})
+}
+
+// defaultEnvironment is GetDefaultEnvironment read through the cache
+func (s *System) defaultEnvironment(ctx context.Context, projectId, agentId string) (string, error) {
+	return s.agentCache().defaultEnvironment(ctx, projectId, agentId, func(ctx context.Context) (string, error) {
+		return s.GetDefaultEnvironment(ctx, projectId, agentId)
+	})
+}
+
+// ValidAgentInDB checks the agent belongs to the project, and the environment to the agent when there is one, for
+// agents that identify themselves with headers rather than a key
+func (s *System) ValidAgentInDB(ctx context.Context, projectId, agentId, environmentId string) (bool, error) {
+	var valid bool
+	if err := s.DB.QueryRow(ctx, `
+    SELECT TRUE
+    FROM public.agent
+      JOIN public.project ON project.id = agent.project_id
+    WHERE agent.agent_id = $1
+      AND project.project_id = $2
+      AND ($3 = '' OR EXISTS (
+        SELECT 1
+        FROM public.environment AS env
+        WHERE env.agent_id = agent.id
+          AND env.env_id = $3))`, agentId, projectId, environmentId).Scan(&valid); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, s.Config.Bugfixes.Logger.Errorf("failed to validate agent: %v", err)
+	}
 
+	return valid, nil
+}
+
+// getEnvironmentFlagsFromDB loads the flags of an environment as stored, linked to each other for prerequisite evaluation,
+// with their stored ids
+func (s *System) getEnvironmentFlagsFromDB(ctx context.Context, projectId, agentId, environmentId string) (*AgentResponse, error) {
+	res := &AgentResponse{
+		IntervalAllowed: 60,
+	}
+
+	var err error
 	if environmentId == "" {
 		envId, err := s.GetDefaultEnvironment(ctx, projectId, agentId)
 		if err != nil {
@@ -41,6 +190,24 @@ func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, en
 		environmentId = envId
 	}
 
+	// read before the flags, a change landing in between is sent again rather than missed
+	enabled := true
+	if err := s.DB.QueryRow(ctx, `
+    SELECT
+      env.revision,
+      project.enabled AND agent.enabled AND env.enabled
+    FROM public.environment AS env
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+    WHERE env.env_id = $1
+      AND agent.agent_id = $2
+      AND project.project_id = $3`, environmentId, agentId, projectId).Scan(&res.Revision, &enabled); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, context.Canceled) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to get environment revision: %v", err)
+	}
+
 	var flags []Flag
 	var menuEnabled sql.NullBool
 	var menuCode sql.NullString
@@ -53,10 +220,42 @@ func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, en
 	var menuHeader sql.NullString
 	var intervalAllowed int
 
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
-      flags.name AS FlagName,
+      flags.id::text AS FlagId,
+      COALESCE(GREATEST(flags.updated_at, def.updated_at)::text, '') AS LastChanged,
+      flags.revision AS Revision,
+      def.name AS FlagName,
       flags.enabled AS FlagEnabled,
+      def.flag_type AS FlagType,
+      def.variants AS FlagVariants,
+      COALESCE(flags.default_variant, '') AS DefaultVariant,
+      COALESCE(flags.off_variant, '') AS OffVariant,
+      flags.targeting_rules AS TargetingRules,
+      flags.rollout AS Rollout,
+      COALESCE((
+        SELECT jsonb_agg(jsonb_build_object(
+          'flagId', pre.prerequisite_flag_id::text,
+          'flag', pfd.name,
+          'variant', COALESCE(pre.variant, '')) ORDER BY pfd.name)
+        FROM public.flag_prerequisite pre
+          JOIN public.flag pf ON pf.id = pre.prerequisite_flag_id
+          JOIN public.flag_definition pfd ON pfd.id = pf.definition_id
+        WHERE pre.flag_id = flags.id
+      ), '[]'::jsonb) AS Prerequisites,
+      jsonb_strip_nulls(jsonb_build_object(
+        'description', def.description,
+        'tags', def.tags,
+        'kind', def.kind,
+        'links', def.links,
+        'owner', (
+          SELECT jsonb_build_object(
+            'subject', usr.subject,
+            'first_name', COALESCE(usr.first_name, ''),
+            'last_name', COALESCE(usr.last_name, ''),
+            'known_as', COALESCE(usr.known_as, ''))
+          FROM public."user" usr
+          WHERE usr.id = def.owner_id))) AS Metadata,
       secretMenu.enabled AS MenuEnabled,
       secretMenu.code AS MenuCode,
       menuStyle.close_button AS MenuCloseButton,
@@ -69,6 +268,7 @@ func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, en
       agent.interval
     FROM public.agent
       LEFT JOIN public.flag AS flags ON agent.id = flags.agent_id
+      LEFT JOIN public.flag_definition AS def ON def.id = flags.definition_id
       LEFT JOIN public.environment AS env ON env.id = flags.environment_id
       LEFT JOIN public.project ON project.id = agent.project_id
       LEFT JOIN public.secret_menu AS secretMenu ON secretMenu.agent_id = agent.id
@@ -77,31 +277,50 @@ func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, en
     WHERE env.env_id = $1
       AND agent.agent_id = $2
       AND project.project_id = $3
-      AND agent.enabled = true
-      AND project.enabled = true`, environmentId, agentId, projectId)
+    ORDER BY def.name, flags.id`, environmentId, agentId, projectId)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 
-		//stats.NewSystem(s.Config).AddAgentError(projectId, agentId, environmentId)
+		//stats.NewSystem(s.Container).AddAgentError(projectId, agentId, environmentId)
 		if err.Error() == "context canceled" || errors.Is(err, context.Canceled) {
 			return nil, nil
 		}
 
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 	}
-	if rows.Err() != nil {
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
-	}
+	defer rows.Close()
 
 	for rows.Next() {
+		var flagId string
+		var lastChanged string
+		var revision int64
 		var flagName string
 		var flagEnabled bool
+		var flagType FlagType
+		var flagVariants []Variant
+		var defaultVariant string
+		var offVariant string
+		var targetingRules []TargetingRule
+		var rollout *Rollout
+		var prerequisites []Prerequisite
+		var metadata FlagMetadata
 
 		if err = rows.Scan(
+			&flagId,
+			&lastChanged,
+			&revision,
 			&flagName,
 			&flagEnabled,
+			&flagType,
+			&flagVariants,
+			&defaultVariant,
+			&offVariant,
+			&targetingRules,
+			&rollout,
+			&prerequisites,
+			&metadata,
 			&menuEnabled,
 			&menuCode,
 			&menuCloseButton,
@@ -116,22 +335,39 @@ func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, en
 			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan row: %v", err)
 		}
 
-		randId, err := rand.Int(rand.Reader, big.NewInt(1000))
-		if err != nil {
-			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to generate random id: %v", err)
-		}
-
 		flag := Flag{
 			Enabled: flagEnabled,
 			Details: Details{
-				Name: flagName,
-				ID:   randId.String(),
+				Name:         flagName,
+				ID:           flagId,
+				LastChanged:  lastChanged,
+				FlagMetadata: metadata,
 			},
+			Type:           flagType,
+			Variants:       flagVariants,
+			DefaultVariant: defaultVariant,
+			OffVariant:     offVariant,
+			TargetingRules: targetingRules,
+			Rollout:        rollout,
+			Prerequisites:  prerequisites,
+			revision:       revision,
 		}
 		flags = append(flags, flag)
 	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", rows.Err())
+	}
+
+	flagRefs := make([]*Flag, len(flags))
+	for i := range flags {
+		flagRefs[i] = &flags[i]
+	}
+	LinkPrerequisites(flagRefs...)
 	res.Flags = flags
 	res.IntervalAllowed = intervalAllowed
+	if !enabled {
+		disableEnvironment(res)
+	}
 
 	if menuEnabled.Bool {
 		sm := &SecretMenu{
@@ -185,26 +421,13 @@ func (s *System) GetAgentFlagsFromDB(ctx context.Context, projectId, agentId, en
 
 	}
 
-	//stats.NewSystem(s.Config).AddAgentSuccess(projectId, agentId, environmentId)
+	//stats.NewSystem(s.Container).AddAgentSuccess(projectId, agentId, environmentId)
 	return res, nil
 }
 
 func (s *System) GetDefaultEnvironment(ctx context.Context, projectId, agentId string) (string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", nil
-		}
-		return "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var envId string
-	err = client.QueryRow(ctx, `
+	err := s.DB.QueryRow(ctx, `
     SELECT env.env_id
     FROM public.environment AS env
       JOIN public.agent ON env.agent_id = agent.id
@@ -222,3 +445,38 @@ func (s *System) GetDefaultEnvironment(ctx context.Context, projectId, agentId s
 
 	return envId, nil
 }
+
+// GetDeletedFlagsFromDB lists the keys deleted from the environment after since, up to the revision the flags were
+// read at
+func (s *System) GetDeletedFlagsFromDB(ctx context.Context, projectId, agentId, environmentId string, since, revision int64) ([]string, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT t.name
+    FROM public.flag_tombstone AS t
+      JOIN public.environment AS env ON env.id = t.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+    WHERE env.env_id = $1
+      AND agent.agent_id = $2
+      AND project.project_id = $3
+      AND t.revision > $4
+      AND t.revision <= $5
+    ORDER BY t.name`, environmentId, agentId, projectId, since, revision)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
+	}
+	defer rows.Close()
+
+	deleted := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan row: %v", err)
+		}
+		deleted = append(deleted, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
+	}
+
+	return deleted, nil
+}
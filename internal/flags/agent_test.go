@@ -0,0 +1,62 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangedSince(t *testing.T) {
+	res := &AgentResponse{
+		Revision: 7,
+		Flags: []Flag{
+			{Details: Details{Name: "checkout"}, revision: 6},
+			{Details: Details{Name: "banner"}, revision: 3, Prerequisites: []Prerequisite{{Flag: "checkout"}}},
+			{Details: Details{Name: "banner-copy"}, revision: 2, Prerequisites: []Prerequisite{{Flag: "banner"}}},
+			{Details: Details{Name: "search"}, revision: 4},
+		},
+	}
+
+	changedSince(res, 5)
+	assert.True(t, res.Partial)
+
+	names := make([]string, 0, len(res.Flags))
+	for _, flag := range res.Flags {
+		names = append(names, flag.Details.Name)
+	}
+	// the flags depending on checkout, directly or not, may be served differently now
+	assert.Equal(t, []string{"checkout", "banner", "banner-copy"}, names)
+}
+
+func TestChangedSinceNothingChanged(t *testing.T) {
+	res := &AgentResponse{
+		Revision: 4,
+		Flags: []Flag{
+			{Details: Details{Name: "search"}, revision: 4},
+		},
+	}
+
+	changedSince(res, 4)
+	assert.True(t, res.Partial)
+	assert.Empty(t, res.Flags)
+}
+
+func TestDisableEnvironment(t *testing.T) {
+	res := &AgentResponse{
+		IntervalAllowed: 60,
+		Revision:        9,
+		Flags: []Flag{
+			{Enabled: true, Details: Details{Name: "checkout"}},
+			{Enabled: false, Details: Details{Name: "search"}},
+		},
+	}
+
+	disableEnvironment(res)
+	assert.True(t, res.Disabled)
+	assert.Equal(t, disabledIntervalAllowed, res.IntervalAllowed)
+	// switching the environment back on doesn't move the revision, the client must ask for everything again
+	assert.Zero(t, res.Revision)
+	for _, flag := range res.Flags {
+		assert.False(t, flag.Enabled)
+	}
+}
@@ -1,67 +1,211 @@
 package flags
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/golang-jwt/jwt/v5"
-	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/google/uuid"
 )
 
+const (
+	// apiKeyLifetime is how long an issued key is valid for
+	apiKeyLifetime = 365 * 24 * time.Hour
+	// apiKeyStatusTTL bounds how long a revocation made on another instance takes to reach this one
+	apiKeyStatusTTL = 30 * time.Second
+	// apiKeyLastUsedInterval is how often a key in use has its last use written, rather than on every request
+	apiKeyLastUsedInterval = time.Minute
+	// apiKeyDefaultOverlap is how long the key a rotation replaces keeps working, unless asked otherwise
+	apiKeyDefaultOverlap = 24 * time.Hour
+	// apiKeyMaxOverlap is the longest both keys of a rotation may work side by side
+	apiKeyMaxOverlap = 30 * 24 * time.Hour
+
+	// ScopeFlagsRead lets the key read and evaluate its agent's flags
+	ScopeFlagsRead = "flags:read"
+)
+
+var (
+	ErrAPIKeyNotFound       = errors.New("api key not found")
+	ErrAPIKeyTargetNotFound = errors.New("project, agent or environment not found")
+	ErrAPIKeyRevoked        = errors.New("api key has been revoked")
+	ErrAPIKeyExpired        = errors.New("api key has expired")
+	ErrAPIKeyRotated        = errors.New("api key has already been rotated")
+	ErrUnknownScope         = errors.New("unknown api key scope")
+)
+
+// apiKeyScopes are the scopes a key can be issued with
+var apiKeyScopes = map[string]bool{
+	ScopeFlagsRead: true,
+}
+
 // APIKeyClaims represents the JWT claims for an API key
 type APIKeyClaims struct {
-	ProjectID     string `json:"project_id"`
-	AgentID       string `json:"agent_id"`
-	EnvironmentID string `json:"environment_id,omitempty"`
+	ProjectID     string   `json:"project_id"`
+	AgentID       string   `json:"agent_id"`
+	EnvironmentID string   `json:"environment_id,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// HasScope reports whether the key may be used for the scope, keys issued before scopes existed could only read flags
+func (c *APIKeyClaims) HasScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return scope == ScopeFlagsRead
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is an issued key as stored, the token itself is only ever handed out when it's issued
+type APIKey struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	ProjectID     string     `json:"project_id"`
+	AgentID       string     `json:"agent_id"`
+	EnvironmentID string     `json:"environment_id,omitempty"`
+	Scopes        []string   `json:"scopes"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	LastUsedAt    *time.Time `json:"last_used_at,omitempty"`
+	Revoked       bool       `json:"revoked"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy    string     `json:"replaced_by,omitempty"`
+}
+
 // APIKeySystem handles API key generation and validation
 type APIKeySystem struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewAPIKeySystem(cfg *ConfigBuilder.Config) *APIKeySystem {
+func NewAPIKeySystem(c *container.Container) *APIKeySystem {
 	return &APIKeySystem{
-		Config: cfg,
+		Container: c,
+	}
+}
+
+// newAPIKey fills in what the system decides for a key about to be issued
+func newAPIKey(key *APIKey, now time.Time) error {
+	if len(key.Scopes) == 0 {
+		key.Scopes = []string{ScopeFlagsRead}
+	}
+	for _, scope := range key.Scopes {
+		if !apiKeyScopes[scope] {
+			return fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+
+	key.ID = uuid.New().String()
+	key.CreatedAt = now.UTC().Truncate(time.Second)
+	key.ExpiresAt = key.CreatedAt.Add(apiKeyLifetime)
+	return nil
+}
+
+// GenerateAPIKey stores the key for a project and agent of the company and returns its token
+func (s *APIKeySystem) GenerateAPIKey(ctx context.Context, companyId string, key *APIKey) (string, error) {
+	if err := newAPIKey(key, time.Now()); err != nil {
+		return "", err
 	}
+	if err := s.CreateAPIKeyInDB(ctx, companyId, key); err != nil {
+		return "", err
+	}
+
+	return s.signAPIKey(key)
 }
 
-// GenerateAPIKey creates a JWT-based API key with project, agent, and environment info
-func (s *APIKeySystem) GenerateAPIKey(projectID, agentID, environmentID string) (string, error) {
+// signAPIKey creates the JWT of a key with its project, agent, and environment info
+func (s *APIKeySystem) signAPIKey(key *APIKey) (string, error) {
 	claims := APIKeyClaims{
-		ProjectID:     projectID,
-		AgentID:       agentID,
-		EnvironmentID: environmentID,
+		ProjectID:     key.ProjectID,
+		AgentID:       key.AgentID,
+		EnvironmentID: key.EnvironmentID,
+		Scopes:        key.Scopes,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(365 * 24 * time.Hour)), // 1 year expiry
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        key.ID,
+			ExpiresAt: jwt.NewNumericDate(key.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(key.CreatedAt),
+			NotBefore: jwt.NewNumericDate(key.CreatedAt),
 			Issuer:    "flags.gg",
-			Subject:   fmt.Sprintf("%s:%s", projectID, agentID),
+			Subject:   fmt.Sprintf("%s:%s", key.ProjectID, key.AgentID),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return s.Keys.Sign(claims)
+}
 
-	// Get signing key from config or use a default for now
-	signingKey := s.getSigningKey()
+// ValidateAPIKey parses and validates a JWT-based API key, and that it hasn't been revoked or cut short by a rotation
+func (s *APIKeySystem) ValidateAPIKey(ctx context.Context, tokenString string) (*APIKeyClaims, error) {
+	claims, err := s.parseAPIKey(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return s.validateLegacyAPIKey(ctx, claims)
+	}
 
-	return token.SignedString([]byte(signingKey))
-}
+	status, err := s.keyStatus(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	switch {
+	case status == nil:
+		return nil, ErrAPIKeyNotFound
+	case status.revoked:
+		return nil, ErrAPIKeyRevoked
+	case !now.Before(status.expiresAt):
+		return nil, ErrAPIKeyExpired
+	}
 
-// ValidateAPIKey parses and validates a JWT-based API key
-func (s *APIKeySystem) ValidateAPIKey(tokenString string) (*APIKeyClaims, error) {
-	signingKey := s.getSigningKey()
+	if now.Sub(status.lastUsed) >= apiKeyLastUsedInterval {
+		if err := s.TouchAPIKeyInDB(ctx, claims.ID, now); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to record api key use: %v", err)
+		} else {
+			s.statuses().used(claims.ID, now)
+		}
+	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &APIKeyClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Verify signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	return claims, nil
+}
+
+// validateLegacyAPIKey accepts a key issued before keys were stored, it has no id and so no row of its own. It keeps
+// working until its agent's legacy keys are rotated, and for the overlap that rotation gave them
+func (s *APIKeySystem) validateLegacyAPIKey(ctx context.Context, claims *APIKeyClaims) (*APIKeyClaims, error) {
+	statusKey := legacyStatusKey(claims.ProjectID, claims.AgentID)
+	status := s.statuses().get(statusKey)
+	if status == nil {
+		retiresAt, err := s.GetLegacyAPIKeyRetirementFromDB(ctx, claims.ProjectID, claims.AgentID)
+		if err != nil {
+			return nil, err
+		}
+		status = &apiKeyStatus{
+			expiresAt: retiresAt,
 		}
-		return []byte(signingKey), nil
-	})
+		s.statuses().put(statusKey, status)
+	}
+	if !status.expiresAt.IsZero() && !time.Now().UTC().Before(status.expiresAt) {
+		return nil, ErrAPIKeyRotated
+	}
 
+	return claims, nil
+}
+
+// legacyStatusKey is what the status of an agent's legacy keys is cached under, they're all retired together
+func legacyStatusKey(projectId, agentId string) string {
+	return fmt.Sprintf("legacy:%s:%s", projectId, agentId)
+}
+
+// parseAPIKey checks the token's signature, against the key of the ring it names, and its expiry
+func (s *APIKeySystem) parseAPIKey(tokenString string) (*APIKeyClaims, error) {
+	token, err := s.Keys.Parse(tokenString, &APIKeyClaims{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
@@ -73,17 +217,154 @@ func (s *APIKeySystem) ValidateAPIKey(tokenString string) (*APIKeyClaims, error)
 	return nil, fmt.Errorf("invalid token claims")
 }
 
-// getSigningKey retrieves the JWT signing key from config
-// TODO: This should be stored in environment variables or secrets management
-func (s *APIKeySystem) getSigningKey() string {
-	// Check if there's a JWT_SIGNING_KEY in environment
-	// For now, return a placeholder that should be configured
-	if s.Config != nil && s.Config.ProjectProperties != nil {
-		if key, ok := s.Config.ProjectProperties["jwt_signing_key"].(string); ok && key != "" {
-			return key
+// sharedAPIKeyStatuses is the container key of the api key status cache
+type sharedAPIKeyStatuses struct{}
+
+// statuses is the container's cache of key statuses, a revocation here is seen by every System built on it
+func (s *APIKeySystem) statuses() *apiKeyStatusCache {
+	return s.Shared(sharedAPIKeyStatuses{}, func() interface{} {
+		return newAPIKeyStatusCache(apiKeyStatusTTL)
+	}).(*apiKeyStatusCache)
+}
+
+// keyStatus is GetAPIKeyStatusFromDB read through the cache
+func (s *APIKeySystem) keyStatus(ctx context.Context, keyId string) (*apiKeyStatus, error) {
+	if status := s.statuses().get(keyId); status != nil {
+		return status, nil
+	}
+
+	status, err := s.GetAPIKeyStatusFromDB(ctx, keyId)
+	if err != nil || status == nil {
+		return nil, err
+	}
+	s.statuses().put(keyId, status)
+	return status, nil
+}
+
+// RevokeAPIKey revokes one of the company's keys, it stops working on this instance straight away
+func (s *APIKeySystem) RevokeAPIKey(ctx context.Context, companyId, keyId string) error {
+	if err := s.RevokeAPIKeyInDB(ctx, companyId, keyId); err != nil {
+		return err
+	}
+	s.statuses().forget(keyId)
+	return nil
+}
+
+// RotateAPIKey issues a replacement for one of the company's keys, the old one keeps working for the overlap so
+// the new one can be rolled out
+func (s *APIKeySystem) RotateAPIKey(ctx context.Context, companyId, keyId, userId string, overlap time.Duration) (string, *APIKey, *APIKey, error) {
+	now := time.Now()
+	replacement := &APIKey{
+		CreatedBy: userId,
+	}
+	if err := newAPIKey(replacement, now); err != nil {
+		return "", nil, nil, err
+	}
+
+	previous, err := s.RotateAPIKeyInDB(ctx, companyId, keyId, replacement, now.UTC().Add(overlap))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	s.statuses().forget(keyId)
+
+	token, err := s.signAPIKey(replacement)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return token, replacement, previous, nil
+}
+
+// RotateLegacyAPIKeys issues a stored key for an agent of the company, and retires the agent's legacy keys at the end
+// of the overlap so the new one can be rolled out. It returns the new key's token and when the legacy keys stop
+func (s *APIKeySystem) RotateLegacyAPIKeys(ctx context.Context, companyId string, key *APIKey, overlap time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	if err := newAPIKey(key, now); err != nil {
+		return "", time.Time{}, err
+	}
+
+	retiresAt := now.UTC().Add(overlap).Truncate(time.Second)
+	if err := s.RotateLegacyAPIKeysInDB(ctx, companyId, key, retiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	s.statuses().forget(legacyStatusKey(key.ProjectID, key.AgentID))
+
+	token, err := s.signAPIKey(key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, retiresAt, nil
+}
+
+// apiKeyStatus is what validating a key needs from its stored row
+type apiKeyStatus struct {
+	revoked   bool
+	expiresAt time.Time
+	lastUsed  time.Time
+	expires   time.Time
+}
+
+// apiKeyStatusCache keeps the status of the keys in use, so validating one doesn't read the database every request
+type apiKeyStatusCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]*apiKeyStatus
+}
+
+func newAPIKeyStatusCache(ttl time.Duration) *apiKeyStatusCache {
+	return &apiKeyStatusCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*apiKeyStatus),
+	}
+}
+
+// get returns a copy of the key's live status, or nil when it has to be loaded
+func (c *apiKeyStatusCache) get(keyId string) *apiKeyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status, ok := c.entries[keyId]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(status.expires) {
+		delete(c.entries, keyId)
+		return nil
+	}
+	cp := *status
+	return &cp
+}
+
+// put keeps the loaded status, dropping the expired entries as it goes
+func (c *apiKeyStatusCache) put(keyId string, status *apiKeyStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for id, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, id)
 		}
 	}
+	cp := *status
+	cp.expires = now.Add(c.ttl)
+	c.entries[keyId] = &cp
+}
+
+// used records the key's last use was written
+func (c *apiKeyStatusCache) used(keyId string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if status, ok := c.entries[keyId]; ok {
+		status.lastUsed = at
+	}
+}
+
+func (c *apiKeyStatusCache) forget(keyId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Default key - should be overridden in production
-	return "flags-gg-jwt-signing-key-change-in-production"
+	delete(c.entries, keyId)
 }
@@ -2,22 +2,25 @@ package flags
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/flags-gg/orchestrator/internal/authz"
 	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/stats"
-	ConfigBuilder "github.com/keloran/go-config"
 )
 
 type APIKeyHTTPSystem struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewAPIKeyHTTPSystem(cfg *ConfigBuilder.Config) *APIKeyHTTPSystem {
+func NewAPIKeyHTTPSystem(c *container.Container) *APIKeyHTTPSystem {
 	return &APIKeyHTTPSystem{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -36,42 +39,135 @@ func (s *APIKeyHTTPSystem) getUserId(r *http.Request) (string, error) {
 	return usr.ID, nil
 }
 
-type GenerateAPIKeyRequest struct {
-	ProjectID     string `json:"project_id"`
-	AgentID       string `json:"agent_id"`
-	EnvironmentID string `json:"environment_id,omitempty"`
-}
-
-type GenerateAPIKeyResponse struct {
-	APIKey    string `json:"api_key"`
-	ExpiresAt string `json:"expires_at"`
-}
-
-// GenerateAPIKeyHandler handles POST /api-key/generate
-func (s *APIKeyHTTPSystem) GenerateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	ctx := r.Context()
-
-	// Authenticate user
+// companyId authenticates the user and returns them with their company, or answers the request itself
+func (s *APIKeyHTTPSystem) companyId(w http.ResponseWriter, r *http.Request) (string, string, bool) {
 	if r.Header.Get("x-user-subject") == "" {
 		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return "", "", false
 	}
 
 	userId, err := s.getUserId(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return "", "", false
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(r.Context(), userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", "", false
 	}
 
 	if companyId == "" {
 		w.WriteHeader(http.StatusUnauthorized)
+		return "", "", false
+	}
+
+	return userId, companyId, true
+}
+
+func (s *APIKeyHTTPSystem) writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+	})
+}
+
+type GenerateAPIKeyRequest struct {
+	ProjectID     string   `json:"project_id"`
+	AgentID       string   `json:"agent_id"`
+	EnvironmentID string   `json:"environment_id,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+}
+
+// RotateLegacyAPIKeysRequest is the key replacing the agent's legacy keys, and how long they keep working, a day when
+// it isn't given
+type RotateLegacyAPIKeysRequest struct {
+	GenerateAPIKeyRequest
+	OverlapSeconds *int64 `json:"overlap_seconds,omitempty"`
+}
+
+// RotateLegacyAPIKeysResponse is the replacement key, with when the legacy keys stop working
+type RotateLegacyAPIKeysResponse struct {
+	GenerateAPIKeyResponse
+	LegacyExpiresAt time.Time `json:"legacy_expires_at"`
+}
+
+type GenerateAPIKeyResponse struct {
+	ID        string    `json:"id"`
+	APIKey    string    `json:"api_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type APIKeysResponse struct {
+	APIKeys []APIKey `json:"api_keys"`
+}
+
+// RotateAPIKeyRequest sets how long the old key keeps working, a day when it isn't given
+type RotateAPIKeyRequest struct {
+	OverlapSeconds *int64 `json:"overlap_seconds,omitempty"`
+}
+
+// RotateAPIKeyResponse is the replacement key, with the old one's new expiry
+type RotateAPIKeyResponse struct {
+	GenerateAPIKeyResponse
+	Replaces          string    `json:"replaces"`
+	PreviousExpiresAt time.Time `json:"previous_expires_at"`
+}
+
+// targetsOfCompany checks the project, agent and environment a key is asked for are the company's, or answers the
+// request itself
+func (s *APIKeyHTTPSystem) targetsOfCompany(w http.ResponseWriter, r *http.Request, companyId string, req *GenerateAPIKeyRequest) bool {
+	if req.ProjectID == "" || req.AgentID == "" {
+		s.writeError(w, http.StatusBadRequest, "project_id and agent_id are required")
+		return false
+	}
+
+	authorizer := authz.NewSystem(s.Container)
+	targets := map[authz.Kind]string{
+		authz.Project: req.ProjectID,
+		authz.Agent:   req.AgentID,
+	}
+	if req.EnvironmentID != "" {
+		targets[authz.Environment] = req.EnvironmentID
+	}
+	for kind, id := range targets {
+		if err := authorizer.Check(r.Context(), companyId, kind, id); err != nil {
+			if errors.Is(err, authz.ErrNotFound) {
+				s.writeError(w, http.StatusNotFound, ErrAPIKeyTargetNotFound.Error())
+				return false
+			}
+			s.writeError(w, http.StatusInternalServerError, "Failed to generate API key")
+			return false
+		}
+	}
+
+	return true
+}
+
+// overlap is how long the keys a rotation replaces keep working, or answers the request itself
+func (s *APIKeyHTTPSystem) overlap(w http.ResponseWriter, seconds *int64) (time.Duration, bool) {
+	if seconds == nil {
+		return apiKeyDefaultOverlap, true
+	}
+
+	overlap := time.Duration(*seconds) * time.Second
+	if overlap < 0 || overlap > apiKeyMaxOverlap {
+		s.writeError(w, http.StatusBadRequest, "overlap_seconds must be between 0 and 30 days")
+		return 0, false
+	}
+	return overlap, true
+}
+
+// GenerateAPIKeyHandler handles POST /api-key/generate
+func (s *APIKeyHTTPSystem) GenerateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+
+	// Authenticate user
+	userId, companyId, ok := s.companyId(w, r)
+	if !ok {
 		return
 	}
 
@@ -85,33 +181,41 @@ func (s *APIKeyHTTPSystem) GenerateAPIKeyHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	if req.ProjectID == "" || req.AgentID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{
-			"error": "project_id and agent_id are required",
-		})
+	if !s.targetsOfCompany(w, r, companyId, &req) {
 		return
 	}
 
 	// Generate API key
-	apiKeySystem := NewAPIKeySystem(s.Config)
-	apiKey, err := apiKeySystem.GenerateAPIKey(req.ProjectID, req.AgentID, req.EnvironmentID)
+	key := &APIKey{
+		Name:          req.Name,
+		ProjectID:     req.ProjectID,
+		AgentID:       req.AgentID,
+		EnvironmentID: req.EnvironmentID,
+		Scopes:        req.Scopes,
+		CreatedBy:     userId,
+	}
+	apiKey, err := NewAPIKeySystem(s.Container).GenerateAPIKey(ctx, companyId, key)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to generate API key",
-		})
+		switch {
+		case errors.Is(err, ErrUnknownScope):
+			s.writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrAPIKeyTargetNotFound):
+			s.writeError(w, http.StatusNotFound, err.Error())
+		default:
+			s.writeError(w, http.StatusInternalServerError, "Failed to generate API key")
+		}
 		return
 	}
 
-	if err := stats.NewSystem(s.Config).RecordAPIKeyCreation(ctx, userId, req.ProjectID, req.AgentID, req.EnvironmentID); err != nil {
+	if err := stats.NewSystem(s.Container).RecordAPIKeyCreation(ctx, userId, req.ProjectID, req.AgentID, req.EnvironmentID); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record api key creation: %v", err)
 	}
 
 	// Return response
 	response := GenerateAPIKeyResponse{
+		ID:        key.ID,
 		APIKey:    apiKey,
-		ExpiresAt: "365 days from now", // TODO: Calculate actual expiry
+		ExpiresAt: key.ExpiresAt,
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -119,3 +223,172 @@ func (s *APIKeyHTTPSystem) GenerateAPIKeyHandler(w http.ResponseWriter, r *http.
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
 	}
 }
+
+// GetAPIKeys handles GET /api-keys, the company's keys without their tokens, ?project_id= narrows them to a project
+func (s *APIKeyHTTPSystem) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, companyId, ok := s.companyId(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := NewAPIKeySystem(s.Container).GetAPIKeysFromDB(r.Context(), companyId, r.URL.Query().Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&APIKeysResponse{
+		APIKeys: keys,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// RevokeAPIKeyHandler handles DELETE /api-key/{keyId}
+func (s *APIKeyHTTPSystem) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	_, companyId, ok := s.companyId(w, r)
+	if !ok {
+		return
+	}
+
+	if err := NewAPIKeySystem(s.Container).RevokeAPIKey(r.Context(), companyId, r.PathValue("keyId")); err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateAPIKeyHandler handles POST /api-key/{keyId}/rotate
+func (s *APIKeyHTTPSystem) RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+
+	userId, companyId, ok := s.companyId(w, r)
+	if !ok {
+		return
+	}
+
+	req := RotateAPIKeyRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	overlap, ok := s.overlap(w, req.OverlapSeconds)
+	if !ok {
+		return
+	}
+
+	keyId := r.PathValue("keyId")
+	apiKey, replacement, previous, err := NewAPIKeySystem(s.Container).RotateAPIKey(ctx, companyId, keyId, userId, overlap)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAPIKeyNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrAPIKeyRevoked),
+			errors.Is(err, ErrAPIKeyExpired),
+			errors.Is(err, ErrAPIKeyRotated):
+			s.writeError(w, http.StatusConflict, err.Error())
+		default:
+			s.writeError(w, http.StatusInternalServerError, "Failed to rotate API key")
+		}
+		return
+	}
+
+	if err := stats.NewSystem(s.Container).RecordAPIKeyCreation(ctx, userId, replacement.ProjectID, replacement.AgentID, replacement.EnvironmentID); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record api key creation: %v", err)
+	}
+
+	if err := json.NewEncoder(w).Encode(RotateAPIKeyResponse{
+		GenerateAPIKeyResponse: GenerateAPIKeyResponse{
+			ID:        replacement.ID,
+			APIKey:    apiKey,
+			ExpiresAt: replacement.ExpiresAt,
+		},
+		Replaces:          previous.ID,
+		PreviousExpiresAt: previous.ExpiresAt,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// RotateLegacyAPIKeysHandler handles POST /api-key/legacy/rotate, it issues a key for the agent and retires the keys
+// it had before keys were stored at the end of the overlap
+func (s *APIKeyHTTPSystem) RotateLegacyAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+
+	userId, companyId, ok := s.companyId(w, r)
+	if !ok {
+		return
+	}
+
+	var req RotateLegacyAPIKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !s.targetsOfCompany(w, r, companyId, &req.GenerateAPIKeyRequest) {
+		return
+	}
+	overlap, ok := s.overlap(w, req.OverlapSeconds)
+	if !ok {
+		return
+	}
+
+	key := &APIKey{
+		Name:          req.Name,
+		ProjectID:     req.ProjectID,
+		AgentID:       req.AgentID,
+		EnvironmentID: req.EnvironmentID,
+		Scopes:        req.Scopes,
+		CreatedBy:     userId,
+	}
+	apiKey, retiresAt, err := NewAPIKeySystem(s.Container).RotateLegacyAPIKeys(ctx, companyId, key, overlap)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrUnknownScope):
+			s.writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrAPIKeyTargetNotFound):
+			s.writeError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, ErrAPIKeyRotated):
+			s.writeError(w, http.StatusConflict, err.Error())
+		default:
+			s.writeError(w, http.StatusInternalServerError, "Failed to rotate API keys")
+		}
+		return
+	}
+
+	if err := stats.NewSystem(s.Container).RecordAPIKeyCreation(ctx, userId, key.ProjectID, key.AgentID, key.EnvironmentID); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record api key creation: %v", err)
+	}
+
+	if err := json.NewEncoder(w).Encode(RotateLegacyAPIKeysResponse{
+		GenerateAPIKeyResponse: GenerateAPIKeyResponse{
+			ID:        key.ID,
+			APIKey:    apiKey,
+			ExpiresAt: key.ExpiresAt,
+		},
+		LegacyExpiresAt: retiresAt,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// GetJWKS handles GET /.well-known/jwks.json, the public keys api keys are signed with so they can be checked
+// without the orchestrator
+func (s *APIKeyHTTPSystem) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := writeCached(w, r, s.Keys.JWKS()); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
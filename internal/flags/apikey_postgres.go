@@ -0,0 +1,311 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const apiKeyColumns = `
+      k.key_id,
+      k.name,
+      project.project_id,
+      agent.agent_id,
+      COALESCE(env.env_id, ''),
+      k.scopes,
+      k.created_by_subject,
+      k.created_at,
+      k.expires_at,
+      k.last_used_at,
+      k.revoked,
+      k.revoked_at,
+      COALESCE(k.replaced_by, '')`
+
+const apiKeyTables = `
+    FROM public.api_key AS k
+      JOIN public.agent ON agent.id = k.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+      LEFT JOIN public.environment AS env ON env.id = k.environment_id`
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	key := &APIKey{}
+	if err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.ProjectID,
+		&key.AgentID,
+		&key.EnvironmentID,
+		&key.Scopes,
+		&key.CreatedBy,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.Revoked,
+		&key.RevokedAt,
+		&key.ReplacedBy,
+	); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CreateAPIKeyInDB stores a key for a project, agent and optionally environment of the company, none of which
+// belonging to another company
+func (s *APIKeySystem) CreateAPIKeyInDB(ctx context.Context, companyId string, key *APIKey) error {
+	return NewSystem(s.Container).inTx(ctx, func(tx pgx.Tx) error {
+		return s.createAPIKeyTx(ctx, tx, companyId, key)
+	})
+}
+
+func (s *APIKeySystem) createAPIKeyTx(ctx context.Context, tx pgx.Tx, companyId string, key *APIKey) error {
+	tag, err := tx.Exec(ctx, `
+    INSERT INTO public.api_key (
+      key_id,
+      name,
+      agent_id,
+      environment_id,
+      scopes,
+      created_by_subject,
+      created_at,
+      expires_at
+    )
+    SELECT $1::varchar, $2::varchar, agent.id, env.id, $3::text[], $4::varchar, $5::timestamp, $6::timestamp
+    FROM public.agent
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+      LEFT JOIN public.environment AS env ON env.agent_id = agent.id
+        AND env.env_id = $7::varchar
+    WHERE company.company_id = $8
+      AND project.project_id = $9
+      AND agent.agent_id = $10
+      AND ($7::varchar = '' OR env.id IS NOT NULL)`,
+		key.ID,
+		key.Name,
+		key.Scopes,
+		key.CreatedBy,
+		key.CreatedAt,
+		key.ExpiresAt,
+		key.EnvironmentID,
+		companyId,
+		key.ProjectID,
+		key.AgentID,
+	)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to insert api key: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAPIKeyTargetNotFound
+	}
+
+	return nil
+}
+
+// GetAPIKeysFromDB lists the company's keys, newest first, optionally only those of a project
+func (s *APIKeySystem) GetAPIKeysFromDB(ctx context.Context, companyId, projectId string) ([]APIKey, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT`+apiKeyColumns+apiKeyTables+`
+    WHERE company.company_id = $1
+      AND ($2 = '' OR project.project_id = $2)
+    ORDER BY k.created_at DESC, k.id DESC`, companyId, projectId)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to get api keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan row: %v", err)
+		}
+		keys = append(keys, *key)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to get api keys: %v", rows.Err())
+	}
+
+	return keys, nil
+}
+
+// GetAPIKeyStatusFromDB returns what validating the key needs, or nil for a key that was never stored
+func (s *APIKeySystem) GetAPIKeyStatusFromDB(ctx context.Context, keyId string) (*apiKeyStatus, error) {
+	status := &apiKeyStatus{}
+	var lastUsed *time.Time
+	if err := s.DB.QueryRow(ctx, `
+    SELECT revoked, expires_at, last_used_at
+    FROM public.api_key
+    WHERE key_id = $1`, keyId).Scan(&status.revoked, &status.expiresAt, &lastUsed); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to get api key: %v", err)
+	}
+	if lastUsed != nil {
+		status.lastUsed = *lastUsed
+	}
+
+	return status, nil
+}
+
+// GetLegacyAPIKeyRetirementFromDB returns when the agent's legacy keys stop working, the zero time while they
+// haven't been rotated
+func (s *APIKeySystem) GetLegacyAPIKeyRetirementFromDB(ctx context.Context, projectId, agentId string) (time.Time, error) {
+	var retiresAt time.Time
+	if err := s.DB.QueryRow(ctx, `
+    SELECT retirement.retires_at
+    FROM public.api_key_legacy_retirement AS retirement
+      JOIN public.agent ON agent.id = retirement.agent_id
+      JOIN public.project ON project.id = agent.project_id
+    WHERE project.project_id = $1
+      AND agent.agent_id = $2`, projectId, agentId).Scan(&retiresAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, s.Config.Bugfixes.Logger.Errorf("Failed to get legacy api key retirement: %v", err)
+	}
+
+	return retiresAt, nil
+}
+
+// RotateLegacyAPIKeysInDB stores the key replacing the agent's legacy keys and when they stop working, an agent's
+// legacy keys are only rotated once
+func (s *APIKeySystem) RotateLegacyAPIKeysInDB(ctx context.Context, companyId string, key *APIKey, retiresAt time.Time) error {
+	return NewSystem(s.Container).inTx(ctx, func(tx pgx.Tx) error {
+		if err := s.createAPIKeyTx(ctx, tx, companyId, key); err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, `
+      INSERT INTO public.api_key_legacy_retirement (
+        agent_id,
+        retires_at,
+        replaced_by,
+        created_by_subject
+      )
+      SELECT agent_id, $2::timestamp, key_id, created_by_subject
+      FROM public.api_key
+      WHERE key_id = $1
+      ON CONFLICT (agent_id) DO NOTHING`, key.ID, retiresAt)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("Failed to retire legacy api keys: %v", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrAPIKeyRotated
+		}
+
+		return nil
+	})
+}
+
+// TouchAPIKeyInDB records the key was used
+func (s *APIKeySystem) TouchAPIKeyInDB(ctx context.Context, keyId string, at time.Time) error {
+	if _, err := s.DB.Exec(ctx, `
+    UPDATE public.api_key
+    SET last_used_at = $2
+    WHERE key_id = $1
+      AND (last_used_at IS NULL OR last_used_at < $2)`, keyId, at); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to update api key: %v", err)
+	}
+
+	return nil
+}
+
+// RevokeAPIKeyInDB revokes one of the company's keys, revoking it again changes nothing
+func (s *APIKeySystem) RevokeAPIKeyInDB(ctx context.Context, companyId, keyId string) error {
+	tag, err := s.DB.Exec(ctx, `
+    UPDATE public.api_key AS k
+    SET revoked = true,
+      revoked_at = COALESCE(k.revoked_at, $3)
+    FROM public.agent
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+    WHERE agent.id = k.agent_id
+      AND company.company_id = $1
+      AND k.key_id = $2`, companyId, keyId, time.Now().UTC())
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to revoke api key: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// RotateAPIKeyInDB stores the replacement with the old key's name, target and scopes, and cuts the old key's expiry
+// down to the end of the overlap. It returns the old key as it now is
+func (s *APIKeySystem) RotateAPIKeyInDB(ctx context.Context, companyId, keyId string, replacement *APIKey, overlapEnd time.Time) (*APIKey, error) {
+	var previous *APIKey
+	err := NewSystem(s.Container).inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		previous, err = scanAPIKey(tx.QueryRow(ctx, `
+      SELECT`+apiKeyColumns+apiKeyTables+`
+      WHERE company.company_id = $1
+        AND k.key_id = $2
+      FOR UPDATE OF k`, companyId, keyId))
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrAPIKeyNotFound
+			}
+			return s.Config.Bugfixes.Logger.Errorf("Failed to get api key: %v", err)
+		}
+		switch {
+		case previous.Revoked:
+			return ErrAPIKeyRevoked
+		case !replacement.CreatedAt.Before(previous.ExpiresAt):
+			return ErrAPIKeyExpired
+		case previous.ReplacedBy != "":
+			return ErrAPIKeyRotated
+		}
+
+		replacement.Name = previous.Name
+		replacement.ProjectID = previous.ProjectID
+		replacement.AgentID = previous.AgentID
+		replacement.EnvironmentID = previous.EnvironmentID
+		replacement.Scopes = previous.Scopes
+		if _, err := tx.Exec(ctx, `
+      INSERT INTO public.api_key (
+        key_id,
+        name,
+        agent_id,
+        environment_id,
+        scopes,
+        created_by_subject,
+        created_at,
+        expires_at
+      )
+      SELECT $1::varchar, name, agent_id, environment_id, scopes, $2::varchar, $3::timestamp, $4::timestamp
+      FROM public.api_key
+      WHERE key_id = $5`,
+			replacement.ID,
+			replacement.CreatedBy,
+			replacement.CreatedAt,
+			replacement.ExpiresAt,
+			keyId,
+		); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("Failed to insert api key: %v", err)
+		}
+
+		if overlapEnd.Before(previous.ExpiresAt) {
+			previous.ExpiresAt = overlapEnd.Truncate(time.Second)
+		}
+		previous.ReplacedBy = replacement.ID
+		if _, err := tx.Exec(ctx, `
+      UPDATE public.api_key
+      SET expires_at = $2,
+        replaced_by = $3
+      WHERE key_id = $1`, keyId, previous.ExpiresAt, previous.ReplacedBy); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("Failed to update api key: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return previous, nil
+}
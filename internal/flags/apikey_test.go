@@ -8,18 +8,46 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/flags-gg/orchestrator/internal/keyring"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	ConfigBuilder "github.com/keloran/go-config"
 	"github.com/stretchr/testify/assert"
 )
 
+// signTestAPIKey signs a key as if it were stored, its status is cached so it validates without a database
+func signTestAPIKey(t *testing.T, s *APIKeySystem, key *APIKey) string {
+	key.ID = uuid.New().String()
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	key.ExpiresAt = key.CreatedAt.Add(time.Hour)
+	s.statuses().put(key.ID, &apiKeyStatus{expiresAt: key.ExpiresAt, lastUsed: time.Now().UTC()})
+	token, err := s.signAPIKey(key)
+	assert.NoError(t, err)
+	return token
+}
+
+// generateTestAPIKey issues a stored key of the test company
+func generateTestAPIKey(t *testing.T, s *APIKeySystem, projectId, agentId, environmentId string) string {
+	token, err := s.GenerateAPIKey(context.Background(), "test-company-1", &APIKey{
+		ProjectID:     projectId,
+		AgentID:       agentId,
+		EnvironmentID: environmentId,
+		CreatedBy:     "test-user-subject",
+	})
+	assert.NoError(t, err)
+	return token
+}
+
 func TestJWTAPIKeyGeneration(t *testing.T) {
 	c := ConfigBuilder.NewConfigNoVault()
 	if err := c.Build(ConfigBuilder.Bugfixes); err != nil {
 		t.Fatalf("Failed to build config: %v", err)
 	}
 
-	apiKeySystem := NewAPIKeySystem(c)
+	apiKeySystem := NewAPIKeySystem(&container.Container{Config: c, Keys: keyring.Development()})
 
 	tests := []struct {
 		name          string
@@ -43,17 +71,26 @@ func TestJWTAPIKeyGeneration(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			apiKey, err := apiKeySystem.GenerateAPIKey(tt.projectID, tt.agentID, tt.environmentID)
+			key := &APIKey{
+				ProjectID:     tt.projectID,
+				AgentID:       tt.agentID,
+				EnvironmentID: tt.environmentID,
+			}
+			assert.NoError(t, newAPIKey(key, time.Now()))
+			apiKey, err := apiKeySystem.signAPIKey(key)
 			assert.NoError(t, err)
 			assert.NotEmpty(t, apiKey)
 
 			// Validate the generated key
-			claims, err := apiKeySystem.ValidateAPIKey(apiKey)
+			claims, err := apiKeySystem.parseAPIKey(apiKey)
 			assert.NoError(t, err)
 			assert.NotNil(t, claims)
 			assert.Equal(t, tt.projectID, claims.ProjectID)
 			assert.Equal(t, tt.agentID, claims.AgentID)
 			assert.Equal(t, tt.environmentID, claims.EnvironmentID)
+			assert.Equal(t, key.ID, claims.ID)
+			assert.Equal(t, []string{ScopeFlagsRead}, claims.Scopes)
+			assert.Equal(t, key.ExpiresAt, claims.ExpiresAt.UTC())
 		})
 	}
 }
@@ -64,9 +101,17 @@ func TestJWTAPIKeyValidation(t *testing.T) {
 		t.Fatalf("Failed to build config: %v", err)
 	}
 
-	apiKeySystem := NewAPIKeySystem(c)
+	apiKeySystem := NewAPIKeySystem(&container.Container{Config: c, Keys: keyring.Development()})
 
-	validKey, _ := apiKeySystem.GenerateAPIKey("test-project", "test-agent", "test-env")
+	validKey := signTestAPIKey(t, apiKeySystem, &APIKey{ProjectID: "test-project", AgentID: "test-agent", EnvironmentID: "test-env"})
+	expired := &APIKey{
+		ProjectID: "test-project",
+		AgentID:   "test-agent",
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+		ExpiresAt: time.Now().Add(-time.Hour),
+	}
+	expiredKey, err := apiKeySystem.signAPIKey(expired)
+	assert.NoError(t, err)
 
 	tests := []struct {
 		name      string
@@ -83,6 +128,11 @@ func TestJWTAPIKeyValidation(t *testing.T) {
 			apiKey:    "invalid.jwt.token",
 			shouldErr: true,
 		},
+		{
+			name:      "Expired JWT",
+			apiKey:    expiredKey,
+			shouldErr: true,
+		},
 		{
 			name:      "Empty string",
 			apiKey:    "",
@@ -97,7 +147,7 @@ func TestJWTAPIKeyValidation(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			claims, err := apiKeySystem.ValidateAPIKey(tt.apiKey)
+			claims, err := apiKeySystem.ValidateAPIKey(context.Background(), tt.apiKey)
 			if tt.shouldErr {
 				assert.Error(t, err)
 				assert.Nil(t, claims)
@@ -125,9 +175,8 @@ func TestOFREPWithJWTAPIKey(t *testing.T) {
 	_, ofrepSystem := setupTestSystem(t)
 
 	// Generate a JWT API key
-	apiKeySystem := NewAPIKeySystem(ofrepSystem.Config)
-	jwtAPIKey, err := apiKeySystem.GenerateAPIKey("test-project-1", "test-agent-1", "test-env-1")
-	assert.NoError(t, err)
+	apiKeySystem := NewAPIKeySystem(ofrepSystem.Container)
+	jwtAPIKey := generateTestAPIKey(t, apiKeySystem, "test-project-1", "test-agent-1", "test-env-1")
 
 	tests := []struct {
 		name           string
@@ -147,7 +196,7 @@ func TestOFREPWithJWTAPIKey(t *testing.T) {
 			name:           "Invalid JWT",
 			apiKey:         "invalid.jwt.token",
 			flagKey:        "feature-flag-1",
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnauthorized,
 			shouldSucceed:  false,
 		},
 	}
@@ -295,7 +344,7 @@ func TestAPIKeyCreationAuditIsRecorded(t *testing.T) {
 	}()
 
 	system, _ := setupTestSystem(t)
-	httpSystem := NewAPIKeyHTTPSystem(system.Config)
+	httpSystem := NewAPIKeyHTTPSystem(system.Container)
 
 	body, _ := json.Marshal(GenerateAPIKeyRequest{
 		ProjectID:     "test-project-1",
@@ -327,3 +376,283 @@ func TestAPIKeyCreationAuditIsRecorded(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, count)
 }
+
+func TestNewAPIKey(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 500, time.UTC)
+
+	key := &APIKey{}
+	assert.NoError(t, newAPIKey(key, now))
+	assert.NotEmpty(t, key.ID)
+	assert.Equal(t, []string{ScopeFlagsRead}, key.Scopes)
+	assert.Equal(t, now.Truncate(time.Second), key.CreatedAt)
+	assert.Equal(t, now.Truncate(time.Second).Add(apiKeyLifetime), key.ExpiresAt)
+
+	assert.ErrorIs(t, newAPIKey(&APIKey{Scopes: []string{"flags:write"}}, now), ErrUnknownScope)
+}
+
+func TestAPIKeyClaimsHasScope(t *testing.T) {
+	// keys from before scopes could only read flags
+	legacy := &APIKeyClaims{}
+	assert.True(t, legacy.HasScope(ScopeFlagsRead))
+	assert.False(t, legacy.HasScope("flags:write"))
+
+	scoped := &APIKeyClaims{Scopes: []string{"flags:write"}}
+	assert.False(t, scoped.HasScope(ScopeFlagsRead))
+	assert.True(t, scoped.HasScope("flags:write"))
+}
+
+func TestAPIKeyStatusCache(t *testing.T) {
+	now := time.Now()
+	cache := newAPIKeyStatusCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.put("key", &apiKeyStatus{expiresAt: now.Add(time.Hour)})
+	status := cache.get("key")
+	assert.NotNil(t, status)
+
+	// the caller's copy isn't the cached status
+	status.revoked = true
+	assert.False(t, cache.get("key").revoked)
+
+	cache.used("key", now)
+	assert.Equal(t, now, cache.get("key").lastUsed)
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, cache.get("key"))
+
+	cache.put("key", &apiKeyStatus{})
+	cache.forget("key")
+	assert.Nil(t, cache.get("key"))
+}
+
+// signLegacyAPIKey signs a key the way they were before they were stored, without an id or a kid
+func signLegacyAPIKey(t *testing.T, secret string, issuedAt time.Time) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, APIKeyClaims{
+		ProjectID: "test-project-1",
+		AgentID:   "test-agent-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(apiKeyLifetime)),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			NotBefore: jwt.NewNumericDate(issuedAt),
+			Issuer:    "flags.gg",
+			Subject:   "test-project-1:test-agent-1",
+		},
+	}).SignedString([]byte(secret))
+	assert.NoError(t, err)
+	return token
+}
+
+// legacyKeyring is the development ring with the secret keys were signed with before it
+func legacyKeyring(t *testing.T, secret string) *keyring.Ring {
+	cfg := &ConfigBuilder.Config{
+		ProjectProperties: map[string]interface{}{
+			"api_key_legacy_secret": secret,
+		},
+	}
+	cfg.Local.Development = true
+	ring, err := keyring.FromConfig(cfg)
+	assert.NoError(t, err)
+	return ring
+}
+
+// testLegacySecret stands in for the secret keys were signed with before the keyring
+const testLegacySecret = "test-legacy-api-key-secret-at-least-32-bytes"
+
+func TestLegacyAPIKeyStatus(t *testing.T) {
+	c := ConfigBuilder.NewConfigNoVault()
+	if err := c.Build(ConfigBuilder.Bugfixes); err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	apiKeySystem := NewAPIKeySystem(&container.Container{Config: c, Keys: legacyKeyring(t, testLegacySecret)})
+
+	token := signLegacyAPIKey(t, testLegacySecret, time.Now().Add(-time.Hour))
+	claims, err := apiKeySystem.parseAPIKey(token)
+	assert.NoError(t, err)
+	assert.Empty(t, claims.ID)
+
+	// no row is no reason to refuse it, only rotating the agent's legacy keys retires it
+	statusKey := legacyStatusKey("test-project-1", "test-agent-1")
+	apiKeySystem.statuses().put(statusKey, &apiKeyStatus{})
+	validated, err := apiKeySystem.ValidateAPIKey(context.Background(), token)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-agent-1", validated.AgentID)
+
+	// through the overlap of the rotation it still works
+	apiKeySystem.statuses().put(statusKey, &apiKeyStatus{expiresAt: time.Now().Add(time.Hour)})
+	_, err = apiKeySystem.ValidateAPIKey(context.Background(), token)
+	assert.NoError(t, err)
+
+	apiKeySystem.statuses().put(statusKey, &apiKeyStatus{expiresAt: time.Now().Add(-time.Second)})
+	_, err = apiKeySystem.ValidateAPIKey(context.Background(), token)
+	assert.ErrorIs(t, err, ErrAPIKeyRotated)
+}
+
+func TestLegacyAPIKeyWorksUntilRotated(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	system.Keys = legacyKeyring(t, testLegacySecret)
+	apiKeySystem := NewAPIKeySystem(system.Container)
+	httpSystem := NewAPIKeyHTTPSystem(system.Container)
+
+	legacy := signLegacyAPIKey(t, testLegacySecret, time.Now().Add(-time.Hour))
+	claims, err := apiKeySystem.ValidateAPIKey(ctx, legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-project-1", claims.ProjectID)
+
+	// serving flags with it works as it did before keys were stored
+	req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-1", bytes.NewReader([]byte(`{"context":{"targetingKey":"user-123"}}`)))
+	req.Header.Set("X-API-Key", legacy)
+	req.Header.Set("x-environment-id", "test-env-1")
+	req.SetPathValue("key", "feature-flag-1")
+	w := httptest.NewRecorder()
+	NewOFREPSystem(system.Container).EvaluateSingleFlag(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// issuing a key for the agent, for any environment, leaves the legacy keys alone
+	generateTestAPIKey(t, apiKeySystem, "test-project-1", "test-agent-1", "test-env-1")
+	apiKeySystem.statuses().forget(legacyStatusKey("test-project-1", "test-agent-1"))
+	_, err = apiKeySystem.ValidateAPIKey(ctx, legacy)
+	assert.NoError(t, err)
+
+	// rotating them issues their replacement and keeps them working through the overlap
+	body, _ := json.Marshal(map[string]interface{}{
+		"project_id":      "test-project-1",
+		"agent_id":        "test-agent-1",
+		"overlap_seconds": 3600,
+	})
+	req = httptest.NewRequest(http.MethodPost, "/api-key/legacy/rotate", bytes.NewReader(body))
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w = httptest.NewRecorder()
+	httpSystem.RotateLegacyAPIKeysHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var rotated RotateLegacyAPIKeysResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&rotated))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), rotated.LegacyExpiresAt, time.Minute)
+	_, err = apiKeySystem.ValidateAPIKey(ctx, rotated.APIKey)
+	assert.NoError(t, err)
+	_, err = apiKeySystem.ValidateAPIKey(ctx, legacy)
+	assert.NoError(t, err)
+
+	// an agent's legacy keys are only rotated once
+	req = httptest.NewRequest(http.MethodPost, "/api-key/legacy/rotate", bytes.NewReader(body))
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w = httptest.NewRecorder()
+	httpSystem.RotateLegacyAPIKeysHandler(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// past the overlap they're refused
+	_, err = system.DB.Exec(ctx, `UPDATE public.api_key_legacy_retirement SET retires_at = now() - interval '1 minute'`)
+	assert.NoError(t, err)
+	apiKeySystem.statuses().forget(legacyStatusKey("test-project-1", "test-agent-1"))
+	_, err = apiKeySystem.ValidateAPIKey(ctx, legacy)
+	assert.ErrorIs(t, err, ErrAPIKeyRotated)
+}
+
+func TestAPIKeyRevokeAndRotate(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	httpSystem := NewAPIKeyHTTPSystem(system.Container)
+	apiKeySystem := NewAPIKeySystem(system.Container)
+
+	body, _ := json.Marshal(GenerateAPIKeyRequest{
+		ProjectID:     "test-project-1",
+		AgentID:       "test-agent-1",
+		EnvironmentID: "test-env-1",
+		Name:          "production",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api-key/generate", bytes.NewReader(body))
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w := httptest.NewRecorder()
+	httpSystem.GenerateAPIKeyHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var generated GenerateAPIKeyResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&generated))
+	assert.WithinDuration(t, time.Now().Add(apiKeyLifetime), generated.ExpiresAt, time.Minute)
+
+	claims, err := apiKeySystem.ValidateAPIKey(ctx, generated.APIKey)
+	assert.NoError(t, err)
+	assert.Equal(t, generated.ID, claims.ID)
+
+	req = httptest.NewRequest(http.MethodGet, "/api-keys", nil)
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w = httptest.NewRecorder()
+	httpSystem.GetAPIKeys(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var keys APIKeysResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+	assert.Len(t, keys.APIKeys, 1)
+	assert.Equal(t, "production", keys.APIKeys[0].Name)
+	assert.Equal(t, "test-env-1", keys.APIKeys[0].EnvironmentID)
+	assert.Equal(t, "test-user-subject", keys.APIKeys[0].CreatedBy)
+	assert.NotNil(t, keys.APIKeys[0].LastUsedAt)
+
+	// rotating keeps the old key working through the overlap
+	overlap, _ := json.Marshal(map[string]int64{"overlap_seconds": 3600})
+	req = httptest.NewRequest(http.MethodPost, "/api-key/"+generated.ID+"/rotate", bytes.NewReader(overlap))
+	req.SetPathValue("keyId", generated.ID)
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w = httptest.NewRecorder()
+	httpSystem.RotateAPIKeyHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var rotated RotateAPIKeyResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&rotated))
+	assert.Equal(t, generated.ID, rotated.Replaces)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), rotated.PreviousExpiresAt, time.Minute)
+
+	_, err = apiKeySystem.ValidateAPIKey(ctx, generated.APIKey)
+	assert.NoError(t, err)
+	claims, err = apiKeySystem.ValidateAPIKey(ctx, rotated.APIKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-env-1", claims.EnvironmentID)
+
+	// a key is only rotated once
+	req = httptest.NewRequest(http.MethodPost, "/api-key/"+generated.ID+"/rotate", nil)
+	req.SetPathValue("keyId", generated.ID)
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w = httptest.NewRecorder()
+	httpSystem.RotateAPIKeyHandler(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api-key/"+generated.ID, nil)
+	req.SetPathValue("keyId", generated.ID)
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w = httptest.NewRecorder()
+	httpSystem.RevokeAPIKeyHandler(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err = apiKeySystem.ValidateAPIKey(ctx, generated.APIKey)
+	assert.ErrorIs(t, err, ErrAPIKeyRevoked)
+	_, err = apiKeySystem.ValidateAPIKey(ctx, rotated.APIKey)
+	assert.NoError(t, err)
+
+	// another company's keys can't be seen to exist
+	assert.ErrorIs(t, apiKeySystem.RevokeAPIKey(ctx, "test-company-2", rotated.ID), ErrAPIKeyNotFound)
+	_, err = apiKeySystem.GenerateAPIKey(ctx, "test-company-2", &APIKey{ProjectID: "test-project-1", AgentID: "test-agent-1"})
+	assert.ErrorIs(t, err, ErrAPIKeyTargetNotFound)
+}
@@ -0,0 +1,94 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type ChangeAction string
+
+const (
+	ChangeUpdate  ChangeAction = "update"
+	ChangeEdit    ChangeAction = "edit"
+	ChangeDelete  ChangeAction = "delete"
+	ChangePromote ChangeAction = "promote"
+)
+
+type ChangeStatus string
+
+const (
+	ChangePending  ChangeStatus = "pending"
+	ChangeApplied  ChangeStatus = "applied"
+	ChangeRejected ChangeStatus = "rejected"
+)
+
+type ReviewDecision string
+
+const (
+	ReviewApprove ReviewDecision = "approve"
+	ReviewReject  ReviewDecision = "reject"
+)
+
+type Review struct {
+	Reviewer  string         `json:"reviewer"`
+	Decision  ReviewDecision `json:"decision"`
+	Comment   string         `json:"comment,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// ChangeRequest is a change to a flag in an environment that requires approval, held until enough company members approve it.
+// Payload is the body the change was requested with
+type ChangeRequest struct {
+	ID                string          `json:"id"`
+	FlagID            string          `json:"flagId,omitempty"`
+	Flag              string          `json:"flag"`
+	EnvironmentID     string          `json:"environmentId"`
+	Action            ChangeAction    `json:"action"`
+	Payload           json.RawMessage `json:"payload,omitempty"`
+	Author            string          `json:"author"`
+	RequiredApprovals int             `json:"requiredApprovals"`
+	Status            ChangeStatus    `json:"status"`
+	Reviews           []Review        `json:"reviews"`
+	CreatedAt         time.Time       `json:"createdAt"`
+	ResolvedAt        *time.Time      `json:"resolvedAt,omitempty"`
+}
+
+type ChangeRequests struct {
+	ChangeRequests []ChangeRequest `json:"changeRequests"`
+}
+
+// flagUpdate is the body of PATCH /flag/{flagId}
+type flagUpdate struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+}
+
+var (
+	ErrApprovalRequired      = errors.New("changes to the environment have to be approved")
+	ErrChangeRequestNotFound = errors.New("change request not found")
+	ErrChangeRequestResolved = errors.New("change request has already been resolved")
+	ErrChangeRequestStale    = errors.New("the flag in the change request no longer exists")
+	ErrAuthorCannotReview    = errors.New("the author of a change request can't review it")
+	ErrAlreadyReviewed       = errors.New("change request has already been reviewed by this user")
+)
+
+// definitionWide reports whether the change reaches the flag in every environment, not just its own
+func (a ChangeAction) definitionWide() bool {
+	return a == ChangeEdit || a == ChangeDelete
+}
+
+// outcome is the status of a request once its reviews are counted, a single rejection is final
+func outcome(requiredApprovals int, reviews []Review) ChangeStatus {
+	approvals := 0
+	for _, review := range reviews {
+		if review.Decision == ReviewReject {
+			return ChangeRejected
+		}
+		approvals++
+	}
+	if approvals >= requiredApprovals {
+		return ChangeApplied
+	}
+	return ChangePending
+}
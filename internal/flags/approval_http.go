@@ -0,0 +1,216 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flags-gg/orchestrator/internal/company"
+)
+
+// requestApproval holds the change in a change request when the flag's environment requires approval, and reports
+// whether it answered the request, in which case the caller must not make the change itself
+func (s *System) requestApproval(ctx context.Context, w http.ResponseWriter, flagId string, action ChangeAction, name string, payload interface{}, userId string) bool {
+	required, err := s.RequiredApprovalsFromDB(ctx, flagId, action, name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	if required == 0 {
+		return false
+	}
+
+	request, err := s.CreateChangeRequestInDB(ctx, flagId, action, payload, required, userId)
+	if err != nil {
+		if errors.Is(err, ErrChangeRequestStale) {
+			w.WriteHeader(http.StatusNotFound)
+			return true
+		}
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to create change request: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(request); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+	return true
+}
+
+// approvalRequired answers 409 when a change that can't be held in a change request reaches an environment that
+// requires approval, and reports whether it answered
+func (s *System) approvalRequired(ctx context.Context, w http.ResponseWriter, flagId string, action ChangeAction) bool {
+	required, err := s.RequiredApprovalsFromDB(ctx, flagId, action, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	if required == 0 {
+		return false
+	}
+
+	s.writeError(w, http.StatusConflict, ErrApprovalRequired)
+	return true
+}
+
+func (s *System) GetChangeRequests(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	status := ChangeStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", ChangePending, ChangeApplied, ChangeRejected:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	requests, err := s.GetChangeRequestsFromDB(ctx, companyId, status)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&ChangeRequests{
+		ChangeRequests: requests,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) GetChangeRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	request, err := s.GetChangeRequestFromDB(ctx, companyId, r.PathValue("requestId"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if request == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(request); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) ApproveChangeRequest(w http.ResponseWriter, r *http.Request) {
+	s.reviewChangeRequest(w, r, ReviewApprove)
+}
+
+func (s *System) RejectChangeRequest(w http.ResponseWriter, r *http.Request) {
+	s.reviewChangeRequest(w, r, ReviewReject)
+}
+
+func (s *System) reviewChangeRequest(w http.ResponseWriter, r *http.Request, decision ReviewDecision) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	type reviewRequest struct {
+		Comment string `json:"comment"`
+	}
+	review := reviewRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	request, err := s.ReviewChangeRequestInDB(ctx, companyId, r.PathValue("requestId"), userId, decision, review.Comment)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrChangeRequestNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrChangeRequestResolved),
+			errors.Is(err, ErrAuthorCannotReview),
+			errors.Is(err, ErrAlreadyReviewed),
+			errors.Is(err, ErrChangeRequestStale),
+			errors.Is(err, ErrFlagNameTaken),
+			errors.Is(err, ErrFlagHasDependents),
+			errors.Is(err, ErrNoChildEnvironment):
+			s.writeError(w, http.StatusConflict, err)
+		default:
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to review change request: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(request); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
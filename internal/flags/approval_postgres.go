@@ -0,0 +1,388 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// notifyAudience picks who a change request notification goes to
+type notifyAudience int
+
+const (
+	notifyAuthor notifyAudience = iota
+	// notifyReviewers is every member of the company other than the author
+	notifyReviewers
+	// notifyParticipants is the author and everyone who reviewed the request
+	notifyParticipants
+)
+
+// requiredApprovalsTx is how many approvals the change needs, 0 when none of the environments it reaches require approval.
+// A rename reaches every environment the flag is in and a promotion reaches the next environment in the chain
+func (s *System) requiredApprovalsTx(ctx context.Context, tx pgx.Tx, flagId string, action ChangeAction, name string) (int, error) {
+	var required int
+	if action == ChangePromote {
+		err := tx.QueryRow(ctx, `
+      SELECT CASE WHEN child.requires_approval THEN child.required_approvals ELSE 0 END
+      FROM public.flag f
+        JOIN public.environment_chain ec ON ec.agent_id = f.agent_id AND ec.parent_environment_id = f.environment_id
+        JOIN public.environment child ON child.id = ec.child_environment_id
+      WHERE f.id = $1`, flagId).Scan(&required)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return 0, s.Config.Bugfixes.Logger.Errorf("failed to get environment approval: %v", err)
+		}
+		return required, nil
+	}
+
+	err := tx.QueryRow(ctx, `
+    SELECT COALESCE(MAX(env.required_approvals) FILTER (WHERE env.requires_approval), 0)
+    FROM public.flag src
+      JOIN public.flag_definition def ON def.id = src.definition_id
+      JOIN public.flag f ON f.definition_id = src.definition_id
+      JOIN public.environment env ON env.id = f.environment_id
+    WHERE src.id = $1
+      AND (f.id = src.id OR $2 OR ($3 <> '' AND $3 <> def.name))`, flagId, action.definitionWide(), name).Scan(&required)
+	if err != nil {
+		return 0, s.Config.Bugfixes.Logger.Errorf("failed to get environment approval: %v", err)
+	}
+
+	return required, nil
+}
+
+// RequiredApprovalsFromDB is how many approvals the change to the flag needs, 0 when it can be made straight away
+func (s *System) RequiredApprovalsFromDB(ctx context.Context, flagId string, action ChangeAction, name string) (int, error) {
+	var required int
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		required, err = s.requiredApprovalsTx(ctx, tx, flagId, action, name)
+		return err
+	})
+
+	return required, err
+}
+
+// CreateChangeRequestInDB holds the change for review and lets the company know it is waiting
+func (s *System) CreateChangeRequestInDB(ctx context.Context, flagId string, action ChangeAction, payload interface{}, requiredApprovals int, author string) (*ChangeRequest, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to encode change: %v", err)
+		}
+	}
+
+	requestId := uuid.New().String()
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var id int
+		if err := tx.QueryRow(ctx, `
+      INSERT INTO public.flag_change_request (request_id, flag_id, flag_name, environment_id, action, payload, author_id, required_approvals)
+      SELECT $1::text, f.id, def.name, f.environment_id, $3::text, $4::jsonb, usr.id, $5::smallint
+      FROM public.flag f
+        JOIN public.flag_definition def ON def.id = f.definition_id
+        JOIN public."user" usr ON usr.subject = $6
+      WHERE f.id = $2
+      RETURNING id`, requestId, flagId, string(action), body, requiredApprovals, author).Scan(&id); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrChangeRequestStale
+			}
+			return s.Config.Bugfixes.Logger.Errorf("failed to create change request: %v", err)
+		}
+
+		if err := s.notifyTx(ctx, tx, id, notifyReviewers, "Change request", "A change to %s in %s is waiting for your review"); err != nil {
+			return err
+		}
+		return s.notifyTx(ctx, tx, id, notifyAuthor, "Change request", "Your change to %s in %s is waiting for review")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getChangeRequest(ctx, "", requestId)
+}
+
+// notifyTx leaves a notification about the change request, the content is a format taking the flag and environment names
+func (s *System) notifyTx(ctx context.Context, tx pgx.Tx, changeRequestId int, audience notifyAudience, subject, content string) error {
+	_, err := tx.Exec(ctx, `
+    INSERT INTO public.user_notifications (user_id, subject, content, action)
+    SELECT DISTINCT
+      recipient.user_id,
+      $3::text,
+      LEFT(format($4::text, cr.flag_name, env.name), 255),
+      '/change-request/' || cr.request_id
+    FROM public.flag_change_request cr
+      JOIN public.environment env ON env.id = cr.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN LATERAL (
+        SELECT cr.author_id AS user_id
+        WHERE $2 IN (0, 2)
+        UNION
+        SELECT cu.user_id
+        FROM public.company_user cu
+        WHERE $2 = 1
+          AND cu.company_id = project.company_id
+          AND cu.user_id <> cr.author_id
+        UNION
+        SELECT review.reviewer_id
+        FROM public.flag_change_review review
+        WHERE $2 = 2
+          AND review.change_request_id = cr.id
+      ) recipient ON true
+    WHERE cr.id = $1`, changeRequestId, int(audience), subject, content)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to notify users: %v", err)
+	}
+
+	return nil
+}
+
+const changeRequestColumns = `
+      cr.request_id,
+      COALESCE(cr.flag_id::text, ''),
+      cr.flag_name,
+      env.env_id,
+      cr.action,
+      cr.payload,
+      author.subject,
+      cr.required_approvals,
+      cr.status,
+      cr.created_at,
+      cr.resolved_at,
+      COALESCE((
+        SELECT jsonb_agg(jsonb_build_object(
+          'reviewer', reviewer.subject,
+          'decision', review.decision,
+          'comment', COALESCE(review.comment, ''),
+          'createdAt', to_char(review.created_at, 'YYYY-MM-DD"T"HH24:MI:SS"Z"')) ORDER BY review.created_at)
+        FROM public.flag_change_review review
+          JOIN public."user" reviewer ON reviewer.id = review.reviewer_id
+        WHERE review.change_request_id = cr.id
+      ), '[]'::jsonb)`
+
+func scanChangeRequest(row pgx.Row) (*ChangeRequest, error) {
+	request := &ChangeRequest{}
+	var payload []byte
+	if err := row.Scan(
+		&request.ID,
+		&request.FlagID,
+		&request.Flag,
+		&request.EnvironmentID,
+		&request.Action,
+		&payload,
+		&request.Author,
+		&request.RequiredApprovals,
+		&request.Status,
+		&request.CreatedAt,
+		&request.ResolvedAt,
+		&request.Reviews,
+	); err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		request.Payload = payload
+	}
+
+	return request, nil
+}
+
+// getChangeRequest reads the change request, limited to the company when companyId is set, nil when it doesn't exist
+func (s *System) getChangeRequest(ctx context.Context, companyId, requestId string) (*ChangeRequest, error) {
+	request, err := scanChangeRequest(s.DB.QueryRow(ctx, `
+    SELECT`+changeRequestColumns+`
+    FROM public.flag_change_request cr
+      JOIN public.environment env ON env.id = cr.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+      JOIN public."user" author ON author.id = cr.author_id
+    WHERE cr.request_id = $1
+      AND ($2 = '' OR company.company_id = $2)`, requestId, companyId))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get change request: %v", err)
+	}
+
+	return request, nil
+}
+
+func (s *System) GetChangeRequestFromDB(ctx context.Context, companyId, requestId string) (*ChangeRequest, error) {
+	return s.getChangeRequest(ctx, companyId, requestId)
+}
+
+// GetChangeRequestsFromDB lists the company's change requests, newest first, with the given status or all of them
+func (s *System) GetChangeRequestsFromDB(ctx context.Context, companyId string, status ChangeStatus) ([]ChangeRequest, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT`+changeRequestColumns+`
+    FROM public.flag_change_request cr
+      JOIN public.environment env ON env.id = cr.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+      JOIN public."user" author ON author.id = cr.author_id
+    WHERE company.company_id = $1
+      AND ($2 = '' OR cr.status = $2)
+    ORDER BY cr.created_at DESC`, companyId, string(status))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return []ChangeRequest{}, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get change requests: %v", err)
+	}
+	defer rows.Close()
+
+	requests := make([]ChangeRequest, 0)
+	for rows.Next() {
+		request, err := scanChangeRequest(rows)
+		if err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		requests = append(requests, *request)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get change requests: %v", rows.Err())
+	}
+
+	return requests, nil
+}
+
+// ReviewChangeRequestInDB records the reviewer's decision, and once the request has enough approvals applies
+// the change in the same transaction, so it is either applied and marked applied or neither
+func (s *System) ReviewChangeRequestInDB(ctx context.Context, companyId, requestId, reviewer string, decision ReviewDecision, comment string) (*ChangeRequest, error) {
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var (
+			id       int
+			authorId int
+			status   ChangeStatus
+		)
+		err := tx.QueryRow(ctx, `
+      SELECT cr.id, cr.author_id, cr.status
+      FROM public.flag_change_request cr
+        JOIN public.environment env ON env.id = cr.environment_id
+        JOIN public.agent ON agent.id = env.agent_id
+        JOIN public.project ON project.id = agent.project_id
+        JOIN public.company ON company.id = project.company_id
+      WHERE cr.request_id = $1
+        AND company.company_id = $2
+      FOR UPDATE OF cr`, requestId, companyId).Scan(&id, &authorId, &status)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrChangeRequestNotFound
+			}
+			return s.Config.Bugfixes.Logger.Errorf("failed to get change request: %v", err)
+		}
+		if status != ChangePending {
+			return ErrChangeRequestResolved
+		}
+
+		var reviewerId int
+		if err := tx.QueryRow(ctx, `SELECT id FROM public."user" WHERE subject = $1`, reviewer).Scan(&reviewerId); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to get reviewer: %v", err)
+		}
+		if reviewerId == authorId {
+			return ErrAuthorCannotReview
+		}
+
+		if _, err := tx.Exec(ctx, `
+      INSERT INTO public.flag_change_review (change_request_id, reviewer_id, decision, comment)
+      VALUES ($1, $2, $3, NULLIF($4, ''))`, id, reviewerId, string(decision), comment); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return ErrAlreadyReviewed
+			}
+			return s.Config.Bugfixes.Logger.Errorf("failed to record review: %v", err)
+		}
+
+		request, err := scanChangeRequest(tx.QueryRow(ctx, `
+      SELECT`+changeRequestColumns+`
+      FROM public.flag_change_request cr
+        JOIN public.environment env ON env.id = cr.environment_id
+        JOIN public."user" author ON author.id = cr.author_id
+      WHERE cr.id = $1`, id))
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to get change request: %v", err)
+		}
+
+		switch outcome(request.RequiredApprovals, request.Reviews) {
+		case ChangeRejected:
+			if err := s.resolveChangeRequestTx(ctx, tx, id, ChangeRejected); err != nil {
+				return err
+			}
+			return s.notifyTx(ctx, tx, id, notifyParticipants, "Change request rejected", "The change to %s in %s was rejected")
+		case ChangeApplied:
+			if err := s.applyChangeTx(ctx, tx, request); err != nil {
+				return err
+			}
+			if err := s.resolveChangeRequestTx(ctx, tx, id, ChangeApplied); err != nil {
+				return err
+			}
+			return s.notifyTx(ctx, tx, id, notifyParticipants, "Change request applied", "The change to %s in %s was approved and applied")
+		}
+
+		return s.notifyTx(ctx, tx, id, notifyAuthor, "Change request approved", "Your change to %s in %s was approved and needs more approvals")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getChangeRequest(ctx, companyId, requestId)
+}
+
+func (s *System) resolveChangeRequestTx(ctx context.Context, tx pgx.Tx, id int, status ChangeStatus) error {
+	if _, err := tx.Exec(ctx, `
+    UPDATE public.flag_change_request
+    SET
+      status = $2,
+      resolved_at = now()
+    WHERE id = $1`, id, string(status)); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to resolve change request: %v", err)
+	}
+
+	return nil
+}
+
+// applyChangeTx makes the requested change, recorded in the flag's history as the author's
+func (s *System) applyChangeTx(ctx context.Context, tx pgx.Tx, request *ChangeRequest) error {
+	if request.FlagID == "" {
+		return ErrChangeRequestStale
+	}
+	ctx = WithChange(ctx, request.Author, "change request "+request.ID)
+
+	switch request.Action {
+	case ChangeUpdate:
+		update := flagUpdate{}
+		if err := json.Unmarshal(request.Payload, &update); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to decode change: %v", err)
+		}
+		return s.updateFlagTx(ctx, tx, Flag{
+			Enabled: update.Enabled,
+			Details: Details{
+				ID:   request.FlagID,
+				Name: update.Name,
+			},
+		})
+	case ChangeEdit:
+		edit := FlagNameChangeRequest{}
+		if err := json.Unmarshal(request.Payload, &edit); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to decode change: %v", err)
+		}
+		edit.ID = request.FlagID
+		return s.editFlagTx(ctx, tx, edit)
+	case ChangeDelete:
+		return s.deleteFlagTx(ctx, tx, Flag{
+			Details: Details{
+				ID: request.FlagID,
+			},
+		})
+	case ChangePromote:
+		_, err := s.promoteFlagTx(ctx, tx, request.FlagID)
+		return err
+	}
+
+	return s.Config.Bugfixes.Logger.Errorf("unknown change request action: %s", request.Action)
+}
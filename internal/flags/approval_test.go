@@ -0,0 +1,38 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcome(t *testing.T) {
+	approve := Review{Decision: ReviewApprove}
+	reject := Review{Decision: ReviewReject}
+
+	tests := []struct {
+		name     string
+		required int
+		reviews  []Review
+		want     ChangeStatus
+	}{
+		{"no reviews", 1, nil, ChangePending},
+		{"enough approvals", 1, []Review{approve}, ChangeApplied},
+		{"needs more approvals", 2, []Review{approve}, ChangePending},
+		{"rejection is final", 2, []Review{approve, reject}, ChangeRejected},
+		{"rejection before approvals", 1, []Review{reject, approve}, ChangeRejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, outcome(tt.required, tt.reviews))
+		})
+	}
+}
+
+func TestChangeActionDefinitionWide(t *testing.T) {
+	assert.False(t, ChangeUpdate.definitionWide())
+	assert.False(t, ChangePromote.definitionWide())
+	assert.True(t, ChangeEdit.definitionWide())
+	assert.True(t, ChangeDelete.definitionWide())
+}
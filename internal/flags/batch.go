@@ -0,0 +1,97 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+)
+
+type BatchAction string
+
+const (
+	BatchCreate  BatchAction = "create"
+	BatchUpdate  BatchAction = "update"
+	BatchDelete  BatchAction = "delete"
+	BatchPromote BatchAction = "promote"
+)
+
+const maxBatchOperations = 100
+
+// BatchOperation is one step of a batch, Flag is the flag to create and Enabled and Name are an update,
+// the same as POST /flag and PATCH /flag/{flagId} take them
+type BatchOperation struct {
+	Action  BatchAction `json:"action"`
+	FlagID  string      `json:"flagId,omitempty"`
+	Flag    *flagCreate `json:"flag,omitempty"`
+	Enabled bool        `json:"enabled"`
+	Name    string      `json:"name,omitempty"`
+}
+
+// BatchRequest runs every operation or none of them, unless ContinueOnError is set
+// in which case the failed operations are skipped and the rest are kept
+type BatchRequest struct {
+	Operations      []BatchOperation `json:"operations"`
+	ContinueOnError bool             `json:"continueOnError"`
+}
+
+// BatchResult is the outcome of one operation, FlagID is the new flag's id for a create or a promote
+type BatchResult struct {
+	Index   int         `json:"index"`
+	Action  BatchAction `json:"action"`
+	FlagID  string      `json:"flagId,omitempty"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// ValidateBatch checks the operations are complete before any of them are run
+func ValidateBatch(req BatchRequest) error {
+	if len(req.Operations) == 0 {
+		return fmt.Errorf("%w: no operations", ErrInvalidBatch)
+	}
+	if len(req.Operations) > maxBatchOperations {
+		return fmt.Errorf("%w: at most %d operations are allowed", ErrInvalidBatch, maxBatchOperations)
+	}
+
+	for i, op := range req.Operations {
+		switch op.Action {
+		case BatchCreate:
+			if op.Flag == nil || op.Flag.Name == "" || op.Flag.AgentId == "" || op.Flag.EnvironmentId == "" {
+				return fmt.Errorf("%w: operation %d needs a flag with a name, agentId and environmentId", ErrInvalidBatch, i)
+			}
+			if err := ValidateVariants(op.Flag.Type, op.Flag.Variants, op.Flag.DefaultVariant, op.Flag.OffVariant); err != nil {
+				return fmt.Errorf("%w: operation %d: %w", ErrInvalidBatch, i, err)
+			}
+		case BatchUpdate, BatchDelete, BatchPromote:
+			if op.FlagID == "" {
+				return fmt.Errorf("%w: operation %d needs a flagId", ErrInvalidBatch, i)
+			}
+		default:
+			return fmt.Errorf("%w: operation %d has unknown action %q", ErrInvalidBatch, i, op.Action)
+		}
+	}
+
+	return nil
+}
+
+// batchError is what a result says about a failed operation, errors that aren't the caller's are already logged
+func batchError(err error) string {
+	for _, known := range []error{
+		ErrFlagExists,
+		ErrDefinitionMismatch,
+		ErrFlagNameTaken,
+		ErrFlagHasDependents,
+		ErrNoChildEnvironment,
+		ErrApprovalRequired,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "failed to apply operation"
+}
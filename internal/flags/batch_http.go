@@ -0,0 +1,77 @@
+package flags
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/flags-gg/orchestrator/internal/authz"
+	"github.com/flags-gg/orchestrator/internal/company"
+)
+
+func (s *System) BatchFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ctx = requestChange(r, userId)
+
+	req := BatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := ValidateBatch(req); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	// the whole batch is refused when any of it reaches outside the company
+	authorizer := authz.NewSystem(s.Container)
+	for _, op := range req.Operations {
+		if op.Action == BatchCreate {
+			if !authorizer.Allow(w, r, companyId, authz.Agent, op.Flag.AgentId) ||
+				!authorizer.Allow(w, r, companyId, authz.Environment, op.Flag.EnvironmentId) {
+				return
+			}
+			continue
+		}
+		if !authorizer.Allow(w, r, companyId, authz.Flag, op.FlagID) {
+			return
+		}
+	}
+
+	response, err := s.RunBatchInDB(ctx, req)
+	if err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to run batch: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Committed {
+		w.WriteHeader(http.StatusConflict)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
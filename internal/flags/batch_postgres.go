@@ -0,0 +1,114 @@
+package flags
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var errBatchFailed = errors.New("batch operation failed")
+
+// batchChangeActions are the batch actions that need approval in a protected environment
+var batchChangeActions = map[BatchAction]ChangeAction{
+	BatchUpdate:  ChangeUpdate,
+	BatchDelete:  ChangeDelete,
+	BatchPromote: ChangePromote,
+}
+
+// RunBatchInDB runs the operations in one transaction, each behind its own savepoint so a failed one can be
+// skipped when the batch continues on error, otherwise the first failure rolls the whole batch back
+func (s *System) RunBatchInDB(ctx context.Context, req BatchRequest) (*BatchResponse, error) {
+	response := &BatchResponse{
+		Results: make([]BatchResult, 0, len(req.Operations)),
+	}
+
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		for i, op := range req.Operations {
+			result := BatchResult{
+				Index:  i,
+				Action: op.Action,
+				FlagID: op.FlagID,
+			}
+
+			flagId, err := s.runBatchOperation(ctx, tx, op)
+			if err != nil {
+				result.Error = batchError(err)
+				response.Results = append(response.Results, result)
+				if !req.ContinueOnError {
+					return errBatchFailed
+				}
+				continue
+			}
+
+			if flagId != "" {
+				result.FlagID = flagId
+			}
+			result.Success = true
+			response.Results = append(response.Results, result)
+		}
+
+		return nil
+	})
+	if errors.Is(err, errBatchFailed) {
+		return response, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response.Committed = true
+	return response, nil
+}
+
+func (s *System) runBatchOperation(ctx context.Context, tx pgx.Tx, op BatchOperation) (string, error) {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to start savepoint: %v", err)
+	}
+	defer func() {
+		_ = savepoint.Rollback(ctx)
+	}()
+
+	// a batch can't hold changes for review, so protected environments are changed through change requests
+	if action, ok := batchChangeActions[op.Action]; ok {
+		required, err := s.requiredApprovalsTx(ctx, savepoint, op.FlagID, action, op.Name)
+		if err != nil {
+			return "", err
+		}
+		if required > 0 {
+			return "", ErrApprovalRequired
+		}
+	}
+
+	var flagId string
+	switch op.Action {
+	case BatchCreate:
+		flagId, err = s.createFlagTx(ctx, savepoint, *op.Flag)
+	case BatchUpdate:
+		err = s.updateFlagTx(ctx, savepoint, Flag{
+			Enabled: op.Enabled,
+			Details: Details{
+				ID:   op.FlagID,
+				Name: op.Name,
+			},
+		})
+	case BatchDelete:
+		err = s.deleteFlagTx(ctx, savepoint, Flag{
+			Details: Details{
+				ID: op.FlagID,
+			},
+		})
+	case BatchPromote:
+		flagId, err = s.promoteFlagTx(ctx, savepoint, op.FlagID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := savepoint.Commit(ctx); err != nil {
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to release savepoint: %v", err)
+	}
+
+	return flagId, nil
+}
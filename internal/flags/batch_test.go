@@ -0,0 +1,74 @@
+package flags
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBatch(t *testing.T) {
+	valid := BatchRequest{
+		Operations: []BatchOperation{
+			{Action: BatchCreate, Flag: &flagCreate{Name: "checkout", AgentId: "agent-1", EnvironmentId: "env-1"}},
+			{Action: BatchUpdate, FlagID: "1", Enabled: true},
+			{Action: BatchDelete, FlagID: "2"},
+			{Action: BatchPromote, FlagID: "3"},
+		},
+	}
+	assert.NoError(t, ValidateBatch(valid))
+
+	tooMany := BatchRequest{}
+	for i := 0; i <= maxBatchOperations; i++ {
+		tooMany.Operations = append(tooMany.Operations, BatchOperation{Action: BatchDelete, FlagID: fmt.Sprint(i)})
+	}
+
+	tests := []struct {
+		name string
+		req  BatchRequest
+	}{
+		{
+			name: "No operations",
+			req:  BatchRequest{},
+		},
+		{
+			name: "Too many operations",
+			req:  tooMany,
+		},
+		{
+			name: "Unknown action",
+			req:  BatchRequest{Operations: []BatchOperation{{Action: "rename", FlagID: "1"}}},
+		},
+		{
+			name: "Update without a flag",
+			req:  BatchRequest{Operations: []BatchOperation{{Action: BatchUpdate}}},
+		},
+		{
+			name: "Create without an environment",
+			req:  BatchRequest{Operations: []BatchOperation{{Action: BatchCreate, Flag: &flagCreate{Name: "checkout", AgentId: "agent-1"}}}},
+		},
+		{
+			name: "Create with an unknown default variant",
+			req: BatchRequest{Operations: []BatchOperation{{Action: BatchCreate, Flag: &flagCreate{
+				Name:           "colour",
+				AgentId:        "agent-1",
+				EnvironmentId:  "env-1",
+				Type:           FlagTypeString,
+				Variants:       []Variant{{Name: "blue", Value: "#0000ff"}},
+				DefaultVariant: "red",
+				OffVariant:     "blue",
+			}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, ValidateBatch(tt.req), ErrInvalidBatch)
+		})
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	assert.Equal(t, ErrFlagHasDependents.Error(), batchError(fmt.Errorf("delete: %w", ErrFlagHasDependents)))
+	assert.Equal(t, "failed to apply operation", batchError(fmt.Errorf("connection reset")))
+}
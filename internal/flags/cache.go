@@ -0,0 +1,248 @@
+package flags
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// agentCacheTTL bounds how stale an environment can be served when its change event is missed
+	agentCacheTTL = 30 * time.Second
+	// agentCacheSize is how many environments and default environment lookups one instance keeps
+	agentCacheSize = 10000
+)
+
+// agentCacheKey is an environment as an agent asks for it, an empty EnvironmentID is the agent's default environment
+type agentCacheKey struct {
+	ProjectID     string
+	AgentID       string
+	EnvironmentID string
+}
+
+type agentCacheEntry struct {
+	key     agentCacheKey
+	res     *AgentResponse
+	envId   string
+	expires time.Time
+}
+
+// CacheStats are the counters of the agent cache since the instance started
+type CacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+// AgentCache keeps the environments agents read, as stored, so the evaluation paths skip the database.
+// Entries go when their environment changes, when they expire, and least recently used first once it's full
+type AgentCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+	entries map[agentCacheKey]*list.Element
+	recent  *list.List
+	loads   singleflight.Group
+	// generation moves on with every change, loads begun before it aren't kept
+	generation uint64
+	// unsubscribe stops the change events, once the container closes
+	unsubscribe func()
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newAgentCache(ttl time.Duration, size int) *AgentCache {
+	return &AgentCache{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		entries: make(map[agentCacheKey]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// environment returns the environment's flags, loading them on a miss, the caller gets its own copy to change
+func (c *AgentCache) environment(ctx context.Context, key agentCacheKey, load func(ctx context.Context) (*AgentResponse, error)) (*AgentResponse, error) {
+	entry, generation := c.get(key)
+	if entry != nil {
+		return copyAgentResponse(entry.res), nil
+	}
+
+	loaded, err, _ := c.loads.Do(c.loadKey(key, generation), func() (interface{}, error) {
+		// the load is shared, one caller leaving mustn't fail the others
+		res, err := load(context.WithoutCancel(ctx))
+		if err != nil || res == nil {
+			return res, err
+		}
+		c.put(&agentCacheEntry{
+			key: key,
+			res: res,
+		}, generation)
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, _ := loaded.(*AgentResponse)
+	if res == nil {
+		return nil, nil
+	}
+
+	return copyAgentResponse(res), nil
+}
+
+// defaultEnvironment returns the agent's default environment, loading it on a miss
+func (c *AgentCache) defaultEnvironment(ctx context.Context, projectId, agentId string, load func(ctx context.Context) (string, error)) (string, error) {
+	key := agentCacheKey{
+		ProjectID: projectId,
+		AgentID:   agentId,
+	}
+	entry, generation := c.get(key)
+	if entry != nil {
+		return entry.envId, nil
+	}
+
+	loaded, err, _ := c.loads.Do(c.loadKey(key, generation), func() (interface{}, error) {
+		envId, err := load(context.WithoutCancel(ctx))
+		if err != nil || envId == "" {
+			return envId, err
+		}
+		c.put(&agentCacheEntry{
+			key:   key,
+			envId: envId,
+		}, generation)
+		return envId, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return loaded.(string), nil
+}
+
+// loadKey shares a load between the misses of a key in one generation, a miss after a change starts its own
+func (c *AgentCache) loadKey(key agentCacheKey, generation uint64) string {
+	return key.ProjectID + "\x00" + key.AgentID + "\x00" + key.EnvironmentID + "\x00" + strconv.FormatUint(generation, 10)
+}
+
+// get returns the live entry for the key, or nil and the generation a load for it belongs to
+func (c *AgentCache) get(key agentCacheKey) (*agentCacheEntry, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, c.generation
+	}
+	entry := element.Value.(*agentCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		c.misses.Add(1)
+		return nil, c.generation
+	}
+	c.recent.MoveToFront(element)
+	c.hits.Add(1)
+
+	return entry, c.generation
+}
+
+// put keeps the loaded entry, unless something changed while it loaded
+func (c *AgentCache) put(entry *agentCacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	entry.expires = c.now().Add(c.ttl)
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.recent.PushFront(entry)
+	for len(c.entries) > c.size {
+		c.remove(c.recent.Back())
+	}
+}
+
+func (c *AgentCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*agentCacheEntry).key)
+}
+
+// changed drops every entry the event reaches, a default environment lookup goes with any change to its agent
+// or to the environment it found
+func (c *AgentCache) changed(event bus.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		entry := element.Value.(*agentCacheEntry)
+		if key.EnvironmentID == "" {
+			if event.AgentID == key.AgentID || (event.EnvironmentID != "" && event.EnvironmentID == entry.envId) {
+				c.remove(element)
+			}
+			continue
+		}
+		if event.Affects(key.AgentID, key.EnvironmentID) {
+			c.remove(element)
+		}
+	}
+	// a load already running may have read the old state, it must not land after the change
+	c.generation++
+}
+
+// clear drops every entry, for changes made behind the bus
+func (c *AgentCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[agentCacheKey]*list.Element)
+	c.recent.Init()
+	c.generation++
+}
+
+// Close stops following changes, the container calls it as it closes
+func (c *AgentCache) Close() {
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+	}
+}
+
+func (c *AgentCache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: entries,
+	}
+}
+
+// copyAgentResponse copies the flags so the caller can resolve and strip them, the rules inside stay shared and
+// must not be changed
+func copyAgentResponse(res *AgentResponse) *AgentResponse {
+	cp := *res
+	cp.SecretMenu.Styles = append([]SecretMenuStyle(nil), res.SecretMenu.Styles...)
+	cp.Flags = append([]Flag(nil), res.Flags...)
+
+	flagRefs := make([]*Flag, len(cp.Flags))
+	for i := range cp.Flags {
+		flagRefs[i] = &cp.Flags[i]
+	}
+	LinkPrerequisites(flagRefs...)
+
+	return &cp
+}
@@ -0,0 +1,31 @@
+package flags
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+)
+
+// sharedAgentCache is the container key of the agent cache
+type sharedAgentCache struct{}
+
+// agentCache is the container's cache, shared by every System built on it and emptied of what each change event reaches
+func (s *System) agentCache() *AgentCache {
+	return s.Shared(sharedAgentCache{}, func() interface{} {
+		cache := newAgentCache(agentCacheTTL, agentCacheSize)
+		cache.unsubscribe = bus.Subscribe(cache.changed)
+		return cache
+	}).(*AgentCache)
+}
+
+// GetCacheStats handles GET /cache, the agent cache counters of the instance that answers. Like /health it's for
+// operators and the platform's own probes, the counters cover every company together and say nothing about any one
+// of them, so it isn't behind a user
+func (s *System) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(s.agentCache().Stats()); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package flags
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingLoader serves a one flag environment and counts the loads that reach it
+type countingLoader struct {
+	loads   int
+	enabled bool
+}
+
+func (l *countingLoader) load(_ context.Context) (*AgentResponse, error) {
+	l.loads++
+	return &AgentResponse{
+		Flags: []Flag{{
+			Enabled: l.enabled,
+			Details: Details{
+				ID:   "1",
+				Name: "feature",
+			},
+		}},
+	}, nil
+}
+
+func TestAgentCacheReadsThrough(t *testing.T) {
+	cache := newAgentCache(time.Minute, 10)
+	loader := &countingLoader{}
+	key := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	first, err := cache.environment(context.Background(), key, loader.load)
+	assert.NoError(t, err)
+	// the copy handed out is the caller's to change
+	first.Flags[0].Enabled = true
+
+	second, err := cache.environment(context.Background(), key, loader.load)
+	assert.NoError(t, err)
+	assert.False(t, second.Flags[0].Enabled)
+	assert.Equal(t, 1, loader.loads)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Entries: 1}, cache.Stats())
+}
+
+func TestAgentCacheExpires(t *testing.T) {
+	now := time.Now()
+	cache := newAgentCache(time.Minute, 10)
+	cache.now = func() time.Time { return now }
+	loader := &countingLoader{}
+	key := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	_, _ = cache.environment(context.Background(), key, loader.load)
+	now = now.Add(59 * time.Second)
+	_, _ = cache.environment(context.Background(), key, loader.load)
+	assert.Equal(t, 1, loader.loads)
+
+	now = now.Add(time.Second)
+	_, _ = cache.environment(context.Background(), key, loader.load)
+	assert.Equal(t, 2, loader.loads)
+}
+
+func TestAgentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newAgentCache(time.Minute, 2)
+	loader := &countingLoader{}
+	a := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "a"}
+	b := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "b"}
+	c := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "c"}
+
+	_, _ = cache.environment(context.Background(), a, loader.load)
+	_, _ = cache.environment(context.Background(), b, loader.load)
+	_, _ = cache.environment(context.Background(), a, loader.load)
+	_, _ = cache.environment(context.Background(), c, loader.load)
+	assert.Equal(t, 3, loader.loads)
+	assert.Equal(t, 2, cache.Stats().Entries)
+
+	// b was the least recently used, a is still there
+	_, _ = cache.environment(context.Background(), a, loader.load)
+	assert.Equal(t, 3, loader.loads)
+	_, _ = cache.environment(context.Background(), b, loader.load)
+	assert.Equal(t, 4, loader.loads)
+}
+
+func TestAgentCacheInvalidatesOnChange(t *testing.T) {
+	cache := newAgentCache(time.Minute, 10)
+	loader := &countingLoader{}
+	env := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+	other := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "other"}
+
+	_, _ = cache.environment(context.Background(), env, loader.load)
+	_, _ = cache.environment(context.Background(), other, loader.load)
+	envId, err := cache.defaultEnvironment(context.Background(), "project", "agent", func(context.Context) (string, error) {
+		return "env", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "env", envId)
+	assert.Equal(t, 3, cache.Stats().Entries)
+
+	loader.enabled = true
+	cache.changed(bus.Event{Kind: bus.KindFlag, Action: bus.ActionUpdated, AgentID: "agent", EnvironmentID: "env", FlagID: "1"})
+	assert.Equal(t, 1, cache.Stats().Entries)
+
+	res, err := cache.environment(context.Background(), env, loader.load)
+	assert.NoError(t, err)
+	assert.True(t, res.Flags[0].Enabled)
+	_, _ = cache.environment(context.Background(), other, loader.load)
+	assert.Equal(t, 3, loader.loads)
+}
+
+func TestAgentCacheDropsLoadsOvertakenByChange(t *testing.T) {
+	cache := newAgentCache(time.Minute, 10)
+	key := agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	// the change lands while the old state is being read
+	_, err := cache.environment(context.Background(), key, func(ctx context.Context) (*AgentResponse, error) {
+		cache.changed(bus.Event{Kind: bus.KindFlag, Action: bus.ActionUpdated, AgentID: "agent", EnvironmentID: "env"})
+		return &AgentResponse{}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestCopyAgentResponseRelinksPrerequisites(t *testing.T) {
+	res := &AgentResponse{
+		Flags: []Flag{
+			{Enabled: false, Details: Details{Name: "parent"}},
+			{Enabled: true, Details: Details{Name: "child"}, Prerequisites: []Prerequisite{{Flag: "parent"}}},
+		},
+	}
+	LinkPrerequisites(&res.Flags[0], &res.Flags[1])
+
+	cp := copyAgentResponse(res)
+	cp.Flags[0].Enabled = true
+	assert.Equal(t, "", cp.Flags[1].FailedPrerequisite())
+	assert.Equal(t, "parent", res.Flags[1].FailedPrerequisite())
+}
+
+func TestAgentCacheIsTheContainers(t *testing.T) {
+	c := &container.Container{}
+	cache := NewSystem(c).agentCache()
+	assert.Same(t, cache, NewSystem(c).agentCache())
+	assert.NotSame(t, cache, NewSystem(&container.Container{}).agentCache())
+	c.Close()
+}
+
+func TestAgentCacheStatsAreInstanceCounters(t *testing.T) {
+	c := &container.Container{}
+	_, err := NewSystem(c).agentCache().environment(context.Background(), agentCacheKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}, (&countingLoader{}).load)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	NewSystem(c).GetCacheStats(w, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"hits":0,"misses":1,"entries":1}`, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "project")
+}
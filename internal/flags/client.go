@@ -2,15 +2,28 @@ package flags
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 
+	"github.com/flags-gg/orchestrator/internal/bus"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrFlagExists         = errors.New("flag already exists in the environment")
+	ErrDefinitionMismatch = errors.New("flag already exists in another environment with a different type or variants")
+	ErrNoChildEnvironment = errors.New("no child environment to promote to")
 )
 
 type flagCreate struct {
-	Name          string `json:"name"`
-	EnvironmentId string `json:"environmentId"`
-	AgentId       string `json:"agentId"`
+	Name           string    `json:"name"`
+	EnvironmentId  string    `json:"environmentId"`
+	AgentId        string    `json:"agentId"`
+	Type           FlagType  `json:"type,omitempty"`
+	Variants       []Variant `json:"variants,omitempty"`
+	DefaultVariant string    `json:"defaultVariant,omitempty"`
+	OffVariant     string    `json:"offVariant,omitempty"`
 }
 
 type CompanyFlagEnvironment struct {
@@ -28,29 +41,47 @@ type CompanyFlagEntry struct {
 }
 
 func (s *System) GetClientFlagsFromDB(ctx context.Context, environmentId string) ([]Flag, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return nil, s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
-		}
-	}()
-
 	var flags []Flag
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
         flags.id,
-        flags.name,
+        def.name,
         flags.enabled,
         COALESCE(flags.updated_at::text, ''),
+        def.flag_type,
+        def.variants,
+        COALESCE(flags.default_variant, ''),
+        COALESCE(flags.off_variant, ''),
+        flags.targeting_rules,
+        flags.rollout,
+        COALESCE((
+          SELECT jsonb_agg(jsonb_build_object(
+            'flagId', pre.prerequisite_flag_id::text,
+            'flag', pfd.name,
+            'variant', COALESCE(pre.variant, '')) ORDER BY pfd.name)
+          FROM public.flag_prerequisite pre
+            JOIN public.flag pf ON pf.id = pre.prerequisite_flag_id
+            JOIN public.flag_definition pfd ON pfd.id = pf.definition_id
+          WHERE pre.flag_id = flags.id
+        ), '[]'::jsonb),
+        jsonb_strip_nulls(jsonb_build_object(
+          'description', def.description,
+          'tags', def.tags,
+          'kind', def.kind,
+          'links', def.links,
+          'owner', (
+            SELECT jsonb_build_object(
+              'subject', usr.subject,
+              'first_name', COALESCE(usr.first_name, ''),
+              'last_name', COALESCE(usr.last_name, ''),
+              'known_as', COALESCE(usr.known_as, ''))
+            FROM public."user" usr
+            WHERE usr.id = def.owner_id))),
         COALESCE(
           EXISTS (
             SELECT 1
             FROM public.environment_chain ec
-            JOIN public.flag f2 ON f2.agent_id = flags.agent_id
-                                AND f2.name = flags.name
+            JOIN public.flag f2 ON f2.definition_id = flags.definition_id
                                 AND f2.environment_id = ec.child_environment_id
             WHERE ec.agent_id = flags.agent_id
               AND ec.parent_environment_id = flags.environment_id
@@ -58,6 +89,7 @@ func (s *System) GetClientFlagsFromDB(ctx context.Context, environmentId string)
         ) AS promoted
     FROM public.agent
         LEFT JOIN public.flag AS flags ON agent.id = flags.agent_id
+        LEFT JOIN public.flag_definition AS def ON def.id = flags.definition_id
         LEFT JOIN public.environment AS env ON env.id = flags.environment_id
         LEFT JOIN public.project ON project.id = agent.project_id
     WHERE env.env_id = $1`, environmentId)
@@ -68,46 +100,64 @@ func (s *System) GetClientFlagsFromDB(ctx context.Context, environmentId string)
 		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get flags: %v", err)
 	}
 	defer rows.Close()
-	if rows.Err() != nil {
-		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get flags: %v", err)
-	}
 	for rows.Next() {
 		flag := Flag{}
 		details := Details{}
-		err := rows.Scan(&details.ID, &details.Name, &flag.Enabled, &details.LastChanged, &details.Promoted)
+		err := rows.Scan(
+			&details.ID,
+			&details.Name,
+			&flag.Enabled,
+			&details.LastChanged,
+			&flag.Type,
+			&flag.Variants,
+			&flag.DefaultVariant,
+			&flag.OffVariant,
+			&flag.TargetingRules,
+			&flag.Rollout,
+			&flag.Prerequisites,
+			&details.FlagMetadata,
+			&details.Promoted,
+		)
 		if err != nil {
 			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
 		}
 		flag.Details = details
 		flags = append(flags, flag)
 	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get flags: %v", rows.Err())
+	}
 
 	return flags, nil
 }
 
-func (s *System) GetCompanyFlagsFromDB(ctx context.Context, companyId string) ([]CompanyFlagEntry, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return nil, s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+// GetCompanyFlagsFromDB lists every flag of the company, optionally only those with a tag or owner
+func (s *System) GetCompanyFlagsFromDB(ctx context.Context, companyId string, filter FlagFilter) ([]CompanyFlagEntry, error) {
+	rows, err := s.DB.Query(ctx, `
 		SELECT
 			f.id,
-			f.name,
+			def.name,
 			f.enabled,
 			COALESCE(f.updated_at::text, ''),
+			def.flag_type,
+			jsonb_strip_nulls(jsonb_build_object(
+				'description', def.description,
+				'tags', def.tags,
+				'kind', def.kind,
+				'links', def.links,
+				'owner', (
+					SELECT jsonb_build_object(
+						'subject', usr.subject,
+						'first_name', COALESCE(usr.first_name, ''),
+						'last_name', COALESCE(usr.last_name, ''),
+						'known_as', COALESCE(usr.known_as, ''))
+					FROM public."user" usr
+					WHERE usr.id = def.owner_id))),
 			COALESCE(
 				EXISTS (
 					SELECT 1
 					FROM public.environment_chain ec
-					JOIN public.flag f2 ON f2.agent_id = f.agent_id
-						AND f2.name = f.name
+					JOIN public.flag f2 ON f2.definition_id = f.definition_id
 						AND f2.environment_id = ec.child_environment_id
 					WHERE ec.agent_id = f.agent_id
 						AND ec.parent_environment_id = f.environment_id
@@ -120,11 +170,19 @@ func (s *System) GetCompanyFlagsFromDB(ctx context.Context, companyId string) ([
 			COALESCE(agent.name, ''),
 			COALESCE(project.name, '')
 		FROM public.flag f
+			JOIN public.flag_definition def ON def.id = f.definition_id
 			JOIN public.environment env ON env.id = f.environment_id
 			JOIN public.agent agent ON agent.id = f.agent_id
 			JOIN public.project project ON project.id = agent.project_id
 			JOIN public.company company ON company.id = project.company_id
-		WHERE company.company_id = $1`, companyId)
+		WHERE company.company_id = $1
+			AND ($2 = '' OR def.tags ? LOWER($2))
+			AND ($3 = '' OR EXISTS (
+				SELECT 1
+				FROM public."user" usr
+				WHERE usr.id = def.owner_id
+					AND usr.subject = $3
+			))`, companyId, filter.Tag, filter.Owner)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return []CompanyFlagEntry{}, nil
@@ -144,6 +202,8 @@ func (s *System) GetCompanyFlagsFromDB(ctx context.Context, companyId string) ([
 			&entry.Flag.Details.Name,
 			&entry.Flag.Enabled,
 			&entry.Flag.Details.LastChanged,
+			&entry.Flag.Type,
+			&entry.Flag.Details.FlagMetadata,
 			&entry.Flag.Details.Promoted,
 			&entry.Environment.Id,
 			&entry.Environment.Name,
@@ -161,173 +221,429 @@ func (s *System) GetCompanyFlagsFromDB(ctx context.Context, companyId string) ([
 }
 
 func (s *System) UpdateFlagInDB(ctx context.Context, flag Flag) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.updateFlagTx(ctx, tx, flag)
+	})
+}
+
+// updateFlagTx toggles the flag in its environment and renames it in every environment, an empty name keeps the current one
+func (s *System) updateFlagTx(ctx context.Context, tx pgx.Tx, flag Flag) error {
+	return s.mutateDefinitionTx(ctx, tx, flag.Details.ID, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+      UPDATE public.flag
+      SET
+        enabled = $1,
+        updated_at = CASE
+          WHEN enabled != $1 THEN now()
+          ELSE updated_at
+        END
+      WHERE id = $2`, flag.Enabled, flag.Details.ID)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to update flag: %v", err)
 		}
-	}()
-
-	_, err = client.Exec(ctx, `
-    UPDATE public.flag
-    SET
-      enabled = $1,
-      name = $3,
-      updated_at = CASE
-        WHEN enabled != $1 THEN now()
-        ELSE updated_at
-      END
-    WHERE id = $2`, flag.Enabled, flag.Details.ID, flag.Details.Name)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to update flag: %v", err)
-	}
 
-	return nil
+		if flag.Details.Name == "" {
+			return nil
+		}
+		return s.updateDefinitionTx(ctx, tx, flag.Details.ID, flag.Details.Name, "", nil)
+	})
 }
 
+// EditFlagInDB renames the flag, and changes its type and variants when given, in every environment,
+// the default and off variants stay per environment
 func (s *System) EditFlagInDB(ctx context.Context, cr FlagNameChangeRequest) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.editFlagTx(ctx, tx, cr)
+	})
+}
+
+func (s *System) editFlagTx(ctx context.Context, tx pgx.Tx, cr FlagNameChangeRequest) error {
+	return s.mutateDefinitionTx(ctx, tx, cr.ID, func(tx pgx.Tx) error {
+		if cr.Type == "" {
+			return s.updateDefinitionTx(ctx, tx, cr.ID, cr.Name, "", nil)
 		}
-	}()
 
-	_, err = client.Exec(ctx, `
-    UPDATE public.flag
-    SET
-      name=$2
-    WHERE id = $1`, cr.ID, cr.Name)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to update flag: %v", err)
-	}
+		variants, err := variantsJSON(cr.Variants)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode variants: %v", err)
+		}
+		if err := s.updateDefinitionTx(ctx, tx, cr.ID, cr.Name, cr.Type, variants); err != nil {
+			return err
+		}
 
-	return nil
+		_, err = tx.Exec(ctx, `
+      UPDATE public.flag
+      SET
+        default_variant = NULLIF($2, ''),
+        off_variant = NULLIF($3, ''),
+        updated_at = now()
+      WHERE id = $1`, cr.ID, cr.DefaultVariant, cr.OffVariant)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to update flag: %v", err)
+		}
+
+		// the other environments keep their variants unless the one they pointed at was removed
+		_, err = tx.Exec(ctx, `
+      UPDATE public.flag f
+      SET
+        default_variant = CASE
+          WHEN EXISTS (SELECT 1 FROM jsonb_array_elements($2::jsonb) v WHERE v->>'name' = f.default_variant) THEN f.default_variant
+          ELSE NULLIF($3, '')
+        END,
+        off_variant = CASE
+          WHEN EXISTS (SELECT 1 FROM jsonb_array_elements($2::jsonb) v WHERE v->>'name' = f.off_variant) THEN f.off_variant
+          ELSE NULLIF($4, '')
+        END,
+        updated_at = now()
+      WHERE f.definition_id = (SELECT definition_id FROM public.flag WHERE id = $1)
+        AND f.id != $1`, cr.ID, variants, cr.DefaultVariant, cr.OffVariant)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to update flag: %v", err)
+		}
+
+		return nil
+	})
 }
 
+// DeleteFlagFromDB deletes the flag's definition, which removes the flag from every environment
 func (s *System) DeleteFlagFromDB(ctx context.Context, flag Flag) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
-		}
-	}()
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.deleteFlagTx(ctx, tx, flag)
+	})
+}
 
-	_, err = client.Exec(ctx, `DELETE FROM public.flag WHERE id = $1`, flag.Details.ID)
+// deleteFlagTx refuses to delete a flag that is still a prerequisite, removing it would silently turn its dependents off
+func (s *System) deleteFlagTx(ctx context.Context, tx pgx.Tx, flag Flag) error {
+	dependents, err := s.dependentFlagsTx(ctx, tx, flag.Details.ID)
 	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to delete flag: %v", err)
+		return err
+	}
+	if len(dependents) > 0 {
+		return ErrFlagHasDependents
 	}
 
-	return nil
+	return s.mutateDefinitionTx(ctx, tx, flag.Details.ID, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+      DELETE FROM public.flag_definition
+      WHERE id = (SELECT definition_id FROM public.flag WHERE id = $1)`, flag.Details.ID)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to delete flag: %v", err)
+		}
+
+		return nil
+	})
 }
 
+// DeleteAllFlagsForEnv deletes the environment's flags, and the definitions left without a flag in any environment so
+// a flag created later with the same name starts afresh
 func (s *System) DeleteAllFlagsForEnv(ctx context.Context, envId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		var envIdInt int
+		err := tx.QueryRow(ctx, `SELECT id FROM public.environment WHERE env_id = $1`, envId).Scan(&envIdInt)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to get environment id: %v", err)
 		}
-	}()
 
-	var envIdInt int
-	err = client.QueryRow(ctx, `SELECT id FROM public.environment WHERE env_id = $1`, envId).Scan(&envIdInt)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to get environment id: %v", err)
-	}
+		var definitionIds []int
+		rows, err := tx.Query(ctx, `
+      DELETE FROM public.flag
+      WHERE environment_id = $1
+      RETURNING definition_id`, envIdInt)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to delete flags: %v", err)
+		}
+		for rows.Next() {
+			var definitionId int
+			if err := rows.Scan(&definitionId); err != nil {
+				rows.Close()
+				return s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+			}
+			definitionIds = append(definitionIds, definitionId)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to delete flags: %v", rows.Err())
+		}
 
-	_, err = client.Exec(ctx, `DELETE FROM public.flag WHERE environment_id = $1`, envIdInt)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to delete flags: %v", err)
-	}
-	return nil
+		// a separate statement, one sharing the delete above would still see the flags it removed
+		_, err = tx.Exec(ctx, `
+      DELETE FROM public.flag_definition AS def
+      WHERE def.id = ANY($1)
+        AND NOT EXISTS (
+          SELECT 1
+          FROM public.flag
+          WHERE flag.definition_id = def.id)`, definitionIds)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to delete flag definitions: %v", err)
+		}
+
+		return bus.PublishTx(ctx, tx, bus.Event{
+			Kind:          bus.KindFlag,
+			Action:        bus.ActionDeleted,
+			EnvironmentID: envId,
+		})
+	})
 }
 
 func (s *System) PromoteFlagInDB(ctx context.Context, flagId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
-		}
-	}()
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := s.promoteFlagTx(ctx, tx, flagId)
+		return err
+	})
+}
 
+// promoteFlagTx copies the flag's state into the next environment in the chain, creating or updating the flag there,
+// and returns the promoted flag's id
+func (s *System) promoteFlagTx(ctx context.Context, tx pgx.Tx, flagId string) (string, error) {
 	// 1) Get source flag info
 	var (
-		flagName            string
-		enabled             bool
 		agentIdInt          int
 		sourceEnvironmentId int
 	)
-	err = client.QueryRow(ctx, `
-		SELECT f.name, f.enabled, f.agent_id, f.environment_id
+	err := tx.QueryRow(ctx, `
+		SELECT f.agent_id, f.environment_id
 		FROM public.flag f
-		WHERE f.id = $1`, flagId).Scan(&flagName, &enabled, &agentIdInt, &sourceEnvironmentId)
+		WHERE f.id = $1`, flagId).Scan(&agentIdInt, &sourceEnvironmentId)
 	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to load flag for promotion: %v", err)
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to load flag for promotion: %v", err)
 	}
 
 	// 2) Find the next child environment in the chain
-	var childEnvId int
-	err = client.QueryRow(ctx, `
-		SELECT ec.child_environment_id
-		FROM public.environment_chain ec
-		WHERE ec.agent_id = $1 AND ec.parent_environment_id = $2`, agentIdInt, sourceEnvironmentId).Scan(&childEnvId)
+	childEnvId, err := s.childEnvironmentTx(ctx, tx, agentIdInt, sourceEnvironmentId)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return s.Config.Bugfixes.Logger.Errorf("no child environment to promote to")
-		}
-		return s.Config.Bugfixes.Logger.Errorf("failed to find child environment: %v", err)
+		return "", err
 	}
 
-	// 3) Create a NEW flag in the child environment (do not rely on name uniqueness)
-	_, err = client.Exec(ctx, `
-		INSERT INTO public.flag (name, agent_id, environment_id, enabled)
-		VALUES ($1, $2, $3, $4)`,
-		flagName, agentIdInt, childEnvId, enabled,
-	)
+	// 3) Upsert the child environment's state for the same definition
+	promotedId, err := s.promoteStateTx(ctx, tx, flagId, childEnvId)
 	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to insert promoted flag: %v", err)
+		return "", err
 	}
 
-	return nil
+	// 4) Carry the prerequisites over to the flags they point at in the child environment
+	if err := s.promotePrerequisitesTx(ctx, tx, flagId, promotedId); err != nil {
+		return "", err
+	}
+
+	return promotedId, nil
 }
 
 func (s *System) CreateFlagInDB(ctx context.Context, flag flagCreate) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		_, err := s.createFlagTx(ctx, tx, flag)
+		return err
+	})
+}
+
+// createFlagTx adds the flag to its environment, under the agent's existing definition of the name when there is one, and returns its id
+func (s *System) createFlagTx(ctx context.Context, tx pgx.Tx, flag flagCreate) (string, error) {
+	flagType := flag.Type
+	if flagType == "" {
+		flagType = FlagTypeBoolean
+	}
+	variants, err := variantsJSON(flag.Variants)
 	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to connect to database: %v", err)
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to encode variants: %v", err)
+	}
+
+	// the flag may already be defined through another environment, then it has to match that definition
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO public.flag_definition (agent_id, name, flag_type, variants)
+        VALUES ((SELECT id FROM public.agent WHERE agent_id = $1), $2, $3, $4)
+        ON CONFLICT (agent_id, name) DO NOTHING`, flag.AgentId, flag.Name, flagType, variants); err != nil {
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to create flag definition: %v", err)
 	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("failed to close database connection: %v", err)
-		}
-	}()
 
-	_, err = client.Exec(ctx, `
+	var (
+		definitionId string
+		matches      bool
+	)
+	err = tx.QueryRow(ctx, `
+        SELECT
+          def.id::text,
+          def.flag_type = $3 AND def.variants = $4::jsonb
+        FROM public.flag_definition def
+        WHERE def.agent_id = (SELECT id FROM public.agent WHERE agent_id = $1)
+          AND def.name = $2`, flag.AgentId, flag.Name, flagType, variants).Scan(&definitionId, &matches)
+	if err != nil {
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to get flag definition: %v", err)
+	}
+	if !matches {
+		return "", ErrDefinitionMismatch
+	}
+
+	var flagId string
+	err = tx.QueryRow(ctx, `
         INSERT INTO public.flag (
-          name,
+          definition_id,
           agent_id,
-          environment_id
+          environment_id,
+          default_variant,
+          off_variant
         ) VALUES (
           $1,
           (SELECT id FROM public.agent WHERE agent_id = $2),
-          (SELECT id FROM public.environment WHERE env_id = $3))`, flag.Name, flag.AgentId, flag.EnvironmentId)
+          (SELECT id FROM public.environment WHERE env_id = $3),
+          NULLIF($4, ''),
+          NULLIF($5, ''))
+        RETURNING id::text`, definitionId, flag.AgentId, flag.EnvironmentId, flag.DefaultVariant, flag.OffVariant).Scan(&flagId)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return "", ErrFlagExists
+		}
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to create flag: %v", err)
+	}
+
+	if err := s.recordFlagVersion(ctx, tx, flagId, nil); err != nil {
+		return "", err
+	}
+	if err := s.publishFlagTx(ctx, tx, flagId, bus.ActionCreated); err != nil {
+		return "", err
+	}
+
+	return flagId, nil
+}
+
+func (s *System) GetFlagFromDB(ctx context.Context, flagId string) (*Flag, error) {
+	var err error
+	flag := &Flag{}
+	err = s.DB.QueryRow(ctx, `
+    SELECT
+      f.id,
+      def.name,
+      f.enabled,
+      COALESCE(f.updated_at::text, ''),
+      def.flag_type,
+      def.variants,
+      COALESCE(f.default_variant, ''),
+      COALESCE(f.off_variant, ''),
+      f.targeting_rules,
+      f.rollout,
+      COALESCE((
+        SELECT jsonb_agg(jsonb_build_object(
+          'flagId', pre.prerequisite_flag_id::text,
+          'flag', pfd.name,
+          'variant', COALESCE(pre.variant, '')) ORDER BY pfd.name)
+        FROM public.flag_prerequisite pre
+          JOIN public.flag pf ON pf.id = pre.prerequisite_flag_id
+          JOIN public.flag_definition pfd ON pfd.id = pf.definition_id
+        WHERE pre.flag_id = f.id
+      ), '[]'::jsonb),
+      jsonb_strip_nulls(jsonb_build_object(
+        'description', def.description,
+        'tags', def.tags,
+        'kind', def.kind,
+        'links', def.links,
+        'owner', (
+          SELECT jsonb_build_object(
+            'subject', usr.subject,
+            'first_name', COALESCE(usr.first_name, ''),
+            'last_name', COALESCE(usr.last_name, ''),
+            'known_as', COALESCE(usr.known_as, ''))
+          FROM public."user" usr
+          WHERE usr.id = def.owner_id)))
+    FROM public.flag f
+      JOIN public.flag_definition def ON def.id = f.definition_id
+    WHERE f.id = $1`, flagId).Scan(
+		&flag.Details.ID,
+		&flag.Details.Name,
+		&flag.Enabled,
+		&flag.Details.LastChanged,
+		&flag.Type,
+		&flag.Variants,
+		&flag.DefaultVariant,
+		&flag.OffVariant,
+		&flag.TargetingRules,
+		&flag.Rollout,
+		&flag.Prerequisites,
+		&flag.Details.FlagMetadata,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get flag: %v", err)
+	}
+
+	return flag, nil
+}
+
+// UpdateTargetingRulesInDB replaces the flag's rules, the company's segments they refer to are locked as they're
+// stored so none is deleted from under them
+func (s *System) UpdateTargetingRulesInDB(ctx context.Context, companyId, flagId string, rules []TargetingRule) error {
+	if rules == nil {
+		rules = []TargetingRule{}
+	}
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to encode targeting rules: %v", err)
+	}
+
+	ruleFlag := Flag{TargetingRules: rules}
+	return s.mutateFlag(ctx, flagId, func(tx pgx.Tx) error {
+		if err := s.lockSegmentsTx(ctx, tx, companyId, ruleFlag.segmentIds()); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `
+      UPDATE public.flag
+      SET
+        targeting_rules = $2,
+        updated_at = now()
+      WHERE id = $1`, flagId, encoded)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to update targeting rules: %v", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *System) UpdateRolloutInDB(ctx context.Context, flagId string, rollout *Rollout) error {
+	var encoded []byte
+	if rollout != nil {
+		var err error
+		encoded, err = json.Marshal(rollout)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode rollout: %v", err)
+		}
+	}
+
+	return s.mutateFlag(ctx, flagId, func(tx pgx.Tx) error {
+		return s.updateRolloutTx(ctx, tx, flagId, encoded)
+	})
+}
+
+func (s *System) updateRolloutTx(ctx context.Context, tx pgx.Tx, flagId string, encoded []byte) error {
+	_, err := tx.Exec(ctx, `
+      UPDATE public.flag
+      SET
+        rollout = $2,
+        updated_at = now()
+      WHERE id = $1`, flagId, encoded)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to update rollout: %v", err)
+	}
+
+	return nil
+}
+
+func (s *System) UpdateDefaultVariantInDB(ctx context.Context, flagId, variant string) error {
+	return s.mutateFlag(ctx, flagId, func(tx pgx.Tx) error {
+		return s.updateDefaultVariantTx(ctx, tx, flagId, variant)
+	})
+}
+
+func (s *System) updateDefaultVariantTx(ctx context.Context, tx pgx.Tx, flagId, variant string) error {
+	_, err := tx.Exec(ctx, `
+      UPDATE public.flag
+      SET
+        default_variant = NULLIF($2, ''),
+        updated_at = now()
+      WHERE id = $1`, flagId, variant)
 	if err != nil {
-		return s.Config.Bugfixes.Logger.Errorf("failed to create flag: %v", err)
+		return s.Config.Bugfixes.Logger.Errorf("failed to update default variant: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,45 @@
+package flags
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// payloadTag is the content hash of an encoded payload, the same flags always get the same tag
+func payloadTag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// writeCached writes v with its ETag, or just a 304 when the client's If-None-Match already names it
+func writeCached(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	etag := `"` + payloadTag(data) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// etagMatches checks an If-None-Match header against the tag, weakly as conditional reads are compared
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
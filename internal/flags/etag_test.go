@@ -0,0 +1,71 @@
+package flags
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCached(t *testing.T) {
+	payload := AgentResponse{
+		IntervalAllowed: 60,
+		Flags: []Flag{{
+			Enabled: true,
+			Details: Details{
+				ID:   publicFlagId("1"),
+				Name: "feature",
+			},
+		}},
+	}
+
+	first := httptest.NewRecorder()
+	assert.NoError(t, writeCached(first, httptest.NewRequest(http.MethodGet, "/flags", nil), payload))
+	assert.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Contains(t, first.Body.String(), `"name":"feature"`)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{name: "no header", ifNoneMatch: "", status: http.StatusOK},
+		{name: "current tag", ifNoneMatch: etag, status: http.StatusNotModified},
+		{name: "weak tag", ifNoneMatch: "W/" + etag, status: http.StatusNotModified},
+		{name: "one of several", ifNoneMatch: `"stale", ` + etag, status: http.StatusNotModified},
+		{name: "any", ifNoneMatch: "*", status: http.StatusNotModified},
+		{name: "stale tag", ifNoneMatch: `"stale"`, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/flags", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			assert.NoError(t, writeCached(w, r, payload))
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, etag, w.Header().Get("ETag"))
+			if tt.status == http.StatusNotModified {
+				assert.Empty(t, w.Body.String())
+			}
+		})
+	}
+
+	payload.Flags[0].Enabled = false
+	changed := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/flags", nil)
+	r.Header.Set("If-None-Match", etag)
+	assert.NoError(t, writeCached(changed, r, payload))
+	assert.Equal(t, http.StatusOK, changed.Code)
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"))
+}
+
+func TestPublicFlagId(t *testing.T) {
+	assert.Equal(t, publicFlagId("1"), publicFlagId("1"))
+	assert.NotEqual(t, publicFlagId("1"), publicFlagId("2"))
+	assert.NotEqual(t, "1", publicFlagId("1"))
+}
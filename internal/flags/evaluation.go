@@ -0,0 +1,126 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStaleDays is how long a flag can go unused and unchanged before it counts as stale
+	DefaultStaleDays = 30
+	maxStaleDays     = 365
+
+	// evaluationFlushInterval is how often the single flag lookups counted in memory are written
+	evaluationFlushInterval = 10 * time.Second
+)
+
+var ErrInvalidStaleDays = errors.New("days must be a whole number between 1 and 365")
+
+// StaleFlag is a flag that hasn't been evaluated, served or changed in a while, LastUsed is nil when it never has been
+type StaleFlag struct {
+	Flag        Flag                   `json:"flag"`
+	Environment CompanyFlagEnvironment `json:"environment"`
+	Evaluations int64                  `json:"evaluations"`
+	Served      int64                  `json:"served"`
+	LastUsed    *time.Time             `json:"lastUsed,omitempty"`
+}
+
+type StaleFlags struct {
+	Days  int         `json:"days"`
+	Flags []StaleFlag `json:"flags"`
+}
+
+// ParseStaleDays reads the days query parameter, DefaultStaleDays when it's missing
+func ParseStaleDays(value string) (int, error) {
+	if value == "" {
+		return DefaultStaleDays, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 1 || days > maxStaleDays {
+		return 0, ErrInvalidStaleDays
+	}
+	return days, nil
+}
+
+// evaluationBuffer counts single flag lookups in memory and writes them together every interval, rather than a
+// statement per request. Counts a write fails on are kept for the next one
+type evaluationBuffer struct {
+	mu      sync.Mutex
+	pending map[string]int64
+	write   func(ctx context.Context, evaluations map[string]int64) error
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+func newEvaluationBuffer(write func(ctx context.Context, evaluations map[string]int64) error, interval time.Duration) *evaluationBuffer {
+	b := &evaluationBuffer{
+		pending: make(map[string]int64),
+		write:   write,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run(interval)
+	return b
+}
+
+// add counts one lookup of the flag
+func (b *evaluationBuffer) add(flagId string) {
+	if flagId == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[flagId]++
+}
+
+// flush writes what has been counted since the last flush
+func (b *evaluationBuffer) flush(ctx context.Context) error {
+	b.mu.Lock()
+	evaluations := b.pending
+	b.pending = make(map[string]int64)
+	b.mu.Unlock()
+
+	if len(evaluations) == 0 {
+		return nil
+	}
+	if err := b.write(ctx, evaluations); err != nil {
+		b.mu.Lock()
+		for flagId, count := range evaluations {
+			b.pending[flagId] += count
+		}
+		b.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (b *evaluationBuffer) run(interval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			_ = b.flush(context.Background())
+			return
+		case <-ticker.C:
+			_ = b.flush(context.Background())
+		}
+	}
+}
+
+// Close writes what's left and stops the flushes, the container calls it as it closes
+func (b *evaluationBuffer) Close() {
+	b.closing.Do(func() {
+		close(b.stop)
+	})
+	<-b.done
+}
@@ -0,0 +1,54 @@
+package flags
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/flags-gg/orchestrator/internal/company"
+)
+
+func (s *System) GetStaleFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	days, err := ParseStaleDays(r.URL.Query().Get("days"))
+	if err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	staleFlags, err := s.GetStaleFlagsFromDB(ctx, companyId, days)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&StaleFlags{
+		Days:  days,
+		Flags: staleFlags,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package flags
+
+import (
+	"context"
+)
+
+// RecordFlagEvaluationsInDB adds the single flag lookups counted since the last write, a lookup knows exactly which
+// flag was evaluated. Flags deleted in the meantime are skipped
+func (s *System) RecordFlagEvaluationsInDB(ctx context.Context, evaluations map[string]int64) error {
+	if len(evaluations) == 0 {
+		return nil
+	}
+	flagIds := make([]string, 0, len(evaluations))
+	counts := make([]int64, 0, len(evaluations))
+	for flagId, count := range evaluations {
+		flagIds = append(flagIds, flagId)
+		counts = append(counts, count)
+	}
+	return s.recordFlagTraffic(ctx, `
+    INSERT INTO public.flag_evaluation (flag_id, evaluations, last_evaluated_at)
+    SELECT f.id, counted.evaluations, now()
+    FROM unnest($1::text[], $2::bigint[]) AS counted(flag_id, evaluations)
+      JOIN public.flag f ON f.id::text = counted.flag_id
+    ON CONFLICT (flag_id) DO UPDATE
+    SET
+      evaluations = flag_evaluation.evaluations + EXCLUDED.evaluations,
+      last_evaluated_at = now()`, flagIds, counts)
+}
+
+// RecordFlagsServedInDB counts a bulk or sdk fetch against every flag it returned, the client may not use them all.
+// The sdk payload doesn't carry the stored ids so the flags are matched by name within the environment
+func (s *System) RecordFlagsServedInDB(ctx context.Context, agentId, environmentId string, flags []Flag) error {
+	names := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		names = append(names, flag.Details.Name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return s.recordFlagTraffic(ctx, `
+    INSERT INTO public.flag_evaluation (flag_id, served, last_served_at)
+    SELECT f.id, 1, now()
+    FROM public.flag f
+      JOIN public.flag_definition def ON def.id = f.definition_id
+      JOIN public.environment env ON env.id = f.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+    WHERE env.env_id = $1
+      AND agent.agent_id = $2
+      AND def.name = ANY($3)
+    ON CONFLICT (flag_id) DO UPDATE
+    SET
+      served = flag_evaluation.served + 1,
+      last_served_at = now()`, environmentId, agentId, names)
+}
+
+// sharedEvaluations is the container key of the evaluation buffer
+type sharedEvaluations struct{}
+
+// evaluations is the container's count of single flag lookups, written every evaluationFlushInterval
+func (s *System) evaluations() *evaluationBuffer {
+	return s.Shared(sharedEvaluations{}, func() interface{} {
+		return newEvaluationBuffer(s.RecordFlagEvaluationsInDB, evaluationFlushInterval)
+	}).(*evaluationBuffer)
+}
+
+func (s *System) recordFlagTraffic(ctx context.Context, query string, args ...interface{}) error {
+	if _, err := s.DB.Exec(ctx, query, args...); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to record flag evaluations: %v", err)
+	}
+
+	return nil
+}
+
+// GetStaleFlagsFromDB lists the company's flags that haven't been evaluated, served or changed in the last days
+func (s *System) GetStaleFlagsFromDB(ctx context.Context, companyId string, days int) ([]StaleFlag, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT
+      f.id::text,
+      def.name,
+      f.enabled,
+      GREATEST(f.updated_at, def.updated_at)::text,
+      COALESCE(ev.evaluations, 0),
+      COALESCE(ev.served, 0),
+      GREATEST(ev.last_evaluated_at, ev.last_served_at),
+      env.id::text,
+      env.name,
+      env.env_id,
+      agent.agent_id,
+      agent.name,
+      project.name
+    FROM public.flag f
+      JOIN public.flag_definition def ON def.id = f.definition_id
+      JOIN public.environment env ON env.id = f.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+      JOIN public.project ON project.id = agent.project_id
+      JOIN public.company ON company.id = project.company_id
+      LEFT JOIN public.flag_evaluation ev ON ev.flag_id = f.id
+    WHERE company.company_id = $1
+      AND GREATEST(f.updated_at, def.updated_at) < now() - make_interval(days => $2)
+      AND COALESCE(GREATEST(ev.last_evaluated_at, ev.last_served_at), '-infinity') < now() - make_interval(days => $2)
+    ORDER BY project.name, agent.name, env.name, def.name`, companyId, days)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get stale flags: %v", err)
+	}
+	defer rows.Close()
+
+	staleFlags := make([]StaleFlag, 0)
+	for rows.Next() {
+		stale := StaleFlag{}
+		if err := rows.Scan(
+			&stale.Flag.Details.ID,
+			&stale.Flag.Details.Name,
+			&stale.Flag.Enabled,
+			&stale.Flag.Details.LastChanged,
+			&stale.Evaluations,
+			&stale.Served,
+			&stale.LastUsed,
+			&stale.Environment.Id,
+			&stale.Environment.Name,
+			&stale.Environment.EnvironmentId,
+			&stale.Environment.AgentId,
+			&stale.Environment.AgentName,
+			&stale.Environment.ProjectName,
+		); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		staleFlags = append(staleFlags, stale)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get stale flags: %v", rows.Err())
+	}
+
+	return staleFlags, nil
+}
@@ -0,0 +1,68 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStaleDays(t *testing.T) {
+	days, err := ParseStaleDays("")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultStaleDays, days)
+
+	days, err = ParseStaleDays("7")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, days)
+
+	for _, value := range []string{"0", "-1", "366", "week"} {
+		_, err := ParseStaleDays(value)
+		assert.ErrorIs(t, err, ErrInvalidStaleDays, value)
+	}
+}
+
+// evaluationWrites records what the buffer writes, failing while told to
+type evaluationWrites struct {
+	mu      sync.Mutex
+	fail    bool
+	written map[string]int64
+}
+
+func (e *evaluationWrites) write(_ context.Context, evaluations map[string]int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fail {
+		return errors.New("database went away")
+	}
+	for flagId, count := range evaluations {
+		e.written[flagId] += count
+	}
+	return nil
+}
+
+func TestEvaluationBufferBatchesLookups(t *testing.T) {
+	writes := &evaluationWrites{written: make(map[string]int64)}
+	// the interval never comes round in the test, only flushes and the close write
+	buffer := newEvaluationBuffer(writes.write, time.Hour)
+
+	buffer.add("1")
+	buffer.add("1")
+	buffer.add("2")
+	buffer.add("")
+	assert.NoError(t, buffer.flush(context.Background()))
+	assert.Equal(t, map[string]int64{"1": 2, "2": 1}, writes.written)
+
+	// a failed write keeps its counts for the next one
+	writes.fail = true
+	buffer.add("1")
+	assert.Error(t, buffer.flush(context.Background()))
+	writes.fail = false
+	buffer.add("1")
+
+	buffer.Close()
+	assert.Equal(t, map[string]int64{"1": 4, "2": 1}, writes.written)
+}
@@ -0,0 +1,48 @@
+package flags
+
+import (
+	"context"
+	"errors"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/jackc/pgx/v5"
+)
+
+// flagEventTx is the change event for the flag, addressed to the agent and environment that are served it,
+// nil when the flag doesn't exist
+func flagEventTx(ctx context.Context, tx pgx.Tx, flagId string, action bus.Action) (*bus.Event, error) {
+	event := &bus.Event{
+		Kind:   bus.KindFlag,
+		Action: action,
+		FlagID: flagId,
+	}
+	err := tx.QueryRow(ctx, `
+    SELECT
+      agent.agent_id,
+      env.env_id
+    FROM public.flag f
+      JOIN public.agent ON agent.id = f.agent_id
+      JOIN public.environment env ON env.id = f.environment_id
+    WHERE f.id = $1`, flagId).Scan(&event.AgentID, &event.EnvironmentID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// publishFlagTx announces the flag's change once the transaction commits
+func (s *System) publishFlagTx(ctx context.Context, tx pgx.Tx, flagId string, action bus.Action) error {
+	event, err := flagEventTx(ctx, tx, flagId, action)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to read flag event: %v", err)
+	}
+	if event == nil {
+		return nil
+	}
+
+	return bus.PublishTx(ctx, tx, *event)
+}
@@ -0,0 +1,65 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// FlagState is the stored state of a flag, history records it before and after every change and rollback restores it
+type FlagState struct {
+	Name           string          `json:"name"`
+	Enabled        bool            `json:"enabled"`
+	Type           FlagType        `json:"type,omitempty"`
+	Variants       []Variant       `json:"variants,omitempty"`
+	DefaultVariant string          `json:"defaultVariant,omitempty"`
+	OffVariant     string          `json:"offVariant,omitempty"`
+	TargetingRules []TargetingRule `json:"targetingRules,omitempty"`
+	Rollout        *Rollout        `json:"rollout,omitempty"`
+}
+
+// FlagVersion is one entry in a flag's history, Before is nil when the flag was created and After is nil when it was deleted
+type FlagVersion struct {
+	Version   int        `json:"version"`
+	Actor     string     `json:"actor"`
+	Source    string     `json:"source"`
+	CreatedAt time.Time  `json:"createdAt"`
+	Before    *FlagState `json:"before"`
+	After     *FlagState `json:"after"`
+}
+
+type History struct {
+	Versions []FlagVersion `json:"versions"`
+}
+
+// Change says who is changing a flag and through what, it travels on the context down to the history record
+type Change struct {
+	Actor  string
+	Source string
+}
+
+type changeKey struct{}
+
+var (
+	ErrVersionNotFound = errors.New("flag version not found")
+	ErrVersionDeleted  = errors.New("flag version is a deletion")
+	ErrFlagNameTaken   = errors.New("flag name is already used by another flag of the agent")
+)
+
+// WithChange marks the context with who is making the change and through which endpoint
+func WithChange(ctx context.Context, actor, source string) context.Context {
+	return context.WithValue(ctx, changeKey{}, Change{
+		Actor:  actor,
+		Source: source,
+	})
+}
+
+func changeFrom(ctx context.Context) Change {
+	if change, ok := ctx.Value(changeKey{}).(Change); ok {
+		return change
+	}
+	return Change{
+		Actor:  "system",
+		Source: "internal",
+	}
+}
@@ -0,0 +1,127 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/flags-gg/orchestrator/internal/authz"
+	"github.com/flags-gg/orchestrator/internal/company"
+)
+
+func (s *System) GetFlagHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	versions, err := s.GetFlagHistoryFromDB(ctx, r.PathValue("flagId"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&History{
+		Versions: versions,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) RollbackFlag(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	flagId := r.PathValue("flagId")
+	// a rollback can restore the name, type and variants, which reaches the flag in every environment
+	if s.approvalRequired(ctx, w, flagId, ChangeEdit) {
+		return
+	}
+	if err := s.RollbackFlagInDB(ctx, flagId, version); err != nil {
+		switch {
+		case errors.Is(err, ErrVersionNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrVersionDeleted):
+			s.writeValidationError(w, err)
+		case errors.Is(err, ErrFlagNameTaken):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to roll back flag: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	flag, err := s.GetFlagFromDB(ctx, flagId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if flag == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(flag); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// flagStateTx reads the flag inside the transaction and locks it until the change is recorded, nil when it doesn't exist
+func flagStateTx(ctx context.Context, tx pgx.Tx, flagId string) (*FlagState, error) {
+	state := &FlagState{}
+	err := tx.QueryRow(ctx, `
+    SELECT
+      def.name,
+      f.enabled,
+      def.flag_type,
+      def.variants,
+      COALESCE(f.default_variant, ''),
+      COALESCE(f.off_variant, ''),
+      f.targeting_rules,
+      f.rollout
+    FROM public.flag f
+      JOIN public.flag_definition def ON def.id = f.definition_id
+    WHERE f.id = $1
+    FOR UPDATE`, flagId).Scan(
+		&state.Name,
+		&state.Enabled,
+		&state.Type,
+		&state.Variants,
+		&state.DefaultVariant,
+		&state.OffVariant,
+		&state.TargetingRules,
+		&state.Rollout,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// recordFlagVersion appends the flag's state in the transaction to its history, changes that leave the state as it was aren't recorded
+func (s *System) recordFlagVersion(ctx context.Context, tx pgx.Tx, flagId string, before *FlagState) error {
+	after, err := flagStateTx(ctx, tx, flagId)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to read flag state: %v", err)
+	}
+	if before == nil && after == nil {
+		return nil
+	}
+	if before != nil && after != nil && reflect.DeepEqual(*before, *after) {
+		return nil
+	}
+
+	var beforeJSON, afterJSON []byte
+	if before != nil {
+		if beforeJSON, err = json.Marshal(before); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode flag state: %v", err)
+		}
+	}
+	if after != nil {
+		if afterJSON, err = json.Marshal(after); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode flag state: %v", err)
+		}
+	}
+
+	change := changeFrom(ctx)
+	if _, err := tx.Exec(ctx, `
+    INSERT INTO public.flag_history (flag_id, version, actor, source, before, after)
+    SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5
+    FROM public.flag_history
+    WHERE flag_id = $1`, flagId, change.Actor, change.Source, beforeJSON, afterJSON); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to record flag history: %v", err)
+	}
+
+	return nil
+}
+
+// inTx runs fn in a transaction and commits it when fn succeeds
+func (s *System) inTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// mutateFlag runs the change in a transaction and records the flag's state before and after it as a new version
+func (s *System) mutateFlag(ctx context.Context, flagId string, change func(tx pgx.Tx) error) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.mutateFlagsTx(ctx, tx, []string{flagId}, change)
+	})
+}
+
+// mutateDefinition runs a change that reaches the flag's definition, which every environment shares,
+// and records a version for each environment's flag the change touched
+func (s *System) mutateDefinition(ctx context.Context, flagId string, change func(tx pgx.Tx) error) error {
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		return s.mutateDefinitionTx(ctx, tx, flagId, change)
+	})
+}
+
+func (s *System) mutateDefinitionTx(ctx context.Context, tx pgx.Tx, flagId string, change func(tx pgx.Tx) error) error {
+	flagIds, err := definitionFlagsTx(ctx, tx, flagId)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to find flags: %v", err)
+	}
+
+	return s.mutateFlagsTx(ctx, tx, flagIds, change)
+}
+
+// definitionFlagsTx lists the flags, one per environment, sharing a definition with the flag
+func definitionFlagsTx(ctx context.Context, tx pgx.Tx, flagId string) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+    SELECT id::text
+    FROM public.flag
+    WHERE definition_id = (SELECT definition_id FROM public.flag WHERE id = $1)
+    ORDER BY id`, flagId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flagIds := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		flagIds = append(flagIds, id)
+	}
+
+	return flagIds, rows.Err()
+}
+
+func (s *System) mutateFlagsTx(ctx context.Context, tx pgx.Tx, flagIds []string, change func(tx pgx.Tx) error) error {
+	before := make([]*FlagState, len(flagIds))
+	// the events are read before the change so a deleted flag can still say where it was
+	events := make([]*bus.Event, len(flagIds))
+	for i, id := range flagIds {
+		state, err := flagStateTx(ctx, tx, id)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to read flag state: %v", err)
+		}
+		before[i] = state
+		if events[i], err = flagEventTx(ctx, tx, id, bus.ActionUpdated); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to read flag event: %v", err)
+		}
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+	for i, id := range flagIds {
+		if err := s.recordFlagVersion(ctx, tx, id, before[i]); err != nil {
+			return err
+		}
+	}
+	for i, id := range flagIds {
+		if events[i] == nil {
+			continue
+		}
+		after, err := flagStateTx(ctx, tx, id)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to read flag state: %v", err)
+		}
+		if after == nil {
+			events[i].Action = bus.ActionDeleted
+		}
+		if err := bus.PublishTx(ctx, tx, *events[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *System) GetFlagHistoryFromDB(ctx context.Context, flagId string) ([]FlagVersion, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT
+      version,
+      actor,
+      source,
+      created_at,
+      before,
+      after
+    FROM public.flag_history
+    WHERE flag_id = $1
+    ORDER BY version DESC`, flagId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return []FlagVersion{}, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get flag history: %v", err)
+	}
+	defer rows.Close()
+
+	versions := make([]FlagVersion, 0)
+	for rows.Next() {
+		version := FlagVersion{}
+		if err := rows.Scan(
+			&version.Version,
+			&version.Actor,
+			&version.Source,
+			&version.CreatedAt,
+			&version.Before,
+			&version.After,
+		); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		versions = append(versions, version)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get flag history: %v", rows.Err())
+	}
+
+	return versions, nil
+}
+
+// RollbackFlagInDB puts the flag back to the state it had after the given version, recorded as a new version.
+// The name, type and variants are shared with the flag in every other environment, so they change there too
+func (s *System) RollbackFlagInDB(ctx context.Context, flagId string, version int) error {
+	return s.mutateDefinition(ctx, flagId, func(tx pgx.Tx) error {
+		var state *FlagState
+		if err := tx.QueryRow(ctx, `
+      SELECT after
+      FROM public.flag_history
+      WHERE flag_id = $1
+        AND version = $2`, flagId, version).Scan(&state); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrVersionNotFound
+			}
+			return s.Config.Bugfixes.Logger.Errorf("failed to get flag version: %v", err)
+		}
+		if state == nil {
+			return ErrVersionDeleted
+		}
+
+		variants, err := variantsJSON(state.Variants)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode variants: %v", err)
+		}
+		if state.TargetingRules == nil {
+			state.TargetingRules = []TargetingRule{}
+		}
+		rules, err := json.Marshal(state.TargetingRules)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode targeting rules: %v", err)
+		}
+		var rollout []byte
+		if state.Rollout != nil {
+			if rollout, err = json.Marshal(state.Rollout); err != nil {
+				return s.Config.Bugfixes.Logger.Errorf("failed to encode rollout: %v", err)
+			}
+		}
+
+		flagType := state.Type
+		if flagType == "" {
+			flagType = FlagTypeBoolean
+		}
+
+		if err := s.updateDefinitionTx(ctx, tx, flagId, state.Name, flagType, variants); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+      UPDATE public.flag
+      SET
+        enabled = $2,
+        default_variant = NULLIF($3, ''),
+        off_variant = NULLIF($4, ''),
+        targeting_rules = $5,
+        rollout = $6,
+        updated_at = now()
+      WHERE id = $1`, flagId, state.Enabled, state.DefaultVariant, state.OffVariant, rules, rollout); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to roll back flag: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// updateDefinitionTx renames the flag's definition and, when flagType is set, replaces its type and variants
+func (s *System) updateDefinitionTx(ctx context.Context, tx pgx.Tx, flagId, name string, flagType FlagType, variants []byte) error {
+	if _, err := tx.Exec(ctx, `
+    UPDATE public.flag_definition
+    SET
+      name = $2,
+      flag_type = COALESCE(NULLIF($3, ''), flag_type),
+      variants = COALESCE($4, variants),
+      updated_at = now()
+    WHERE id = (SELECT definition_id FROM public.flag WHERE id = $1)`, flagId, name, string(flagType), variants); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrFlagNameTaken
+		}
+		return s.Config.Bugfixes.Logger.Errorf("failed to update flag definition: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package flags
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeContext(t *testing.T) {
+	assert.Equal(t, Change{Actor: "system", Source: "internal"}, changeFrom(context.Background()))
+
+	ctx := WithChange(context.Background(), "user_123", "PATCH /flag/{flagId}")
+	assert.Equal(t, Change{Actor: "user_123", Source: "PATCH /flag/{flagId}"}, changeFrom(ctx))
+
+	req := httptest.NewRequest("DELETE", "/flag/12", nil)
+	assert.Equal(t, Change{Actor: "user_123", Source: "DELETE /flag/12"}, changeFrom(requestChange(req, "user_123")))
+}
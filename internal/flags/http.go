@@ -1,17 +1,23 @@
 package flags
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/flags-gg/orchestrator/internal/authz"
 	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/stats"
-	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/google/uuid"
 )
 
 type SecretMenuStyle struct {
@@ -27,32 +33,61 @@ type Details struct {
 	ID          string `json:"id"`
 	LastChanged string `json:"lastChanged,omitempty"`
 	Promoted    bool   `json:"promoted,omitempty"`
+	FlagMetadata
 }
 type Flag struct {
-	Enabled bool    `json:"enabled"`
-	Details Details `json:"details"`
+	Enabled        bool            `json:"enabled"`
+	Details        Details         `json:"details"`
+	Type           FlagType        `json:"type,omitempty"`
+	Variant        string          `json:"variant,omitempty"`
+	Value          interface{}     `json:"value,omitempty"`
+	Variants       []Variant       `json:"variants,omitempty"`
+	DefaultVariant string          `json:"defaultVariant,omitempty"`
+	OffVariant     string          `json:"offVariant,omitempty"`
+	TargetingRules []TargetingRule `json:"targetingRules,omitempty"`
+	Rollout        *Rollout        `json:"rollout,omitempty"`
+	Prerequisites  []Prerequisite  `json:"prerequisites,omitempty"`
+
+	segments     map[string]*Segment
+	dependencies prerequisiteGraph
+	revision     int64
 }
 type AgentResponse struct {
 	IntervalAllowed int        `json:"intervalAllowed,omitempty"`
 	SecretMenu      SecretMenu `json:"secretMenu,omitempty"`
 	Flags           []Flag     `json:"flags,omitempty"`
+	// Revision is the environment's revision the flags were read at, sent back as since it gets only what changed after
+	Revision int64 `json:"revision"`
+	// Partial is set when Flags only holds the changes since the client's revision and Deleted the keys that went
+	Partial bool     `json:"partial,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+	// Disabled is set when the project, agent or environment is switched off, every flag is served off
+	Disabled bool `json:"disabled,omitempty"`
 }
+
+// disabledIntervalAllowed is how long an sdk of a disabled environment waits between polls, as for an unauthorized one
+const disabledIntervalAllowed = 900
+
 type Response struct {
 	Flags []Flag `json:"flags"`
 }
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
 type FlagNameChangeRequest struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
+	Name           string    `json:"name"`
+	ID             string    `json:"id"`
+	Type           FlagType  `json:"type,omitempty"`
+	Variants       []Variant `json:"variants,omitempty"`
+	DefaultVariant string    `json:"defaultVariant,omitempty"`
+	OffVariant     string    `json:"offVariant,omitempty"`
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -71,6 +106,15 @@ func (s *System) getUserId(r *http.Request) (string, error) {
 	return usr.ID, nil
 }
 
+// requestChange marks the request context with the user making a change and the route they used, for the flag history
+func requestChange(r *http.Request, userId string) context.Context {
+	source := r.Pattern
+	if source == "" {
+		source = r.Method + " " + r.URL.Path
+	}
+	return WithChange(r.Context(), userId, source)
+}
+
 func (s *System) GetAgentFlags(w http.ResponseWriter, r *http.Request) {
 	logs.Infof("Headers: %v", r.Header)
 	ctx := r.Context()
@@ -78,18 +122,28 @@ func (s *System) GetAgentFlags(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("x-flags-timestamp", strconv.FormatInt(time.Now().Unix(), 10))
 	w.Header().Set("Content-Type", "application/json")
 
-	if r.Header.Get("x-project-id") == "" || r.Header.Get("x-agent-id") == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+	// the same credentials as OFREP and the stream, a key or headers naming an agent of the project
+	projectId, agentId, environmentId, err := NewOFREPSystem(s.Container).extractCredentials(r)
+	if err != nil {
+		w.WriteHeader(credentialsStatus(err))
 		return
 	}
 
+	// since asks for only what changed after a revision the client already holds
+	since := int64(-1)
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
 	var responseObj AgentResponse
 
-	projectId := r.Header.Get("x-project-id")
-	agentId := r.Header.Get("x-agent-id")
-	environmentId := r.Header.Get("x-environment-id")
 	if environmentId == "" {
-		resolvedEnvironmentId, err := s.GetDefaultEnvironment(ctx, projectId, agentId)
+		resolvedEnvironmentId, err := s.defaultEnvironment(ctx, projectId, agentId)
 		if err != nil {
 			_ = s.Config.Bugfixes.Logger.Errorf("Failed to resolve environment: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -98,7 +152,7 @@ func (s *System) GetAgentFlags(w http.ResponseWriter, r *http.Request) {
 		environmentId = resolvedEnvironmentId
 	}
 
-	res, err := s.GetAgentFlagsFromDB(ctx, projectId, agentId, environmentId)
+	res, err := s.getAgentFlags(ctx, projectId, agentId, environmentId)
 	if err != nil {
 		responseObj = AgentResponse{
 			IntervalAllowed: 600,
@@ -109,13 +163,19 @@ func (s *System) GetAgentFlags(w http.ResponseWriter, r *http.Request) {
 	if res != nil {
 		responseObj = *res
 	}
+	served := responseObj.Flags
+	if res != nil && since >= 0 {
+		s.agentFlagsSince(ctx, projectId, agentId, environmentId, since, &responseObj)
+	}
 
-	if err := json.NewEncoder(w).Encode(responseObj); err != nil {
+	sdkPayload(&responseObj)
+
+	if err := writeCached(w, r, responseObj); err != nil {
 		_, _ = w.Write([]byte(`{"error": "failed to encode response"}`))
-		//stats.NewSystem(s.Config).AddAgentError(projectId, agentId, environmentId)
+		//stats.NewSystem(s.Container).AddAgentError(projectId, agentId, environmentId)
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
 	}
-	if err := stats.NewSystem(s.Config).RecordEnvironmentRequest(
+	if err := stats.NewSystem(s.Container).RecordEnvironmentRequest(
 		ctx,
 		projectId,
 		agentId,
@@ -125,6 +185,9 @@ func (s *System) GetAgentFlags(w http.ResponseWriter, r *http.Request) {
 	); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record sdk flag request: %v", err)
 	}
+	if err := s.RecordFlagsServedInDB(ctx, agentId, environmentId, served); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record served flags: %v", err)
+	}
 }
 
 func (s *System) GetClientFlags(w http.ResponseWriter, r *http.Request) {
@@ -142,7 +205,7 @@ func (s *System) GetClientFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -153,6 +216,10 @@ func (s *System) GetClientFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
 	environmentId := r.PathValue("environmentId")
 
 	res, err := s.GetClientFlagsFromDB(ctx, environmentId)
@@ -181,7 +248,7 @@ func (s *System) CreateFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -191,6 +258,7 @@ func (s *System) CreateFlags(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	ctx = requestChange(r, userId)
 
 	flag := flagCreate{}
 	if err := json.NewDecoder(r.Body).Decode(&flag); err != nil {
@@ -198,10 +266,25 @@ func (s *System) CreateFlags(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if err := ValidateVariants(flag.Type, flag.Variants, flag.DefaultVariant, flag.OffVariant); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	authorizer := authz.NewSystem(s.Container)
+	if !authorizer.Allow(w, r, companyId, authz.Agent, flag.AgentId) ||
+		!authorizer.Allow(w, r, companyId, authz.Environment, flag.EnvironmentId) {
+		return
+	}
 
 	if err := s.CreateFlagInDB(ctx, flag); err != nil {
-		_ = s.Config.Bugfixes.Logger.Errorf("Failed to create flag: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, ErrFlagExists), errors.Is(err, ErrDefinitionMismatch):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to create flag: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -222,7 +305,7 @@ func (s *System) UpdateFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -233,12 +316,13 @@ func (s *System) UpdateFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type changeRequest struct {
-		Enabled bool   `json:"enabled"`
-		Name    string `json:"name"`
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
 	}
 
-	cr := changeRequest{}
+	ctx = requestChange(r, userId)
+
+	cr := flagUpdate{}
 	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -251,7 +335,14 @@ func (s *System) UpdateFlags(w http.ResponseWriter, r *http.Request) {
 			ID:   r.PathValue("flagId"),
 		},
 	}
+	if s.requestApproval(ctx, w, flagChange.Details.ID, ChangeUpdate, cr.Name, cr, userId) {
+		return
+	}
 	if err := s.UpdateFlagInDB(ctx, flagChange); err != nil {
+		if errors.Is(err, ErrFlagNameTaken) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update flag: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -275,7 +366,7 @@ func (s *System) PromoteFlag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -285,12 +376,21 @@ func (s *System) PromoteFlag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
 	flagId := r.PathValue("flagId")
 	if flagId == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if s.requestApproval(ctx, w, flagId, ChangePromote, "", nil, userId) {
+		return
+	}
 	if err := s.PromoteFlagInDB(ctx, flagId); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to promote flag: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -314,7 +414,7 @@ func (s *System) EditFlag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -325,6 +425,12 @@ func (s *System) EditFlag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
 	flagId := r.PathValue("flagId")
 	flagChange := FlagNameChangeRequest{}
 	if err := json.NewDecoder(r.Body).Decode(&flagChange); err != nil {
@@ -333,8 +439,21 @@ func (s *System) EditFlag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	flagChange.ID = flagId
+	if flagChange.Type != "" {
+		if err := ValidateVariants(flagChange.Type, flagChange.Variants, flagChange.DefaultVariant, flagChange.OffVariant); err != nil {
+			s.writeValidationError(w, err)
+			return
+		}
+	}
 
+	if s.requestApproval(ctx, w, flagId, ChangeEdit, flagChange.Name, flagChange, userId) {
+		return
+	}
 	if err := s.EditFlagInDB(ctx, flagChange); err != nil {
+		if errors.Is(err, ErrFlagNameTaken) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update flag: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -358,7 +477,7 @@ func (s *System) DeleteFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -369,12 +488,39 @@ func (s *System) DeleteFlags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
 	f := Flag{
 		Details: Details{
 			ID: r.PathValue("flagId"),
 		},
 	}
 
+	// removing a prerequisite would silently turn its dependents off
+	dependents, err := s.GetDependentFlagsFromDB(ctx, f.Details.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(dependents) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": ErrFlagHasDependents.Error(),
+			"flags": dependents,
+		}); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+		}
+		return
+	}
+
+	if s.requestApproval(ctx, w, f.Details.ID, ChangeDelete, "", nil, userId) {
+		return
+	}
 	if err := s.DeleteFlagFromDB(ctx, f); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to delete flag: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -383,3 +529,328 @@ func (s *System) DeleteFlags(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (s *System) UpdateTargeting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
+	type targetingRequest struct {
+		Rules []TargetingRule `json:"rules"`
+	}
+
+	tr := targetingRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	flagId := r.PathValue("flagId")
+	flag, err := s.GetFlagFromDB(ctx, flagId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if flag == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	for i := range tr.Rules {
+		if tr.Rules[i].ID == "" {
+			tr.Rules[i].ID = uuid.NewString()
+		}
+	}
+	if err := ValidateTargetingRules(flag, tr.Rules); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+	if s.approvalRequired(ctx, w, flagId, ChangeUpdate) {
+		return
+	}
+
+	if err := s.UpdateTargetingRulesInDB(ctx, companyId, flagId, tr.Rules); err != nil {
+		if errors.Is(err, ErrSegmentNotFound) {
+			s.writeValidationError(w, err)
+			return
+		}
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update targeting: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tr); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) UpdateRollout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
+	// a null body removes the rollout
+	var rollout *Rollout
+	if err := json.NewDecoder(r.Body).Decode(&rollout); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	flagId := r.PathValue("flagId")
+	flag, err := s.GetFlagFromDB(ctx, flagId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if flag == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := ValidateRollout(flag, rollout); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+	if s.approvalRequired(ctx, w, flagId, ChangeUpdate) {
+		return
+	}
+
+	// keep the existing salt so changing the weights doesn't reshuffle users
+	if rollout != nil && rollout.Salt == "" {
+		rollout.Salt = uuid.NewString()
+		if flag.Rollout != nil && flag.Rollout.Salt != "" {
+			rollout.Salt = flag.Rollout.Salt
+		}
+	}
+
+	if err := s.UpdateRolloutInDB(ctx, flagId, rollout); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update rollout: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rollout); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) UpdatePrerequisites(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	type prerequisitesRequest struct {
+		Prerequisites []Prerequisite `json:"prerequisites"`
+	}
+
+	pr := prerequisitesRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	flagId := r.PathValue("flagId")
+	environment, edges, err := s.GetEnvironmentPrerequisitesFromDB(ctx, flagId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := environment[flagId]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := ValidatePrerequisites(flagId, pr.Prerequisites, environment, edges); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+	if s.approvalRequired(ctx, w, flagId, ChangeUpdate) {
+		return
+	}
+
+	if err := s.UpdatePrerequisitesInDB(ctx, flagId, pr.Prerequisites); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update prerequisites: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pr); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) UpdateMetadata(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	mr := FlagMetadataRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&mr); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := ValidateMetadata(&mr); err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+
+	// the owner has to be someone in the same company
+	if mr.OwnerID != "" {
+		users, err := company.NewSystem(s.Container).GetCompanyUsersFromDB(ctx, companyId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !slices.ContainsFunc(users, func(u company.User) bool {
+			return u.Subject == mr.OwnerID
+		}) {
+			s.writeValidationError(w, fmt.Errorf("%w: owner is not a member of the company", ErrInvalidMetadata))
+			return
+		}
+	}
+
+	flagId := r.PathValue("flagId")
+	if err := s.UpdateFlagMetadataInDB(ctx, flagId, mr); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update metadata: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	flag, err := s.GetFlagFromDB(ctx, flagId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if flag == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(flag.Details.FlagMetadata); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// writeValidationError reports a rejected flag definition back to the dashboard
+func (s *System) writeValidationError(w http.ResponseWriter, err error) {
+	s.writeError(w, http.StatusBadRequest, err)
+}
+
+// writeError reports why a request was refused
+func (s *System) writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"error": err.Error(),
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/flags-gg/orchestrator/internal/company"
+)
+
+type FlagKind string
+
+const (
+	FlagKindRelease    FlagKind = "release"
+	FlagKindOps        FlagKind = "ops"
+	FlagKindExperiment FlagKind = "experiment"
+	FlagKindPermission FlagKind = "permission"
+)
+
+// FlagLink points at a ticket or doc about the flag
+type FlagLink struct {
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url"`
+}
+
+// FlagMetadata describes a flag, it is stored on the flag definition so every environment shares it
+type FlagMetadata struct {
+	Description string        `json:"description,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	Owner       *company.User `json:"owner,omitempty"`
+	Kind        FlagKind      `json:"kind,omitempty"`
+	Links       []FlagLink    `json:"links,omitempty"`
+}
+
+// FlagMetadataRequest is what the dashboard sends, the owner is a user subject
+type FlagMetadataRequest struct {
+	Description string     `json:"description"`
+	Tags        []string   `json:"tags"`
+	OwnerID     string     `json:"ownerId,omitempty"`
+	Kind        FlagKind   `json:"kind,omitempty"`
+	Links       []FlagLink `json:"links"`
+}
+
+// FlagFilter narrows the company flag list, empty fields match everything
+type FlagFilter struct {
+	Tag   string
+	Owner string
+}
+
+var ErrInvalidMetadata = errors.New("invalid flag metadata")
+
+func (k FlagKind) valid() bool {
+	switch k {
+	case "", FlagKindRelease, FlagKindOps, FlagKindExperiment, FlagKindPermission:
+		return true
+	}
+	return false
+}
+
+// ValidateMetadata checks the request and tidies the tags so they can be filtered on
+func ValidateMetadata(req *FlagMetadataRequest) error {
+	if !req.Kind.valid() {
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidMetadata, req.Kind)
+	}
+
+	tags := make([]string, 0, len(req.Tags))
+	for _, tag := range req.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	req.Tags = tags
+
+	for _, link := range req.Links {
+		u, err := url.Parse(link.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: link %q is not an http url", ErrInvalidMetadata, link.URL)
+		}
+	}
+
+	return nil
+}
+
+// addTo copies the metadata into an OFREP metadata map, which only allows strings, numbers and booleans
+func (m FlagMetadata) addTo(metadata map[string]interface{}) {
+	if m.Description != "" {
+		metadata["description"] = m.Description
+	}
+	if len(m.Tags) > 0 {
+		metadata["tags"] = strings.Join(m.Tags, ",")
+	}
+	if m.Kind != "" {
+		metadata["kind"] = string(m.Kind)
+	}
+	if m.Owner != nil {
+		metadata["owner"] = m.Owner.Subject
+	}
+}
@@ -0,0 +1,58 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/jackc/pgx/v5"
+)
+
+// UpdateFlagMetadataInDB stores the metadata on the flag's definition, so every environment picks it up
+func (s *System) UpdateFlagMetadataInDB(ctx context.Context, flagId string, req FlagMetadataRequest) error {
+	var err error
+	if req.Tags == nil {
+		req.Tags = []string{}
+	}
+	if req.Links == nil {
+		req.Links = []FlagLink{}
+	}
+	tags, err := json.Marshal(req.Tags)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to encode tags: %v", err)
+	}
+	links, err := json.Marshal(req.Links)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to encode links: %v", err)
+	}
+
+	var agentId string
+	err = s.DB.QueryRow(ctx, `
+    UPDATE public.flag_definition
+    SET
+      description = NULLIF($2, ''),
+      tags = $3,
+      owner_id = (SELECT id FROM public."user" WHERE subject = NULLIF($4, '')),
+      kind = NULLIF($5, ''),
+      links = $6,
+      updated_at = now()
+    WHERE id = (SELECT definition_id FROM public.flag WHERE id = $1)
+    RETURNING (SELECT agent_id FROM public.agent WHERE id = flag_definition.agent_id)`, flagId, req.Description, tags, req.OwnerID, string(req.Kind), links).Scan(&agentId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return s.Config.Bugfixes.Logger.Errorf("failed to update flag metadata: %v", err)
+	}
+
+	// the definition is shared, so every environment of the agent sees the change
+	_ = bus.Publish(ctx, bus.Event{
+		Kind:    bus.KindFlag,
+		Action:  bus.ActionUpdated,
+		AgentID: agentId,
+		FlagID:  flagId,
+	})
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	req := FlagMetadataRequest{
+		Tags:  []string{" Checkout ", "checkout", "", "Q3"},
+		Kind:  FlagKindExperiment,
+		Links: []FlagLink{{URL: "https://example.com/FLAG-1"}},
+	}
+	assert.NoError(t, ValidateMetadata(&req))
+	assert.Equal(t, []string{"checkout", "q3"}, req.Tags)
+
+	tests := []struct {
+		name string
+		req  FlagMetadataRequest
+	}{
+		{
+			name: "Unknown kind",
+			req:  FlagMetadataRequest{Kind: "temporary"},
+		},
+		{
+			name: "Link without a scheme",
+			req:  FlagMetadataRequest{Links: []FlagLink{{URL: "example.com/FLAG-1"}}},
+		},
+		{
+			name: "Link that isn't http",
+			req:  FlagMetadataRequest{Links: []FlagLink{{URL: "javascript:alert(1)"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, ValidateMetadata(&tt.req), ErrInvalidMetadata)
+		})
+	}
+}
+
+func TestFlagMetadataOFREP(t *testing.T) {
+	metadata := map[string]interface{}{}
+	FlagMetadata{
+		Description: "New checkout flow",
+		Tags:        []string{"checkout", "q3"},
+		Kind:        FlagKindRelease,
+		Owner:       &company.User{Subject: "user_123"},
+		Links:       []FlagLink{{URL: "https://example.com/FLAG-1"}},
+	}.addTo(metadata)
+
+	assert.Equal(t, map[string]interface{}{
+		"description": "New checkout flow",
+		"tags":        "checkout,q3",
+		"kind":        "release",
+		"owner":       "user_123",
+	}, metadata)
+
+	empty := map[string]interface{}{}
+	FlagMetadata{}.addTo(empty)
+	assert.Empty(t, empty)
+}
@@ -2,12 +2,14 @@ package flags
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/stats"
-	ConfigBuilder "github.com/keloran/go-config"
 )
 
 // OFREP (OpenFeature Remote Evaluation Protocol) implementation
@@ -35,6 +37,7 @@ type ResolutionReason string
 const (
 	ReasonStatic         ResolutionReason = "STATIC"
 	ReasonTargetingMatch ResolutionReason = "TARGETING_MATCH"
+	ReasonSplit          ResolutionReason = "SPLIT"
 	ReasonDefault        ResolutionReason = "DEFAULT"
 	ReasonDisabled       ResolutionReason = "DISABLED"
 	ReasonError          ResolutionReason = "ERROR"
@@ -76,38 +79,180 @@ type BulkEvaluationResponse struct {
 	Flags []interface{} `json:"flags"`
 }
 
+// BulkEvaluationFailure is the body of a bulk evaluation that failed as a whole
+type BulkEvaluationFailure struct {
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorDetails string    `json:"errorDetails,omitempty"`
+}
+
+// GeneralErrorResponse is the body of a request refused before any flag was looked at
+type GeneralErrorResponse struct {
+	ErrorDetails string `json:"errorDetails,omitempty"`
+}
+
+// ConfigurationResponse tells providers how to talk to the service
+type ConfigurationResponse struct {
+	Name         string                    `json:"name"`
+	Capabilities ConfigurationCapabilities `json:"capabilities"`
+}
+
+type ConfigurationCapabilities struct {
+	CacheInvalidation CacheInvalidationCapability `json:"cacheInvalidation"`
+	FlagEvaluation    FlagEvaluationCapability    `json:"flagEvaluation"`
+}
+
+type CacheInvalidationCapability struct {
+	Polling PollingCapability `json:"polling"`
+}
+
+// PollingCapability is how often a provider may poll the bulk evaluation, which answers unchanged flags with a 304
+type PollingCapability struct {
+	Enabled              bool  `json:"enabled"`
+	MinPollingIntervalMs int64 `json:"minPollingIntervalMs"`
+}
+
+type FlagEvaluationCapability struct {
+	UnsupportedTypes []string `json:"unsupportedTypes"`
+}
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials, send an X-API-Key or the x-project-id and x-agent-id headers")
+	ErrInvalidAPIKey      = errors.New("invalid or expired api key")
+	ErrAPIKeyMismatch     = errors.New("api key isn't for the requested project, agent or environment")
+	ErrAPIKeyScope        = errors.New("api key can't read flags")
+	ErrUnknownAgent       = errors.New("no such project, agent or environment")
+)
+
 // OFREPSystem handles OFREP endpoints
 type OFREPSystem struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewOFREPSystem(cfg *ConfigBuilder.Config) *OFREPSystem {
+func NewOFREPSystem(c *container.Container) *OFREPSystem {
 	return &OFREPSystem{
-		Config: cfg,
+		Container: c,
 	}
 }
 
 // extractCredentials gets credentials from X-API-Key (JWT) or individual headers
 // Priority: X-API-Key (JWT) > individual headers (x-project-id, x-agent-id, x-environment-id)
-func (s *OFREPSystem) extractCredentials(r *http.Request) (projectId, agentId, environmentId string) {
-	// Check X-API-Key header first (OFREP standard)
+func (s *OFREPSystem) extractCredentials(r *http.Request) (projectId, agentId, environmentId string, err error) {
+	projectId = r.Header.Get("x-project-id")
+	agentId = r.Header.Get("x-agent-id")
+	environmentId = r.Header.Get("x-environment-id")
+
+	// Check X-API-Key header first (OFREP standard), a key that doesn't validate is refused rather than ignored
 	apiKey := r.Header.Get("X-API-Key")
 	if apiKey != "" {
 		// X-API-Key contains a JWT with project_id, agent_id, environment_id
-		apiKeySystem := NewAPIKeySystem(s.Config)
-		claims, err := apiKeySystem.ValidateAPIKey(apiKey)
-		if err == nil && claims != nil {
-			return claims.ProjectID, claims.AgentID, claims.EnvironmentID
+		claims, err := NewAPIKeySystem(s.Container).ValidateAPIKey(r.Context(), apiKey)
+		if err != nil || claims == nil {
+			return "", "", "", ErrInvalidAPIKey
+		}
+		if !claims.HasScope(ScopeFlagsRead) {
+			return "", "", "", ErrAPIKeyScope
+		}
+
+		// headers sent alongside the key have to name what it was issued for, a key without an environment
+		// can be pointed at any of the agent's
+		if (projectId != "" && projectId != claims.ProjectID) ||
+			(agentId != "" && agentId != claims.AgentID) ||
+			(claims.EnvironmentID != "" && environmentId != "" && environmentId != claims.EnvironmentID) {
+			return "", "", "", ErrAPIKeyMismatch
+		}
+		if claims.EnvironmentID != "" {
+			environmentId = claims.EnvironmentID
 		}
-		// If JWT validation fails, silently continue to fallback
+		return claims.ProjectID, claims.AgentID, environmentId, nil
 	}
 
-	// Fall back to individual headers (existing flags.gg method)
-	projectId = r.Header.Get("x-project-id")
-	agentId = r.Header.Get("x-agent-id")
-	environmentId = r.Header.Get("x-environment-id")
+	// Fall back to individual headers (existing flags.gg method), they're only taken when they name an agent of
+	// the project, and an environment of the agent when there is one
+	if projectId == "" || agentId == "" {
+		return "", "", "", ErrMissingCredentials
+	}
+
+	valid, err := NewSystem(s.Container).ValidAgentInDB(r.Context(), projectId, agentId, environmentId)
+	if err != nil {
+		return "", "", "", err
+	}
+	if !valid {
+		return "", "", "", ErrUnknownAgent
+	}
+
+	return projectId, agentId, environmentId, nil
+}
+
+// credentialsStatus is the status a request is refused with, 403 for a valid key used for something else, 401 for
+// credentials that don't check out, and 500 when they couldn't be checked
+func credentialsStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAPIKeyMismatch), errors.Is(err, ErrAPIKeyScope):
+		return http.StatusForbidden
+	case errors.Is(err, ErrMissingCredentials), errors.Is(err, ErrInvalidAPIKey), errors.Is(err, ErrUnknownAgent):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
 
-	return projectId, agentId, environmentId
+// sendCredentialsError refuses the request with its credentialsStatus
+func (s *OFREPSystem) sendCredentialsError(w http.ResponseWriter, err error) {
+	status := credentialsStatus(err)
+	if status == http.StatusInternalServerError {
+		s.sendGeneralError(w, "Failed to check credentials", status)
+		return
+	}
+	s.sendGeneralError(w, err.Error(), status)
+}
+
+// GetConfiguration handles GET /ofrep/v1/configuration
+func (s *OFREPSystem) GetConfiguration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+
+	projectId, agentId, environmentId, err := s.extractCredentials(r)
+	if err != nil {
+		s.sendCredentialsError(w, err)
+		return
+	}
+
+	if environmentId == "" {
+		defaultEnvironmentId, err := NewSystem(s.Container).defaultEnvironment(ctx, projectId, agentId)
+		if err != nil {
+			s.sendGeneralError(w, "Failed to resolve environment", http.StatusInternalServerError)
+			return
+		}
+		environmentId = defaultEnvironmentId
+	}
+
+	// agents are told how often they may poll, providers get the same interval
+	interval := 60
+	environment, err := NewSystem(s.Container).environmentFlags(ctx, projectId, agentId, environmentId)
+	if err != nil {
+		s.sendGeneralError(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	if environment != nil && environment.IntervalAllowed > 0 {
+		interval = environment.IntervalAllowed
+	}
+
+	configuration := ConfigurationResponse{
+		Name: "flags.gg",
+		Capabilities: ConfigurationCapabilities{
+			CacheInvalidation: CacheInvalidationCapability{
+				Polling: PollingCapability{
+					Enabled:              true,
+					MinPollingIntervalMs: int64(interval) * 1000,
+				},
+			},
+			FlagEvaluation: FlagEvaluationCapability{
+				UnsupportedTypes: []string{},
+			},
+		},
+	}
+	if err := writeCached(w, r, configuration); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
 }
 
 // EvaluateSingleFlag handles POST /ofrep/v1/evaluate/flags/{key}
@@ -116,6 +261,12 @@ func (s *OFREPSystem) EvaluateSingleFlag(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("x-flags-timestamp", strconv.FormatInt(time.Now().Unix(), 10))
 	ctx := r.Context()
 
+	projectId, agentId, environmentId, err := s.extractCredentials(r)
+	if err != nil {
+		s.sendCredentialsError(w, err)
+		return
+	}
+
 	flagKey := r.PathValue("key")
 	if flagKey == "" {
 		s.sendErrorResponse(w, "", ErrorFlagNotFound, "Flag key is required", http.StatusBadRequest)
@@ -128,14 +279,8 @@ func (s *OFREPSystem) EvaluateSingleFlag(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	projectId, agentId, environmentId := s.extractCredentials(r)
-
-	if projectId == "" || agentId == "" {
-		s.sendErrorResponse(w, flagKey, ErrorInvalidContext, "Missing project-id or agent-id headers", http.StatusBadRequest)
-		return
-	}
 	if environmentId == "" {
-		defaultEnvironmentId, err := NewSystem(s.Config).GetDefaultEnvironment(ctx, projectId, agentId)
+		defaultEnvironmentId, err := NewSystem(s.Container).defaultEnvironment(ctx, projectId, agentId)
 		if err != nil {
 			s.sendErrorResponse(w, flagKey, ErrorGeneral, "Failed to resolve environment", http.StatusInternalServerError)
 			return
@@ -143,18 +288,27 @@ func (s *OFREPSystem) EvaluateSingleFlag(w http.ResponseWriter, r *http.Request)
 		environmentId = defaultEnvironmentId
 	}
 
-	flag, err := s.GetSingleFlagFromDB(ctx, projectId, agentId, environmentId, flagKey)
+	environment, err := NewSystem(s.Container).environmentFlags(ctx, projectId, agentId, environmentId)
 	if err != nil {
 		s.sendErrorResponse(w, flagKey, ErrorGeneral, "Failed to retrieve flag", http.StatusInternalServerError)
 		return
 	}
+	var flag *Flag
+	if environment != nil {
+		for i := range environment.Flags {
+			if strings.EqualFold(environment.Flags[i].Details.Name, flagKey) {
+				flag = &environment.Flags[i]
+				break
+			}
+		}
+	}
 
 	if flag == nil {
 		s.sendErrorResponse(w, flagKey, ErrorFlagNotFound, "Flag not found", http.StatusNotFound)
 		return
 	}
 
-	if err := stats.NewSystem(s.Config).RecordEnvironmentRequest(
+	if err := stats.NewSystem(s.Container).RecordEnvironmentRequest(
 		ctx,
 		projectId,
 		agentId,
@@ -164,20 +318,27 @@ func (s *OFREPSystem) EvaluateSingleFlag(w http.ResponseWriter, r *http.Request)
 	); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record single flag request: %v", err)
 	}
-
-	response := SuccessEvaluationResponse{
-		Key:    flagKey,
-		Reason: ReasonStatic,
-		Value:  flag.Enabled,
-		Variant: func() string {
-			if flag.Enabled {
-				return "enabled"
+	// counted in memory, the lookups are written together rather than holding up the response
+	NewSystem(s.Container).evaluations().add(flag.Details.ID)
+
+	// prerequisites are evaluated against the rest of the environment, their targeting may also refer to segments
+	evaluated := []*Flag{flag}
+	if len(flag.Prerequisites) > 0 {
+		for i := range environment.Flags {
+			if &environment.Flags[i] != flag {
+				evaluated = append(evaluated, &environment.Flags[i])
 			}
-			return "disabled"
-		}(),
-		Metadata: map[string]interface{}{
-			"flagId": flag.Details.ID,
-		},
+		}
+	}
+
+	if err := NewSystem(s.Container).AttachSegments(ctx, projectId, evaluated...); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to load segments: %v", err)
+	}
+
+	response, errResponse := s.evaluate(flagKey, flag, req.Context, environment.Disabled)
+	if errResponse != nil {
+		s.sendErrorResponse(w, flagKey, errResponse.ErrorCode, errResponse.ErrorDetails, http.StatusBadRequest)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -192,46 +353,35 @@ func (s *OFREPSystem) EvaluateBulkFlags(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("x-flags-timestamp", strconv.FormatInt(time.Now().Unix(), 10))
 	ctx := r.Context()
 
-	var req BulkEvaluationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(BulkEvaluationResponse{
-			Flags: []interface{}{},
-		})
+	projectId, agentId, environmentId, err := s.extractCredentials(r)
+	if err != nil {
+		s.sendCredentialsError(w, err)
 		return
 	}
 
-	projectId, agentId, environmentId := s.extractCredentials(r)
-
-	if projectId == "" || agentId == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(BulkEvaluationResponse{
-			Flags: []interface{}{},
-		})
+	var req BulkEvaluationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendBulkError(w, ErrorParseError, "Invalid request body")
 		return
 	}
+
 	if environmentId == "" {
-		defaultEnvironmentId, err := NewSystem(s.Config).GetDefaultEnvironment(ctx, projectId, agentId)
+		defaultEnvironmentId, err := NewSystem(s.Container).defaultEnvironment(ctx, projectId, agentId)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = json.NewEncoder(w).Encode(BulkEvaluationResponse{
-				Flags: []interface{}{},
-			})
+			s.sendGeneralError(w, "Failed to resolve environment", http.StatusInternalServerError)
 			return
 		}
 		environmentId = defaultEnvironmentId
 	}
 
-	flags, err := NewSystem(s.Config).GetAgentFlagsFromDB(ctx, projectId, agentId, environmentId)
+	// prerequisites are evaluated against the request context, so the flags are taken as stored
+	flags, err := NewSystem(s.Container).environmentFlags(ctx, projectId, agentId, environmentId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(BulkEvaluationResponse{
-			Flags: []interface{}{},
-		})
+		s.sendGeneralError(w, "Failed to retrieve flags", http.StatusInternalServerError)
 		return
 	}
 
-	if err := stats.NewSystem(s.Config).RecordEnvironmentRequest(
+	if err := stats.NewSystem(s.Container).RecordEnvironmentRequest(
 		ctx,
 		projectId,
 		agentId,
@@ -241,23 +391,39 @@ func (s *OFREPSystem) EvaluateBulkFlags(w http.ResponseWriter, r *http.Request)
 	); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to record bulk flag request: %v", err)
 	}
+	if flags != nil {
+		if err := NewSystem(s.Container).RecordFlagsServedInDB(ctx, agentId, environmentId, flags.Flags); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to record served flags: %v", err)
+		}
+	}
 
-	var responses []interface{}
+	responses := []interface{}{}
 	if flags != nil {
-		for _, flag := range flags.Flags {
-			response := SuccessEvaluationResponse{
-				Key:    flag.Details.Name,
-				Reason: ReasonStatic,
-				Value:  flag.Enabled,
-				Variant: func() string {
-					if flag.Enabled {
-						return "enabled"
-					}
-					return "disabled"
-				}(),
-				Metadata: map[string]interface{}{
-					"flagId": flag.Details.ID,
-				},
+		flagRefs := make([]*Flag, len(flags.Flags))
+		for i := range flags.Flags {
+			flagRefs[i] = &flags.Flags[i]
+		}
+		// without their segments the targeting would quietly miss, those flags are failed on their own
+		segmentsErr := NewSystem(s.Container).AttachSegments(ctx, projectId, flagRefs...)
+		if segmentsErr != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to load segments: %v", segmentsErr)
+		}
+
+		for _, flag := range flagRefs {
+			if segmentsErr != nil && !flags.Disabled && len(flag.segmentIds()) > 0 {
+				responses = append(responses, ErrorEvaluationResponse{
+					Key:          flag.Details.Name,
+					ErrorCode:    ErrorGeneral,
+					ErrorDetails: "Failed to load the flag's segments",
+					Reason:       ReasonError,
+				})
+				continue
+			}
+
+			response, errResponse := s.evaluate(flag.Details.Name, flag, req.Context, flags.Disabled)
+			if errResponse != nil {
+				responses = append(responses, *errResponse)
+				continue
 			}
 			responses = append(responses, response)
 		}
@@ -267,12 +433,55 @@ func (s *OFREPSystem) EvaluateBulkFlags(w http.ResponseWriter, r *http.Request)
 		Flags: responses,
 	}
 
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(bulkResponse); err != nil {
+	if err := writeCached(w, r, bulkResponse); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
 	}
 }
 
+// evaluate resolves a flag for the request context into an OFREP response, or an error response when it can't be served,
+// the flags of a disabled environment are already off and only need the reason
+func (s *OFREPSystem) evaluate(key string, flag *Flag, ec EvaluationContext, disabled bool) (SuccessEvaluationResponse, *ErrorEvaluationResponse) {
+	evaluation, err := flag.Evaluate(ec)
+	if err != nil {
+		code := ErrorGeneral
+		switch {
+		case errors.Is(err, ErrVariantTypeMismatch):
+			code = ErrorTypeMismatch
+		case errors.Is(err, ErrTargetingKeyMissing):
+			code = ErrorTargetingKeyMissing
+		}
+		return SuccessEvaluationResponse{}, &ErrorEvaluationResponse{
+			Key:          key,
+			ErrorCode:    code,
+			ErrorDetails: err.Error(),
+			Reason:       ReasonError,
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"flagId":   publicFlagId(flag.Details.ID),
+		"flagType": string(flag.FlagType()),
+	}
+	if evaluation.RuleID != "" {
+		metadata["ruleId"] = evaluation.RuleID
+	}
+	if evaluation.PrerequisiteFailed != "" {
+		metadata["prerequisiteFailed"] = evaluation.PrerequisiteFailed
+	}
+	flag.Details.FlagMetadata.addTo(metadata)
+	if disabled {
+		evaluation.Reason = ReasonDisabled
+	}
+
+	return SuccessEvaluationResponse{
+		Key:      key,
+		Reason:   evaluation.Reason,
+		Value:    evaluation.Value,
+		Variant:  evaluation.Variant,
+		Metadata: metadata,
+	}, nil
+}
+
 func (s *OFREPSystem) sendErrorResponse(w http.ResponseWriter, key string, code ErrorCode, details string, statusCode int) {
 	w.WriteHeader(statusCode)
 	response := ErrorEvaluationResponse{
@@ -285,3 +494,22 @@ func (s *OFREPSystem) sendErrorResponse(w http.ResponseWriter, key string, code
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode error response: %v", err)
 	}
 }
+
+func (s *OFREPSystem) sendBulkError(w http.ResponseWriter, code ErrorCode, details string) {
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(BulkEvaluationFailure{
+		ErrorCode:    code,
+		ErrorDetails: details,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode error response: %v", err)
+	}
+}
+
+func (s *OFREPSystem) sendGeneralError(w http.ResponseWriter, details string, statusCode int) {
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(GeneralErrorResponse{
+		ErrorDetails: details,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode error response: %v", err)
+	}
+}
@@ -9,11 +9,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/docker/go-connections/nat"
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/flags-gg/orchestrator/internal/keyring"
 	ConfigBuilder "github.com/keloran/go-config"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
@@ -129,17 +132,101 @@ func setupTestDatabase(c context.Context) (*testContainer, error) {
 			agent_id integer REFERENCES public.agent(id),
 			name varchar(255) NOT NULL,
 			"default" boolean NOT NULL DEFAULT false,
+			requires_approval boolean NOT NULL DEFAULT false,
+			required_approvals smallint NOT NULL DEFAULT 1,
+			enabled boolean NOT NULL DEFAULT true,
 			created_at timestamp NOT NULL DEFAULT now()
 		);
 
-		CREATE TABLE public.flag (
+		CREATE TABLE public.flag_definition (
 			id serial PRIMARY KEY,
+			agent_id integer NOT NULL REFERENCES public.agent(id),
 			name varchar(255) NOT NULL,
+			flag_type varchar(32) NOT NULL DEFAULT 'boolean',
+			variants jsonb NOT NULL DEFAULT '[]'::jsonb,
+			description text,
+			tags jsonb NOT NULL DEFAULT '[]'::jsonb,
+			owner_id integer REFERENCES public."user"(id),
+			kind varchar(32),
+			links jsonb NOT NULL DEFAULT '[]'::jsonb,
+			created_at timestamp NOT NULL DEFAULT now(),
+			updated_at timestamp NOT NULL DEFAULT now(),
+			UNIQUE (agent_id, name)
+		);
+
+		CREATE TABLE public.flag (
+			id serial PRIMARY KEY,
+			definition_id integer NOT NULL REFERENCES public.flag_definition(id) ON DELETE CASCADE,
 			enabled boolean NOT NULL DEFAULT false,
 			agent_id integer REFERENCES public.agent(id),
 			environment_id integer REFERENCES public.environment(id),
+			default_variant varchar(255),
+			off_variant varchar(255),
+			targeting_rules jsonb NOT NULL DEFAULT '[]'::jsonb,
+			rollout jsonb,
+			created_at timestamp NOT NULL DEFAULT now(),
+		    updated_at timestamp NOT NULL DEFAULT now(),
+			UNIQUE (environment_id, definition_id)
+		);
+
+		CREATE TABLE public.segment (
+			id serial PRIMARY KEY,
+			segment_id varchar(255) NOT NULL UNIQUE,
+			company_id integer REFERENCES public.company(id),
+			name varchar(255) NOT NULL,
+			description text,
+			rules jsonb NOT NULL DEFAULT '[]'::jsonb,
+			included jsonb NOT NULL DEFAULT '[]'::jsonb,
+			excluded jsonb NOT NULL DEFAULT '[]'::jsonb,
+			created_at timestamp NOT NULL DEFAULT now(),
+			updated_at timestamp NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE public.flag_schedule (
+			id serial PRIMARY KEY,
+			schedule_id varchar(255) NOT NULL UNIQUE,
+			flag_id integer REFERENCES public.flag(id) ON DELETE CASCADE,
+			run_at timestamptz NOT NULL,
+			timezone varchar(255) NOT NULL DEFAULT 'Europe/London',
+			enabled boolean,
+			default_variant varchar(255),
+			rollout jsonb,
+			clear_rollout boolean NOT NULL DEFAULT false,
+			status varchar(32) NOT NULL DEFAULT 'pending',
+			error text,
+			created_by varchar(255),
+			claimed_at timestamptz,
+			applied_at timestamptz,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE public.flag_prerequisite (
+			id serial PRIMARY KEY,
+			flag_id integer NOT NULL REFERENCES public.flag(id) ON DELETE CASCADE,
+			prerequisite_flag_id integer NOT NULL REFERENCES public.flag(id),
+			variant varchar(255),
 			created_at timestamp NOT NULL DEFAULT now(),
-		    updated_at timestamp NOT NULL DEFAULT now()
+			UNIQUE (flag_id, prerequisite_flag_id)
+		);
+
+		CREATE TABLE public.environment_chain (
+			id serial PRIMARY KEY,
+			agent_id integer REFERENCES public.agent(id),
+			parent_environment_id integer REFERENCES public.environment(id),
+			child_environment_id integer REFERENCES public.environment(id),
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE public.flag_history (
+			id serial PRIMARY KEY,
+			flag_id integer NOT NULL,
+			version integer NOT NULL,
+			actor varchar(255) NOT NULL,
+			source varchar(255) NOT NULL,
+			before jsonb,
+			after jsonb,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			UNIQUE (flag_id, version)
 		);
 
 		CREATE TABLE public.secret_menu (
@@ -174,6 +261,50 @@ func setupTestDatabase(c context.Context) (*testContainer, error) {
 			created_at timestamp NOT NULL DEFAULT now()
 		);
 
+		CREATE TABLE public.flag_change_request (
+			id serial PRIMARY KEY,
+			request_id varchar(255) NOT NULL UNIQUE,
+			flag_id integer REFERENCES public.flag(id) ON DELETE SET NULL,
+			flag_name varchar(255) NOT NULL,
+			environment_id integer NOT NULL REFERENCES public.environment(id) ON DELETE CASCADE,
+			action varchar(32) NOT NULL,
+			payload jsonb,
+			author_id integer NOT NULL REFERENCES public."user"(id),
+			required_approvals smallint NOT NULL DEFAULT 1,
+			status varchar(32) NOT NULL DEFAULT 'pending',
+			resolved_at timestamp,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE public.flag_change_review (
+			id serial PRIMARY KEY,
+			change_request_id integer NOT NULL REFERENCES public.flag_change_request(id) ON DELETE CASCADE,
+			reviewer_id integer NOT NULL REFERENCES public."user"(id),
+			decision varchar(16) NOT NULL,
+			comment text,
+			created_at timestamp NOT NULL DEFAULT now(),
+			UNIQUE (change_request_id, reviewer_id)
+		);
+
+		CREATE TABLE public.flag_evaluation (
+			flag_id integer PRIMARY KEY REFERENCES public.flag(id) ON DELETE CASCADE,
+			evaluations bigint NOT NULL DEFAULT 0,
+			served bigint NOT NULL DEFAULT 0,
+			last_evaluated_at timestamp,
+			last_served_at timestamp
+		);
+
+		CREATE TABLE public.user_notifications (
+			id serial PRIMARY KEY,
+			user_id integer,
+			subject varchar(255),
+			content varchar(255),
+			action varchar(255),
+			read boolean NOT NULL DEFAULT false,
+			deleted boolean NOT NULL DEFAULT false,
+			created_at timestamp NOT NULL DEFAULT now()
+		);
+
 		CREATE TABLE public.api_key_audit (
 			id serial PRIMARY KEY,
 			project_id varchar(255) NOT NULL,
@@ -187,6 +318,17 @@ func setupTestDatabase(c context.Context) (*testContainer, error) {
 		return nil, err
 	}
 
+	// the revision triggers and the api keys are tested as they ship
+	for _, migration := range []string{"0015_flag_revision", "0016_api_keys", "0017_api_key_legacy"} {
+		schema, err := os.ReadFile("../../k8s/schema/" + migration + ".up.sql")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(string(schema)); err != nil {
+			return nil, err
+		}
+	}
+
 	// Insert test data
 	_, err = db.Exec(`
 		INSERT INTO public.company (company_id, name)
@@ -207,11 +349,17 @@ func setupTestDatabase(c context.Context) (*testContainer, error) {
 		INSERT INTO public.environment (env_id, agent_id, name, "default")
 		VALUES ('test-env-1', 1, 'Test Environment', true);
 
-		INSERT INTO public.flag (name, enabled, agent_id, environment_id)
+		INSERT INTO public.flag_definition (agent_id, name)
+		VALUES
+			(1, 'feature-flag-1'),
+			(1, 'feature-flag-2'),
+			(1, 'feature-flag-3');
+
+		INSERT INTO public.flag (definition_id, enabled, agent_id, environment_id)
 		VALUES
-			('feature-flag-1', true, 1, 1),
-			('feature-flag-2', false, 1, 1),
-			('feature-flag-3', true, 1, 1);
+			(1, true, 1, 1),
+			(2, false, 1, 1),
+			(3, true, 1, 1);
 	`)
 	if err != nil {
 		return nil, err
@@ -231,7 +379,18 @@ func setupTestSystem(t *testing.T) (*System, *OFREPSystem) {
 	c.Local.Development = true
 	c.Clerk.DevUser = "test-user-subject"
 
-	return NewSystem(c), NewOFREPSystem(c)
+	cont, err := container.New(context.Background(), c)
+	if err != nil {
+		t.Fatalf("Failed to open database pool: %v", err)
+	}
+	t.Cleanup(cont.Close)
+	cont.Keys = keyring.Development()
+
+	// every test has its own database behind the same ids
+	system := NewSystem(cont)
+	system.agentCache().clear()
+
+	return system, NewOFREPSystem(cont)
 }
 
 func TestOFREPSingleFlagEvaluation(t *testing.T) {
@@ -309,8 +468,25 @@ func TestOFREPSingleFlagEvaluation(t *testing.T) {
 			agentId:        "test-agent-1",
 			environmentId:  "test-env-1",
 			requestBody:    EvaluationRequest{},
-			expectedStatus: http.StatusBadRequest,
-			expectedError:  ErrorInvalidContext,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Agent of another project",
+			flagKey:        "feature-flag-1",
+			projectId:      "test-project-2",
+			agentId:        "test-agent-1",
+			environmentId:  "test-env-1",
+			requestBody:    EvaluationRequest{},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Environment the agent doesn't have",
+			flagKey:        "feature-flag-1",
+			projectId:      "test-project-1",
+			agentId:        "test-agent-1",
+			environmentId:  "made-up-env",
+			requestBody:    EvaluationRequest{},
+			expectedStatus: http.StatusUnauthorized,
 		},
 	}
 
@@ -337,6 +513,11 @@ func TestOFREPSingleFlagEvaluation(t *testing.T) {
 				assert.Equal(t, ReasonStatic, response.Reason)
 				assert.NotEmpty(t, response.Variant)
 				assert.NotNil(t, response.Metadata)
+			} else if tt.expectedStatus == http.StatusUnauthorized {
+				var response GeneralErrorResponse
+				err := json.NewDecoder(w.Body).Decode(&response)
+				assert.NoError(t, err)
+				assert.NotEmpty(t, response.ErrorDetails)
 			} else {
 				var response ErrorEvaluationResponse
 				err := json.NewDecoder(w.Body).Decode(&response)
@@ -391,7 +572,7 @@ func TestOFREPBulkFlagEvaluation(t *testing.T) {
 			agentId:        "",
 			environmentId:  "test-env-1",
 			requestBody:    BulkEvaluationRequest{},
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnauthorized,
 			expectedCount:  0,
 		},
 	}
@@ -520,15 +701,14 @@ func TestOFREPAPIKeyAuthentication(t *testing.T) {
 	_, ofrepSystem := setupTestSystem(t)
 
 	// Generate JWT API keys
-	apiKeySystem := NewAPIKeySystem(ofrepSystem.Config)
-	validAPIKeyWithEnv, err := apiKeySystem.GenerateAPIKey("test-project-1", "test-agent-1", "test-env-1")
-	assert.NoError(t, err)
-	validAPIKeyWithoutEnv, err := apiKeySystem.GenerateAPIKey("test-project-1", "test-agent-1", "")
-	assert.NoError(t, err)
+	apiKeySystem := NewAPIKeySystem(ofrepSystem.Container)
+	validAPIKeyWithEnv := generateTestAPIKey(t, apiKeySystem, "test-project-1", "test-agent-1", "test-env-1")
+	validAPIKeyWithoutEnv := generateTestAPIKey(t, apiKeySystem, "test-project-1", "test-agent-1", "")
 
 	tests := []struct {
 		name           string
 		apiKey         string
+		agentId        string
 		flagKey        string
 		expectedStatus int
 		shouldSucceed  bool
@@ -547,18 +727,34 @@ func TestOFREPAPIKeyAuthentication(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			shouldSucceed:  true,
 		},
+		{
+			name:           "API key with the agent it was issued for",
+			apiKey:         validAPIKeyWithEnv,
+			agentId:        "test-agent-1",
+			flagKey:        "feature-flag-1",
+			expectedStatus: http.StatusOK,
+			shouldSucceed:  true,
+		},
+		{
+			name:           "API key used for another agent",
+			apiKey:         validAPIKeyWithEnv,
+			agentId:        "test-agent-2",
+			flagKey:        "feature-flag-1",
+			expectedStatus: http.StatusForbidden,
+			shouldSucceed:  false,
+		},
 		{
 			name:           "Invalid API key format",
 			apiKey:         "invalid-key",
 			flagKey:        "feature-flag-1",
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnauthorized,
 			shouldSucceed:  false,
 		},
 		{
 			name:           "Empty API key",
 			apiKey:         "",
 			flagKey:        "feature-flag-1",
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnauthorized,
 			shouldSucceed:  false,
 		},
 	}
@@ -574,6 +770,9 @@ func TestOFREPAPIKeyAuthentication(t *testing.T) {
 			if tt.apiKey != "" {
 				req.Header.Set("X-API-Key", tt.apiKey)
 			}
+			if tt.agentId != "" {
+				req.Header.Set("x-agent-id", tt.agentId)
+			}
 			req.SetPathValue("key", tt.flagKey)
 
 			w := httptest.NewRecorder()
@@ -588,10 +787,10 @@ func TestOFREPAPIKeyAuthentication(t *testing.T) {
 				assert.Equal(t, tt.flagKey, response.Key)
 				assert.NotNil(t, response.Value)
 			} else {
-				var response ErrorEvaluationResponse
+				var response GeneralErrorResponse
 				err := json.NewDecoder(w.Body).Decode(&response)
 				assert.NoError(t, err)
-				assert.NotEmpty(t, response.ErrorCode)
+				assert.NotEmpty(t, response.ErrorDetails)
 			}
 		})
 	}
@@ -667,3 +866,1626 @@ func TestOFREPCaseInsensitiveFlagLookup(t *testing.T) {
 		})
 	}
 }
+
+func TestOFREPMultivariateFlagEvaluation(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	_, err = db.Exec(`
+		INSERT INTO public.flag_definition (agent_id, name, flag_type, variants)
+		VALUES
+			(1, 'button-colour', 'string', '[{"name":"blue","value":"#0000ff"},{"name":"red","value":"#ff0000"}]'),
+			(1, 'page-size', 'integer', '[{"name":"small","value":10},{"name":"large","value":50}]'),
+			(1, 'broken-limit', 'integer', '[{"name":"on","value":"ten"},{"name":"off","value":0}]');
+
+		INSERT INTO public.flag (definition_id, enabled, agent_id, environment_id, default_variant, off_variant)
+		VALUES
+			(4, true, 1, 1, 'blue', 'red'),
+			(5, false, 1, 1, 'large', 'small'),
+			(6, true, 1, 1, 'on', 'off')`)
+	assert.NoError(t, err)
+
+	_, ofrepSystem := setupTestSystem(t)
+
+	tests := []struct {
+		name            string
+		flagKey         string
+		expectedStatus  int
+		expectedVariant string
+		expectedValue   interface{}
+		expectedError   ErrorCode
+	}{
+		{
+			name:            "String flag serves default variant",
+			flagKey:         "button-colour",
+			expectedStatus:  http.StatusOK,
+			expectedVariant: "blue",
+			expectedValue:   "#0000ff",
+		},
+		{
+			name:            "Disabled integer flag serves off variant",
+			flagKey:         "page-size",
+			expectedStatus:  http.StatusOK,
+			expectedVariant: "small",
+			expectedValue:   float64(10),
+		},
+		{
+			name:           "Variant value does not match type",
+			flagKey:        "broken-limit",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  ErrorTypeMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(EvaluationRequest{})
+			req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/"+tt.flagKey, bytes.NewReader(body))
+			req.Header.Set("x-project-id", "test-project-1")
+			req.Header.Set("x-agent-id", "test-agent-1")
+			req.Header.Set("x-environment-id", "test-env-1")
+			req.SetPathValue("key", tt.flagKey)
+
+			w := httptest.NewRecorder()
+			ofrepSystem.EvaluateSingleFlag(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+
+			if tt.expectedStatus == http.StatusOK {
+				var response SuccessEvaluationResponse
+				err := json.NewDecoder(w.Body).Decode(&response)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedVariant, response.Variant)
+				assert.Equal(t, tt.expectedValue, response.Value)
+			} else {
+				var response ErrorEvaluationResponse
+				err := json.NewDecoder(w.Body).Decode(&response)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedError, response.ErrorCode)
+			}
+		})
+	}
+}
+
+func TestOFREPTargetingRuleEvaluation(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	_, err = db.Exec(`
+		UPDATE public.flag
+		SET targeting_rules = '[{"id":"gb-users","variant":"disabled","conditions":[{"attribute":"country","operator":"equals","value":"GB"}]}]'
+		WHERE name = 'feature-flag-1'`)
+	assert.NoError(t, err)
+
+	_, ofrepSystem := setupTestSystem(t)
+
+	tests := []struct {
+		name           string
+		context        EvaluationContext
+		expectedValue  interface{}
+		expectedReason ResolutionReason
+		expectedRule   interface{}
+	}{
+		{
+			name: "Rule matches",
+			context: EvaluationContext{
+				TargetingKey: "user-123",
+				Context:      map[string]interface{}{"country": "GB"},
+			},
+			expectedValue:  false,
+			expectedReason: ReasonTargetingMatch,
+			expectedRule:   "gb-users",
+		},
+		{
+			name: "No rule matches",
+			context: EvaluationContext{
+				TargetingKey: "user-123",
+				Context:      map[string]interface{}{"country": "FR"},
+			},
+			expectedValue:  true,
+			expectedReason: ReasonDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(EvaluationRequest{Context: tt.context})
+			req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-1", bytes.NewReader(body))
+			req.Header.Set("x-project-id", "test-project-1")
+			req.Header.Set("x-agent-id", "test-agent-1")
+			req.Header.Set("x-environment-id", "test-env-1")
+			req.SetPathValue("key", "feature-flag-1")
+
+			w := httptest.NewRecorder()
+			ofrepSystem.EvaluateSingleFlag(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response SuccessEvaluationResponse
+			err := json.NewDecoder(w.Body).Decode(&response)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedValue, response.Value)
+			assert.Equal(t, tt.expectedReason, response.Reason)
+			assert.Equal(t, tt.expectedRule, response.Metadata["ruleId"])
+		})
+	}
+}
+
+func TestOFREPRolloutRequiresTargetingKey(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	_, err = db.Exec(`
+		UPDATE public.flag
+		SET rollout = '{"salt":"test","splits":[{"variant":"enabled","weight":50},{"variant":"disabled","weight":50}]}'
+		WHERE name = 'feature-flag-1'`)
+	assert.NoError(t, err)
+
+	_, ofrepSystem := setupTestSystem(t)
+
+	body, _ := json.Marshal(EvaluationRequest{})
+	req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-1", bytes.NewReader(body))
+	req.Header.Set("x-project-id", "test-project-1")
+	req.Header.Set("x-agent-id", "test-agent-1")
+	req.Header.Set("x-environment-id", "test-env-1")
+	req.SetPathValue("key", "feature-flag-1")
+
+	w := httptest.NewRecorder()
+	ofrepSystem.EvaluateSingleFlag(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response ErrorEvaluationResponse
+	err = json.NewDecoder(w.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorTargetingKeyMissing, response.ErrorCode)
+}
+
+func TestGetFlagsUsingSegment(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	_, err = db.Exec(`
+		INSERT INTO public.segment (segment_id, company_id, name, included)
+		VALUES ('beta-segment', 1, 'Beta', '["user-123"]');
+
+		UPDATE public.flag
+		SET targeting_rules = '[{"id":"beta","variant":"enabled","conditions":[{"attribute":"","operator":"in_segment","value":"beta-segment"}]}]'
+		WHERE definition_id = 2`)
+	assert.NoError(t, err)
+
+	system, ofrepSystem := setupTestSystem(t)
+
+	dependents, err := system.GetFlagsUsingSegment(ctx, "test-company-1", "beta-segment")
+	assert.NoError(t, err)
+	assert.Len(t, dependents, 1)
+	assert.Equal(t, "feature-flag-2", dependents[0].Flag.Details.Name)
+
+	unused, err := system.GetFlagsUsingSegment(ctx, "test-company-1", "other-segment")
+	assert.NoError(t, err)
+	assert.Empty(t, unused)
+
+	// another company neither sees the flags using the segment nor can use the segment
+	_, err = db.Exec(`
+		INSERT INTO public.company (company_id, name)
+		VALUES ('test-company-2', 'Other Company');
+
+		INSERT INTO public.segment (segment_id, company_id, name, included)
+		VALUES ('other-company-segment', 2, 'Other', '["user-123"]')`)
+	assert.NoError(t, err)
+
+	hidden, err := system.GetFlagsUsingSegment(ctx, "test-company-2", "beta-segment")
+	assert.NoError(t, err)
+	assert.Empty(t, hidden)
+
+	segments, err := system.GetSegmentsFromDB(ctx, "test-company-1", []string{"beta-segment", "other-company-segment"})
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	assert.Contains(t, segments, "beta-segment")
+
+	// feature-flag-2 is disabled so the segment rule is not applied
+	body, _ := json.Marshal(EvaluationRequest{Context: EvaluationContext{TargetingKey: "user-123"}})
+	req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-2", bytes.NewReader(body))
+	req.Header.Set("x-project-id", "test-project-1")
+	req.Header.Set("x-agent-id", "test-agent-1")
+	req.Header.Set("x-environment-id", "test-env-1")
+	req.SetPathValue("key", "feature-flag-2")
+
+	w := httptest.NewRecorder()
+	ofrepSystem.EvaluateSingleFlag(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, err = db.Exec(`UPDATE public.flag SET enabled = true WHERE id = 2`)
+	assert.NoError(t, err)
+	system.agentCache().clear()
+
+	body, _ = json.Marshal(EvaluationRequest{Context: EvaluationContext{TargetingKey: "user-123"}})
+	req = httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-2", bytes.NewReader(body))
+	req.Header.Set("x-project-id", "test-project-1")
+	req.Header.Set("x-agent-id", "test-agent-1")
+	req.Header.Set("x-environment-id", "test-env-1")
+	req.SetPathValue("key", "feature-flag-2")
+
+	w = httptest.NewRecorder()
+	ofrepSystem.EvaluateSingleFlag(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response SuccessEvaluationResponse
+	err = json.NewDecoder(w.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, ReasonTargetingMatch, response.Reason)
+	assert.Equal(t, "beta", response.Metadata["ruleId"])
+}
+
+func TestTargetingWaitsOnASegmentBeingDeleted(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	_, err = system.DB.Exec(ctx, `
+		INSERT INTO public.segment (segment_id, company_id, name, included)
+		VALUES ('beta-segment', 1, 'Beta', '["user-123"]')`)
+	assert.NoError(t, err)
+
+	rules := []TargetingRule{{
+		ID:         "beta",
+		Variant:    VariantEnabled,
+		Conditions: []Condition{{Operator: OperatorInSegment, Value: "beta-segment"}},
+	}}
+	err = system.UpdateTargetingRulesInDB(ctx, "test-company-1", "1", []TargetingRule{{
+		ID:         "missing",
+		Variant:    VariantEnabled,
+		Conditions: []Condition{{Operator: OperatorInSegment, Value: "no-such-segment"}},
+	}})
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+
+	// the deletion holds the segment, the targeting update waits for it and then finds the segment gone
+	tx, err := system.DB.Begin(ctx)
+	assert.NoError(t, err)
+	_, err = tx.Exec(ctx, `SELECT id FROM public.segment WHERE segment_id = 'beta-segment' FOR UPDATE`)
+	assert.NoError(t, err)
+	dependents, err := system.FlagsUsingSegmentTx(ctx, tx, "test-company-1", "beta-segment")
+	assert.NoError(t, err)
+	assert.Empty(t, dependents)
+
+	updated := make(chan error, 1)
+	go func() {
+		updated <- system.UpdateTargetingRulesInDB(ctx, "test-company-1", "1", rules)
+	}()
+	select {
+	case err := <-updated:
+		t.Fatalf("targeting was stored while the segment was being deleted: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM public.segment WHERE segment_id = 'beta-segment'`)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit(ctx))
+	assert.ErrorIs(t, <-updated, ErrSegmentNotFound)
+
+	flag, err := system.GetFlagFromDB(ctx, "1")
+	assert.NoError(t, err)
+	assert.Empty(t, flag.TargetingRules)
+}
+
+func TestSchedulerAppliesDueSchedules(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	_, err = db.Exec(`
+		INSERT INTO public.flag_schedule (schedule_id, flag_id, run_at, enabled)
+		VALUES
+			('due', 2, now() - interval '1 minute', true),
+			('future', 3, now() + interval '1 day', false)`)
+	assert.NoError(t, err)
+
+	system, _ := setupTestSystem(t)
+	NewScheduler(system.Container).runDue(ctx)
+
+	var enabled bool
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 2`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 3`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	var status string
+	err = db.QueryRow(`SELECT status FROM public.flag_schedule WHERE schedule_id = 'due'`).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, string(ScheduleStatusApplied), status)
+
+	err = db.QueryRow(`SELECT status FROM public.flag_schedule WHERE schedule_id = 'future'`).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, string(ScheduleStatusPending), status)
+}
+
+func TestSchedulerRollsBackAFailedSchedule(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// the default variant is changed first, turning the flag on then fails
+	_, err = db.Exec(`
+		CREATE FUNCTION refuse_enable() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'refused';
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE TRIGGER refuse_enable BEFORE UPDATE OF enabled ON public.flag
+		FOR EACH ROW WHEN (NEW.enabled IS DISTINCT FROM OLD.enabled) EXECUTE FUNCTION refuse_enable();
+
+		INSERT INTO public.flag_schedule (schedule_id, flag_id, run_at, enabled, default_variant)
+		VALUES ('due', 2, now() - interval '1 minute', true, 'enabled')`)
+	assert.NoError(t, err)
+
+	system, _ := setupTestSystem(t)
+	NewScheduler(system.Container).runDue(ctx)
+
+	var status string
+	err = db.QueryRow(`SELECT status FROM public.flag_schedule WHERE schedule_id = 'due'`).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, string(ScheduleStatusFailed), status)
+
+	var (
+		enabled        bool
+		defaultVariant sql.NullString
+		versions       int
+	)
+	err = db.QueryRow(`SELECT enabled, default_variant FROM public.flag WHERE id = 2`).Scan(&enabled, &defaultVariant)
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+	assert.False(t, defaultVariant.Valid)
+
+	err = db.QueryRow(`SELECT count(*) FROM public.flag_history WHERE flag_id = 2`).Scan(&versions)
+	assert.NoError(t, err)
+	assert.Zero(t, versions)
+}
+
+func TestOFREPPrerequisiteEvaluation(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// feature-flag-3 is on but depends on feature-flag-2, which is off
+	_, err = db.Exec(`INSERT INTO public.flag_prerequisite (flag_id, prerequisite_flag_id) VALUES (3, 2)`)
+	assert.NoError(t, err)
+
+	system, ofrepSystem := setupTestSystem(t)
+
+	body, _ := json.Marshal(EvaluationRequest{Context: EvaluationContext{TargetingKey: "user-123"}})
+	req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-3", bytes.NewReader(body))
+	req.Header.Set("x-project-id", "test-project-1")
+	req.Header.Set("x-agent-id", "test-agent-1")
+	req.Header.Set("x-environment-id", "test-env-1")
+	req.SetPathValue("key", "feature-flag-3")
+
+	w := httptest.NewRecorder()
+	ofrepSystem.EvaluateSingleFlag(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response SuccessEvaluationResponse
+	err = json.NewDecoder(w.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, false, response.Value)
+	assert.Equal(t, ReasonDefault, response.Reason)
+	assert.Equal(t, "feature-flag-2", response.Metadata["prerequisiteFailed"])
+
+	res, err := system.GetAgentFlagsFromDB(ctx, "test-project-1", "test-agent-1", "test-env-1")
+	assert.NoError(t, err)
+	for _, flag := range res.Flags {
+		if flag.Details.Name == "feature-flag-3" {
+			assert.False(t, flag.Enabled)
+			assert.Equal(t, false, flag.Value)
+		}
+	}
+
+	dependents, err := system.GetDependentFlagsFromDB(ctx, "2")
+	assert.NoError(t, err)
+	assert.Len(t, dependents, 1)
+	assert.Equal(t, "feature-flag-3", dependents[0].Details.Name)
+}
+
+func TestFlagMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, ofrepSystem := setupTestSystem(t)
+
+	err = system.UpdateFlagMetadataInDB(ctx, "1", FlagMetadataRequest{
+		Description: "New checkout flow",
+		Tags:        []string{"checkout", "q3"},
+		OwnerID:     "test-user-subject",
+		Kind:        FlagKindRelease,
+		Links:       []FlagLink{{Title: "Ticket", URL: "https://example.com/FLAG-1"}},
+	})
+	assert.NoError(t, err)
+
+	flag, err := system.GetFlagFromDB(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "New checkout flow", flag.Details.Description)
+	assert.Equal(t, []string{"checkout", "q3"}, flag.Details.Tags)
+	assert.Equal(t, FlagKindRelease, flag.Details.Kind)
+	if assert.NotNil(t, flag.Details.Owner) {
+		assert.Equal(t, "test-user-subject", flag.Details.Owner.Subject)
+		assert.Equal(t, "Tester", flag.Details.Owner.KnownAs)
+	}
+
+	tagged, err := system.GetCompanyFlagsFromDB(ctx, "test-company-1", FlagFilter{Tag: "Checkout"})
+	assert.NoError(t, err)
+	assert.Len(t, tagged, 1)
+	assert.Equal(t, "feature-flag-1", tagged[0].Flag.Details.Name)
+
+	owned, err := system.GetCompanyFlagsFromDB(ctx, "test-company-1", FlagFilter{Owner: "someone-else"})
+	assert.NoError(t, err)
+	assert.Empty(t, owned)
+
+	all, err := system.GetCompanyFlagsFromDB(ctx, "test-company-1", FlagFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-1", bytes.NewReader([]byte(`{"context":{}}`)))
+	req.Header.Set("x-project-id", "test-project-1")
+	req.Header.Set("x-agent-id", "test-agent-1")
+	req.Header.Set("x-environment-id", "test-env-1")
+	req.SetPathValue("key", "feature-flag-1")
+
+	w := httptest.NewRecorder()
+	ofrepSystem.EvaluateSingleFlag(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response SuccessEvaluationResponse
+	err = json.NewDecoder(w.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, "New checkout flow", response.Metadata["description"])
+	assert.Equal(t, "checkout,q3", response.Metadata["tags"])
+	assert.Equal(t, "release", response.Metadata["kind"])
+	assert.Equal(t, "test-user-subject", response.Metadata["owner"])
+	// the sdk knows the flag by the id GET /flags serves it with, not the stored one
+	assert.Equal(t, publicFlagId("1"), response.Metadata["flagId"])
+}
+
+func TestFlagHistoryAndRollback(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	changeCtx := WithChange(ctx, "test-user-subject", "PUT /flags/{flagId}")
+
+	err = system.UpdateFlagInDB(changeCtx, Flag{Enabled: false, Details: Details{ID: "1", Name: "feature-flag-1"}})
+	assert.NoError(t, err)
+	err = system.EditFlagInDB(changeCtx, FlagNameChangeRequest{ID: "1", Name: "renamed-flag"})
+	assert.NoError(t, err)
+
+	// saving the same state again isn't a new version
+	err = system.EditFlagInDB(changeCtx, FlagNameChangeRequest{ID: "1", Name: "renamed-flag"})
+	assert.NoError(t, err)
+
+	versions, err := system.GetFlagHistoryFromDB(ctx, "1")
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, 2, versions[0].Version)
+		assert.Equal(t, "feature-flag-1", versions[0].Before.Name)
+		assert.Equal(t, "renamed-flag", versions[0].After.Name)
+		assert.Equal(t, 1, versions[1].Version)
+		assert.True(t, versions[1].Before.Enabled)
+		assert.False(t, versions[1].After.Enabled)
+		assert.Equal(t, "test-user-subject", versions[1].Actor)
+		assert.Equal(t, "PUT /flags/{flagId}", versions[1].Source)
+	}
+
+	err = system.RollbackFlagInDB(WithChange(ctx, "test-user-subject", "POST /flag/{flagId}/rollback/{version}"), "1", 1)
+	assert.NoError(t, err)
+
+	flag, err := system.GetFlagFromDB(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "feature-flag-1", flag.Details.Name)
+	assert.False(t, flag.Enabled)
+
+	versions, err = system.GetFlagHistoryFromDB(ctx, "1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, "POST /flag/{flagId}/rollback/{version}", versions[0].Source)
+
+	err = system.RollbackFlagInDB(ctx, "1", 42)
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+
+	err = system.DeleteFlagFromDB(changeCtx, Flag{Details: Details{ID: "1"}})
+	assert.NoError(t, err)
+	versions, err = system.GetFlagHistoryFromDB(ctx, "1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+	assert.Nil(t, versions[0].After)
+}
+
+func TestFlagDefinitionAcrossEnvironments(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	_, err = db.Exec(`INSERT INTO public.environment (env_id, agent_id, name) VALUES ('test-env-2', 1, 'Second Environment')`)
+	assert.NoError(t, err)
+
+	system, _ := setupTestSystem(t)
+
+	// creating the flag in another environment reuses its definition
+	err = system.CreateFlagInDB(ctx, flagCreate{Name: "feature-flag-1", AgentId: "test-agent-1", EnvironmentId: "test-env-2"})
+	assert.NoError(t, err)
+	err = system.CreateFlagInDB(ctx, flagCreate{Name: "feature-flag-1", AgentId: "test-agent-1", EnvironmentId: "test-env-2"})
+	assert.ErrorIs(t, err, ErrFlagExists)
+	err = system.CreateFlagInDB(ctx, flagCreate{
+		Name:           "feature-flag-2",
+		AgentId:        "test-agent-1",
+		EnvironmentId:  "test-env-2",
+		Type:           FlagTypeString,
+		Variants:       []Variant{{Name: "a", Value: "a"}, {Name: "b", Value: "b"}},
+		DefaultVariant: "a",
+		OffVariant:     "b",
+	})
+	assert.ErrorIs(t, err, ErrDefinitionMismatch)
+
+	var definitions int
+	err = db.QueryRow(`SELECT COUNT(*) FROM public.flag_definition WHERE name = 'feature-flag-1'`).Scan(&definitions)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, definitions)
+
+	// renaming and metadata in one environment show in the other, the state stays per environment
+	err = system.EditFlagInDB(ctx, FlagNameChangeRequest{ID: "1", Name: "checkout"})
+	assert.NoError(t, err)
+	err = system.UpdateFlagMetadataInDB(ctx, "1", FlagMetadataRequest{Description: "Checkout flow", Tags: []string{"checkout"}})
+	assert.NoError(t, err)
+
+	entries, err := system.GetCompanyFlagsFromDB(ctx, "test-company-1", FlagFilter{Tag: "checkout"})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		for _, entry := range entries {
+			assert.Equal(t, "checkout", entry.Flag.Details.Name)
+			assert.Equal(t, "Checkout flow", entry.Flag.Details.Description)
+		}
+	}
+
+	var copyId string
+	err = db.QueryRow(`SELECT id::text FROM public.flag WHERE environment_id = 2`).Scan(&copyId)
+	assert.NoError(t, err)
+	flag, err := system.GetFlagFromDB(ctx, copyId)
+	assert.NoError(t, err)
+	assert.Equal(t, "checkout", flag.Details.Name)
+	assert.False(t, flag.Enabled)
+
+	versions, err := system.GetFlagHistoryFromDB(ctx, copyId)
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, "checkout", versions[0].After.Name)
+	}
+
+	// a name can only be used once per agent
+	err = system.EditFlagInDB(ctx, FlagNameChangeRequest{ID: "2", Name: "checkout"})
+	assert.ErrorIs(t, err, ErrFlagNameTaken)
+
+	// deleting removes the flag from every environment
+	err = system.DeleteFlagFromDB(ctx, Flag{Details: Details{ID: copyId}})
+	assert.NoError(t, err)
+	var remaining int
+	err = db.QueryRow(`SELECT COUNT(*) FROM public.flag WHERE id IN (1, $1)`, copyId).Scan(&remaining)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, remaining)
+
+	// emptying an environment drops the definitions only it had, a flag made later with the name starts afresh
+	err = system.CreateFlagInDB(ctx, flagCreate{Name: "second-only", AgentId: "test-agent-1", EnvironmentId: "test-env-2"})
+	assert.NoError(t, err)
+	err = system.CreateFlagInDB(ctx, flagCreate{Name: "feature-flag-2", AgentId: "test-agent-1", EnvironmentId: "test-env-2"})
+	assert.NoError(t, err)
+	err = system.DeleteAllFlagsForEnv(ctx, "test-env-2")
+	assert.NoError(t, err)
+
+	err = db.QueryRow(`SELECT COUNT(*) FROM public.flag_definition WHERE name IN ('second-only', 'feature-flag-2')`).Scan(&definitions)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, definitions)
+	err = system.CreateFlagInDB(ctx, flagCreate{
+		Name:           "second-only",
+		AgentId:        "test-agent-1",
+		EnvironmentId:  "test-env-2",
+		Type:           FlagTypeString,
+		Variants:       []Variant{{Name: "a", Value: "a"}, {Name: "b", Value: "b"}},
+		DefaultVariant: "a",
+		OffVariant:     "b",
+	})
+	assert.NoError(t, err)
+}
+
+func TestBatchFlagsInDB(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	system, _ := setupTestSystem(t)
+	operations := []BatchOperation{
+		{Action: BatchUpdate, FlagID: "2", Enabled: true},
+		{Action: BatchCreate, Flag: &flagCreate{Name: "feature-flag-1", AgentId: "test-agent-1", EnvironmentId: "test-env-1"}},
+		{Action: BatchCreate, Flag: &flagCreate{Name: "feature-flag-4", AgentId: "test-agent-1", EnvironmentId: "test-env-1"}},
+	}
+
+	// the duplicate flag rolls the whole batch back
+	response, err := system.RunBatchInDB(ctx, BatchRequest{Operations: operations})
+	assert.NoError(t, err)
+	assert.False(t, response.Committed)
+	if assert.Len(t, response.Results, 2) {
+		assert.True(t, response.Results[0].Success)
+		assert.Equal(t, ErrFlagExists.Error(), response.Results[1].Error)
+	}
+
+	var enabled bool
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 2`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	// continuing on error keeps everything but the duplicate
+	response, err = system.RunBatchInDB(ctx, BatchRequest{Operations: operations, ContinueOnError: true})
+	assert.NoError(t, err)
+	assert.True(t, response.Committed)
+	if assert.Len(t, response.Results, 3) {
+		assert.True(t, response.Results[0].Success)
+		assert.False(t, response.Results[1].Success)
+		assert.True(t, response.Results[2].Success)
+		assert.NotEmpty(t, response.Results[2].FlagID)
+	}
+
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 2`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	var flags int
+	err = db.QueryRow(`SELECT COUNT(*) FROM public.flag WHERE environment_id = 1`).Scan(&flags)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, flags)
+}
+
+func TestPromoteEnvironmentInDB(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	_, err = db.Exec(`
+		INSERT INTO public.environment (env_id, agent_id, name) VALUES ('test-env-2', 1, 'Production');
+		INSERT INTO public.environment_chain (agent_id, parent_environment_id, child_environment_id) VALUES (1, 1, 2);
+		INSERT INTO public.flag_prerequisite (flag_id, prerequisite_flag_id) VALUES (3, 1);`)
+	assert.NoError(t, err)
+
+	system, _ := setupTestSystem(t)
+
+	// promoting the same flag twice updates the copy rather than failing
+	err = system.PromoteFlagInDB(ctx, "1")
+	assert.NoError(t, err)
+	err = system.PromoteFlagInDB(ctx, "1")
+	assert.NoError(t, err)
+
+	_, err = db.Exec(`UPDATE public.flag SET enabled = false WHERE id = 1`)
+	assert.NoError(t, err)
+
+	preview, err := system.PromoteEnvironmentInDB(ctx, "test-env-1", EnvironmentPromotion{DryRun: true, Exclude: []string{"feature-flag-2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "test-env-2", preview.TargetEnvironmentID)
+	if assert.Len(t, preview.Changes, 2) {
+		assert.Equal(t, "feature-flag-1", preview.Changes[0].Flag)
+		assert.Equal(t, PromotionUpdate, preview.Changes[0].Action)
+		assert.Equal(t, []string{"enabled"}, preview.Changes[0].Fields)
+		assert.Equal(t, "feature-flag-3", preview.Changes[1].Flag)
+		assert.Equal(t, PromotionCreate, preview.Changes[1].Action)
+	}
+
+	var flags int
+	err = db.QueryRow(`SELECT COUNT(*) FROM public.flag WHERE environment_id = 2`).Scan(&flags)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, flags)
+
+	result, err := system.PromoteEnvironmentInDB(ctx, "test-env-1", EnvironmentPromotion{Exclude: []string{"feature-flag-2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, preview.Changes, result.Changes)
+
+	err = db.QueryRow(`SELECT COUNT(*) FROM public.flag WHERE environment_id = 2`).Scan(&flags)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, flags)
+
+	var prerequisites int
+	err = db.QueryRow(`
+		SELECT COUNT(*)
+		FROM public.flag_prerequisite pre
+			JOIN public.flag f ON f.id = pre.flag_id
+			JOIN public.flag p ON p.id = pre.prerequisite_flag_id
+		WHERE f.environment_id = 2 AND p.environment_id = 2`).Scan(&prerequisites)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, prerequisites)
+
+	_, err = system.PromoteEnvironmentInDB(ctx, "test-env-1", EnvironmentPromotion{Include: []string{"missing-flag"}})
+	assert.ErrorIs(t, err, ErrInvalidPromotion)
+	_, err = system.PromoteEnvironmentInDB(ctx, "test-env-2", EnvironmentPromotion{})
+	assert.ErrorIs(t, err, ErrNoChildEnvironment)
+}
+
+func TestChangeRequestApproval(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	_, err = db.Exec(`
+		INSERT INTO public."user" (subject, email_address, first_name, last_name, known_as)
+		VALUES ('test-reviewer-subject', 'reviewer@example.com', 'Test', 'Reviewer', 'Reviewer');
+		INSERT INTO public.company_user (company_id, user_id) VALUES (1, 2);
+		UPDATE public.environment SET requires_approval = true WHERE id = 1;`)
+	assert.NoError(t, err)
+
+	system, _ := setupTestSystem(t)
+
+	required, err := system.RequiredApprovalsFromDB(ctx, "2", ChangeUpdate, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, required)
+
+	request, err := system.CreateChangeRequestInDB(ctx, "2", ChangeUpdate, flagUpdate{Enabled: true}, required, "test-user-subject")
+	assert.NoError(t, err)
+	assert.Equal(t, ChangePending, request.Status)
+	assert.Equal(t, "feature-flag-2", request.Flag)
+
+	// the change waits on review
+	var enabled bool
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 2`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	_, err = system.ReviewChangeRequestInDB(ctx, "test-company-1", request.ID, "test-user-subject", ReviewApprove, "")
+	assert.ErrorIs(t, err, ErrAuthorCannotReview)
+
+	reviewed, err := system.ReviewChangeRequestInDB(ctx, "test-company-1", request.ID, "test-reviewer-subject", ReviewApprove, "looks good")
+	assert.NoError(t, err)
+	assert.Equal(t, ChangeApplied, reviewed.Status)
+	if assert.Len(t, reviewed.Reviews, 1) {
+		assert.Equal(t, "test-reviewer-subject", reviewed.Reviews[0].Reviewer)
+	}
+
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 2`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	_, err = system.ReviewChangeRequestInDB(ctx, "test-company-1", request.ID, "test-reviewer-subject", ReviewReject, "")
+	assert.ErrorIs(t, err, ErrChangeRequestResolved)
+	_, err = system.ReviewChangeRequestInDB(ctx, "other-company", request.ID, "test-reviewer-subject", ReviewApprove, "")
+	assert.ErrorIs(t, err, ErrChangeRequestNotFound)
+
+	var notified int
+	err = db.QueryRow(`SELECT COUNT(DISTINCT user_id) FROM public.user_notifications`).Scan(&notified)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, notified)
+
+	_, err = system.RunBatchInDB(ctx, BatchRequest{
+		Operations: []BatchOperation{{Action: BatchUpdate, FlagID: "1", Enabled: false}},
+	})
+	assert.NoError(t, err)
+	err = db.QueryRow(`SELECT enabled FROM public.flag WHERE id = 1`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+}
+
+func TestStaleFlags(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	db, err := sql.Open("postgres", testDB.uri)
+	assert.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	_, err = db.Exec(`
+		UPDATE public.flag SET updated_at = now() - interval '60 days';
+		UPDATE public.flag_definition SET updated_at = now() - interval '60 days';`)
+	assert.NoError(t, err)
+
+	system, _ := setupTestSystem(t)
+
+	stale, err := system.GetStaleFlagsFromDB(ctx, "test-company-1", 30)
+	assert.NoError(t, err)
+	assert.Len(t, stale, 3)
+
+	// a lookup evaluates one flag, a fetch serves them all by name
+	err = system.RecordFlagEvaluationsInDB(ctx, map[string]int64{"1": 1})
+	assert.NoError(t, err)
+	err = system.RecordFlagsServedInDB(ctx, "test-agent-1", "test-env-1", []Flag{{Details: Details{Name: "feature-flag-2"}}})
+	assert.NoError(t, err)
+
+	stale, err = system.GetStaleFlagsFromDB(ctx, "test-company-1", 30)
+	assert.NoError(t, err)
+	if assert.Len(t, stale, 1) {
+		assert.Equal(t, "feature-flag-3", stale[0].Flag.Details.Name)
+		assert.Equal(t, "test-env-1", stale[0].Environment.EnvironmentId)
+		assert.Nil(t, stale[0].LastUsed)
+	}
+
+	var evaluations, served int
+	err = db.QueryRow(`SELECT evaluations, served FROM public.flag_evaluation WHERE flag_id = 1`).Scan(&evaluations, &served)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, evaluations)
+	assert.Equal(t, 0, served)
+}
+
+func TestAgentFlagsSince(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	getFlags := func(since string) (int, AgentResponse) {
+		target := "/flags"
+		if since != "" {
+			target += "?since=" + since
+		}
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("x-project-id", "test-project-1")
+		req.Header.Set("x-agent-id", "test-agent-1")
+		req.Header.Set("x-environment-id", "test-env-1")
+		w := httptest.NewRecorder()
+		system.GetAgentFlags(w, req)
+
+		var res AgentResponse
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		}
+		return w.Code, res
+	}
+
+	code, full := getFlags("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Positive(t, full.Revision)
+	assert.False(t, full.Partial)
+	assert.Len(t, full.Flags, 3)
+	for _, flag := range full.Flags {
+		assert.NotEmpty(t, flag.Details.LastChanged)
+	}
+
+	// ids are the same on every read
+	_, again := getFlags("")
+	assert.Equal(t, full.Flags[0].Details.ID, again.Flags[0].Details.ID)
+
+	changeCtx := WithChange(ctx, "test-user-subject", "PATCH /flag/{flagId}")
+	err = system.UpdateFlagInDB(changeCtx, Flag{Enabled: false, Details: Details{ID: "1", Name: "feature-flag-1"}})
+	assert.NoError(t, err)
+	err = system.DeleteFlagFromDB(changeCtx, Flag{Details: Details{ID: "2"}})
+	assert.NoError(t, err)
+
+	code, changes := getFlags(strconv.FormatInt(full.Revision, 10))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Greater(t, changes.Revision, full.Revision)
+	assert.True(t, changes.Partial)
+	if assert.Len(t, changes.Flags, 1) {
+		assert.Equal(t, "feature-flag-1", changes.Flags[0].Details.Name)
+		assert.False(t, changes.Flags[0].Enabled)
+	}
+	assert.Equal(t, []string{"feature-flag-2"}, changes.Deleted)
+
+	_, current := getFlags(strconv.FormatInt(changes.Revision, 10))
+	assert.True(t, current.Partial)
+	assert.Empty(t, current.Flags)
+	assert.Empty(t, current.Deleted)
+
+	// a client ahead of the environment starts over
+	_, ahead := getFlags(strconv.FormatInt(changes.Revision+100, 10))
+	assert.False(t, ahead.Partial)
+	assert.Len(t, ahead.Flags, 2)
+
+	code, _ = getFlags("yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestOFREPExtractCredentials(t *testing.T) {
+	c := ConfigBuilder.NewConfigNoVault()
+	if err := c.Build(ConfigBuilder.Bugfixes); err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	ofrepSystem := NewOFREPSystem(&container.Container{Config: c, Keys: keyring.Development()})
+	apiKeySystem := NewAPIKeySystem(ofrepSystem.Container)
+	envKey := signTestAPIKey(t, apiKeySystem, &APIKey{ProjectID: "test-project-1", AgentID: "test-agent-1", EnvironmentID: "test-env-1"})
+	agentKey := signTestAPIKey(t, apiKeySystem, &APIKey{ProjectID: "test-project-1", AgentID: "test-agent-1"})
+	writeKey := signTestAPIKey(t, apiKeySystem, &APIKey{ProjectID: "test-project-1", AgentID: "test-agent-1", Scopes: []string{"flags:write"}})
+
+	tests := []struct {
+		name          string
+		headers       map[string]string
+		environmentId string
+		expectedErr   error
+	}{
+		{
+			name:          "API key",
+			headers:       map[string]string{"X-API-Key": envKey},
+			environmentId: "test-env-1",
+		},
+		{
+			name:          "API key with matching headers",
+			headers:       map[string]string{"X-API-Key": envKey, "x-project-id": "test-project-1", "x-agent-id": "test-agent-1"},
+			environmentId: "test-env-1",
+		},
+		{
+			name:          "Agent key pointed at an environment",
+			headers:       map[string]string{"X-API-Key": agentKey, "x-environment-id": "test-env-2"},
+			environmentId: "test-env-2",
+		},
+		{
+			name:        "API key for another project",
+			headers:     map[string]string{"X-API-Key": envKey, "x-project-id": "test-project-2"},
+			expectedErr: ErrAPIKeyMismatch,
+		},
+		{
+			name:        "API key for another environment",
+			headers:     map[string]string{"X-API-Key": envKey, "x-environment-id": "test-env-2"},
+			expectedErr: ErrAPIKeyMismatch,
+		},
+		{
+			name:        "Invalid API key doesn't fall back to the headers",
+			headers:     map[string]string{"X-API-Key": "invalid.jwt.token", "x-project-id": "test-project-1", "x-agent-id": "test-agent-1"},
+			expectedErr: ErrInvalidAPIKey,
+		},
+		{
+			name:        "API key without the scope",
+			headers:     map[string]string{"X-API-Key": writeKey},
+			expectedErr: ErrAPIKeyScope,
+		},
+		{
+			name:        "Nothing",
+			headers:     map[string]string{"x-project-id": "test-project-1"},
+			expectedErr: ErrMissingCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags", nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			projectId, agentId, environmentId, err := ofrepSystem.extractCredentials(req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "test-project-1", projectId)
+			assert.Equal(t, "test-agent-1", agentId)
+			assert.Equal(t, tt.environmentId, environmentId)
+		})
+	}
+}
+
+func TestOFREPConfiguration(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	_, ofrepSystem := setupTestSystem(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/ofrep/v1/configuration", nil)
+	req.Header.Set("x-project-id", "test-project-1")
+	req.Header.Set("x-agent-id", "test-agent-1")
+	w := httptest.NewRecorder()
+	ofrepSystem.GetConfiguration(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	var configuration ConfigurationResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&configuration))
+	assert.True(t, configuration.Capabilities.CacheInvalidation.Polling.Enabled)
+	assert.Equal(t, int64(60000), configuration.Capabilities.CacheInvalidation.Polling.MinPollingIntervalMs)
+	assert.Empty(t, configuration.Capabilities.FlagEvaluation.UnsupportedTypes)
+
+	unauthorized := httptest.NewRecorder()
+	ofrepSystem.GetConfiguration(unauthorized, httptest.NewRequest(http.MethodGet, "/ofrep/v1/configuration", nil))
+	assert.Equal(t, http.StatusUnauthorized, unauthorized.Code)
+}
+
+func TestDisabledEnvironmentServesFlagsOff(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, ofrepSystem := setupTestSystem(t)
+
+	tests := []struct {
+		name    string
+		disable string
+	}{
+		{name: "project", disable: `UPDATE public.project SET enabled = false`},
+		{name: "agent", disable: `UPDATE public.agent SET enabled = false`},
+		{name: "environment", disable: `UPDATE public.environment SET enabled = false`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := system.DB.Exec(ctx, tt.disable)
+			assert.NoError(t, err)
+			defer func() {
+				_, err := system.DB.Exec(ctx, `
+					UPDATE public.project SET enabled = true;
+					UPDATE public.agent SET enabled = true;
+					UPDATE public.environment SET enabled = true;`)
+				assert.NoError(t, err)
+				system.agentCache().clear()
+			}()
+			system.agentCache().clear()
+
+			body, _ := json.Marshal(EvaluationRequest{Context: EvaluationContext{TargetingKey: "user-123"}})
+			req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags/feature-flag-1", bytes.NewReader(body))
+			req.SetPathValue("key", "feature-flag-1")
+			req.Header.Set("x-project-id", "test-project-1")
+			req.Header.Set("x-agent-id", "test-agent-1")
+			req.Header.Set("x-environment-id", "test-env-1")
+			w := httptest.NewRecorder()
+			ofrepSystem.EvaluateSingleFlag(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var response SuccessEvaluationResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			assert.Equal(t, ReasonDisabled, response.Reason)
+			assert.Equal(t, false, response.Value)
+
+			req = httptest.NewRequest(http.MethodGet, "/flags?since=1", nil)
+			req.Header.Set("x-project-id", "test-project-1")
+			req.Header.Set("x-agent-id", "test-agent-1")
+			req.Header.Set("x-environment-id", "test-env-1")
+			w = httptest.NewRecorder()
+			system.GetAgentFlags(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var agentResponse AgentResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&agentResponse))
+			assert.True(t, agentResponse.Disabled)
+			assert.False(t, agentResponse.Partial)
+			assert.Equal(t, disabledIntervalAllowed, agentResponse.IntervalAllowed)
+			assert.Len(t, agentResponse.Flags, 3)
+			for _, flag := range agentResponse.Flags {
+				assert.False(t, flag.Enabled)
+			}
+		})
+	}
+}
+
+func TestCrossTenantFlagAccess(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+
+	// a second company the test user isn't part of
+	_, err = system.DB.Exec(ctx, `
+		INSERT INTO public.company (company_id, name)
+		VALUES ('test-company-2', 'Other Company');
+
+		INSERT INTO public.project (company_id, project_id, name)
+		SELECT id, 'other-project', 'Other Project' FROM public.company WHERE company_id = 'test-company-2';
+
+		INSERT INTO public.agent (agent_id, project_id, name)
+		SELECT 'other-agent', id, 'Other Agent' FROM public.project WHERE project_id = 'other-project';
+
+		INSERT INTO public.environment (env_id, agent_id, name, "default")
+		SELECT 'other-env', id, 'Other Environment', true FROM public.agent WHERE agent_id = 'other-agent';
+
+		INSERT INTO public.flag_definition (agent_id, name)
+		SELECT id, 'other-flag' FROM public.agent WHERE agent_id = 'other-agent';
+
+		INSERT INTO public.flag (definition_id, enabled, agent_id, environment_id)
+		SELECT def.id, true, def.agent_id, env.id
+		FROM public.flag_definition def
+		  JOIN public.environment env ON env.agent_id = def.agent_id
+		WHERE def.name = 'other-flag';`)
+	assert.NoError(t, err)
+
+	var otherFlagId string
+	err = system.DB.QueryRow(ctx, `
+		SELECT f.id::text
+		FROM public.flag f
+		  JOIN public.flag_definition def ON def.id = f.definition_id
+		WHERE def.name = 'other-flag'`).Scan(&otherFlagId)
+	assert.NoError(t, err)
+
+	encode := func(v interface{}) []byte {
+		body, _ := json.Marshal(v)
+		return body
+	}
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+		path    map[string]string
+		body    []byte
+	}{
+		{name: "update", method: http.MethodPatch, handler: system.UpdateFlags, path: map[string]string{"flagId": otherFlagId}, body: encode(flagUpdate{Enabled: false, Name: "other-flag"})},
+		{name: "edit", method: http.MethodPut, handler: system.EditFlag, path: map[string]string{"flagId": otherFlagId}, body: encode(FlagNameChangeRequest{Name: "renamed"})},
+		{name: "delete", method: http.MethodDelete, handler: system.DeleteFlags, path: map[string]string{"flagId": otherFlagId}},
+		{name: "promote", method: http.MethodPost, handler: system.PromoteFlag, path: map[string]string{"flagId": otherFlagId}},
+		{name: "targeting", method: http.MethodPut, handler: system.UpdateTargeting, path: map[string]string{"flagId": otherFlagId}, body: []byte(`{"rules":[]}`)},
+		{name: "rollout", method: http.MethodPut, handler: system.UpdateRollout, path: map[string]string{"flagId": otherFlagId}, body: []byte(`null`)},
+		{name: "history", method: http.MethodGet, handler: system.GetFlagHistory, path: map[string]string{"flagId": otherFlagId}},
+		{name: "schedules", method: http.MethodGet, handler: system.GetSchedules, path: map[string]string{"flagId": otherFlagId}},
+		{name: "environment flags", method: http.MethodGet, handler: system.GetClientFlags, path: map[string]string{"environmentId": "other-env"}},
+		{name: "promote environment", method: http.MethodPost, handler: system.PromoteEnvironment, path: map[string]string{"environmentId": "other-env"}},
+		{name: "create in another agent", method: http.MethodPost, handler: system.CreateFlags, body: encode(flagCreate{Name: "new-flag", AgentId: "other-agent", EnvironmentId: "other-env"})},
+		{name: "create in another environment", method: http.MethodPost, handler: system.CreateFlags, body: encode(flagCreate{Name: "new-flag", AgentId: "test-agent-1", EnvironmentId: "other-env"})},
+		{name: "batch", method: http.MethodPost, handler: system.BatchFlags, body: encode(BatchRequest{Operations: []BatchOperation{
+			{Action: BatchUpdate, FlagID: "1", Enabled: true, Name: "feature-flag-1"},
+			{Action: BatchDelete, FlagID: otherFlagId},
+		}})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", bytes.NewReader(tt.body))
+			for name, value := range tt.path {
+				req.SetPathValue(name, value)
+			}
+			req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+			w := httptest.NewRecorder()
+			tt.handler(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		})
+	}
+
+	// none of it reached the other company's flag
+	var (
+		name    string
+		enabled bool
+	)
+	err = system.DB.QueryRow(ctx, `
+		SELECT def.name, f.enabled
+		FROM public.flag f
+		  JOIN public.flag_definition def ON def.id = f.definition_id
+		WHERE f.id = $1`, otherFlagId).Scan(&name, &enabled)
+	assert.NoError(t, err)
+	assert.Equal(t, "other-flag", name)
+	assert.True(t, enabled)
+
+	var created int
+	err = system.DB.QueryRow(ctx, `SELECT count(*) FROM public.flag_definition WHERE name = 'new-flag'`).Scan(&created)
+	assert.NoError(t, err)
+	assert.Zero(t, created)
+
+	// the company's own flags are still its to change
+	req := httptest.NewRequest(http.MethodPatch, "/flag/2", bytes.NewReader(encode(flagUpdate{Enabled: true, Name: "feature-flag-2"})))
+	req.SetPathValue("flagId", "2")
+	req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+	w := httptest.NewRecorder()
+	system.UpdateFlags(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestApprovalBlocksChangesThatCantBeHeld(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+
+	_, err = system.DB.Exec(ctx, `
+		UPDATE public.environment SET requires_approval = true WHERE id = 1;
+
+		INSERT INTO public.flag_schedule (schedule_id, flag_id, run_at, enabled)
+		VALUES ('due', 2, now() - interval '1 minute', true)`)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+		path    map[string]string
+		body    []byte
+	}{
+		{name: "rollback", method: http.MethodPost, handler: system.RollbackFlag, path: map[string]string{"flagId": "2", "version": "1"}},
+		{name: "schedule", method: http.MethodPost, handler: system.CreateSchedule, path: map[string]string{"flagId": "2"}, body: []byte(`{"enabled":true,"runAt":"2099-01-01T00:00:00Z"}`)},
+		{name: "targeting", method: http.MethodPut, handler: system.UpdateTargeting, path: map[string]string{"flagId": "2"}, body: []byte(`{"rules":[]}`)},
+		{name: "rollout", method: http.MethodPut, handler: system.UpdateRollout, path: map[string]string{"flagId": "2"}, body: []byte(`null`)},
+		{name: "prerequisites", method: http.MethodPut, handler: system.UpdatePrerequisites, path: map[string]string{"flagId": "2"}, body: []byte(`{"prerequisites":[]}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", bytes.NewReader(tt.body))
+			for name, value := range tt.path {
+				req.SetPathValue(name, value)
+			}
+			req.Header.Set("x-user-subject", "ignored-in-dev-mode")
+			w := httptest.NewRecorder()
+			tt.handler(w, req)
+
+			assert.Equal(t, http.StatusConflict, w.Code)
+		})
+	}
+
+	// a schedule made before the environment was protected isn't applied either
+	NewScheduler(system.Container).runDue(ctx)
+
+	var status string
+	err = system.DB.QueryRow(ctx, `SELECT status FROM public.flag_schedule WHERE schedule_id = 'due'`).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, string(ScheduleStatusFailed), status)
+
+	var (
+		enabled   bool
+		versions  int
+		schedules int
+	)
+	err = system.DB.QueryRow(ctx, `SELECT enabled FROM public.flag WHERE id = 2`).Scan(&enabled)
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	err = system.DB.QueryRow(ctx, `SELECT count(*) FROM public.flag_history WHERE flag_id = 2`).Scan(&versions)
+	assert.NoError(t, err)
+	assert.Zero(t, versions)
+
+	err = system.DB.QueryRow(ctx, `SELECT count(*) FROM public.flag_schedule WHERE flag_id = 2`).Scan(&schedules)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, schedules)
+}
+
+func TestOFREPHeaderCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	ofrepSystem := NewOFREPSystem(system.Container)
+
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		expectedErr error
+	}{
+		{
+			name:    "Agent of the project",
+			headers: map[string]string{"x-project-id": "test-project-1", "x-agent-id": "test-agent-1"},
+		},
+		{
+			name:    "Environment of the agent",
+			headers: map[string]string{"x-project-id": "test-project-1", "x-agent-id": "test-agent-1", "x-environment-id": "test-env-1"},
+		},
+		{
+			name:        "Made up agent",
+			headers:     map[string]string{"x-project-id": "test-project-1", "x-agent-id": "made-up-agent"},
+			expectedErr: ErrUnknownAgent,
+		},
+		{
+			name:        "Agent of another project",
+			headers:     map[string]string{"x-project-id": "made-up-project", "x-agent-id": "test-agent-1"},
+			expectedErr: ErrUnknownAgent,
+		},
+		{
+			name:        "Environment of another agent",
+			headers:     map[string]string{"x-project-id": "test-project-1", "x-agent-id": "test-agent-1", "x-environment-id": "made-up-env"},
+			expectedErr: ErrUnknownAgent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ofrep/v1/evaluate/flags", nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			projectId, agentId, environmentId, err := ofrepSystem.extractCredentials(req)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.headers["x-project-id"], projectId)
+			assert.Equal(t, tt.headers["x-agent-id"], agentId)
+			assert.Equal(t, tt.headers["x-environment-id"], environmentId)
+		})
+	}
+}
+
+func TestAgentFlagsCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	testDB, err := setupTestDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer func() {
+		if err := testDB.container.Terminate(ctx); err != nil {
+			t.Errorf("Failed to terminate container: %v", err)
+		}
+	}()
+
+	system, _ := setupTestSystem(t)
+	apiKeySystem := NewAPIKeySystem(system.Container)
+	environmentKey := generateTestAPIKey(t, apiKeySystem, "test-project-1", "test-agent-1", "test-env-1")
+
+	// GET /flags takes the credentials OFREP does, so the two can't serve different agents
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{
+			name:           "Agent of the project",
+			headers:        map[string]string{"x-project-id": "test-project-1", "x-agent-id": "test-agent-1", "x-environment-id": "test-env-1"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Key of the agent",
+			headers:        map[string]string{"X-API-Key": environmentKey},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "No credentials",
+			headers:        map[string]string{},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Made up agent",
+			headers:        map[string]string{"x-project-id": "test-project-1", "x-agent-id": "made-up-agent"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Environment of another agent",
+			headers:        map[string]string{"x-project-id": "test-project-1", "x-agent-id": "test-agent-1", "x-environment-id": "made-up-env"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Key for another environment",
+			headers:        map[string]string{"X-API-Key": environmentKey, "x-environment-id": "made-up-env"},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/flags", nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			w := httptest.NewRecorder()
+			system.GetAgentFlags(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
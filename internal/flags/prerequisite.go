@@ -0,0 +1,171 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Prerequisite is another flag in the same environment that has to be on, and serving Variant when set, for this flag to be evaluated
+type Prerequisite struct {
+	FlagID  string `json:"flagId"`
+	Flag    string `json:"flag,omitempty"`
+	Variant string `json:"variant,omitempty"`
+}
+
+var (
+	ErrInvalidPrerequisite = errors.New("invalid prerequisite")
+	ErrPrerequisiteCycle   = errors.New("prerequisites form a cycle")
+	ErrFlagHasDependents   = errors.New("flag is a prerequisite of other flags")
+)
+
+// prerequisiteGraph is every flag of an environment keyed by name, so prerequisites can be evaluated against each other
+type prerequisiteGraph map[string]*Flag
+
+// prerequisiteRun remembers which prerequisites have been checked for one context,
+// and which are mid check so a cycle that slipped past validation can't recurse forever
+type prerequisiteRun struct {
+	static   bool
+	met      map[string]bool
+	visiting map[string]bool
+}
+
+func newPrerequisiteRun(static bool) *prerequisiteRun {
+	return &prerequisiteRun{
+		static:   static,
+		met:      make(map[string]bool),
+		visiting: make(map[string]bool),
+	}
+}
+
+// LinkPrerequisites lets each of the flags see the others when checking its prerequisites
+func LinkPrerequisites(flags ...*Flag) {
+	graph := make(prerequisiteGraph, len(flags))
+	for _, flag := range flags {
+		graph[flag.Details.Name] = flag
+	}
+	for _, flag := range flags {
+		flag.dependencies = graph
+	}
+}
+
+// FailedPrerequisite returns the name of the first prerequisite that isn't met without an evaluation context, used for the SDK payload
+func (f *Flag) FailedPrerequisite() string {
+	return f.failedPrerequisite(EvaluationContext{}, newPrerequisiteRun(true))
+}
+
+func (f *Flag) failedPrerequisite(ec EvaluationContext, run *prerequisiteRun) string {
+	for _, pre := range f.Prerequisites {
+		if !f.dependencies.met(pre, ec, run) {
+			return pre.Flag
+		}
+	}
+	return ""
+}
+
+// met reports whether the prerequisite flag is on for the context, a prerequisite that can't be found or evaluated is not met
+func (g prerequisiteGraph) met(pre Prerequisite, ec EvaluationContext, run *prerequisiteRun) bool {
+	dependency, ok := g[pre.Flag]
+	if !ok || !dependency.Enabled {
+		return false
+	}
+
+	key := pre.Flag + "/" + pre.Variant
+	if met, ok := run.met[key]; ok {
+		return met
+	}
+	if run.visiting[pre.Flag] {
+		return false
+	}
+	run.visiting[pre.Flag] = true
+	defer delete(run.visiting, pre.Flag)
+
+	met := false
+	if run.static {
+		if dependency.failedPrerequisite(ec, run) == "" {
+			variant, _, err := dependency.Resolve()
+			met = err == nil && (pre.Variant == "" || variant == pre.Variant)
+		}
+	} else {
+		evaluation, err := dependency.evaluate(ec, run)
+		met = err == nil && evaluation.PrerequisiteFailed == "" && (pre.Variant == "" || evaluation.Variant == pre.Variant)
+	}
+
+	run.met[key] = met
+	return met
+}
+
+// ValidatePrerequisites checks a flag's prerequisites against the flags in its environment, keyed by id,
+// and the prerequisites already stored for them, and fills in the prerequisite flag names
+func ValidatePrerequisites(flagId string, prerequisites []Prerequisite, environment map[string]*Flag, edges map[string][]string) error {
+	seen := make(map[string]bool, len(prerequisites))
+	for i, pre := range prerequisites {
+		if pre.FlagID == "" {
+			return fmt.Errorf("%w: flagId is required", ErrInvalidPrerequisite)
+		}
+		if pre.FlagID == flagId {
+			return fmt.Errorf("%w: a flag can't depend on itself", ErrInvalidPrerequisite)
+		}
+		if seen[pre.FlagID] {
+			return fmt.Errorf("%w: flag %s is listed more than once", ErrInvalidPrerequisite, pre.FlagID)
+		}
+		seen[pre.FlagID] = true
+
+		dependency, ok := environment[pre.FlagID]
+		if !ok {
+			return fmt.Errorf("%w: flag %s is not in the same environment", ErrInvalidPrerequisite, pre.FlagID)
+		}
+		if pre.Variant != "" {
+			if _, err := dependency.VariantValue(pre.Variant); err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidPrerequisite, err)
+			}
+		}
+		prerequisites[i].Flag = dependency.Details.Name
+	}
+
+	proposed := make(map[string][]string, len(edges)+1)
+	for id, to := range edges {
+		proposed[id] = to
+	}
+	proposed[flagId] = nil
+	for _, pre := range prerequisites {
+		proposed[flagId] = append(proposed[flagId], pre.FlagID)
+	}
+
+	if path := findCycle(flagId, proposed); path != nil {
+		names := make([]string, len(path))
+		for i, id := range path {
+			names[i] = id
+			if flag, ok := environment[id]; ok {
+				names[i] = flag.Details.Name
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrPrerequisiteCycle, strings.Join(names, " -> "))
+	}
+
+	return nil
+}
+
+// findCycle walks the prerequisites from start and returns the path back to it, or nil when there isn't one
+func findCycle(start string, edges map[string][]string) []string {
+	visited := make(map[string]bool)
+	var walk func(id string, path []string) []string
+	walk = func(id string, path []string) []string {
+		for _, next := range edges[id] {
+			if next == start {
+				return append(slices.Clone(path), next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if found := walk(next, append(path, next)); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+
+	return walk(start, []string{start})
+}
@@ -0,0 +1,163 @@
+package flags
+
+import (
+	"context"
+	"errors"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetEnvironmentPrerequisitesFromDB loads the flags sharing an environment with the flag, keyed by id,
+// and the prerequisites already stored between them
+func (s *System) GetEnvironmentPrerequisitesFromDB(ctx context.Context, flagId string) (map[string]*Flag, map[string][]string, error) {
+	var err error
+	environment := make(map[string]*Flag)
+	rows, err := s.DB.Query(ctx, `
+    SELECT
+      f.id::text,
+      def.name,
+      f.enabled,
+      def.flag_type,
+      def.variants,
+      COALESCE(f.default_variant, ''),
+      COALESCE(f.off_variant, '')
+    FROM public.flag f
+      JOIN public.flag_definition def ON def.id = f.definition_id
+    WHERE f.environment_id = (SELECT environment_id FROM public.flag WHERE id = $1)`, flagId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return environment, map[string][]string{}, nil
+		}
+		return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to get environment flags: %v", err)
+	}
+	for rows.Next() {
+		flag := &Flag{}
+		if err := rows.Scan(
+			&flag.Details.ID,
+			&flag.Details.Name,
+			&flag.Enabled,
+			&flag.Type,
+			&flag.Variants,
+			&flag.DefaultVariant,
+			&flag.OffVariant,
+		); err != nil {
+			rows.Close()
+			return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		environment[flag.Details.ID] = flag
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to get environment flags: %v", rows.Err())
+	}
+
+	edges := make(map[string][]string)
+	rows, err = s.DB.Query(ctx, `
+    SELECT
+      pre.flag_id::text,
+      pre.prerequisite_flag_id::text
+    FROM public.flag_prerequisite pre
+      JOIN public.flag f ON f.id = pre.flag_id
+    WHERE f.environment_id = (SELECT environment_id FROM public.flag WHERE id = $1)`, flagId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return environment, edges, nil
+		}
+		return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to get prerequisites: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var from, to string
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		edges[from] = append(edges[from], to)
+	}
+	if rows.Err() != nil {
+		return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to get prerequisites: %v", rows.Err())
+	}
+
+	return environment, edges, nil
+}
+
+// UpdatePrerequisitesInDB replaces the prerequisites of a flag
+func (s *System) UpdatePrerequisitesInDB(ctx context.Context, flagId string, prerequisites []Prerequisite) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if _, err := tx.Exec(ctx, `DELETE FROM public.flag_prerequisite WHERE flag_id = $1`, flagId); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to clear prerequisites: %v", err)
+	}
+	for _, pre := range prerequisites {
+		if _, err := tx.Exec(ctx, `
+      INSERT INTO public.flag_prerequisite (flag_id, prerequisite_flag_id, variant)
+      VALUES ($1, $2, NULLIF($3, ''))`, flagId, pre.FlagID, pre.Variant); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to insert prerequisite: %v", err)
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE public.flag SET updated_at = now() WHERE id = $1`, flagId); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to update flag: %v", err)
+	}
+	if err := s.publishFlagTx(ctx, tx, flagId, bus.ActionUpdated); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to commit prerequisites: %v", err)
+	}
+
+	return nil
+}
+
+// GetDependentFlagsFromDB lists the flags that have the flag as a prerequisite in any environment,
+// deleting a flag removes it from every environment so all of them are checked
+func (s *System) GetDependentFlagsFromDB(ctx context.Context, flagId string) ([]Flag, error) {
+	var dependents []Flag
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		dependents, err = s.dependentFlagsTx(ctx, tx, flagId)
+		return err
+	})
+
+	return dependents, err
+}
+
+func (s *System) dependentFlagsTx(ctx context.Context, tx pgx.Tx, flagId string) ([]Flag, error) {
+	rows, err := tx.Query(ctx, `
+    SELECT
+      f.id::text,
+      def.name
+    FROM public.flag_prerequisite pre
+      JOIN public.flag f ON f.id = pre.flag_id
+      JOIN public.flag_definition def ON def.id = f.definition_id
+      JOIN public.flag pf ON pf.id = pre.prerequisite_flag_id
+    WHERE pf.definition_id = (SELECT definition_id FROM public.flag WHERE id = $1)
+    ORDER BY def.name, f.id`, flagId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return []Flag{}, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get dependent flags: %v", err)
+	}
+	defer rows.Close()
+
+	dependents := make([]Flag, 0)
+	for rows.Next() {
+		flag := Flag{}
+		if err := rows.Scan(&flag.Details.ID, &flag.Details.Name); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		dependents = append(dependents, flag)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get dependent flags: %v", rows.Err())
+	}
+
+	return dependents, nil
+}
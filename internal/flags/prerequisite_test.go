@@ -0,0 +1,167 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prerequisiteFlags() (*Flag, *Flag, *Flag) {
+	checkout := &Flag{
+		Enabled: true,
+		Details: Details{ID: "1", Name: "new-checkout"},
+		TargetingRules: []TargetingRule{
+			{
+				ID:         "beta",
+				Variant:    VariantEnabled,
+				Conditions: []Condition{{Attribute: "plan", Operator: OperatorEquals, Value: "beta"}},
+			},
+		},
+		DefaultVariant: VariantDisabled,
+	}
+	checkoutV2 := &Flag{
+		Enabled:       true,
+		Details:       Details{ID: "2", Name: "new-checkout-v2"},
+		Prerequisites: []Prerequisite{{FlagID: "1", Flag: "new-checkout", Variant: VariantEnabled}},
+	}
+	banner := &Flag{
+		Enabled:       true,
+		Details:       Details{ID: "3", Name: "checkout-banner"},
+		Prerequisites: []Prerequisite{{FlagID: "2", Flag: "new-checkout-v2"}},
+	}
+	LinkPrerequisites(checkout, checkoutV2, banner)
+
+	return checkout, checkoutV2, banner
+}
+
+func TestPrerequisiteEvaluation(t *testing.T) {
+	_, checkoutV2, banner := prerequisiteFlags()
+
+	beta := EvaluationContext{TargetingKey: "user-1", Context: map[string]interface{}{"plan": "beta"}}
+	evaluation, err := checkoutV2.Evaluate(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, true, evaluation.Value)
+	assert.Empty(t, evaluation.PrerequisiteFailed)
+
+	evaluation, err = banner.Evaluate(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, true, evaluation.Value)
+
+	free := EvaluationContext{TargetingKey: "user-2", Context: map[string]interface{}{"plan": "free"}}
+	evaluation, err = checkoutV2.Evaluate(free)
+	assert.NoError(t, err)
+	assert.Equal(t, false, evaluation.Value)
+	assert.Equal(t, ReasonDefault, evaluation.Reason)
+	assert.Equal(t, "new-checkout", evaluation.PrerequisiteFailed)
+
+	// a failure further up the chain turns off everything below it
+	evaluation, err = banner.Evaluate(free)
+	assert.NoError(t, err)
+	assert.Equal(t, false, evaluation.Value)
+	assert.Equal(t, "new-checkout-v2", evaluation.PrerequisiteFailed)
+}
+
+func TestPrerequisiteWithoutContext(t *testing.T) {
+	checkout, checkoutV2, banner := prerequisiteFlags()
+
+	// without a context new-checkout serves its default, which isn't the variant v2 needs
+	assert.Equal(t, "new-checkout", checkoutV2.FailedPrerequisite())
+	assert.Equal(t, "new-checkout-v2", banner.FailedPrerequisite())
+
+	checkout.DefaultVariant = VariantEnabled
+	assert.Empty(t, checkoutV2.FailedPrerequisite())
+	assert.Empty(t, banner.FailedPrerequisite())
+
+	checkout.Enabled = false
+	assert.Equal(t, "new-checkout", checkoutV2.FailedPrerequisite())
+}
+
+func TestPrerequisiteMissingFlag(t *testing.T) {
+	flag := &Flag{
+		Enabled:       true,
+		Details:       Details{ID: "1", Name: "orphan"},
+		Prerequisites: []Prerequisite{{FlagID: "9", Flag: "deleted"}},
+	}
+	LinkPrerequisites(flag)
+
+	evaluation, err := flag.Evaluate(EvaluationContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, false, evaluation.Value)
+	assert.Equal(t, "deleted", evaluation.PrerequisiteFailed)
+}
+
+func TestPrerequisiteStoredCycle(t *testing.T) {
+	a := &Flag{Enabled: true, Details: Details{ID: "1", Name: "a"}, Prerequisites: []Prerequisite{{FlagID: "2", Flag: "b"}}}
+	b := &Flag{Enabled: true, Details: Details{ID: "2", Name: "b"}, Prerequisites: []Prerequisite{{FlagID: "1", Flag: "a"}}}
+	LinkPrerequisites(a, b)
+
+	evaluation, err := a.Evaluate(EvaluationContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, false, evaluation.Value)
+	assert.Equal(t, "b", a.FailedPrerequisite())
+}
+
+func TestValidatePrerequisites(t *testing.T) {
+	environment := map[string]*Flag{
+		"1": {Details: Details{ID: "1", Name: "new-checkout"}},
+		"2": {Details: Details{ID: "2", Name: "new-checkout-v2"}},
+		"3": {Details: Details{ID: "3", Name: "checkout-banner"}},
+	}
+	edges := map[string][]string{
+		"2": {"1"},
+		"3": {"2"},
+	}
+
+	prerequisites := []Prerequisite{{FlagID: "2", Variant: VariantEnabled}}
+	err := ValidatePrerequisites("3", prerequisites, environment, edges)
+	assert.NoError(t, err)
+	assert.Equal(t, "new-checkout-v2", prerequisites[0].Flag)
+
+	tests := []struct {
+		name          string
+		flagId        string
+		prerequisites []Prerequisite
+		expected      error
+	}{
+		{
+			name:          "Depends on itself",
+			flagId:        "1",
+			prerequisites: []Prerequisite{{FlagID: "1"}},
+			expected:      ErrInvalidPrerequisite,
+		},
+		{
+			name:          "Another environment",
+			flagId:        "1",
+			prerequisites: []Prerequisite{{FlagID: "42"}},
+			expected:      ErrInvalidPrerequisite,
+		},
+		{
+			name:          "Listed twice",
+			flagId:        "3",
+			prerequisites: []Prerequisite{{FlagID: "1"}, {FlagID: "1"}},
+			expected:      ErrInvalidPrerequisite,
+		},
+		{
+			name:          "Unknown variant",
+			flagId:        "3",
+			prerequisites: []Prerequisite{{FlagID: "1", Variant: "purple"}},
+			expected:      ErrInvalidPrerequisite,
+		},
+		{
+			name:          "Closes a cycle",
+			flagId:        "1",
+			prerequisites: []Prerequisite{{FlagID: "3"}},
+			expected:      ErrPrerequisiteCycle,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePrerequisites(tt.flagId, tt.prerequisites, environment, edges)
+			assert.ErrorIs(t, err, tt.expected)
+		})
+	}
+
+	err = ValidatePrerequisites("1", []Prerequisite{{FlagID: "3"}}, environment, edges)
+	assert.EqualError(t, err, "prerequisites form a cycle: new-checkout -> checkout-banner -> new-checkout-v2 -> new-checkout")
+}
@@ -0,0 +1,132 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+type PromotionAction string
+
+const (
+	PromotionCreate PromotionAction = "create"
+	PromotionUpdate PromotionAction = "update"
+)
+
+// EnvironmentPromotion picks which flags of an environment are promoted, every flag when Include is empty,
+// DryRun only reports what would change
+type EnvironmentPromotion struct {
+	DryRun  bool     `json:"dryRun"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// PromotionChange is what promoting one flag does to the child environment, Before is nil when the flag is created there
+type PromotionChange struct {
+	Flag   string          `json:"flag"`
+	FlagID string          `json:"flagId"`
+	Action PromotionAction `json:"action"`
+	Fields []string        `json:"fields,omitempty"`
+	Before *FlagState      `json:"before,omitempty"`
+	After  *FlagState      `json:"after"`
+}
+
+type PromotionResult struct {
+	SourceEnvironmentID string            `json:"sourceEnvironmentId"`
+	TargetEnvironmentID string            `json:"targetEnvironmentId"`
+	DryRun              bool              `json:"dryRun"`
+	Changes             []PromotionChange `json:"changes"`
+}
+
+var (
+	ErrInvalidPromotion    = errors.New("invalid promotion")
+	ErrEnvironmentNotFound = errors.New("environment not found")
+)
+
+// validate checks every flag named in the include and exclude lists is in the environment
+func (p EnvironmentPromotion) validate(names []string) error {
+	for _, name := range append(slices.Clone(p.Include), p.Exclude...) {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("%w: flag %q is not in the environment", ErrInvalidPromotion, name)
+		}
+	}
+	return nil
+}
+
+func (p EnvironmentPromotion) selects(name string) bool {
+	if len(p.Include) > 0 && !slices.Contains(p.Include, name) {
+		return false
+	}
+	return !slices.Contains(p.Exclude, name)
+}
+
+// promotedState is the target's state once the source is promoted onto it, the name, type and variants come from
+// the shared definition so only the per environment state is taken from the source
+func promotedState(source FlagState, target *FlagState) FlagState {
+	if target == nil {
+		return source
+	}
+	promoted := *target
+	promoted.Enabled = source.Enabled
+	promoted.DefaultVariant = source.DefaultVariant
+	promoted.OffVariant = source.OffVariant
+	promoted.TargetingRules = source.TargetingRules
+	promoted.Rollout = source.Rollout
+	return promoted
+}
+
+// changedFields names the per environment fields that differ between the two states
+func changedFields(before, after FlagState) []string {
+	fields := make([]string, 0)
+	if before.Enabled != after.Enabled {
+		fields = append(fields, "enabled")
+	}
+	if before.DefaultVariant != after.DefaultVariant {
+		fields = append(fields, "defaultVariant")
+	}
+	if before.OffVariant != after.OffVariant {
+		fields = append(fields, "offVariant")
+	}
+	if len(before.TargetingRules) != len(after.TargetingRules) ||
+		(len(before.TargetingRules) > 0 && !reflect.DeepEqual(before.TargetingRules, after.TargetingRules)) {
+		fields = append(fields, "targetingRules")
+	}
+	if !reflect.DeepEqual(before.Rollout, after.Rollout) {
+		fields = append(fields, "rollout")
+	}
+	return fields
+}
+
+// state is the flag's stored state, as history and promotion compare it
+func (f Flag) state() FlagState {
+	return FlagState{
+		Name:           f.Details.Name,
+		Enabled:        f.Enabled,
+		Type:           f.Type,
+		Variants:       f.Variants,
+		DefaultVariant: f.DefaultVariant,
+		OffVariant:     f.OffVariant,
+		TargetingRules: f.TargetingRules,
+		Rollout:        f.Rollout,
+	}
+}
+
+// DriftFields names what differs between the same flag in two environments, prerequisites are compared by flag name
+// since the ids are per environment
+func DriftFields(from, to Flag) []string {
+	fields := changedFields(from.state(), to.state())
+
+	prerequisites := func(f Flag) []Prerequisite {
+		names := make([]Prerequisite, len(f.Prerequisites))
+		for i, pre := range f.Prerequisites {
+			names[i] = Prerequisite{Flag: pre.Flag, Variant: pre.Variant}
+		}
+		return names
+	}
+	if !slices.Equal(prerequisites(from), prerequisites(to)) {
+		fields = append(fields, "prerequisites")
+	}
+
+	return fields
+}
@@ -0,0 +1,72 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flags-gg/orchestrator/internal/authz"
+	"github.com/flags-gg/orchestrator/internal/company"
+)
+
+func (s *System) PromoteEnvironment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
+	ctx = requestChange(r, userId)
+
+	promotion := EnvironmentPromotion{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&promotion); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := s.PromoteEnvironmentInDB(ctx, r.PathValue("environmentId"), promotion)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrEnvironmentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrInvalidPromotion), errors.Is(err, ErrNoChildEnvironment):
+			s.writeValidationError(w, err)
+		case errors.Is(err, ErrApprovalRequired):
+			s.writeError(w, http.StatusConflict, err)
+		default:
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to promote environment: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
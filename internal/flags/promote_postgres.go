@@ -0,0 +1,273 @@
+package flags
+
+import (
+	"context"
+	"errors"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/jackc/pgx/v5"
+)
+
+// childEnvironmentTx finds the environment after the given one in the agent's chain
+func (s *System) childEnvironmentTx(ctx context.Context, tx pgx.Tx, agentId, environmentId int) (int, error) {
+	var childEnvId int
+	err := tx.QueryRow(ctx, `
+		SELECT ec.child_environment_id
+		FROM public.environment_chain ec
+		WHERE ec.agent_id = $1 AND ec.parent_environment_id = $2`, agentId, environmentId).Scan(&childEnvId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNoChildEnvironment
+		}
+		return 0, s.Config.Bugfixes.Logger.Errorf("failed to find child environment: %v", err)
+	}
+
+	return childEnvId, nil
+}
+
+// promotedFlagTx finds the flag sharing the source flag's definition in the target environment, empty when there isn't one
+func (s *System) promotedFlagTx(ctx context.Context, tx pgx.Tx, sourceId string, targetEnvId int) (string, error) {
+	var targetId string
+	err := tx.QueryRow(ctx, `
+		SELECT t.id::text
+		FROM public.flag f
+			JOIN public.flag t ON t.definition_id = f.definition_id AND t.environment_id = $2
+		WHERE f.id = $1`, sourceId, targetEnvId).Scan(&targetId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", nil
+		}
+		return "", s.Config.Bugfixes.Logger.Errorf("failed to find promoted flag: %v", err)
+	}
+
+	return targetId, nil
+}
+
+// promoteStateTx copies the source flag's state onto its definition in the target environment,
+// creating the flag there when it's missing, and returns the target flag's id
+func (s *System) promoteStateTx(ctx context.Context, tx pgx.Tx, sourceId string, targetEnvId int) (string, error) {
+	targetId, err := s.promotedFlagTx(ctx, tx, sourceId, targetEnvId)
+	if err != nil {
+		return "", err
+	}
+
+	if targetId == "" {
+		err = tx.QueryRow(ctx, `
+			INSERT INTO public.flag (definition_id, agent_id, environment_id, enabled, default_variant, off_variant, targeting_rules, rollout)
+			SELECT f.definition_id, f.agent_id, $2, f.enabled, f.default_variant, f.off_variant, f.targeting_rules, f.rollout
+			FROM public.flag f
+			WHERE f.id = $1
+			RETURNING id::text`, sourceId, targetEnvId).Scan(&targetId)
+		if err != nil {
+			return "", s.Config.Bugfixes.Logger.Errorf("failed to insert promoted flag: %v", err)
+		}
+
+		// the promoted flag starts its own history
+		if err := s.recordFlagVersion(ctx, tx, targetId, nil); err != nil {
+			return "", err
+		}
+		if err := s.publishFlagTx(ctx, tx, targetId, bus.ActionCreated); err != nil {
+			return "", err
+		}
+		return targetId, nil
+	}
+
+	err = s.mutateFlagsTx(ctx, tx, []string{targetId}, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			UPDATE public.flag t
+			SET
+				enabled = f.enabled,
+				default_variant = f.default_variant,
+				off_variant = f.off_variant,
+				targeting_rules = f.targeting_rules,
+				rollout = f.rollout,
+				updated_at = now()
+			FROM public.flag f
+			WHERE f.id = $1
+				AND t.id = $2
+				AND (t.enabled, t.default_variant, t.off_variant, t.targeting_rules, t.rollout)
+					IS DISTINCT FROM (f.enabled, f.default_variant, f.off_variant, f.targeting_rules, f.rollout)`, sourceId, targetId); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to update promoted flag: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return targetId, nil
+}
+
+// promotePrerequisitesTx gives the target flag the source flag's prerequisites,
+// pointing at the same definitions in the target environment, those missing there are left out
+func (s *System) promotePrerequisitesTx(ctx context.Context, tx pgx.Tx, sourceId, targetId string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM public.flag_prerequisite WHERE flag_id = $1`, targetId); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to clear prerequisites: %v", err)
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO public.flag_prerequisite (flag_id, prerequisite_flag_id, variant)
+		SELECT t.id, tp.id, pre.variant
+		FROM public.flag_prerequisite pre
+			JOIN public.flag p ON p.id = pre.prerequisite_flag_id
+			JOIN public.flag t ON t.id = $2
+			JOIN public.flag tp ON tp.definition_id = p.definition_id AND tp.environment_id = t.environment_id
+		WHERE pre.flag_id = $1`, sourceId, targetId); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to promote prerequisites: %v", err)
+	}
+
+	return nil
+}
+
+// PromoteEnvironmentInDB upserts the environment's flags into the next environment in its chain,
+// returning what changed, or on a dry run what would change
+func (s *System) PromoteEnvironmentInDB(ctx context.Context, envId string, promotion EnvironmentPromotion) (*PromotionResult, error) {
+	result := &PromotionResult{
+		SourceEnvironmentID: envId,
+		DryRun:              promotion.DryRun,
+		Changes:             make([]PromotionChange, 0),
+	}
+
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var sourceEnvId, agentId int
+		err := tx.QueryRow(ctx, `
+			SELECT id, agent_id
+			FROM public.environment
+			WHERE env_id = $1`, envId).Scan(&sourceEnvId, &agentId)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrEnvironmentNotFound
+			}
+			return s.Config.Bugfixes.Logger.Errorf("failed to get environment: %v", err)
+		}
+
+		targetEnvId, err := s.childEnvironmentTx(ctx, tx, agentId, sourceEnvId)
+		if err != nil {
+			return err
+		}
+		var requiresApproval bool
+		if err := tx.QueryRow(ctx, `SELECT env_id, requires_approval FROM public.environment WHERE id = $1`, targetEnvId).Scan(&result.TargetEnvironmentID, &requiresApproval); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to get child environment: %v", err)
+		}
+		// a protected environment only takes reviewed changes, flag by flag
+		if requiresApproval && !promotion.DryRun {
+			return ErrApprovalRequired
+		}
+
+		sourceIds, names, err := s.environmentFlagNamesTx(ctx, tx, sourceEnvId)
+		if err != nil {
+			return err
+		}
+		if err := promotion.validate(names); err != nil {
+			return err
+		}
+
+		promoted := make(map[string]string)
+		for i, sourceId := range sourceIds {
+			if !promotion.selects(names[i]) {
+				continue
+			}
+
+			change, err := s.promotionChangeTx(ctx, tx, sourceId, targetEnvId)
+			if err != nil {
+				return err
+			}
+			if change != nil {
+				result.Changes = append(result.Changes, *change)
+			}
+			if promotion.DryRun {
+				continue
+			}
+
+			targetId, err := s.promoteStateTx(ctx, tx, sourceId, targetEnvId)
+			if err != nil {
+				return err
+			}
+			promoted[sourceId] = targetId
+		}
+
+		// prerequisites go last so they can point at flags created by this promotion
+		for sourceId, targetId := range promoted {
+			if err := s.promotePrerequisitesTx(ctx, tx, sourceId, targetId); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// environmentFlagNamesTx lists the ids and names of the environment's flags, in name order
+func (s *System) environmentFlagNamesTx(ctx context.Context, tx pgx.Tx, environmentId int) ([]string, []string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT f.id::text, def.name
+		FROM public.flag f
+			JOIN public.flag_definition def ON def.id = f.definition_id
+		WHERE f.environment_id = $1
+		ORDER BY def.name`, environmentId)
+	if err != nil {
+		return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to get environment flags: %v", err)
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	names := make([]string, 0)
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		ids = append(ids, id)
+		names = append(names, name)
+	}
+	if rows.Err() != nil {
+		return nil, nil, s.Config.Bugfixes.Logger.Errorf("failed to get environment flags: %v", rows.Err())
+	}
+
+	return ids, names, nil
+}
+
+// promotionChangeTx works out what promoting the flag does to the target environment, nil when nothing changes
+func (s *System) promotionChangeTx(ctx context.Context, tx pgx.Tx, sourceId string, targetEnvId int) (*PromotionChange, error) {
+	source, err := flagStateTx(ctx, tx, sourceId)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to read flag state: %v", err)
+	}
+	if source == nil {
+		return nil, nil
+	}
+
+	targetId, err := s.promotedFlagTx(ctx, tx, sourceId, targetEnvId)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &PromotionChange{
+		Flag:   source.Name,
+		FlagID: sourceId,
+		Action: PromotionCreate,
+	}
+	if targetId != "" {
+		target, err := flagStateTx(ctx, tx, targetId)
+		if err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to read flag state: %v", err)
+		}
+		change.Action = PromotionUpdate
+		change.Before = target
+	}
+
+	after := promotedState(*source, change.Before)
+	change.After = &after
+	if change.Before != nil {
+		change.Fields = changedFields(*change.Before, after)
+		if len(change.Fields) == 0 {
+			return nil, nil
+		}
+	}
+
+	return change, nil
+}
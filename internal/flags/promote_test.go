@@ -0,0 +1,62 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironmentPromotionSelection(t *testing.T) {
+	names := []string{"checkout", "dark-mode", "search"}
+
+	all := EnvironmentPromotion{}
+	assert.NoError(t, all.validate(names))
+	assert.True(t, all.selects("search"))
+
+	some := EnvironmentPromotion{Include: []string{"checkout", "search"}, Exclude: []string{"search"}}
+	assert.NoError(t, some.validate(names))
+	assert.True(t, some.selects("checkout"))
+	assert.False(t, some.selects("dark-mode"))
+	assert.False(t, some.selects("search"))
+
+	unknown := EnvironmentPromotion{Exclude: []string{"billing"}}
+	assert.ErrorIs(t, unknown.validate(names), ErrInvalidPromotion)
+}
+
+func TestPromotedState(t *testing.T) {
+	source := FlagState{
+		Name:           "checkout",
+		Enabled:        true,
+		DefaultVariant: "on",
+		TargetingRules: []TargetingRule{{Variant: "on"}},
+		Rollout:        &Rollout{},
+	}
+
+	created := promotedState(source, nil)
+	assert.Equal(t, source, created)
+
+	target := &FlagState{Name: "checkout", OffVariant: "off"}
+	updated := promotedState(source, target)
+	assert.Equal(t, []string{"enabled", "defaultVariant", "offVariant", "targetingRules", "rollout"}, changedFields(*target, updated))
+	assert.Empty(t, changedFields(updated, promotedState(source, &updated)))
+	assert.Empty(t, changedFields(FlagState{TargetingRules: []TargetingRule{}}, FlagState{}))
+}
+
+func TestDriftFields(t *testing.T) {
+	staging := Flag{
+		Enabled:       true,
+		Details:       Details{ID: "1", Name: "checkout"},
+		Prerequisites: []Prerequisite{{FlagID: "2", Flag: "payments"}},
+	}
+	production := Flag{
+		Details:       Details{ID: "7", Name: "checkout"},
+		Prerequisites: []Prerequisite{{FlagID: "8", Flag: "payments"}},
+	}
+	assert.Equal(t, []string{"enabled"}, DriftFields(staging, production))
+
+	production.Enabled = true
+	assert.Empty(t, DriftFields(staging, production))
+
+	production.Prerequisites = nil
+	assert.Equal(t, []string{"prerequisites"}, DriftFields(staging, production))
+}
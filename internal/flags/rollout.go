@@ -0,0 +1,85 @@
+package flags
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Rollout splits the users a flag serves across its variants by percentage
+type Rollout struct {
+	Salt   string  `json:"salt"`
+	Splits []Split `json:"splits"`
+}
+
+// Split is the share of users, as a whole percentage, that is served a variant
+type Split struct {
+	Variant string `json:"variant"`
+	Weight  int    `json:"weight"`
+}
+
+// rolloutBuckets is the number of buckets users are hashed into, one per percent
+const rolloutBuckets = 100
+
+var (
+	ErrInvalidRollout      = errors.New("invalid rollout")
+	ErrTargetingKeyMissing = errors.New("targeting key is required for a percentage rollout")
+)
+
+// bucket places a targeting key in a stable bucket for the flag, the same key always lands in the same bucket
+func (r *Rollout) bucket(flagKey, targetingKey string) int {
+	sum := sha256.Sum256([]byte(flagKey + "." + r.Salt + "." + targetingKey))
+	return int(binary.BigEndian.Uint64(sum[:8]) % rolloutBuckets)
+}
+
+// allocate picks the split a targeting key falls into, splits fill the buckets in order
+// so growing the first split keeps everyone it already served
+func (r *Rollout) allocate(flagKey, targetingKey string) (string, error) {
+	if targetingKey == "" {
+		return "", ErrTargetingKeyMissing
+	}
+
+	bucket := r.bucket(flagKey, targetingKey)
+	upper := 0
+	for _, split := range r.Splits {
+		upper += split.Weight
+		if bucket < upper {
+			return split.Variant, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: weights do not cover bucket %d", ErrInvalidRollout, bucket)
+}
+
+// ValidateRollout checks a rollout against the flag it will be stored on
+func ValidateRollout(flag *Flag, rollout *Rollout) error {
+	if rollout == nil {
+		return nil
+	}
+	if len(rollout.Splits) == 0 {
+		return fmt.Errorf("%w: at least one split is required", ErrInvalidRollout)
+	}
+
+	total := 0
+	seen := make(map[string]bool, len(rollout.Splits))
+	for _, split := range rollout.Splits {
+		if split.Weight < 0 {
+			return fmt.Errorf("%w: split %q has a negative weight", ErrInvalidRollout, split.Variant)
+		}
+		if seen[split.Variant] {
+			return fmt.Errorf("%w: variant %q is split more than once", ErrInvalidRollout, split.Variant)
+		}
+		seen[split.Variant] = true
+
+		if _, err := flag.VariantValue(split.Variant); err != nil {
+			return fmt.Errorf("split: %w", err)
+		}
+		total += split.Weight
+	}
+	if total != rolloutBuckets {
+		return fmt.Errorf("%w: weights add up to %d, not %d", ErrInvalidRollout, total, rolloutBuckets)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package flags
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rolloutFlag(onWeight int) Flag {
+	return Flag{
+		Enabled: true,
+		Details: Details{Name: "new-checkout"},
+		Rollout: &Rollout{
+			Salt: "salt",
+			Splits: []Split{
+				{Variant: VariantEnabled, Weight: onWeight},
+				{Variant: VariantDisabled, Weight: 100 - onWeight},
+			},
+		},
+	}
+}
+
+func TestRolloutIsSticky(t *testing.T) {
+	flag := rolloutFlag(50)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		first, err := flag.Evaluate(EvaluationContext{TargetingKey: key})
+		assert.NoError(t, err)
+		assert.Equal(t, ReasonSplit, first.Reason)
+
+		second, err := flag.Evaluate(EvaluationContext{TargetingKey: key})
+		assert.NoError(t, err)
+		assert.Equal(t, first.Variant, second.Variant)
+	}
+}
+
+func TestRolloutDistribution(t *testing.T) {
+	flag := rolloutFlag(10)
+
+	enabled := 0
+	for i := 0; i < 10000; i++ {
+		evaluation, err := flag.Evaluate(EvaluationContext{TargetingKey: fmt.Sprintf("user-%d", i)})
+		assert.NoError(t, err)
+		if evaluation.Variant == VariantEnabled {
+			enabled++
+		}
+	}
+
+	assert.InDelta(t, 1000, enabled, 150)
+}
+
+func TestRolloutGrowingKeepsExistingUsers(t *testing.T) {
+	small := rolloutFlag(1)
+	large := rolloutFlag(50)
+
+	for i := 0; i < 5000; i++ {
+		ec := EvaluationContext{TargetingKey: fmt.Sprintf("user-%d", i)}
+		before, err := small.Evaluate(ec)
+		assert.NoError(t, err)
+		if before.Variant != VariantEnabled {
+			continue
+		}
+
+		after, err := large.Evaluate(ec)
+		assert.NoError(t, err)
+		assert.Equal(t, VariantEnabled, after.Variant)
+	}
+}
+
+func TestRolloutRequiresTargetingKey(t *testing.T) {
+	flag := rolloutFlag(50)
+
+	_, err := flag.Evaluate(EvaluationContext{})
+	assert.ErrorIs(t, err, ErrTargetingKeyMissing)
+}
+
+func TestValidateRollout(t *testing.T) {
+	flag := &Flag{}
+
+	tests := []struct {
+		name        string
+		rollout     *Rollout
+		expectedErr error
+	}{
+		{
+			name: "No rollout",
+		},
+		{
+			name:    "Valid split",
+			rollout: &Rollout{Splits: []Split{{Variant: VariantEnabled, Weight: 25}, {Variant: VariantDisabled, Weight: 75}}},
+		},
+		{
+			name:        "Weights short of 100",
+			rollout:     &Rollout{Splits: []Split{{Variant: VariantEnabled, Weight: 25}}},
+			expectedErr: ErrInvalidRollout,
+		},
+		{
+			name:        "Unknown variant",
+			rollout:     &Rollout{Splits: []Split{{Variant: "blue", Weight: 100}}},
+			expectedErr: ErrVariantNotFound,
+		},
+		{
+			name:        "Negative weight",
+			rollout:     &Rollout{Splits: []Split{{Variant: VariantEnabled, Weight: 110}, {Variant: VariantDisabled, Weight: -10}}},
+			expectedErr: ErrInvalidRollout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRollout(flag, tt.rollout)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/container"
+)
+
+type ScheduleStatus string
+
+const (
+	ScheduleStatusPending   ScheduleStatus = "pending"
+	ScheduleStatusRunning   ScheduleStatus = "running"
+	ScheduleStatusApplied   ScheduleStatus = "applied"
+	ScheduleStatusFailed    ScheduleStatus = "failed"
+	ScheduleStatusCancelled ScheduleStatus = "cancelled"
+)
+
+// Schedule is a change to a flag that the scheduler applies once RunAt has passed
+type Schedule struct {
+	ID             string         `json:"id"`
+	FlagID         string         `json:"flagId"`
+	RunAt          time.Time      `json:"runAt"`
+	Timezone       string         `json:"timezone"`
+	Enabled        *bool          `json:"enabled,omitempty"`
+	DefaultVariant string         `json:"defaultVariant,omitempty"`
+	Rollout        *Rollout       `json:"rollout,omitempty"`
+	ClearRollout   bool           `json:"clearRollout,omitempty"`
+	Status         ScheduleStatus `json:"status"`
+	Error          string         `json:"error,omitempty"`
+	CreatedBy      string         `json:"createdBy,omitempty"`
+	AppliedAt      *time.Time     `json:"appliedAt,omitempty"`
+}
+
+// ScheduleRequest is what the dashboard sends, RunAt without an offset is read in the company timezone
+type ScheduleRequest struct {
+	RunAt          string   `json:"runAt"`
+	Enabled        *bool    `json:"enabled,omitempty"`
+	DefaultVariant string   `json:"defaultVariant,omitempty"`
+	Rollout        *Rollout `json:"rollout,omitempty"`
+	ClearRollout   bool     `json:"clearRollout,omitempty"`
+}
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// schedulerInterval is how often the scheduler looks for due changes
+const schedulerInterval = 30 * time.Second
+
+// staleClaim is how long a claimed schedule can go unfinished before another worker picks it up again
+const staleClaim = 5 * time.Minute
+
+// ParseRunAt reads a timestamp, local timestamps are placed in the given timezone
+func ParseRunAt(runAt, timezone string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, runAt); err == nil {
+		return t.UTC(), nil
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: unknown timezone %q", ErrInvalidSchedule, timezone)
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, runAt, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: can't read runAt %q", ErrInvalidSchedule, runAt)
+}
+
+// NewSchedule validates a request against the flag it changes and turns it into a pending schedule
+func NewSchedule(flag *Flag, req ScheduleRequest, timezone string, now time.Time) (*Schedule, error) {
+	runAt, err := ParseRunAt(req.RunAt, timezone)
+	if err != nil {
+		return nil, err
+	}
+	if !runAt.After(now) {
+		return nil, fmt.Errorf("%w: runAt must be in the future", ErrInvalidSchedule)
+	}
+	if req.Enabled == nil && req.DefaultVariant == "" && req.Rollout == nil && !req.ClearRollout {
+		return nil, fmt.Errorf("%w: nothing to change", ErrInvalidSchedule)
+	}
+	if req.Rollout != nil && req.ClearRollout {
+		return nil, fmt.Errorf("%w: can't set and clear the rollout", ErrInvalidSchedule)
+	}
+	if req.DefaultVariant != "" {
+		if _, err := flag.VariantValue(req.DefaultVariant); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateRollout(flag, req.Rollout); err != nil {
+		return nil, err
+	}
+
+	return &Schedule{
+		FlagID:         flag.Details.ID,
+		RunAt:          runAt,
+		Timezone:       timezone,
+		Enabled:        req.Enabled,
+		DefaultVariant: req.DefaultVariant,
+		Rollout:        req.Rollout,
+		ClearRollout:   req.ClearRollout,
+		Status:         ScheduleStatusPending,
+	}, nil
+}
+
+// Scheduler applies due schedules in the background, claims are made with SKIP LOCKED so replicas don't collide
+type Scheduler struct {
+	*container.Container
+}
+
+func NewScheduler(c *container.Container) *Scheduler {
+	return &Scheduler{
+		Container: c,
+	}
+}
+
+func (sc *Scheduler) Start(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		sc.runDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sc *Scheduler) runDue(ctx context.Context) {
+	s := NewSystem(sc.Container)
+
+	schedules, err := s.ClaimDueSchedulesInDB(ctx)
+	if err != nil {
+		_ = sc.Config.Bugfixes.Logger.Errorf("Failed to claim schedules: %v", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		actor := schedule.CreatedBy
+		if actor == "" {
+			actor = "scheduler"
+		}
+
+		status := ScheduleStatusApplied
+		applyErr := s.applySchedule(WithChange(ctx, actor, "schedule "+schedule.ID), schedule)
+		if applyErr != nil {
+			status = ScheduleStatusFailed
+			_ = sc.Config.Bugfixes.Logger.Errorf("Failed to apply schedule %s: %v", schedule.ID, applyErr)
+		}
+
+		if err := s.FinishScheduleInDB(ctx, schedule.ID, status, applyErr); err != nil {
+			_ = sc.Config.Bugfixes.Logger.Errorf("Failed to finish schedule %s: %v", schedule.ID, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package flags
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/authz"
+	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/google/uuid"
+)
+
+func (s *System) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	req := ScheduleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	flag, err := s.GetFlagFromDB(ctx, r.PathValue("flagId"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if flag == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if s.approvalRequired(ctx, w, flag.Details.ID, ChangeUpdate) {
+		return
+	}
+
+	timezone, err := company.NewSystem(s.Container).GetCompanyTimezone(ctx, companyId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	schedule, err := NewSchedule(flag, req, timezone, time.Now())
+	if err != nil {
+		s.writeValidationError(w, err)
+		return
+	}
+	schedule.CreatedBy = userId
+	// a scheduled rollout keeps the flag's salt so the users already in it stay in the same buckets
+	if schedule.Rollout != nil && schedule.Rollout.Salt == "" {
+		if flag.Rollout != nil && flag.Rollout.Salt != "" {
+			schedule.Rollout.Salt = flag.Rollout.Salt
+		} else {
+			schedule.Rollout.Salt = uuid.NewString()
+		}
+	}
+
+	if err := s.CreateScheduleInDB(ctx, schedule); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(schedule); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) GetSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	type Schedules struct {
+		Schedules []Schedule `json:"schedules"`
+	}
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	schedules, err := s.GetSchedulesFromDB(ctx, r.PathValue("flagId"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&Schedules{
+		Schedules: schedules,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Header.Get("x-user-subject") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Flag, r.PathValue("flagId")) {
+		return
+	}
+
+	cancelled, err := s.CancelScheduleInDB(ctx, r.PathValue("flagId"), r.PathValue("scheduleId"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,242 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const scheduleColumns = `
+      fs.schedule_id,
+      fs.flag_id::text,
+      fs.run_at,
+      fs.timezone,
+      fs.enabled,
+      COALESCE(fs.default_variant, ''),
+      fs.rollout,
+      fs.clear_rollout,
+      fs.status,
+      COALESCE(fs.error, ''),
+      COALESCE(fs.created_by, ''),
+      fs.applied_at`
+
+func scanSchedule(row pgx.Row) (Schedule, error) {
+	schedule := Schedule{}
+	err := row.Scan(
+		&schedule.ID,
+		&schedule.FlagID,
+		&schedule.RunAt,
+		&schedule.Timezone,
+		&schedule.Enabled,
+		&schedule.DefaultVariant,
+		&schedule.Rollout,
+		&schedule.ClearRollout,
+		&schedule.Status,
+		&schedule.Error,
+		&schedule.CreatedBy,
+		&schedule.AppliedAt,
+	)
+	return schedule, err
+}
+
+func (s *System) CreateScheduleInDB(ctx context.Context, schedule *Schedule) error {
+	var err error
+	var rollout []byte
+	if schedule.Rollout != nil {
+		rollout, err = json.Marshal(schedule.Rollout)
+		if err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode rollout: %v", err)
+		}
+	}
+
+	schedule.ID = uuid.New().String()
+	_, err = s.DB.Exec(ctx, `
+    INSERT INTO public.flag_schedule (
+      schedule_id,
+      flag_id,
+      run_at,
+      timezone,
+      enabled,
+      default_variant,
+      rollout,
+      clear_rollout,
+      created_by
+    ) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, NULLIF($9, ''))`,
+		schedule.ID,
+		schedule.FlagID,
+		schedule.RunAt,
+		schedule.Timezone,
+		schedule.Enabled,
+		schedule.DefaultVariant,
+		rollout,
+		schedule.ClearRollout,
+		schedule.CreatedBy)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to create schedule: %v", err)
+	}
+
+	return nil
+}
+
+func (s *System) GetSchedulesFromDB(ctx context.Context, flagId string) ([]Schedule, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT`+scheduleColumns+`
+    FROM public.flag_schedule fs
+    WHERE fs.flag_id = $1
+      AND fs.status IN ('pending', 'running')
+    ORDER BY fs.run_at`, flagId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return []Schedule{}, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get schedules: %v", err)
+	}
+	defer rows.Close()
+
+	schedules := make([]Schedule, 0)
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		schedules = append(schedules, schedule)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get schedules: %v", rows.Err())
+	}
+
+	return schedules, nil
+}
+
+// CancelScheduleInDB cancels a pending schedule, it reports false when there was nothing left to cancel
+func (s *System) CancelScheduleInDB(ctx context.Context, flagId, scheduleId string) (bool, error) {
+	tag, err := s.DB.Exec(ctx, `
+    UPDATE public.flag_schedule
+    SET status = 'cancelled'
+    WHERE schedule_id = $1
+      AND flag_id = $2
+      AND status = 'pending'`, scheduleId, flagId)
+	if err != nil {
+		return false, s.Config.Bugfixes.Logger.Errorf("failed to cancel schedule: %v", err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// ClaimDueSchedulesInDB marks due schedules as running and returns them, rows another worker holds are skipped
+func (s *System) ClaimDueSchedulesInDB(ctx context.Context) ([]Schedule, error) {
+	rows, err := s.DB.Query(ctx, `
+    UPDATE public.flag_schedule AS fs
+    SET
+      status = 'running',
+      claimed_at = now()
+    WHERE fs.id IN (
+      SELECT id
+      FROM public.flag_schedule
+      WHERE run_at <= now()
+        AND (
+          status = 'pending'
+          OR (status = 'running' AND claimed_at < now() - make_interval(secs => $1))
+        )
+      ORDER BY run_at
+      LIMIT 50
+      FOR UPDATE SKIP LOCKED
+    )
+    RETURNING`+scheduleColumns, staleClaim.Seconds())
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to claim schedules: %v", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		schedules = append(schedules, schedule)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to claim schedules: %v", rows.Err())
+	}
+
+	return schedules, nil
+}
+
+func (s *System) FinishScheduleInDB(ctx context.Context, scheduleId string, status ScheduleStatus, applyErr error) error {
+	var err error
+	var message string
+	if applyErr != nil {
+		message = applyErr.Error()
+	}
+
+	_, err = s.DB.Exec(ctx, `
+    UPDATE public.flag_schedule
+    SET
+      status = $2,
+      error = NULLIF($3, ''),
+      applied_at = now()
+    WHERE schedule_id = $1`, scheduleId, status, message)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to finish schedule: %v", err)
+	}
+
+	return nil
+}
+
+// applySchedule makes the change through the same calls the dashboard uses, all of it or, when a step fails, none of it
+func (s *System) applySchedule(ctx context.Context, schedule Schedule) error {
+	flag, err := s.GetFlagFromDB(ctx, schedule.FlagID)
+	if err != nil {
+		return err
+	}
+	if flag == nil {
+		return fmt.Errorf("flag %s no longer exists", schedule.FlagID)
+	}
+
+	var rollout []byte
+	if schedule.Rollout != nil {
+		if rollout, err = json.Marshal(schedule.Rollout); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to encode rollout: %v", err)
+		}
+	}
+
+	flagIds := []string{flag.Details.ID}
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		// the environment may have started requiring approval since the schedule was made
+		required, err := s.requiredApprovalsTx(ctx, tx, flag.Details.ID, ChangeUpdate, "")
+		if err != nil {
+			return err
+		}
+		if required > 0 {
+			return ErrApprovalRequired
+		}
+
+		if schedule.DefaultVariant != "" {
+			if err := s.mutateFlagsTx(ctx, tx, flagIds, func(tx pgx.Tx) error {
+				return s.updateDefaultVariantTx(ctx, tx, flag.Details.ID, schedule.DefaultVariant)
+			}); err != nil {
+				return err
+			}
+		}
+		if schedule.Rollout != nil || schedule.ClearRollout {
+			if err := s.mutateFlagsTx(ctx, tx, flagIds, func(tx pgx.Tx) error {
+				return s.updateRolloutTx(ctx, tx, flag.Details.ID, rollout)
+			}); err != nil {
+				return err
+			}
+		}
+		if schedule.Enabled != nil {
+			flag.Enabled = *schedule.Enabled
+			if err := s.updateFlagTx(ctx, tx, *flag); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package flags
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRunAt(t *testing.T) {
+	tests := []struct {
+		name     string
+		runAt    string
+		timezone string
+		expected time.Time
+		wantErr  bool
+	}{
+		{
+			name:     "Local time in company timezone",
+			runAt:    "2026-06-01T09:00",
+			timezone: "Europe/London",
+			expected: time.Date(2026, 6, 1, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Winter local time",
+			runAt:    "2026-01-05T09:00:00",
+			timezone: "Europe/London",
+			expected: time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Explicit offset wins over timezone",
+			runAt:    "2026-06-01T09:00:00+02:00",
+			timezone: "America/New_York",
+			expected: time.Date(2026, 6, 1, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Unknown timezone",
+			runAt:    "2026-06-01T09:00",
+			timezone: "Mars/Olympus",
+			wantErr:  true,
+		},
+		{
+			name:     "Unreadable time",
+			runAt:    "next monday",
+			timezone: "Europe/London",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runAt, err := ParseRunAt(tt.runAt, tt.timezone)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidSchedule)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tt.expected.Equal(runAt), "expected %s, got %s", tt.expected, runAt)
+		})
+	}
+}
+
+func TestNewSchedule(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	flag := &Flag{Details: Details{ID: "1"}}
+	enabled := true
+
+	schedule, err := NewSchedule(flag, ScheduleRequest{RunAt: "2026-01-05T09:00", Enabled: &enabled}, "Europe/London", now)
+	assert.NoError(t, err)
+	assert.Equal(t, ScheduleStatusPending, schedule.Status)
+	assert.Equal(t, "1", schedule.FlagID)
+
+	_, err = NewSchedule(flag, ScheduleRequest{RunAt: "2025-12-31T09:00", Enabled: &enabled}, "Europe/London", now)
+	assert.ErrorIs(t, err, ErrInvalidSchedule)
+
+	_, err = NewSchedule(flag, ScheduleRequest{RunAt: "2026-01-05T09:00"}, "Europe/London", now)
+	assert.ErrorIs(t, err, ErrInvalidSchedule)
+
+	_, err = NewSchedule(flag, ScheduleRequest{RunAt: "2026-01-05T09:00", DefaultVariant: "blue"}, "Europe/London", now)
+	assert.ErrorIs(t, err, ErrVariantNotFound)
+}
@@ -0,0 +1,116 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	OperatorInSegment    Operator = "in_segment"
+	OperatorNotInSegment Operator = "not_in_segment"
+)
+
+// SegmentRule matches when every one of its conditions matches
+type SegmentRule struct {
+	Conditions []Condition `json:"conditions"`
+}
+
+// Segment is a reusable company audience that flag targeting can refer to by id
+type Segment struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Rules       []SegmentRule `json:"rules"`
+	Included    []string      `json:"included"`
+	Excluded    []string      `json:"excluded"`
+}
+
+var (
+	ErrInvalidSegment  = errors.New("invalid segment")
+	ErrSegmentNotFound = errors.New("segment not found")
+	ErrSegmentInUse    = errors.New("segment is used by flags")
+)
+
+// Contains reports whether the context is in the segment, the explicit lists win over the rules
+func (s *Segment) Contains(ec EvaluationContext) (bool, error) {
+	if ec.TargetingKey != "" {
+		if slices.Contains(s.Excluded, ec.TargetingKey) {
+			return false, nil
+		}
+		if slices.Contains(s.Included, ec.TargetingKey) {
+			return true, nil
+		}
+	}
+
+	for _, rule := range s.Rules {
+		if len(rule.Conditions) == 0 {
+			continue
+		}
+
+		matched := true
+		for _, c := range rule.Conditions {
+			ok, err := c.matches(ec, nil)
+			if err != nil {
+				return false, fmt.Errorf("segment %s: %w", s.ID, err)
+			}
+			if !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ValidateSegment checks a segment before it is stored
+func ValidateSegment(s *Segment) error {
+	if s.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidSegment)
+	}
+
+	for _, rule := range s.Rules {
+		if len(rule.Conditions) == 0 {
+			return fmt.Errorf("%w: rule has no conditions", ErrInvalidSegment)
+		}
+		for _, c := range rule.Conditions {
+			if c.Attribute == "" {
+				return fmt.Errorf("%w: condition without an attribute", ErrInvalidSegment)
+			}
+			// segments can't nest, it keeps evaluation a single lookup deep
+			if c.Operator == OperatorInSegment || c.Operator == OperatorNotInSegment {
+				return fmt.Errorf("%w: segments can't refer to other segments", ErrInvalidSegment)
+			}
+			if err := c.validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// segmentIds lists the segments the flag's targeting refers to
+func (f *Flag) segmentIds() []string {
+	var ids []string
+	for _, rule := range f.TargetingRules {
+		for _, c := range rule.Conditions {
+			if c.Operator != OperatorInSegment && c.Operator != OperatorNotInSegment {
+				continue
+			}
+			if id, ok := c.Value.(string); ok && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// WithSegments attaches the segments the flag's targeting needs to be evaluated
+func (f *Flag) WithSegments(segments map[string]*Segment) {
+	f.segments = segments
+}
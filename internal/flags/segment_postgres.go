@@ -0,0 +1,191 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/flags-gg/orchestrator/internal/authz"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetSegmentsFromDB loads the company's segments with the given ids, keyed by id, another company's are never found
+func (s *System) GetSegmentsFromDB(ctx context.Context, companyId string, segmentIds []string) (map[string]*Segment, error) {
+	segments := make(map[string]*Segment)
+	if len(segmentIds) == 0 {
+		return segments, nil
+	}
+
+	rows, err := s.DB.Query(ctx, `
+    SELECT
+      segment.segment_id,
+      segment.name,
+      COALESCE(segment.description, ''),
+      segment.rules,
+      segment.included,
+      segment.excluded
+    FROM public.segment
+      JOIN public.company ON company.id = segment.company_id
+    WHERE company.company_id = $1
+      AND segment.segment_id = ANY($2)`, companyId, segmentIds)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return segments, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get segments: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		segment := &Segment{}
+		if err := rows.Scan(
+			&segment.ID,
+			&segment.Name,
+			&segment.Description,
+			&segment.Rules,
+			&segment.Included,
+			&segment.Excluded,
+		); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		segments[segment.ID] = segment
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get segments: %v", rows.Err())
+	}
+
+	return segments, nil
+}
+
+// AttachSegments loads every segment the project's flags refer to and hands them to the flags for evaluation, only
+// the segments of the company owning the project are used
+func (s *System) AttachSegments(ctx context.Context, projectId string, flags ...*Flag) error {
+	var ids []string
+	for _, flag := range flags {
+		ids = append(ids, flag.segmentIds()...)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	companyId, err := authz.NewSystem(s.Container).CompanyOf(ctx, authz.Project, projectId)
+	if err != nil {
+		return err
+	}
+	segments, err := s.GetSegmentsFromDB(ctx, companyId, ids)
+	if err != nil {
+		return err
+	}
+	for _, flag := range flags {
+		flag.WithSegments(segments)
+	}
+
+	return nil
+}
+
+// lockSegmentsTx locks the company's segments the targeting refers to until the transaction ends, so none is deleted
+// while a flag starts using it, a segment that doesn't exist is ErrSegmentNotFound
+func (s *System) lockSegmentsTx(ctx context.Context, tx pgx.Tx, companyId string, segmentIds []string) error {
+	if len(segmentIds) == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx, `
+    SELECT segment.segment_id
+    FROM public.segment
+      JOIN public.company ON company.id = segment.company_id
+    WHERE company.company_id = $1
+      AND segment.segment_id = ANY($2)
+    FOR UPDATE OF segment`, companyId, segmentIds)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to lock segments: %v", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool, len(segmentIds))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		found[id] = true
+	}
+	if rows.Err() != nil {
+		return s.Config.Bugfixes.Logger.Errorf("failed to lock segments: %v", rows.Err())
+	}
+	for _, id := range segmentIds {
+		if !found[id] {
+			return fmt.Errorf("%w: %s", ErrSegmentNotFound, id)
+		}
+	}
+
+	return nil
+}
+
+// GetFlagsUsingSegment lists the company's flags whose targeting refers to the segment
+func (s *System) GetFlagsUsingSegment(ctx context.Context, companyId, segmentId string) ([]CompanyFlagEntry, error) {
+	var entries []CompanyFlagEntry
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		entries, err = s.FlagsUsingSegmentTx(ctx, tx, companyId, segmentId)
+		return err
+	})
+
+	return entries, err
+}
+
+// FlagsUsingSegmentTx is GetFlagsUsingSegment in the transaction, the one deleting the segment holds its lock so no
+// flag starts using it before it's gone
+func (s *System) FlagsUsingSegmentTx(ctx context.Context, tx pgx.Tx, companyId, segmentId string) ([]CompanyFlagEntry, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT
+			f.id,
+			def.name,
+			env.id,
+			env.name,
+			env.env_id,
+			agent.agent_id,
+			COALESCE(agent.name, ''),
+			COALESCE(project.name, '')
+		FROM public.flag f
+			JOIN public.flag_definition def ON def.id = f.definition_id
+			JOIN public.environment env ON env.id = f.environment_id
+			JOIN public.agent agent ON agent.id = f.agent_id
+			JOIN public.project project ON project.id = agent.project_id
+			JOIN public.company company ON company.id = project.company_id
+		WHERE company.company_id = $2
+			AND (f.targeting_rules @> jsonb_build_array(jsonb_build_object('conditions', jsonb_build_array(
+				jsonb_build_object('operator', 'in_segment', 'value', $1::text))))
+			OR f.targeting_rules @> jsonb_build_array(jsonb_build_object('conditions', jsonb_build_array(
+				jsonb_build_object('operator', 'not_in_segment', 'value', $1::text)))))`, segmentId, companyId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return []CompanyFlagEntry{}, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get segment flags: %v", err)
+	}
+	defer rows.Close()
+
+	entries := make([]CompanyFlagEntry, 0)
+	for rows.Next() {
+		entry := CompanyFlagEntry{}
+		if err := rows.Scan(
+			&entry.Flag.Details.ID,
+			&entry.Flag.Details.Name,
+			&entry.Environment.Id,
+			&entry.Environment.Name,
+			&entry.Environment.EnvironmentId,
+			&entry.Environment.AgentId,
+			&entry.Environment.AgentName,
+			&entry.Environment.ProjectName,
+		); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("failed to scan row: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("failed to get segment flags: %v", rows.Err())
+	}
+
+	return entries, nil
+}
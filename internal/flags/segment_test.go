@@ -0,0 +1,95 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentContains(t *testing.T) {
+	segment := &Segment{
+		ID:       "staff",
+		Name:     "Internal staff",
+		Included: []string{"contractor-1"},
+		Excluded: []string{"ex-employee"},
+		Rules: []SegmentRule{
+			{Conditions: []Condition{{Attribute: "email", Operator: OperatorMatches, Value: `@flags\.gg$`}}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		context  EvaluationContext
+		expected bool
+	}{
+		{
+			name:     "Rule match",
+			context:  EvaluationContext{TargetingKey: "user-1", Context: map[string]interface{}{"email": "a@flags.gg"}},
+			expected: true,
+		},
+		{
+			name:     "Explicitly included",
+			context:  EvaluationContext{TargetingKey: "contractor-1", Context: map[string]interface{}{"email": "c@example.com"}},
+			expected: true,
+		},
+		{
+			name:     "Excluded wins over rules",
+			context:  EvaluationContext{TargetingKey: "ex-employee", Context: map[string]interface{}{"email": "old@flags.gg"}},
+			expected: false,
+		},
+		{
+			name:     "No match",
+			context:  EvaluationContext{TargetingKey: "user-2", Context: map[string]interface{}{"email": "b@example.com"}},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := segment.Contains(tt.context)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, in)
+		})
+	}
+}
+
+func TestFlagEvaluateInSegment(t *testing.T) {
+	flag := Flag{
+		Enabled:        true,
+		DefaultVariant: VariantDisabled,
+		TargetingRules: []TargetingRule{
+			{
+				ID:         "staff-only",
+				Variant:    VariantEnabled,
+				Conditions: []Condition{{Operator: OperatorInSegment, Value: "staff"}},
+			},
+		},
+	}
+	flag.WithSegments(map[string]*Segment{
+		"staff": {ID: "staff", Included: []string{"user-1"}},
+	})
+	assert.Equal(t, []string{"staff"}, flag.segmentIds())
+
+	evaluation, err := flag.Evaluate(EvaluationContext{TargetingKey: "user-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, true, evaluation.Value)
+	assert.Equal(t, "staff-only", evaluation.RuleID)
+
+	evaluation, err = flag.Evaluate(EvaluationContext{TargetingKey: "user-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, false, evaluation.Value)
+	assert.Equal(t, ReasonDefault, evaluation.Reason)
+
+	flag.WithSegments(nil)
+	_, err = flag.Evaluate(EvaluationContext{TargetingKey: "user-1"})
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestValidateSegment(t *testing.T) {
+	assert.NoError(t, ValidateSegment(&Segment{Name: "Beta"}))
+	assert.ErrorIs(t, ValidateSegment(&Segment{}), ErrInvalidSegment)
+	assert.ErrorIs(t, ValidateSegment(&Segment{
+		Name:  "Nested",
+		Rules: []SegmentRule{{Conditions: []Condition{{Attribute: "x", Operator: OperatorInSegment, Value: "other"}}}},
+	}), ErrInvalidSegment)
+}
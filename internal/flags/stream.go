@@ -0,0 +1,231 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+)
+
+const (
+	// streamHeartbeat keeps idle streams open through proxies that drop quiet connections
+	streamHeartbeat = 15 * time.Second
+	// streamPollInterval is how often an environment with open streams is checked for changes the bus missed,
+	// change events reload it straight away
+	streamPollInterval = 30 * time.Second
+	// maxStreamConnections is how many streams one instance holds open, across every environment
+	maxStreamConnections = 1000
+)
+
+var (
+	ErrTooManyStreams   = errors.New("too many open flag streams")
+	ErrStreamLoadFailed = errors.New("failed to read the environment's flags")
+)
+
+// streamKey is the environment a stream follows, as the agent identified it
+type streamKey struct {
+	ProjectID     string
+	AgentID       string
+	EnvironmentID string
+}
+
+// streamEvent is one full flag set, ID is a fingerprint of it so a reconnecting client with the same ID is up to date
+type streamEvent struct {
+	ID   string
+	Data []byte
+}
+
+// streamLoader reads the environment's current sdk payload
+type streamLoader func(ctx context.Context, key streamKey) (*AgentResponse, error)
+
+// streamEnvironment is the shared watch on one environment, there is one however many clients follow it
+type streamEnvironment struct {
+	subscribers map[chan streamEvent]struct{}
+	latest      *streamEvent
+	cancel      context.CancelFunc
+	refresh     chan struct{}
+}
+
+// StreamHub fans environment changes out to the open streams of this instance
+type StreamHub struct {
+	mu sync.Mutex
+	// ctx is the hub's own, loads and watches outlive the request that started them and end when the hub closes
+	ctx          context.Context
+	stop         context.CancelFunc
+	load         streamLoader
+	pollInterval time.Duration
+	limit        int
+	connections  int
+	environments map[streamKey]*streamEnvironment
+	// unsubscribe stops the change events, once the container closes
+	unsubscribe func()
+}
+
+func newStreamHub(load streamLoader, pollInterval time.Duration, limit int) *StreamHub {
+	ctx, stop := context.WithCancel(context.Background())
+	return &StreamHub{
+		ctx:          ctx,
+		stop:         stop,
+		load:         load,
+		pollInterval: pollInterval,
+		limit:        limit,
+		environments: make(map[streamKey]*streamEnvironment),
+	}
+}
+
+// newStreamEvent fingerprints the payload, the event id is the ETag GET /v1/flags gives the same flags
+func newStreamEvent(res *AgentResponse) (*streamEvent, error) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamEvent{
+		ID:   payloadTag(data),
+		Data: data,
+	}, nil
+}
+
+// subscribe opens a stream on the environment, the returned event is its current flag set.
+// The channel only ever holds the newest change, a slow client skips straight to it
+func (h *StreamHub) subscribe(key streamKey) (chan streamEvent, *streamEvent, func(), error) {
+	h.mu.Lock()
+	if h.connections >= h.limit {
+		h.mu.Unlock()
+		return nil, nil, nil, ErrTooManyStreams
+	}
+	h.connections++
+	env, watching := h.environments[key]
+	if !watching {
+		// the watch starts with the environment, so whoever finds it in the map finds it watched
+		watchCtx, cancel := context.WithCancel(h.ctx)
+		env = &streamEnvironment{
+			subscribers: make(map[chan streamEvent]struct{}),
+			cancel:      cancel,
+			refresh:     make(chan struct{}, 1),
+		}
+		h.environments[key] = env
+		go h.watch(watchCtx, key, env)
+	}
+	events := make(chan streamEvent, 1)
+	env.subscribers[events] = struct{}{}
+	latest := env.latest
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.connections--
+		delete(env.subscribers, events)
+		if len(env.subscribers) == 0 && h.environments[key] == env {
+			delete(h.environments, key)
+			env.cancel()
+		}
+	}
+
+	if latest == nil {
+		// the hub's context, a client leaving mid load mustn't fail the others waiting on the environment
+		res, err := h.load(h.ctx, key)
+		if err != nil {
+			unsubscribe()
+			return nil, nil, nil, err
+		}
+		event, err := newStreamEvent(res)
+		if err != nil {
+			unsubscribe()
+			return nil, nil, nil, err
+		}
+
+		// the watch may have published a newer set while this one loaded
+		h.mu.Lock()
+		if env.latest == nil {
+			env.latest = event
+		}
+		latest = env.latest
+		h.mu.Unlock()
+	}
+
+	return events, latest, unsubscribe, nil
+}
+
+// Close stops following changes and every environment's watch, the container calls it as it closes
+func (h *StreamHub) Close() {
+	if h.unsubscribe != nil {
+		h.unsubscribe()
+	}
+	h.stop()
+}
+
+// changed asks every watched environment the event reaches to reload
+func (h *StreamHub) changed(event bus.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, env := range h.environments {
+		if !event.Affects(key.AgentID, key.EnvironmentID) {
+			continue
+		}
+		select {
+		case env.refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch reloads the environment on each change event and poll until its last stream closes, publishing each change
+func (h *StreamHub) watch(ctx context.Context, key streamKey, env *streamEnvironment) {
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-env.refresh:
+		}
+
+		res, err := h.load(ctx, key)
+		if err != nil || res == nil {
+			continue
+		}
+		event, err := newStreamEvent(res)
+		if err != nil {
+			continue
+		}
+		h.publish(env, event)
+	}
+}
+
+// publish hands the event to every subscriber of the environment, unless it's the flag set they already have
+func (h *StreamHub) publish(env *streamEnvironment, event *streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if env.latest != nil && env.latest.ID == event.ID {
+		return
+	}
+	env.latest = event
+
+	for events := range env.subscribers {
+		select {
+		case <-events:
+		default:
+		}
+		events <- *event
+	}
+}
+
+// sdkPayload strips what the sdk doesn't get, targeting and prerequisites are evaluated server side so the rules
+// themselves and the dashboard metadata stay out of it
+func sdkPayload(res *AgentResponse) {
+	for i := range res.Flags {
+		res.Flags[i].TargetingRules = nil
+		res.Flags[i].Rollout = nil
+		res.Flags[i].Prerequisites = nil
+		res.Flags[i].Details.FlagMetadata = FlagMetadata{}
+	}
+}
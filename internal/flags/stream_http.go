@@ -0,0 +1,134 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+)
+
+// sharedStreamHub is the container key of the stream hub
+type sharedStreamHub struct{}
+
+// streams is the container's hub, every stream shares it whichever System handles the request
+func (s *System) streams() *StreamHub {
+	return s.Shared(sharedStreamHub{}, func() interface{} {
+		hub := newStreamHub(s.loadStream, streamPollInterval, maxStreamConnections)
+		hub.unsubscribe = bus.Subscribe(hub.changed)
+		return hub
+	}).(*StreamHub)
+}
+
+// loadStream reads the environment's sdk payload, a read that didn't finish is an error rather than an empty flag set
+func (s *System) loadStream(ctx context.Context, key streamKey) (*AgentResponse, error) {
+	res, err := s.GetAgentFlagsFromDB(ctx, key.ProjectID, key.AgentID, key.EnvironmentID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrStreamLoadFailed
+	}
+	sdkPayload(res)
+	return res, nil
+}
+
+// StreamAgentFlags handles GET /v1/flags/stream, sending the agent's full flag set on connect and again whenever
+// anything in it changes
+func (s *System) StreamAgentFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	projectId, agentId, environmentId, err := NewOFREPSystem(s.Container).extractCredentials(r)
+	if err != nil {
+		w.WriteHeader(credentialsStatus(err))
+		return
+	}
+	if environmentId == "" {
+		resolvedEnvironmentId, err := s.defaultEnvironment(ctx, projectId, agentId)
+		if err != nil || resolvedEnvironmentId == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		environmentId = resolvedEnvironmentId
+	}
+
+	valid, err := s.ValidAgentInDB(ctx, projectId, agentId, environmentId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// the server's write timeout is for ordinary requests, a stream stays open until the client leaves
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to clear stream write deadline: %v", err)
+	}
+
+	events, current, unsubscribe, err := s.streams().subscribe(streamKey{
+		ProjectID:     projectId,
+		AgentID:       agentId,
+		EnvironmentID: environmentId,
+	})
+	if err != nil {
+		if errors.Is(err, ErrTooManyStreams) {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to open flag stream: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// a client resuming with the flag set it already has only needs what changes from here
+	if r.Header.Get("Last-Event-ID") != current.ID {
+		if err := writeStreamEvent(w, *current); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if err := writeStreamEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event streamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: flags\ndata: %s\n\n", event.ID, event.Data)
+	return err
+}
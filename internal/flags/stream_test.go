@@ -0,0 +1,211 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEnvironment is a flag set the hub polls, changed by the test
+type fakeEnvironment struct {
+	mu      sync.Mutex
+	enabled bool
+}
+
+func (f *fakeEnvironment) load(_ context.Context, _ streamKey) (*AgentResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &AgentResponse{
+		Flags: []Flag{{
+			Enabled: f.enabled,
+			Details: Details{
+				ID:   "1",
+				Name: "feature",
+			},
+		}},
+	}, nil
+}
+
+func (f *fakeEnvironment) set(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled = enabled
+}
+
+func TestNewStreamEventFollowsPayload(t *testing.T) {
+	env := &fakeEnvironment{}
+	first, _ := env.load(context.Background(), streamKey{})
+	second, _ := env.load(context.Background(), streamKey{})
+
+	a, err := newStreamEvent(first)
+	assert.NoError(t, err)
+	b, err := newStreamEvent(second)
+	assert.NoError(t, err)
+	assert.Equal(t, a.ID, b.ID)
+
+	env.set(true)
+	changed, _ := env.load(context.Background(), streamKey{})
+	c, err := newStreamEvent(changed)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a.ID, c.ID)
+}
+
+func TestStreamHubPublishesChanges(t *testing.T) {
+	env := &fakeEnvironment{}
+	hub := newStreamHub(env.load, 10*time.Millisecond, 10)
+	key := streamKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	events, current, unsubscribe, err := hub.subscribe(key)
+	assert.NoError(t, err)
+	defer unsubscribe()
+
+	// the second stream shares the first one's watch
+	_, shared, unsubscribeShared, err := hub.subscribe(key)
+	assert.NoError(t, err)
+	assert.Equal(t, current.ID, shared.ID)
+	unsubscribeShared()
+
+	env.set(true)
+	select {
+	case event := <-events:
+		assert.NotEqual(t, current.ID, event.ID)
+		assert.Contains(t, string(event.Data), `"enabled":true`)
+	case <-time.After(time.Second):
+		t.Fatal("no event after the flag changed")
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %s without a change", event.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamHubConnectionLimit(t *testing.T) {
+	env := &fakeEnvironment{}
+	hub := newStreamHub(env.load, time.Hour, 1)
+	key := streamKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	_, _, unsubscribe, err := hub.subscribe(key)
+	assert.NoError(t, err)
+
+	_, _, _, err = hub.subscribe(key)
+	assert.ErrorIs(t, err, ErrTooManyStreams)
+
+	unsubscribe()
+	assert.Empty(t, hub.environments)
+
+	_, _, unsubscribe, err = hub.subscribe(key)
+	assert.NoError(t, err)
+	unsubscribe()
+}
+
+func TestStreamHubReloadsOnChangeEvent(t *testing.T) {
+	env := &fakeEnvironment{}
+	// the poll never comes round in the test, only the change event can reload
+	hub := newStreamHub(env.load, time.Hour, 10)
+	key := streamKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	events, current, unsubscribe, err := hub.subscribe(key)
+	assert.NoError(t, err)
+	defer unsubscribe()
+
+	env.set(true)
+	hub.changed(bus.Event{Kind: bus.KindFlag, Action: bus.ActionUpdated, AgentID: "agent", EnvironmentID: "other"})
+	select {
+	case <-events:
+		t.Fatal("reloaded for another environment's change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	hub.changed(bus.Event{Kind: bus.KindFlag, Action: bus.ActionUpdated, AgentID: "agent", EnvironmentID: "env"})
+	select {
+	case event := <-events:
+		assert.NotEqual(t, current.ID, event.ID)
+	case <-time.After(time.Second):
+		t.Fatal("no event after the change event")
+	}
+}
+
+func TestStreamHubWatchesForLateSubscribers(t *testing.T) {
+	env := &fakeEnvironment{}
+	failed := errors.New("database went away")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls sync.Map
+	load := func(ctx context.Context, key streamKey) (*AgentResponse, error) {
+		// the first subscriber's load hangs until the second has joined, then fails
+		if _, loaded := calls.LoadOrStore("first", true); !loaded {
+			close(started)
+			<-release
+			return nil, failed
+		}
+		return env.load(ctx, key)
+	}
+	hub := newStreamHub(load, time.Hour, 10)
+	defer hub.Close()
+	key := streamKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	firstErr := make(chan error)
+	go func() {
+		_, _, _, err := hub.subscribe(key)
+		firstErr <- err
+	}()
+	<-started
+
+	events, current, unsubscribe, err := hub.subscribe(key)
+	assert.NoError(t, err)
+	defer unsubscribe()
+	close(release)
+	assert.ErrorIs(t, <-firstErr, failed)
+
+	// the first subscriber leaving doesn't take the watch with it
+	env.set(true)
+	hub.changed(bus.Event{Kind: bus.KindFlag, Action: bus.ActionUpdated, AgentID: "agent", EnvironmentID: "env"})
+	select {
+	case event := <-events:
+		assert.NotEqual(t, current.ID, event.ID)
+	case <-time.After(time.Second):
+		t.Fatal("no event for the subscriber that stayed")
+	}
+}
+
+func TestStreamHubSkipsFailedReloads(t *testing.T) {
+	env := &fakeEnvironment{}
+	var failing sync.Mutex
+	fail := false
+	load := func(ctx context.Context, key streamKey) (*AgentResponse, error) {
+		failing.Lock()
+		defer failing.Unlock()
+		if fail {
+			return nil, ErrStreamLoadFailed
+		}
+		return env.load(ctx, key)
+	}
+	hub := newStreamHub(load, time.Hour, 10)
+	defer hub.Close()
+	key := streamKey{ProjectID: "project", AgentID: "agent", EnvironmentID: "env"}
+
+	events, current, unsubscribe, err := hub.subscribe(key)
+	assert.NoError(t, err)
+	defer unsubscribe()
+
+	failing.Lock()
+	fail = true
+	failing.Unlock()
+	hub.changed(bus.Event{Kind: bus.KindFlag, Action: bus.ActionUpdated, AgentID: "agent", EnvironmentID: "env"})
+	select {
+	case event := <-events:
+		t.Fatalf("published %s from a failed load", event.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	hub.mu.Lock()
+	assert.Equal(t, current.ID, hub.environments[key].latest.ID)
+	hub.mu.Unlock()
+}
@@ -0,0 +1,530 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operator is the comparison a targeting condition applies to a context attribute
+type Operator string
+
+const (
+	OperatorEquals         Operator = "equals"
+	OperatorNotEquals      Operator = "not_equals"
+	OperatorIn             Operator = "in"
+	OperatorNotIn          Operator = "not_in"
+	OperatorMatches        Operator = "matches"
+	OperatorSemverEquals   Operator = "semver_eq"
+	OperatorSemverGreater  Operator = "semver_gt"
+	OperatorSemverLess     Operator = "semver_lt"
+	OperatorGreaterThan    Operator = "gt"
+	OperatorGreaterOrEqual Operator = "gte"
+	OperatorLessThan       Operator = "lt"
+	OperatorLessOrEqual    Operator = "lte"
+	OperatorBefore         Operator = "before"
+	OperatorAfter          Operator = "after"
+)
+
+// AttributeTargetingKey addresses the OFREP targeting key rather than a context attribute
+const AttributeTargetingKey = "targetingKey"
+
+// Condition compares a single context attribute against a value
+type Condition struct {
+	Attribute string      `json:"attribute"`
+	Operator  Operator    `json:"operator"`
+	Value     interface{} `json:"value"`
+
+	// pattern is the compiled pattern of a matches condition, compiled as the condition is loaded
+	pattern *regexp.Regexp
+}
+
+// UnmarshalJSON compiles a matches condition's pattern once as it's loaded, rather than on every evaluation. A pattern
+// that doesn't compile is left for validating or evaluating the condition to report
+func (c *Condition) UnmarshalJSON(data []byte) error {
+	type condition Condition
+	var decoded condition
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*c = Condition(decoded)
+
+	if pattern, ok := c.Value.(string); ok && c.Operator == OperatorMatches {
+		c.pattern, _ = regexp.Compile(pattern)
+	}
+	return nil
+}
+
+// TargetingRule serves its variant when every condition matches, rules are checked in order
+type TargetingRule struct {
+	ID         string      `json:"id"`
+	Conditions []Condition `json:"conditions"`
+	Variant    string      `json:"variant"`
+}
+
+// Evaluation is the outcome of evaluating a flag against a context
+type Evaluation struct {
+	Variant            string
+	Value              interface{}
+	Reason             ResolutionReason
+	RuleID             string
+	PrerequisiteFailed string
+}
+
+var (
+	ErrInvalidRule     = errors.New("invalid targeting rule")
+	ErrUnknownOperator = errors.New("unknown operator")
+)
+
+// Evaluate resolves the flag for a context, applying targeting rules and then any rollout when the flag is enabled,
+// a flag whose prerequisites aren't met serves its off variant
+func (f *Flag) Evaluate(ec EvaluationContext) (Evaluation, error) {
+	return f.evaluate(ec, newPrerequisiteRun(false))
+}
+
+func (f *Flag) evaluate(ec EvaluationContext, run *prerequisiteRun) (Evaluation, error) {
+	if f.Enabled {
+		if failed := f.failedPrerequisite(ec, run); failed != "" {
+			variant := f.offVariant()
+			value, err := f.VariantValue(variant)
+			if err != nil {
+				return Evaluation{}, err
+			}
+			return Evaluation{
+				Variant:            variant,
+				Value:              value,
+				Reason:             ReasonDefault,
+				PrerequisiteFailed: failed,
+			}, nil
+		}
+	}
+
+	if !f.Enabled || (len(f.TargetingRules) == 0 && f.Rollout == nil) {
+		variant, value, err := f.Resolve()
+		if err != nil {
+			return Evaluation{}, err
+		}
+		return Evaluation{
+			Variant: variant,
+			Value:   value,
+			Reason:  ReasonStatic,
+		}, nil
+	}
+
+	for _, rule := range f.TargetingRules {
+		matched, err := rule.matches(ec, f.segments)
+		if err != nil {
+			return Evaluation{}, err
+		}
+		if !matched {
+			continue
+		}
+
+		value, err := f.VariantValue(rule.Variant)
+		if err != nil {
+			return Evaluation{}, err
+		}
+		return Evaluation{
+			Variant: rule.Variant,
+			Value:   value,
+			Reason:  ReasonTargetingMatch,
+			RuleID:  rule.ID,
+		}, nil
+	}
+
+	if f.Rollout != nil {
+		variant, err := f.Rollout.allocate(f.Details.Name, ec.TargetingKey)
+		if err != nil {
+			return Evaluation{}, err
+		}
+		value, err := f.VariantValue(variant)
+		if err != nil {
+			return Evaluation{}, err
+		}
+		return Evaluation{
+			Variant: variant,
+			Value:   value,
+			Reason:  ReasonSplit,
+		}, nil
+	}
+
+	variant := f.onVariant()
+	value, err := f.VariantValue(variant)
+	if err != nil {
+		return Evaluation{}, err
+	}
+	return Evaluation{
+		Variant: variant,
+		Value:   value,
+		Reason:  ReasonDefault,
+	}, nil
+}
+
+func (r TargetingRule) matches(ec EvaluationContext, segments map[string]*Segment) (bool, error) {
+	if len(r.Conditions) == 0 {
+		return false, nil
+	}
+
+	for _, c := range r.Conditions {
+		matched, err := c.matches(ec, segments)
+		if err != nil {
+			return false, fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// attribute looks up a context attribute, dotted names reach into nested objects
+func (ec EvaluationContext) attribute(name string) (interface{}, bool) {
+	if name == AttributeTargetingKey {
+		return ec.TargetingKey, ec.TargetingKey != ""
+	}
+
+	var current interface{} = ec.Context
+	for _, part := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, current != nil
+}
+
+// matches reports whether the context satisfies the condition, a missing attribute never matches
+func (c Condition) matches(ec EvaluationContext, segments map[string]*Segment) (bool, error) {
+	if c.Operator == OperatorInSegment || c.Operator == OperatorNotInSegment {
+		id, _ := c.Value.(string)
+		segment, ok := segments[id]
+		if !ok {
+			return false, fmt.Errorf("%w: %s", ErrSegmentNotFound, id)
+		}
+		in, err := segment.Contains(ec)
+		if err != nil {
+			return false, err
+		}
+		return in == (c.Operator == OperatorInSegment), nil
+	}
+
+	actual, ok := ec.attribute(c.Attribute)
+	if !ok {
+		return false, nil
+	}
+
+	switch c.Operator {
+	case OperatorEquals:
+		return valuesEqual(actual, c.Value), nil
+	case OperatorNotEquals:
+		return !valuesEqual(actual, c.Value), nil
+	case OperatorIn, OperatorNotIn:
+		list, ok := c.Value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%w: %s requires a list", ErrInvalidRule, c.Operator)
+		}
+		found := false
+		for _, v := range list {
+			if valuesEqual(actual, v) {
+				found = true
+				break
+			}
+		}
+		return found == (c.Operator == OperatorIn), nil
+	case OperatorMatches:
+		re := c.pattern
+		if re == nil {
+			pattern, ok := c.Value.(string)
+			if !ok {
+				return false, fmt.Errorf("%w: %s requires a pattern", ErrInvalidRule, c.Operator)
+			}
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return false, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+			}
+		}
+		return re.MatchString(fmt.Sprint(actual)), nil
+	case OperatorSemverEquals, OperatorSemverGreater, OperatorSemverLess:
+		want, ok := c.Value.(string)
+		if !ok {
+			return false, fmt.Errorf("%w: %s requires a version", ErrInvalidRule, c.Operator)
+		}
+		got, ok := actual.(string)
+		if !ok {
+			return false, nil
+		}
+		cmp, err := compareSemver(got, want)
+		if err != nil {
+			return false, nil
+		}
+		switch c.Operator {
+		case OperatorSemverGreater:
+			return cmp > 0, nil
+		case OperatorSemverLess:
+			return cmp < 0, nil
+		}
+		return cmp == 0, nil
+	case OperatorGreaterThan, OperatorGreaterOrEqual, OperatorLessThan, OperatorLessOrEqual:
+		want, ok := toNumber(c.Value)
+		if !ok {
+			return false, fmt.Errorf("%w: %s requires a number", ErrInvalidRule, c.Operator)
+		}
+		got, ok := toNumber(actual)
+		if !ok {
+			return false, nil
+		}
+		switch c.Operator {
+		case OperatorGreaterThan:
+			return got > want, nil
+		case OperatorGreaterOrEqual:
+			return got >= want, nil
+		case OperatorLessThan:
+			return got < want, nil
+		}
+		return got <= want, nil
+	case OperatorBefore, OperatorAfter:
+		want, ok := toTime(c.Value)
+		if !ok {
+			return false, fmt.Errorf("%w: %s requires a date", ErrInvalidRule, c.Operator)
+		}
+		got, ok := toTime(actual)
+		if !ok {
+			return false, nil
+		}
+		if c.Operator == OperatorBefore {
+			return got.Before(want), nil
+		}
+		return got.After(want), nil
+	}
+
+	return false, fmt.Errorf("%w: %s", ErrUnknownOperator, c.Operator)
+}
+
+// ValidateTargetingRules checks rules against the flag they will be stored on
+func ValidateTargetingRules(flag *Flag, rules []TargetingRule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if rule.ID == "" {
+			return fmt.Errorf("%w: rule id is required", ErrInvalidRule)
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("%w: duplicate rule id %q", ErrInvalidRule, rule.ID)
+		}
+		seen[rule.ID] = true
+
+		if len(rule.Conditions) == 0 {
+			return fmt.Errorf("%w: rule %q has no conditions", ErrInvalidRule, rule.ID)
+		}
+		if _, err := flag.VariantValue(rule.Variant); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+
+		for _, c := range rule.Conditions {
+			if c.Attribute == "" && c.Operator != OperatorInSegment && c.Operator != OperatorNotInSegment {
+				return fmt.Errorf("%w: rule %q has a condition without an attribute", ErrInvalidRule, rule.ID)
+			}
+			if err := c.validate(); err != nil {
+				return fmt.Errorf("rule %q: %w", rule.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c Condition) validate() error {
+	switch c.Operator {
+	case OperatorInSegment, OperatorNotInSegment:
+		if id, ok := c.Value.(string); !ok || id == "" {
+			return fmt.Errorf("%w: %s requires a segment id", ErrInvalidRule, c.Operator)
+		}
+		return nil
+	case OperatorEquals, OperatorNotEquals:
+		return nil
+	case OperatorIn, OperatorNotIn:
+		if _, ok := c.Value.([]interface{}); !ok {
+			return fmt.Errorf("%w: %s requires a list", ErrInvalidRule, c.Operator)
+		}
+		return nil
+	case OperatorMatches:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s requires a pattern", ErrInvalidRule, c.Operator)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		return nil
+	case OperatorSemverEquals, OperatorSemverGreater, OperatorSemverLess:
+		version, ok := c.Value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s requires a version", ErrInvalidRule, c.Operator)
+		}
+		if _, err := parseSemver(version); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		return nil
+	case OperatorGreaterThan, OperatorGreaterOrEqual, OperatorLessThan, OperatorLessOrEqual:
+		if _, ok := toNumber(c.Value); !ok {
+			return fmt.Errorf("%w: %s requires a number", ErrInvalidRule, c.Operator)
+		}
+		return nil
+	case OperatorBefore, OperatorAfter:
+		if _, ok := toTime(c.Value); !ok {
+			return fmt.Errorf("%w: %s requires an RFC3339 date", ErrInvalidRule, c.Operator)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownOperator, c.Operator)
+}
+
+// valuesEqual compares JSON decoded values, numbers compare numerically and everything else as text
+func valuesEqual(a, b interface{}) bool {
+	if an, ok := toNumber(a); ok {
+		if bn, ok := toNumber(b); ok {
+			return an == bn
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toTime accepts RFC3339 strings, plain dates, or unix seconds
+func toTime(v interface{}) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, true
+		}
+		if t, err := time.Parse(time.DateOnly, s); err == nil {
+			return t, true
+		}
+		return time.Time{}, false
+	}
+	if n, ok := toNumber(v); ok {
+		return time.Unix(int64(n), 0), true
+	}
+	return time.Time{}, false
+}
+
+type semver struct {
+	core       [3]int
+	prerelease []string
+}
+
+func parseSemver(v string) (semver, error) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var sv semver
+	core := v
+	if i := strings.Index(v, "-"); i >= 0 {
+		core = v[:i]
+		sv.prerelease = strings.Split(v[i+1:], ".")
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return sv, fmt.Errorf("invalid version %q", v)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return sv, fmt.Errorf("invalid version %q", v)
+		}
+		sv.core[i] = n
+	}
+	return sv, nil
+}
+
+// compareSemver returns -1, 0 or 1 following semver precedence, build metadata is ignored
+func compareSemver(a, b string) (int, error) {
+	av, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+	bv, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range av.core {
+		if av.core[i] != bv.core[i] {
+			if av.core[i] < bv.core[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	// a release outranks any of its pre-releases
+	switch {
+	case len(av.prerelease) == 0 && len(bv.prerelease) == 0:
+		return 0, nil
+	case len(av.prerelease) == 0:
+		return 1, nil
+	case len(bv.prerelease) == 0:
+		return -1, nil
+	}
+
+	for i := 0; i < len(av.prerelease) && i < len(bv.prerelease); i++ {
+		ap, bp := av.prerelease[i], bv.prerelease[i]
+		if ap == bp {
+			continue
+		}
+		an, aErr := strconv.Atoi(ap)
+		bn, bErr := strconv.Atoi(bp)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an < bn {
+				return -1, nil
+			}
+			return 1, nil
+		case aErr == nil:
+			return -1, nil
+		case bErr == nil:
+			return 1, nil
+		}
+		if ap < bp {
+			return -1, nil
+		}
+		return 1, nil
+	}
+
+	switch {
+	case len(av.prerelease) < len(bv.prerelease):
+		return -1, nil
+	case len(av.prerelease) > len(bv.prerelease):
+		return 1, nil
+	}
+	return 0, nil
+}
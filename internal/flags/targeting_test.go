@@ -0,0 +1,241 @@
+package flags
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagEvaluateTargeting(t *testing.T) {
+	flag := Flag{
+		Enabled: true,
+		Type:    FlagTypeString,
+		Variants: []Variant{
+			{Name: "control", Value: "a"},
+			{Name: "beta", Value: "b"},
+			{Name: "internal", Value: "c"},
+		},
+		DefaultVariant: "control",
+		OffVariant:     "control",
+		TargetingRules: []TargetingRule{
+			{
+				ID:      "staff",
+				Variant: "internal",
+				Conditions: []Condition{
+					{Attribute: "email", Operator: OperatorMatches, Value: `@flags\.gg$`},
+				},
+			},
+			{
+				ID:      "beta-testers",
+				Variant: "beta",
+				Conditions: []Condition{
+					{Attribute: "country", Operator: OperatorIn, Value: []interface{}{"GB", "IE"}},
+					{Attribute: "app.version", Operator: OperatorSemverGreater, Value: "2.0.0"},
+				},
+			},
+			{
+				ID:      "pinned-user",
+				Variant: "beta",
+				Conditions: []Condition{
+					{Attribute: AttributeTargetingKey, Operator: OperatorEquals, Value: "user-42"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		context         EvaluationContext
+		expectedVariant string
+		expectedReason  ResolutionReason
+		expectedRule    string
+	}{
+		{
+			name: "Regex match",
+			context: EvaluationContext{
+				Context: map[string]interface{}{"email": "dev@flags.gg"},
+			},
+			expectedVariant: "internal",
+			expectedReason:  ReasonTargetingMatch,
+			expectedRule:    "staff",
+		},
+		{
+			name: "All conditions match",
+			context: EvaluationContext{
+				Context: map[string]interface{}{
+					"country": "GB",
+					"app":     map[string]interface{}{"version": "2.1.0"},
+				},
+			},
+			expectedVariant: "beta",
+			expectedReason:  ReasonTargetingMatch,
+			expectedRule:    "beta-testers",
+		},
+		{
+			name: "One condition fails",
+			context: EvaluationContext{
+				Context: map[string]interface{}{
+					"country": "GB",
+					"app":     map[string]interface{}{"version": "1.9.9"},
+				},
+			},
+			expectedVariant: "control",
+			expectedReason:  ReasonDefault,
+		},
+		{
+			name:            "Targeting key match",
+			context:         EvaluationContext{TargetingKey: "user-42"},
+			expectedVariant: "beta",
+			expectedReason:  ReasonTargetingMatch,
+			expectedRule:    "pinned-user",
+		},
+		{
+			name:            "Empty context",
+			context:         EvaluationContext{},
+			expectedVariant: "control",
+			expectedReason:  ReasonDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evaluation, err := flag.Evaluate(tt.context)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedVariant, evaluation.Variant)
+			assert.Equal(t, tt.expectedReason, evaluation.Reason)
+			assert.Equal(t, tt.expectedRule, evaluation.RuleID)
+		})
+	}
+}
+
+func TestFlagEvaluateDisabledIgnoresRules(t *testing.T) {
+	flag := Flag{
+		TargetingRules: []TargetingRule{
+			{
+				ID:         "everyone",
+				Variant:    VariantEnabled,
+				Conditions: []Condition{{Attribute: AttributeTargetingKey, Operator: OperatorMatches, Value: ".*"}},
+			},
+		},
+	}
+
+	evaluation, err := flag.Evaluate(EvaluationContext{TargetingKey: "user-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, false, evaluation.Value)
+	assert.Equal(t, ReasonStatic, evaluation.Reason)
+}
+
+func TestConditionOperators(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition Condition
+		value     interface{}
+		expected  bool
+	}{
+		{"Equals number", Condition{Operator: OperatorEquals, Value: float64(3)}, "3", true},
+		{"Not equals", Condition{Operator: OperatorNotEquals, Value: "a"}, "b", true},
+		{"Not in", Condition{Operator: OperatorNotIn, Value: []interface{}{"a", "b"}}, "a", false},
+		{"Greater than", Condition{Operator: OperatorGreaterThan, Value: float64(10)}, float64(11), true},
+		{"Greater or equal", Condition{Operator: OperatorGreaterOrEqual, Value: float64(10)}, float64(10), true},
+		{"Less than", Condition{Operator: OperatorLessThan, Value: float64(10)}, float64(10), false},
+		{"Less or equal", Condition{Operator: OperatorLessOrEqual, Value: float64(10)}, float64(9.5), true},
+		{"Non numeric attribute", Condition{Operator: OperatorGreaterThan, Value: float64(10)}, "many", false},
+		{"Semver equals", Condition{Operator: OperatorSemverEquals, Value: "v1.2.0"}, "1.2", true},
+		{"Semver pre-release is lower", Condition{Operator: OperatorSemverLess, Value: "1.2.0"}, "1.2.0-rc.1", true},
+		{"Before date", Condition{Operator: OperatorBefore, Value: "2025-01-01T00:00:00Z"}, "2024-06-01", true},
+		{"After date", Condition{Operator: OperatorAfter, Value: "2025-01-01T00:00:00Z"}, "2024-06-01T00:00:00Z", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.condition.Attribute = "attr"
+			matched, err := tt.condition.matches(EvaluationContext{
+				Context: map[string]interface{}{"attr": tt.value},
+			}, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, matched)
+		})
+	}
+}
+
+func TestConditionCompilesPatternOnLoad(t *testing.T) {
+	var rules []TargetingRule
+	assert.NoError(t, json.Unmarshal([]byte(`[{"id":"staff","variant":"enabled","conditions":[
+		{"attribute":"email","operator":"matches","value":"@flags\\.gg$"},
+		{"attribute":"plan","operator":"equals","value":"pro"}
+	]}]`), &rules))
+	staff := rules[0].Conditions[0]
+	if assert.NotNil(t, staff.pattern) {
+		assert.Equal(t, `@flags\.gg$`, staff.pattern.String())
+	}
+	assert.Nil(t, rules[0].Conditions[1].pattern)
+
+	matched, err := staff.matches(EvaluationContext{Context: map[string]interface{}{"email": "dev@flags.gg"}}, nil)
+	assert.NoError(t, err)
+	assert.True(t, matched)
+
+	// a pattern that doesn't compile is still refused when it's checked
+	var broken Condition
+	assert.NoError(t, json.Unmarshal([]byte(`{"attribute":"plan","operator":"matches","value":"("}`), &broken))
+	assert.Nil(t, broken.pattern)
+	_, err = broken.matches(EvaluationContext{Context: map[string]interface{}{"plan": "pro"}}, nil)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+}
+
+func TestValidateTargetingRules(t *testing.T) {
+	flag := &Flag{}
+
+	tests := []struct {
+		name        string
+		rules       []TargetingRule
+		expectedErr error
+	}{
+		{
+			name: "Valid rule",
+			rules: []TargetingRule{
+				{ID: "a", Variant: VariantEnabled, Conditions: []Condition{{Attribute: "plan", Operator: OperatorEquals, Value: "pro"}}},
+			},
+		},
+		{
+			name: "Unknown variant",
+			rules: []TargetingRule{
+				{ID: "a", Variant: "blue", Conditions: []Condition{{Attribute: "plan", Operator: OperatorEquals, Value: "pro"}}},
+			},
+			expectedErr: ErrVariantNotFound,
+		},
+		{
+			name: "Unknown operator",
+			rules: []TargetingRule{
+				{ID: "a", Variant: VariantEnabled, Conditions: []Condition{{Attribute: "plan", Operator: "like", Value: "pro"}}},
+			},
+			expectedErr: ErrUnknownOperator,
+		},
+		{
+			name: "Bad regex",
+			rules: []TargetingRule{
+				{ID: "a", Variant: VariantEnabled, Conditions: []Condition{{Attribute: "plan", Operator: OperatorMatches, Value: "("}}},
+			},
+			expectedErr: ErrInvalidRule,
+		},
+		{
+			name: "Duplicate rule id",
+			rules: []TargetingRule{
+				{ID: "a", Variant: VariantEnabled, Conditions: []Condition{{Attribute: "plan", Operator: OperatorEquals, Value: "pro"}}},
+				{ID: "a", Variant: VariantDisabled, Conditions: []Condition{{Attribute: "plan", Operator: OperatorEquals, Value: "free"}}},
+			},
+			expectedErr: ErrInvalidRule,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTargetingRules(flag, tt.rules)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
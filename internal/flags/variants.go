@@ -0,0 +1,192 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// FlagType is the declared type of the values a flag's variants hold
+type FlagType string
+
+const (
+	FlagTypeBoolean FlagType = "boolean"
+	FlagTypeString  FlagType = "string"
+	FlagTypeInteger FlagType = "integer"
+	FlagTypeFloat   FlagType = "float"
+	FlagTypeObject  FlagType = "object"
+)
+
+// Variant is a named value a flag can resolve to
+type Variant struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// implicit variants of a boolean flag that has not declared any of its own
+const (
+	VariantEnabled  = "enabled"
+	VariantDisabled = "disabled"
+)
+
+var (
+	ErrUnknownFlagType     = errors.New("unknown flag type")
+	ErrVariantTypeMismatch = errors.New("variant value does not match flag type")
+	ErrVariantNotFound     = errors.New("variant not found")
+	ErrDuplicateVariant    = errors.New("duplicate variant name")
+)
+
+func (t FlagType) valid() bool {
+	switch t {
+	case FlagTypeBoolean, FlagTypeString, FlagTypeInteger, FlagTypeFloat, FlagTypeObject:
+		return true
+	}
+	return false
+}
+
+// matches reports whether a JSON decoded value is of the declared type
+func (t FlagType) matches(value interface{}) bool {
+	switch t {
+	case FlagTypeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case FlagTypeString:
+		_, ok := value.(string)
+		return ok
+	case FlagTypeInteger:
+		switch v := value.(type) {
+		case int, int32, int64:
+			return true
+		case float64:
+			return v == math.Trunc(v) && !math.IsInf(v, 0)
+		case json.Number:
+			_, err := v.Int64()
+			return err == nil
+		}
+		return false
+	case FlagTypeFloat:
+		switch value.(type) {
+		case int, int32, int64, float32, float64, json.Number:
+			return true
+		}
+		return false
+	case FlagTypeObject:
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// FlagType returns the declared type of the flag, flags created before types existed are boolean
+func (f *Flag) FlagType() FlagType {
+	if f.Type == "" {
+		return FlagTypeBoolean
+	}
+	return f.Type
+}
+
+// variants returns the declared variants, or the implicit enabled/disabled pair for plain boolean flags
+func (f *Flag) variants() []Variant {
+	if len(f.Variants) == 0 && f.FlagType() == FlagTypeBoolean {
+		return []Variant{
+			{Name: VariantEnabled, Value: true},
+			{Name: VariantDisabled, Value: false},
+		}
+	}
+	return f.Variants
+}
+
+func (f *Flag) onVariant() string {
+	if f.DefaultVariant != "" {
+		return f.DefaultVariant
+	}
+	return VariantEnabled
+}
+
+func (f *Flag) offVariant() string {
+	if f.OffVariant != "" {
+		return f.OffVariant
+	}
+	return VariantDisabled
+}
+
+// VariantValue looks up a variant by name and checks it against the declared type
+func (f *Flag) VariantValue(name string) (interface{}, error) {
+	for _, v := range f.variants() {
+		if v.Name != name {
+			continue
+		}
+		if !f.FlagType().matches(v.Value) {
+			return nil, fmt.Errorf("%w: variant %q is not a %s", ErrVariantTypeMismatch, name, f.FlagType())
+		}
+		return v.Value, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrVariantNotFound, name)
+}
+
+// Resolve returns the variant and value the flag serves without any evaluation context
+func (f *Flag) Resolve() (string, interface{}, error) {
+	variant := f.offVariant()
+	if f.Enabled {
+		variant = f.onVariant()
+	}
+
+	value, err := f.VariantValue(variant)
+	if err != nil {
+		return "", nil, err
+	}
+	return variant, value, nil
+}
+
+// ValidateVariants checks a flag definition before it is stored
+func ValidateVariants(flagType FlagType, variants []Variant, defaultVariant, offVariant string) error {
+	if flagType == "" {
+		flagType = FlagTypeBoolean
+	}
+	if !flagType.valid() {
+		return fmt.Errorf("%w: %s", ErrUnknownFlagType, flagType)
+	}
+
+	seen := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if v.Name == "" {
+			return fmt.Errorf("%w: variant name is required", ErrVariantNotFound)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("%w: %q", ErrDuplicateVariant, v.Name)
+		}
+		seen[v.Name] = true
+
+		if !flagType.matches(v.Value) {
+			return fmt.Errorf("%w: variant %q is not a %s", ErrVariantTypeMismatch, v.Name, flagType)
+		}
+	}
+
+	f := Flag{
+		Type:           flagType,
+		Variants:       variants,
+		DefaultVariant: defaultVariant,
+		OffVariant:     offVariant,
+	}
+	if _, err := f.VariantValue(f.onVariant()); err != nil {
+		return err
+	}
+	if _, err := f.VariantValue(f.offVariant()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// variantsJSON encodes variants for a jsonb column, never producing a JSON null
+func variantsJSON(variants []Variant) ([]byte, error) {
+	if variants == nil {
+		variants = []Variant{}
+	}
+	return json.Marshal(variants)
+}
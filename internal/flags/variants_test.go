@@ -0,0 +1,176 @@
+package flags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagResolve(t *testing.T) {
+	tests := []struct {
+		name            string
+		flag            Flag
+		expectedVariant string
+		expectedValue   interface{}
+		expectedErr     error
+	}{
+		{
+			name:            "Boolean flag enabled",
+			flag:            Flag{Enabled: true},
+			expectedVariant: VariantEnabled,
+			expectedValue:   true,
+		},
+		{
+			name:            "Boolean flag disabled",
+			flag:            Flag{Enabled: false},
+			expectedVariant: VariantDisabled,
+			expectedValue:   false,
+		},
+		{
+			name: "String flag serves default variant",
+			flag: Flag{
+				Enabled: true,
+				Type:    FlagTypeString,
+				Variants: []Variant{
+					{Name: "blue", Value: "#0000ff"},
+					{Name: "red", Value: "#ff0000"},
+				},
+				DefaultVariant: "blue",
+				OffVariant:     "red",
+			},
+			expectedVariant: "blue",
+			expectedValue:   "#0000ff",
+		},
+		{
+			name: "String flag serves off variant",
+			flag: Flag{
+				Type: FlagTypeString,
+				Variants: []Variant{
+					{Name: "blue", Value: "#0000ff"},
+					{Name: "red", Value: "#ff0000"},
+				},
+				DefaultVariant: "blue",
+				OffVariant:     "red",
+			},
+			expectedVariant: "red",
+			expectedValue:   "#ff0000",
+		},
+		{
+			name: "Stored value does not match type",
+			flag: Flag{
+				Enabled:        true,
+				Type:           FlagTypeInteger,
+				Variants:       []Variant{{Name: "on", Value: "ten"}, {Name: "off", Value: float64(0)}},
+				DefaultVariant: "on",
+				OffVariant:     "off",
+			},
+			expectedErr: ErrVariantTypeMismatch,
+		},
+		{
+			name: "Default variant missing",
+			flag: Flag{
+				Enabled:        true,
+				Type:           FlagTypeFloat,
+				Variants:       []Variant{{Name: "low", Value: 0.1}},
+				DefaultVariant: "high",
+			},
+			expectedErr: ErrVariantNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variant, value, err := tt.flag.Resolve()
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedVariant, variant)
+			assert.Equal(t, tt.expectedValue, value)
+		})
+	}
+}
+
+func TestValidateVariants(t *testing.T) {
+	tests := []struct {
+		name           string
+		flagType       FlagType
+		variants       []Variant
+		defaultVariant string
+		offVariant     string
+		expectedErr    error
+	}{
+		{
+			name: "Plain boolean flag",
+		},
+		{
+			name:     "Integer variants",
+			flagType: FlagTypeInteger,
+			variants: []Variant{
+				{Name: "small", Value: float64(10)},
+				{Name: "large", Value: float64(100)},
+			},
+			defaultVariant: "large",
+			offVariant:     "small",
+		},
+		{
+			name:     "Object variants",
+			flagType: FlagTypeObject,
+			variants: []Variant{
+				{Name: "on", Value: map[string]interface{}{"limit": float64(5)}},
+				{Name: "off", Value: map[string]interface{}{}},
+			},
+			defaultVariant: "on",
+			offVariant:     "off",
+		},
+		{
+			name:        "Unknown type",
+			flagType:    FlagType("date"),
+			expectedErr: ErrUnknownFlagType,
+		},
+		{
+			name:     "Fractional value for integer flag",
+			flagType: FlagTypeInteger,
+			variants: []Variant{
+				{Name: "on", Value: 1.5},
+				{Name: "off", Value: float64(0)},
+			},
+			defaultVariant: "on",
+			offVariant:     "off",
+			expectedErr:    ErrVariantTypeMismatch,
+		},
+		{
+			name:     "Duplicate variant",
+			flagType: FlagTypeString,
+			variants: []Variant{
+				{Name: "on", Value: "a"},
+				{Name: "on", Value: "b"},
+			},
+			defaultVariant: "on",
+			offVariant:     "on",
+			expectedErr:    ErrDuplicateVariant,
+		},
+		{
+			name:     "Off variant not declared",
+			flagType: FlagTypeString,
+			variants: []Variant{
+				{Name: "on", Value: "a"},
+			},
+			defaultVariant: "on",
+			offVariant:     "missing",
+			expectedErr:    ErrVariantNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateVariants(tt.flagType, tt.variants, tt.defaultVariant, tt.offVariant)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
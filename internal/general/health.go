@@ -0,0 +1,61 @@
+package general
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/keloran/go-healthcheck"
+)
+
+// healthPingTimeout is how long the health check waits on the database before calling it down
+const healthPingTimeout = 2 * time.Second
+
+type Health struct {
+	healthcheck.Health
+	Database DatabaseHealth `json:"database"`
+}
+
+type DatabaseHealth struct {
+	Status healthcheck.HealthStatus `json:"status"`
+	Pool   container.PoolStats      `json:"pool"`
+}
+
+// Health is the service health check with the state of the database pool
+func (s *System) Health(w http.ResponseWriter, r *http.Request) {
+	hc := healthcheck.HealthCheck{
+		Name:         os.Getenv("SERVICE_NAME"),
+		URL:          r.Host,
+		Dependencies: os.Getenv("SERVICE_DEPENDENCIES"),
+	}
+
+	service, err := hc.Check()
+	if err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Health check failed: %v", err)
+		service.Status = healthcheck.HealthFail
+	}
+
+	health := Health{
+		Health: service,
+		Database: DatabaseHealth{
+			Status: healthcheck.HealthPass,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+	defer cancel()
+	if err := s.DB.Ping(ctx); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Database health check failed: %v", err)
+		health.Status = healthcheck.HealthFail
+		health.Database.Status = healthcheck.HealthFail
+	}
+	health.Database.Pool = s.PoolStats()
+
+	w.Header().Set("Content-Type", "application/health+json")
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package keyring
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/golang-jwt/jwt/v5"
+	ConfigBuilder "github.com/keloran/go-config"
+)
+
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmES256 = "ES256"
+
+	// minSecretLength is the shortest HS256 secret accepted, the size of the hash
+	minSecretLength = 32
+
+	// developmentKeyId is the key a development instance signs with when none are configured
+	developmentKeyId = "development"
+
+	// defaultLegacySecret is the secret keys were signed with when none was configured, anyone can sign with it
+	defaultLegacySecret = "flags-gg-jwt-signing-key-change-in-production"
+)
+
+var (
+	ErrNoKeys             = errors.New("no api key signing keys configured, set API_KEY_SIGNING_KEYS")
+	ErrNoSigningKey       = errors.New("the active api key signing key can't sign")
+	ErrUnknownKey         = errors.New("token signed with an unknown key")
+	ErrKeyMismatch        = errors.New("token algorithm doesn't match its key")
+	ErrMalformedKeys      = errors.New("malformed api key signing keys")
+	ErrPublicLegacySecret = errors.New("the api key legacy secret is the public default, only a development instance may use it")
+)
+
+// Key is one key of the ring, a key without a private half only verifies the tokens it signed before
+type Key struct {
+	ID        string
+	Algorithm string
+	signing   interface{}
+	verifying interface{}
+}
+
+// Ring holds the keys API key tokens are verified with, and the one new tokens are signed with
+type Ring struct {
+	keys   map[string]*Key
+	order  []*Key
+	active *Key
+	// legacy is the HS256 secret keys were signed with before the ring named its keys, they have no kid
+	legacy []byte
+}
+
+// FromConfig builds the ring the project config loaded, a development instance without keys gets a fixed secret
+func FromConfig(cfg *ConfigBuilder.Config) (*Ring, error) {
+	spec, _ := cfg.ProjectProperties["api_key_signing_keys"].(string)
+	activeId, _ := cfg.ProjectProperties["api_key_signing_key_id"].(string)
+	legacy, _ := cfg.ProjectProperties["api_key_legacy_secret"].(string)
+
+	var ring *Ring
+	if strings.TrimSpace(spec) == "" {
+		if !cfg.Local.Development {
+			return nil, ErrNoKeys
+		}
+		logs.Logf("No api key signing keys configured, using the development key")
+		ring = Development()
+	} else {
+		var err error
+		if ring, err = Parse(spec, activeId); err != nil {
+			return nil, err
+		}
+	}
+	if legacy != "" {
+		if len(legacy) < minSecretLength {
+			return nil, fmt.Errorf("%w: legacy secret is shorter than %d bytes", ErrMalformedKeys, minSecretLength)
+		}
+		if legacy == defaultLegacySecret && !cfg.Local.Development {
+			return nil, ErrPublicLegacySecret
+		}
+		ring.legacy = []byte(legacy)
+	}
+
+	return ring, nil
+}
+
+// Development is a ring of one well known secret, never for anything but a development instance
+func Development() *Ring {
+	key := &Key{
+		ID:        developmentKeyId,
+		Algorithm: AlgorithmHS256,
+		signing:   []byte("flags-gg-development-api-key-signing-secret"),
+	}
+	key.verifying = key.signing
+	ring, _ := newRing([]*Key{key}, developmentKeyId)
+	return ring
+}
+
+// Parse reads a ring from comma separated id:algorithm:key entries. The key is base64, the secret for HS256 and
+// the PKCS8 private or PKIX public key as DER for EdDSA and ES256. New tokens are signed with the key of activeId,
+// or the first key that can sign
+func Parse(spec, activeId string) (*Ring, error) {
+	var keys []*Key
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, err := parseKey(entry)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return newRing(keys, activeId)
+}
+
+func newRing(keys []*Key, activeId string) (*Ring, error) {
+	ring := &Ring{
+		keys: make(map[string]*Key, len(keys)),
+	}
+	for _, key := range keys {
+		if _, ok := ring.keys[key.ID]; ok {
+			return nil, fmt.Errorf("%w: key %s appears twice", ErrMalformedKeys, key.ID)
+		}
+		ring.keys[key.ID] = key
+		ring.order = append(ring.order, key)
+		if ring.active == nil && activeId == "" && key.signing != nil {
+			ring.active = key
+		}
+	}
+	if activeId != "" {
+		ring.active = ring.keys[activeId]
+		if ring.active == nil {
+			return nil, fmt.Errorf("%w: active key %s isn't in the ring", ErrMalformedKeys, activeId)
+		}
+	}
+	if ring.active == nil || ring.active.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return ring, nil
+}
+
+func parseKey(entry string) (*Key, error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("%w: entries are id:algorithm:key", ErrMalformedKeys)
+	}
+	key := &Key{
+		ID:        parts[0],
+		Algorithm: parts[1],
+	}
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s isn't base64: %v", ErrMalformedKeys, key.ID, err)
+	}
+
+	if key.Algorithm == AlgorithmHS256 {
+		if len(material) < minSecretLength {
+			return nil, fmt.Errorf("%w: key %s is shorter than %d bytes", ErrMalformedKeys, key.ID, minSecretLength)
+		}
+		key.signing = material
+		key.verifying = material
+		return key, nil
+	}
+
+	if private, err := x509.ParsePKCS8PrivateKey(material); err == nil {
+		switch private := private.(type) {
+		case ed25519.PrivateKey:
+			key.signing, key.verifying = private, private.Public()
+		case *ecdsa.PrivateKey:
+			key.signing, key.verifying = private, &private.PublicKey
+		}
+	} else if public, err := x509.ParsePKIXPublicKey(material); err == nil {
+		key.verifying = public
+	} else {
+		return nil, fmt.Errorf("%w: key %s is neither a PKCS8 private nor a PKIX public key", ErrMalformedKeys, key.ID)
+	}
+
+	switch public := key.verifying.(type) {
+	case ed25519.PublicKey:
+		if key.Algorithm == AlgorithmEdDSA {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if key.Algorithm == AlgorithmES256 && public.Curve == elliptic.P256() {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: key %s isn't an %s key", ErrMalformedKeys, key.ID, key.Algorithm)
+}
+
+// Sign signs the claims with the active key, naming it in the kid header
+func (r *Ring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(r.active.Algorithm), claims)
+	token.Header["kid"] = r.active.ID
+	return token.SignedString(r.active.signing)
+}
+
+// Parse verifies the token against the key its kid names and reads it into the claims
+func (r *Ring) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, r.keyfunc, jwt.WithValidMethods(r.methods()))
+}
+
+func (r *Ring) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return r.unnamedKey(token)
+	}
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, ErrKeyMismatch
+	}
+	return key.verifying, nil
+}
+
+// unnamedKey verifies a token without a kid, one signed before the ring named its keys. It was signed with the
+// legacy secret when one is configured, otherwise with the key that is active now
+func (r *Ring) unnamedKey(token *jwt.Token) (interface{}, error) {
+	if r.legacy != nil && token.Method.Alg() == AlgorithmHS256 {
+		return r.legacy, nil
+	}
+	if token.Method.Alg() != r.active.Algorithm {
+		return nil, ErrKeyMismatch
+	}
+	return r.active.verifying, nil
+}
+
+func (r *Ring) methods() []string {
+	var methods []string
+	seen := make(map[string]bool)
+	for _, key := range r.order {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			methods = append(methods, key.Algorithm)
+		}
+	}
+	if r.legacy != nil && !seen[AlgorithmHS256] {
+		methods = append(methods, AlgorithmHS256)
+	}
+	return methods
+}
+
+// JWK is a public key of the ring as a JSON Web Key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS is the key set edge relays verify tokens with
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the asymmetric keys of the ring, the HS256 secrets stay secret
+func (r *Ring) JWKS() JWKS {
+	set := JWKS{
+		Keys: []JWK{},
+	}
+	for _, key := range r.order {
+		switch public := key.verifying.(type) {
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.ID,
+				Algorithm: key.Algorithm,
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(public),
+			})
+		case *ecdsa.PublicKey:
+			x, y := make([]byte, 32), make([]byte, 32)
+			public.X.FillBytes(x)
+			public.Y.FillBytes(y)
+			set.Keys = append(set.Keys, JWK{
+				KeyType:   "EC",
+				KeyID:     key.ID,
+				Algorithm: key.Algorithm,
+				Use:       "sig",
+				Curve:     "P-256",
+				X:         base64.RawURLEncoding.EncodeToString(x),
+				Y:         base64.RawURLEncoding.EncodeToString(y),
+			})
+		}
+	}
+	return set
+}
@@ -0,0 +1,231 @@
+package keyring
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/stretchr/testify/assert"
+)
+
+func ed25519Entry(t *testing.T, id string) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	assert.NoError(t, err)
+
+	return id + ":EdDSA:" + base64.StdEncoding.EncodeToString(privateDER),
+		id + ":EdDSA:" + base64.StdEncoding.EncodeToString(publicDER)
+}
+
+func es256Entry(t *testing.T, id string) string {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+
+	return id + ":ES256:" + base64.StdEncoding.EncodeToString(der)
+}
+
+func hs256Entry(id string) string {
+	return id + ":HS256:" + base64.StdEncoding.EncodeToString([]byte("a secret of at least thirty-two bytes"))
+}
+
+func claims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Subject:   "project:agent",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func TestRingSignsWithTheActiveKey(t *testing.T) {
+	edPrivate, _ := ed25519Entry(t, "ed")
+	tests := []struct {
+		name      string
+		spec      string
+		activeId  string
+		algorithm string
+	}{
+		{name: "EdDSA", spec: edPrivate, algorithm: AlgorithmEdDSA},
+		{name: "ES256", spec: es256Entry(t, "ec"), algorithm: AlgorithmES256},
+		{name: "HS256", spec: hs256Entry("hs"), algorithm: AlgorithmHS256},
+		{name: "Chosen key", spec: edPrivate + "," + hs256Entry("hs"), activeId: "hs", algorithm: AlgorithmHS256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring, err := Parse(tt.spec, tt.activeId)
+			assert.NoError(t, err)
+
+			signed, err := ring.Sign(claims())
+			assert.NoError(t, err)
+
+			token, err := ring.Parse(signed, &jwt.RegisteredClaims{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.algorithm, token.Method.Alg())
+			assert.Equal(t, ring.active.ID, token.Header["kid"])
+		})
+	}
+}
+
+func TestRingVerifiesWithRetiredKeys(t *testing.T) {
+	oldPrivate, oldPublic := ed25519Entry(t, "old")
+	newPrivate, _ := ed25519Entry(t, "new")
+
+	old, err := Parse(oldPrivate, "")
+	assert.NoError(t, err)
+	signed, err := old.Sign(claims())
+	assert.NoError(t, err)
+
+	// the old key is kept only to verify what it signed
+	ring, err := Parse(newPrivate+","+oldPublic, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", ring.active.ID)
+	_, err = ring.Parse(signed, &jwt.RegisteredClaims{})
+	assert.NoError(t, err)
+
+	dropped, err := Parse(newPrivate, "")
+	assert.NoError(t, err)
+	_, err = dropped.Parse(signed, &jwt.RegisteredClaims{})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestRingRejectsForgedTokens(t *testing.T) {
+	edPrivate, edPublic := ed25519Entry(t, "ed")
+	ring, err := Parse(edPrivate, "")
+	assert.NoError(t, err)
+
+	// the public key used as an HMAC secret must not pass for the key
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	token.Header["kid"] = "ed"
+	forged, err := token.SignedString([]byte(edPublic))
+	assert.NoError(t, err)
+	_, err = ring.Parse(forged, &jwt.RegisteredClaims{})
+	assert.Error(t, err)
+
+	// a token without a kid is checked against the active key, not whichever key would take it
+	otherPrivate, _ := ed25519Entry(t, "other")
+	other, err := Parse(otherPrivate, "")
+	assert.NoError(t, err)
+	unnamed := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims())
+	signed, err := unnamed.SignedString(other.active.signing)
+	assert.NoError(t, err)
+	_, err = ring.Parse(signed, &jwt.RegisteredClaims{})
+	assert.Error(t, err)
+}
+
+func TestRingVerifiesTokensWithoutKid(t *testing.T) {
+	edPrivate, _ := ed25519Entry(t, "ed")
+	ring, err := Parse(edPrivate, "")
+	assert.NoError(t, err)
+
+	unnamed := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims())
+	signed, err := unnamed.SignedString(ring.active.signing)
+	assert.NoError(t, err)
+	_, err = ring.Parse(signed, &jwt.RegisteredClaims{})
+	assert.NoError(t, err)
+
+	// keys issued before the ring were signed with the plain legacy secret
+	legacySecret := "the secret keys were signed with before the ring"
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims()).SignedString([]byte(legacySecret))
+	assert.NoError(t, err)
+	_, err = ring.Parse(legacy, &jwt.RegisteredClaims{})
+	assert.Error(t, err)
+
+	ring.legacy = []byte(legacySecret)
+	_, err = ring.Parse(legacy, &jwt.RegisteredClaims{})
+	assert.NoError(t, err)
+
+	wrongSecret, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims()).SignedString([]byte("not the legacy secret at all, no"))
+	assert.NoError(t, err)
+	_, err = ring.Parse(wrongSecret, &jwt.RegisteredClaims{})
+	assert.Error(t, err)
+}
+
+func TestParseMalformedKeys(t *testing.T) {
+	_, edPublic := ed25519Entry(t, "ed")
+	tests := []struct {
+		name     string
+		spec     string
+		activeId string
+		err      error
+	}{
+		{name: "Nothing", spec: " , ", err: ErrNoKeys},
+		{name: "Missing parts", spec: "ed:EdDSA", err: ErrMalformedKeys},
+		{name: "Not base64", spec: "ed:EdDSA:???", err: ErrMalformedKeys},
+		{name: "Short secret", spec: "hs:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), err: ErrMalformedKeys},
+		{name: "Wrong algorithm", spec: "ed:ES256:" + edPublic[len("ed:EdDSA:"):], err: ErrMalformedKeys},
+		{name: "Duplicate id", spec: hs256Entry("hs") + "," + hs256Entry("hs"), err: ErrMalformedKeys},
+		{name: "Unknown active key", spec: hs256Entry("hs"), activeId: "other", err: ErrMalformedKeys},
+		{name: "Only public keys", spec: edPublic, err: ErrNoSigningKey},
+		{name: "Public active key", spec: hs256Entry("hs") + "," + edPublic, activeId: "ed", err: ErrNoSigningKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.spec, tt.activeId)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	edPrivate, _ := ed25519Entry(t, "ed")
+	ring, err := Parse(edPrivate+","+es256Entry(t, "ec")+","+hs256Entry("hs"), "")
+	assert.NoError(t, err)
+
+	set := ring.JWKS()
+	assert.Len(t, set.Keys, 2)
+	assert.Equal(t, "ed", set.Keys[0].KeyID)
+	assert.Equal(t, "OKP", set.Keys[0].KeyType)
+	assert.Equal(t, "Ed25519", set.Keys[0].Curve)
+	assert.Len(t, set.Keys[0].X, 43)
+	assert.Equal(t, "ec", set.Keys[1].KeyID)
+	assert.Equal(t, "EC", set.Keys[1].KeyType)
+	assert.Len(t, set.Keys[1].Y, 43)
+}
+
+func TestFromConfig(t *testing.T) {
+	cfg := &ConfigBuilder.Config{
+		ProjectProperties: map[string]interface{}{},
+	}
+	_, err := FromConfig(cfg)
+	assert.ErrorIs(t, err, ErrNoKeys)
+
+	cfg.Local.Development = true
+	ring, err := FromConfig(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, developmentKeyId, ring.active.ID)
+
+	cfg.ProjectProperties["api_key_signing_keys"] = hs256Entry("hs")
+	ring, err = FromConfig(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "hs", ring.active.ID)
+	assert.Nil(t, ring.legacy)
+
+	cfg.ProjectProperties["api_key_legacy_secret"] = "the secret keys were signed with before"
+	ring, err = FromConfig(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("the secret keys were signed with before"), ring.legacy)
+
+	cfg.ProjectProperties["api_key_legacy_secret"] = "too short"
+	_, err = FromConfig(cfg)
+	assert.ErrorIs(t, err, ErrMalformedKeys)
+
+	// the secret that shipped as the default is public, only development may still accept keys signed with it
+	cfg.ProjectProperties["api_key_legacy_secret"] = defaultLegacySecret
+	_, err = FromConfig(cfg)
+	assert.NoError(t, err)
+	cfg.Local.Development = false
+	_, err = FromConfig(cfg)
+	assert.ErrorIs(t, err, ErrPublicLegacySecret)
+}
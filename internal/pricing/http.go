@@ -6,16 +6,16 @@ import (
 	"strconv"
 	"time"
 
-	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/flags-gg/orchestrator/internal/container"
 )
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -3,7 +3,6 @@ package pricing
 import (
 	"context"
 	"database/sql"
-	"strings"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -34,21 +33,8 @@ type Price struct {
 }
 
 func (s *System) GetPrices(ctx context.Context) ([]Price, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var prices []Price
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
       payment_plans.name,
       payment_plans.price,
@@ -98,22 +84,9 @@ func (s *System) GetPrices(ctx context.Context) ([]Price, error) {
 }
 
 func (s *System) GetPrice(ctx context.Context, title string) (Price, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return Price{}, nil
-		}
-		return Price{}, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var price Price
 	var stripe Stripe
-	row := client.QueryRow(ctx, `
+	row := s.DB.QueryRow(ctx, `
     SELECT
       payment_plans.name,
       payment_plans.price,
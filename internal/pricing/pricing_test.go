@@ -14,6 +14,7 @@ import (
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/docker/go-connections/nat"
 
+	"github.com/flags-gg/orchestrator/internal/container"
 	ConfigBuilder "github.com/keloran/go-config"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
@@ -127,7 +128,13 @@ func setupTestSystem(t *testing.T) *System {
 		t.Fatalf("Failed to build config: %v", err)
 	}
 
-	return NewSystem(c)
+	cont, err := container.New(context.Background(), c)
+	if err != nil {
+		t.Fatalf("Failed to open database pool: %v", err)
+	}
+	t.Cleanup(cont.Close)
+
+	return NewSystem(cont)
 }
 
 func TestGetCompanyPricing(t *testing.T) {
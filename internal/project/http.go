@@ -9,17 +9,18 @@ import (
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
 	"github.com/flags-gg/orchestrator/internal/agent"
+	"github.com/flags-gg/orchestrator/internal/authz"
 	"github.com/flags-gg/orchestrator/internal/company"
-	ConfigBuilder "github.com/keloran/go-config"
+	"github.com/flags-gg/orchestrator/internal/container"
 )
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -60,7 +61,7 @@ func (s *System) GetProjects(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -96,12 +97,16 @@ func (s *System) GetProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, r.PathValue("projectId")) {
+		return
+	}
+
 	proj, err := s.GetProjectFromDB(ctx, companyId, r.PathValue("projectId"))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -142,7 +147,7 @@ func (s *System) CreateProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, usr.ID)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, usr.ID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -184,13 +189,27 @@ func (s *System) UpdateProject(w http.ResponseWriter, r *http.Request) {
 		Enabled bool   `json:"enabled"`
 	}
 
-	clerk.SetKey(s.Config.Clerk.Key)
-	_, err := clerkUser.Get(ctx, r.Header.Get("x-user-subject"))
+	userId, err := s.getUserId(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, projectId) {
+		return
+	}
+
 	proj := ProjEdit{}
 	if err := json.NewDecoder(r.Body).Decode(&proj); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode body: %v", err)
@@ -224,14 +243,28 @@ func (s *System) DeleteProject(w http.ResponseWriter, r *http.Request) {
 
 	projectId := r.PathValue("projectId")
 
-	clerk.SetKey(s.Config.Clerk.Key)
-	_, err := clerkUser.Get(ctx, r.Header.Get("x-user-subject"))
+	userId, err := s.getUserId(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	if err := agent.NewSystem(s.Config).DeleteAllAgentsForProject(ctx, projectId); err != nil {
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, projectId) {
+		return
+	}
+
+	if err := agent.NewSystem(s.Container).DeleteAllAgentsForProject(ctx, projectId); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update project: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -265,13 +298,27 @@ func (s *System) UpdateProjectImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clerk.SetKey(s.Config.Clerk.Key)
-	_, err := clerkUser.Get(ctx, r.Header.Get("x-user-subject"))
+	userId, err := s.getUserId(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, projectId) {
+		return
+	}
+
 	if err := s.UpdateProjectImageInDB(ctx, projectId, imageChange.Image); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update project: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -294,7 +341,7 @@ func (s *System) GetLimits(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -304,6 +351,10 @@ func (s *System) GetLimits(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Project, r.PathValue("projectId")) {
+		return
+	}
+
 	projectId := r.PathValue("projectId")
 
 	limits, err := s.GetLimitsFromDB(ctx, companyId, projectId)
@@ -4,9 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"strings"
 
 	"github.com/flags-gg/orchestrator/internal/agent"
+	"github.com/flags-gg/orchestrator/internal/bus"
 	"github.com/flags-gg/orchestrator/internal/environment"
 	"github.com/google/uuid"
 )
@@ -22,20 +22,7 @@ type Project struct {
 }
 
 func (s *System) GetProjectsFromDB(ctx context.Context, companyId string) ([]Project, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT DISTINCT
       project.id,
       project.project_id,
@@ -83,22 +70,9 @@ func (s *System) GetProjectsFromDB(ctx context.Context, companyId string) ([]Pro
 }
 
 func (s *System) GetProjectFromDB(ctx context.Context, companyId, projectId string) (*Project, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var project Project
 	var pLogo sql.NullString
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
         SELECT
           project.name,
           project.id,
@@ -127,23 +101,11 @@ func (s *System) GetProjectFromDB(ctx context.Context, companyId, projectId stri
 }
 
 func (s *System) CreateProjectInDB(ctx context.Context, companyId, projectName string) (*Project, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
+	var err error
 	// create the project
 	projectId := uuid.New().String()
 	var insertedProjectId string
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
       INSERT INTO public.project (
           company_id,
           project_id,
@@ -159,12 +121,12 @@ func (s *System) CreateProjectInDB(ctx context.Context, companyId, projectName s
 	}
 
 	// create the default agent
-	agentDetails, err := agent.NewSystem(s.Config).CreateAgentInDB(ctx, "Default Agent", projectId)
+	agentDetails, err := agent.NewSystem(s.Container).CreateAgentInDB(ctx, "Default Agent", projectId)
 	if err != nil {
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to create default agent: %v", err)
 	}
 
-	_, err = environment.NewSystem(s.Config).CreateEnvironmentInDB(ctx, "Development", agentDetails.AgentId)
+	_, err = environment.NewSystem(s.Container).CreateEnvironmentInDB(ctx, "Development", agentDetails.AgentId)
 	if err != nil {
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to create default environment: %v", err)
 	}
@@ -177,25 +139,13 @@ func (s *System) CreateProjectInDB(ctx context.Context, companyId, projectName s
 }
 
 func (s *System) UpdateProjectInDB(ctx context.Context, projectId, projectName string, enabled bool) (*Project, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
       UPDATE public.project
       SET name = $1, enabled = $2
       WHERE project_id = $3`, projectName, enabled, projectId); err != nil {
 		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to update project in database: %v", err)
 	}
+	s.publishAgentChanges(ctx, projectId)
 
 	return &Project{
 		ProjectID: projectId,
@@ -204,21 +154,36 @@ func (s *System) UpdateProjectInDB(ctx context.Context, projectId, projectName s
 	}, nil
 }
 
-func (s *System) DeleteProjectInDB(ctx context.Context, projectId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
+// publishAgentChanges tells every agent of the project it changed, switching the project off or on changes what they're
+// served
+func (s *System) publishAgentChanges(ctx context.Context, projectId string) {
+	rows, err := s.DB.Query(ctx, `
+      SELECT agent.agent_id
+      FROM public.agent
+        JOIN public.project ON project.id = agent.project_id
+      WHERE project.project_id = $1`, projectId)
 	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to get project agents: %v", err)
+		return
 	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var agentId string
+		if err := rows.Scan(&agentId); err != nil {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to scan agent: %v", err)
+			return
 		}
-	}()
+		_ = bus.Publish(ctx, bus.Event{
+			Kind:    bus.KindAgent,
+			Action:  bus.ActionUpdated,
+			AgentID: agentId,
+		})
+	}
+}
 
-	if _, err := client.Exec(ctx, `
+func (s *System) DeleteProjectInDB(ctx context.Context, projectId string) error {
+	if _, err := s.DB.Exec(ctx, `
       DELETE FROM public.project
       WHERE project_id = $1`, projectId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to delete project in database: %v", err)
@@ -228,20 +193,7 @@ func (s *System) DeleteProjectInDB(ctx context.Context, projectId string) error
 }
 
 func (s *System) UpdateProjectImageInDB(ctx context.Context, projectId, logo string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
       UPDATE public.project
       SET logo = $1
       WHERE project_id = $2`, logo, projectId); err != nil {
@@ -259,20 +211,7 @@ type AgentLimits struct {
 func (s *System) GetLimitsFromDB(ctx context.Context, companyId, projectId string) (AgentLimits, error) {
 	var limits AgentLimits
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return limits, nil
-		}
-		return limits, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
 		pp.agents,
 		(
@@ -7,6 +7,7 @@ import (
 
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/flags-gg/orchestrator/internal/authz"
 	"github.com/flags-gg/orchestrator/internal/company"
 
 	flagsService "github.com/flags-gg/go-flags"
@@ -51,7 +52,7 @@ func (s *System) GetSecretMenu(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -62,6 +63,10 @@ func (s *System) GetSecretMenu(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.SecretMenu, r.PathValue("menuId")) {
+		return
+	}
+
 	menuId := r.PathValue("menuId")
 	secretMenu, err := s.GetSecretMenuFromDB(ctx, menuId)
 	if err != nil {
@@ -92,7 +97,7 @@ func (s *System) CreateSecretMenu(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -103,6 +108,10 @@ func (s *System) CreateSecretMenu(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.Environment, r.PathValue("environmentId")) {
+		return
+	}
+
 	envId := r.PathValue("environmentId")
 	menuUpdate := SecretMenu{}
 	if err := json.NewDecoder(r.Body).Decode(&menuUpdate); err != nil {
@@ -144,7 +153,7 @@ func (s *System) UpdateSecretMenuState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -155,6 +164,10 @@ func (s *System) UpdateSecretMenuState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.SecretMenu, r.PathValue("menuId")) {
+		return
+	}
+
 	menuId := r.PathValue("menuId")
 	if err := s.UpdateSecretMenuStateInDB(ctx, menuId); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to update secret menu: %v", err)
@@ -179,7 +192,7 @@ func (s *System) UpdateSecretMenuSequence(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -190,6 +203,10 @@ func (s *System) UpdateSecretMenuSequence(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.SecretMenu, r.PathValue("menuId")) {
+		return
+	}
+
 	menuUpdate := SecretMenu{}
 	if err := json.NewDecoder(r.Body).Decode(&menuUpdate); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
@@ -235,7 +252,7 @@ func (s *System) UpdateSecretMenuStyle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -246,6 +263,10 @@ func (s *System) UpdateSecretMenuStyle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.SecretMenu, r.PathValue("menuId")) {
+		return
+	}
+
 	var menuUpdate SecretMenu
 	if err := json.NewDecoder(r.Body).Decode(&menuUpdate); err != nil {
 		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
@@ -354,7 +375,7 @@ func (s *System) GetSecretMenuStyle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	companyId, err := company.NewSystem(s.Config).GetCompanyId(ctx, userId)
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -365,6 +386,10 @@ func (s *System) GetSecretMenuStyle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.NewSystem(s.Container).Allow(w, r, companyId, authz.SecretMenu, r.PathValue("menuId")) {
+		return
+	}
+
 	menuId := r.PathValue("menuId")
 	secretMenu, err := s.GetSecretMenuStyleFromDB(ctx, menuId)
 	if err != nil {
@@ -6,14 +6,14 @@ import (
 	"errors"
 	"strings"
 
-	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	ConfigBuilder "github.com/keloran/go-config"
 )
 
 type System struct {
-	Config *ConfigBuilder.Config
+	*container.Container
 }
 
 type ResetButton struct {
@@ -110,9 +110,9 @@ type EnvironmentDetails struct {
 	Name          string `json:"name"`
 }
 
-func NewSystem(cfg *ConfigBuilder.Config) *System {
+func NewSystem(c *container.Container) *System {
 	return &System{
-		Config: cfg,
+		Container: c,
 	}
 }
 
@@ -120,22 +120,9 @@ func (s *System) GetEnvironmentSecretMenu(ctx context.Context, environmentId str
 	var secretMenu SecretMenu
 	var menuStyle MenuStyle
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return secretMenu, nil
-		}
-		return secretMenu, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var sequence sql.NullString
 
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
         menu_id,
         secret_menu.enabled,
@@ -182,22 +169,9 @@ func (s *System) GetSecretMenuFromDB(ctx context.Context, menuId string) (Secret
 	var menuStyle MenuStyle
 	var envDetails EnvironmentDetails
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return secretMenu, nil
-		}
-		return secretMenu, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var sequence sql.NullString
 
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
         menu_id,
         secret_menu.enabled,
@@ -248,68 +222,31 @@ func (s *System) GetSecretMenuFromDB(ctx context.Context, menuId string) (Secret
 }
 
 func (s *System) UpdateSecretMenuSequenceInDB(ctx context.Context, menuId string, secretMenu SecretMenu) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	sequence := strings.Join(secretMenu.Sequence, ",")
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     UPDATE public.secret_menu
     SET code = $1
     WHERE menu_id = $2`, sequence, menuId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update database: %v", err)
 	}
+	s.publishChange(ctx, menuId, bus.ActionUpdated)
 
 	return nil
 }
 
 func (s *System) UpdateSecretMenuStateInDB(ctx context.Context, menuId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     UPDATE public.secret_menu
     SET enabled = NOT enabled
     WHERE menu_id = $1`, menuId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update database: %v", err)
 	}
+	s.publishChange(ctx, menuId, bus.ActionUpdated)
 
 	return nil
 }
 
 func (s *System) UpdateSecretMenuStyleInDB(ctx context.Context, menuId string, secretMenu SecretMenu) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	if secretMenu.CustomStyle.Id == "" {
 		uu, err := uuid.NewRandom()
 		if err != nil {
@@ -318,7 +255,7 @@ func (s *System) UpdateSecretMenuStyleInDB(ctx context.Context, menuId string, s
 		styleId := uu.String()
 
 		var secretMenuId int
-		if err := client.QueryRow(ctx, `SELECT id FROM public.secret_menu WHERE menu_id = $1`, menuId).Scan(&secretMenuId); err != nil {
+		if err := s.DB.QueryRow(ctx, `SELECT id FROM public.secret_menu WHERE menu_id = $1`, menuId).Scan(&secretMenuId); err != nil {
 			if err.Error() == "context canceled" || errors.Is(err, context.Canceled) {
 				return nil
 			}
@@ -329,7 +266,7 @@ func (s *System) UpdateSecretMenuStyleInDB(ctx context.Context, menuId string, s
 			return s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 		}
 
-		if _, err := client.Exec(ctx, `
+		if _, err := s.DB.Exec(ctx, `
       INSERT INTO public.secret_menu_style (secret_menu_id, close_button, container, reset_button, flag, button_enabled, button_disabled, header, style_id)
       VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
 			secretMenuId,
@@ -342,10 +279,11 @@ func (s *System) UpdateSecretMenuStyleInDB(ctx context.Context, menuId string, s
 			secretMenu.CustomStyle.SQLHeader, styleId); err != nil {
 			return s.Config.Bugfixes.Logger.Errorf("Failed to insert into database: %v", err)
 		}
+		s.publishChange(ctx, menuId, bus.ActionUpdated)
 		return nil
 	}
 
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     	UPDATE public.secret_menu_style
     	SET close_button = $1, container = $2, reset_button = $3, flag = $4, button_enabled = $5, button_disabled = $6, header = $7
     	WHERE style_id = $8`,
@@ -359,24 +297,36 @@ func (s *System) UpdateSecretMenuStyleInDB(ctx context.Context, menuId string, s
 		secretMenu.CustomStyle.Id); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update database: %v", err)
 	}
+	s.publishChange(ctx, menuId, bus.ActionUpdated)
 
 	return nil
 }
 
-func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string, secretMenu SecretMenu) (string, string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", "", nil
-		}
-		return "", "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
+// publishChange tells the agents of the menu's environment it changed, the bus logs its own failures
+func (s *System) publishChange(ctx context.Context, menuId string, action bus.Action) {
+	event := bus.Event{
+		Kind:   bus.KindSecretMenu,
+		Action: action,
+		MenuID: menuId,
 	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
+	if err := s.DB.QueryRow(ctx, `
+    SELECT
+      agent.agent_id,
+      env.env_id
+    FROM public.secret_menu menu
+      JOIN public.environment env ON env.id = menu.environment_id
+      JOIN public.agent ON agent.id = env.agent_id
+    WHERE menu.menu_id = $1`, menuId).Scan(&event.AgentID, &event.EnvironmentID); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			_ = s.Config.Bugfixes.Logger.Errorf("Failed to find secret menu environment: %v", err)
 		}
-	}()
+		return
+	}
 
+	_ = bus.Publish(ctx, event)
+}
+
+func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string, secretMenu SecretMenu) (string, string, error) {
 	sequence := strings.Join(secretMenu.Sequence, ",")
 	menuId, err := uuid.NewRandom()
 	if err != nil {
@@ -385,7 +335,7 @@ func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string,
 
 	var envId int
 	var agentId int
-	if err := client.QueryRow(ctx, `SELECT agent_id, id FROM public.environment WHERE env_id = $1`, environmentId).Scan(&agentId, &envId); err != nil {
+	if err := s.DB.QueryRow(ctx, `SELECT agent_id, id FROM public.environment WHERE env_id = $1`, environmentId).Scan(&agentId, &envId); err != nil {
 		if err.Error() == "context canceled" || errors.Is(err, context.Canceled) {
 			return "", "", nil
 		}
@@ -396,7 +346,7 @@ func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string,
 		return "", "", s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 	}
 
-	if _, err := client.Exec(ctx, `INSERT INTO public.secret_menu (menu_id, environment_id, enabled, code, agent_id) VALUES ($1, $2, $3, $4, $5)`, menuId.String(), envId, secretMenu.Enabled, sequence, agentId); err != nil {
+	if _, err := s.DB.Exec(ctx, `INSERT INTO public.secret_menu (menu_id, environment_id, enabled, code, agent_id) VALUES ($1, $2, $3, $4, $5)`, menuId.String(), envId, secretMenu.Enabled, sequence, agentId); err != nil {
 		return "", "", s.Config.Bugfixes.Logger.Errorf("Failed to insert into database: %v", err)
 	}
 
@@ -408,7 +358,7 @@ func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string,
 		styleId := uu.String()
 
 		var secretMenuId int
-		if err := client.QueryRow(ctx, `SELECT id FROM public.secret_menu WHERE menu_id = $1`, menuId.String()).Scan(&secretMenuId); err != nil {
+		if err := s.DB.QueryRow(ctx, `SELECT id FROM public.secret_menu WHERE menu_id = $1`, menuId.String()).Scan(&secretMenuId); err != nil {
 			if err.Error() == "context canceled" || errors.Is(err, context.Canceled) {
 				return "", "", nil
 			}
@@ -419,7 +369,7 @@ func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string,
 			return "", "", s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
 		}
 
-		if _, err := client.Exec(ctx, `
+		if _, err := s.DB.Exec(ctx, `
       INSERT INTO public.secret_menu_style (secret_menu_id, close_button, container, reset_button, flag, button_enabled, button_disabled, header, style_id)
       VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
 			secretMenuId,
@@ -432,27 +382,16 @@ func (s *System) CreateSecretMenuInDB(ctx context.Context, environmentId string,
 			secretMenu.CustomStyle.SQLHeader, styleId); err != nil {
 			return "", "", s.Config.Bugfixes.Logger.Errorf("Failed to insert into database: %v", err)
 		}
+		s.publishChange(ctx, menuId.String(), bus.ActionCreated)
 		return menuId.String(), uu.String(), nil
 	}
+	s.publishChange(ctx, menuId.String(), bus.ActionCreated)
 
 	return menuId.String(), "", nil
 }
 
 func (s *System) DeleteSecretMenuForEnv(ctx context.Context, envId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     DELETE FROM public.secret_menu
            WHERE environment_id = (
              SELECT id
@@ -462,6 +401,11 @@ func (s *System) DeleteSecretMenuForEnv(ctx context.Context, envId string) error
            )`, envId); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to delete from database: %v", err)
 	}
+	_ = bus.Publish(ctx, bus.Event{
+		Kind:          bus.KindSecretMenu,
+		Action:        bus.ActionDeleted,
+		EnvironmentID: envId,
+	})
 
 	return nil
 }
@@ -471,20 +415,7 @@ func (s *System) GetSecretMenuStyleFromDB(ctx context.Context, menuId string) (S
 	var styleMenu StyleMenu
 	var styleId sql.NullString
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return styleMenu, nil
-		}
-		return styleMenu, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = logs.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
         style_id,
         close_button,
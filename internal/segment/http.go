@@ -0,0 +1,272 @@
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/clerk/clerk-sdk-go/v2"
+	clerkUser "github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/flags-gg/orchestrator/internal/company"
+	"github.com/flags-gg/orchestrator/internal/container"
+	"github.com/flags-gg/orchestrator/internal/flags"
+)
+
+type System struct {
+	*container.Container
+}
+
+func NewSystem(c *container.Container) *System {
+	return &System{
+		Container: c,
+	}
+}
+
+// getUserId returns the user ID, using dev mode config if in development, otherwise Clerk
+func (s *System) getUserId(r *http.Request) (string, error) {
+	if s.Config.Local.Development && s.Config.Clerk.DevUser != "" {
+		return s.Config.Clerk.DevUser, nil
+	}
+
+	// Production mode: use Clerk authentication
+	clerk.SetKey(s.Config.Clerk.Key)
+	usr, err := clerkUser.Get(r.Context(), r.Header.Get("x-user-subject"))
+	if err != nil {
+		return "", err
+	}
+	return usr.ID, nil
+}
+
+func (s *System) GetSegments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	type Segments struct {
+		Segments []flags.Segment `json:"segments"`
+	}
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	segments, err := s.GetSegmentsFromDB(ctx, companyId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&Segments{
+		Segments: segments,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) GetSegment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	segment, err := s.GetSegmentFromDB(ctx, companyId, r.PathValue("segmentId"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if segment == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(segment); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) CreateSegment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	segment := flags.Segment{}
+	if err := json.NewDecoder(r.Body).Decode(&segment); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := flags.ValidateSegment(&segment); err != nil {
+		s.writeError(w, http.StatusBadRequest, err, nil)
+		return
+	}
+
+	created, err := s.CreateSegmentInDB(ctx, companyId, &segment)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// UpdateSegment replaces the segment definition, every flag referring to it picks the change up on its next evaluation
+func (s *System) UpdateSegment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	segmentId := r.PathValue("segmentId")
+	existing, err := s.GetSegmentFromDB(ctx, companyId, segmentId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	segment := flags.Segment{}
+	if err := json.NewDecoder(r.Body).Decode(&segment); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	segment.ID = segmentId
+	if err := flags.ValidateSegment(&segment); err != nil {
+		s.writeError(w, http.StatusBadRequest, err, nil)
+		return
+	}
+
+	if err := s.UpdateSegmentInDB(ctx, companyId, &segment); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&segment); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *System) DeleteSegment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := s.getUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	companyId, err := company.NewSystem(s.Container).GetCompanyId(ctx, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if companyId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	segmentId := r.PathValue("segmentId")
+	existing, err := s.GetSegmentFromDB(ctx, companyId, segmentId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	dependents, err := s.DeleteSegmentInDB(ctx, companyId, segmentId)
+	if err != nil {
+		if errors.Is(err, flags.ErrSegmentInUse) {
+			s.writeError(w, http.StatusConflict, err, dependents)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeError reports a rejected request, along with the flags that caused it when there are any
+func (s *System) writeError(w http.ResponseWriter, status int, err error, dependents []flags.CompanyFlagEntry) {
+	type errorResponse struct {
+		Error string                   `json:"error"`
+		Flags []flags.CompanyFlagEntry `json:"flags,omitempty"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&errorResponse{
+		Error: err.Error(),
+		Flags: dependents,
+	}); err != nil {
+		_ = s.Config.Bugfixes.Logger.Errorf("Failed to encode response: %v", err)
+	}
+}
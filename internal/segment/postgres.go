@@ -0,0 +1,204 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/flags-gg/orchestrator/internal/flags"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// segmentLists encodes the jsonb columns of a segment, never producing a JSON null
+func segmentLists(segment *flags.Segment) (rules, included, excluded []byte, err error) {
+	if segment.Rules == nil {
+		segment.Rules = []flags.SegmentRule{}
+	}
+	if segment.Included == nil {
+		segment.Included = []string{}
+	}
+	if segment.Excluded == nil {
+		segment.Excluded = []string{}
+	}
+
+	if rules, err = json.Marshal(segment.Rules); err != nil {
+		return nil, nil, nil, err
+	}
+	if included, err = json.Marshal(segment.Included); err != nil {
+		return nil, nil, nil, err
+	}
+	if excluded, err = json.Marshal(segment.Excluded); err != nil {
+		return nil, nil, nil, err
+	}
+	return rules, included, excluded, nil
+}
+
+func (s *System) GetSegmentsFromDB(ctx context.Context, companyId string) ([]flags.Segment, error) {
+	rows, err := s.DB.Query(ctx, `
+    SELECT
+      segment.segment_id,
+      segment.name,
+      COALESCE(segment.description, ''),
+      segment.rules,
+      segment.included,
+      segment.excluded
+    FROM public.segment
+      JOIN public.company ON company.id = segment.company_id
+    WHERE company.company_id = $1
+    ORDER BY segment.name`, companyId)
+	if err != nil {
+		if err.Error() == "context canceled" || errors.Is(err, context.Canceled) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", err)
+	}
+	defer rows.Close()
+
+	segments := make([]flags.Segment, 0)
+	for rows.Next() {
+		var segment flags.Segment
+		if err := rows.Scan(
+			&segment.ID,
+			&segment.Name,
+			&segment.Description,
+			&segment.Rules,
+			&segment.Included,
+			&segment.Excluded,
+		); err != nil {
+			return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan database: %v", err)
+		}
+		segments = append(segments, segment)
+	}
+	if rows.Err() != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to query database: %v", rows.Err())
+	}
+
+	return segments, nil
+}
+
+func (s *System) GetSegmentFromDB(ctx context.Context, companyId, segmentId string) (*flags.Segment, error) {
+	var segment flags.Segment
+	if err := s.DB.QueryRow(ctx, `
+    SELECT
+      segment.segment_id,
+      segment.name,
+      COALESCE(segment.description, ''),
+      segment.rules,
+      segment.included,
+      segment.excluded
+    FROM public.segment
+      JOIN public.company ON company.id = segment.company_id
+    WHERE company.company_id = $1
+      AND segment.segment_id = $2`, companyId, segmentId).Scan(
+		&segment.ID,
+		&segment.Name,
+		&segment.Description,
+		&segment.Rules,
+		&segment.Included,
+		&segment.Excluded,
+	); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to scan database: %v", err)
+	}
+
+	return &segment, nil
+}
+
+func (s *System) CreateSegmentInDB(ctx context.Context, companyId string, segment *flags.Segment) (*flags.Segment, error) {
+	rules, included, excluded, err := segmentLists(segment)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to encode segment: %v", err)
+	}
+
+	segment.ID = uuid.New().String()
+	if _, err := s.DB.Exec(ctx, `
+      INSERT INTO public.segment (
+        segment_id,
+        company_id,
+        name,
+        description,
+        rules,
+        included,
+        excluded
+      ) VALUES (
+        $1,
+        (SELECT id FROM public.company WHERE company_id = $2),
+        $3,
+        NULLIF($4, ''),
+        $5,
+        $6,
+        $7)`, segment.ID, companyId, segment.Name, segment.Description, rules, included, excluded); err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to insert segment into database: %v", err)
+	}
+
+	return segment, nil
+}
+
+func (s *System) UpdateSegmentInDB(ctx context.Context, companyId string, segment *flags.Segment) error {
+	rules, included, excluded, err := segmentLists(segment)
+	if err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to encode segment: %v", err)
+	}
+
+	if _, err := s.DB.Exec(ctx, `
+      UPDATE public.segment
+      SET
+        name = $3,
+        description = NULLIF($4, ''),
+        rules = $5,
+        included = $6,
+        excluded = $7,
+        updated_at = now()
+      WHERE segment_id = $2
+        AND company_id = (SELECT id FROM public.company WHERE company_id = $1)`, companyId, segment.ID, segment.Name, segment.Description, rules, included, excluded); err != nil {
+		return s.Config.Bugfixes.Logger.Errorf("Failed to update segment in database: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteSegmentInDB deletes the segment unless a flag's targeting refers to it, then it returns those flags with
+// flags.ErrSegmentInUse. The segment is locked first, so no targeting starts using it while it's checked
+func (s *System) DeleteSegmentInDB(ctx context.Context, companyId, segmentId string) ([]flags.CompanyFlagEntry, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to start transaction: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	var id int
+	if err := tx.QueryRow(ctx, `
+      SELECT segment.id
+      FROM public.segment
+        JOIN public.company ON company.id = segment.company_id
+      WHERE company.company_id = $1
+        AND segment.segment_id = $2
+      FOR UPDATE OF segment`, companyId, segmentId).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to lock segment: %v", err)
+	}
+
+	dependents, err := flags.NewSystem(s.Container).FlagsUsingSegmentTx(ctx, tx, companyId, segmentId)
+	if err != nil {
+		return nil, err
+	}
+	if len(dependents) > 0 {
+		return dependents, flags.ErrSegmentInUse
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM public.segment WHERE id = $1`, id); err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to delete segment in database: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to commit segment deletion: %v", err)
+	}
+
+	return nil, nil
+}
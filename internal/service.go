@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net/http"
@@ -8,17 +9,20 @@ import (
 	"time"
 
 	"github.com/flags-gg/orchestrator/internal/agent"
+	"github.com/flags-gg/orchestrator/internal/bus"
+	"github.com/flags-gg/orchestrator/internal/container"
 	"github.com/flags-gg/orchestrator/internal/dashboard"
 	"github.com/flags-gg/orchestrator/internal/environment"
 	"github.com/flags-gg/orchestrator/internal/general"
+	"github.com/flags-gg/orchestrator/internal/keyring"
 	"github.com/flags-gg/orchestrator/internal/pricing"
 	"github.com/flags-gg/orchestrator/internal/project"
 	"github.com/flags-gg/orchestrator/internal/secretmenu"
+	"github.com/flags-gg/orchestrator/internal/segment"
 	ConfigBuilder "github.com/keloran/go-config"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/bugfixes/go-bugfixes/middleware"
-	"github.com/keloran/go-healthcheck"
 	"github.com/keloran/go-probe"
 
 	"github.com/flags-gg/orchestrator/internal/company"
@@ -28,7 +32,8 @@ import (
 )
 
 type Service struct {
-	Config *ConfigBuilder.Config
+	Config    *ConfigBuilder.Config
+	Container *container.Container
 }
 
 func New(cfg *ConfigBuilder.Config) *Service {
@@ -40,6 +45,26 @@ func New(cfg *ConfigBuilder.Config) *Service {
 func (s *Service) Start() error {
 	errChan := make(chan error)
 
+	// without keys no api key could be issued or checked, so the instance doesn't start
+	keys, err := keyring.FromConfig(s.Config)
+	if err != nil {
+		return logs.Errorf("failed to load the api key signing keys: %v", err)
+	}
+
+	c, err := container.New(context.Background(), s.Config)
+	if err != nil {
+		return logs.Errorf("failed to start the database pool: %v", err)
+	}
+	defer c.Close()
+	c.Keys = keys
+	s.Container = c
+
+	// changes made on any instance reach this one's caches and streams through the database
+	changes := bus.NewPostgres(s.Container)
+	bus.Use(changes)
+	go changes.Listen(context.Background())
+
+	go flags.NewScheduler(s.Container).Start(context.Background())
 	go s.startHTTP(errChan)
 
 	return <-errChan
@@ -49,97 +74,133 @@ func (s *Service) startHTTP(errChan chan error) {
 	mux := http.NewServeMux()
 
 	// Projects
-	mux.HandleFunc("GET /projects", project.NewSystem(s.Config).GetProjects)
-	mux.HandleFunc("POST /project", project.NewSystem(s.Config).CreateProject)
-	mux.HandleFunc("GET /project/{projectId}", project.NewSystem(s.Config).GetProject)
-	mux.HandleFunc("PUT /project/{projectId}", project.NewSystem(s.Config).UpdateProject)
-	mux.HandleFunc("PUT /project/{projectId}/image", project.NewSystem(s.Config).UpdateProjectImage)
-	mux.HandleFunc("GET /project/{projectId}/limits", project.NewSystem(s.Config).GetLimits)
-	mux.HandleFunc("DELETE /project/{projectId}", project.NewSystem(s.Config).DeleteProject)
+	mux.HandleFunc("GET /projects", project.NewSystem(s.Container).GetProjects)
+	mux.HandleFunc("POST /project", project.NewSystem(s.Container).CreateProject)
+	mux.HandleFunc("GET /project/{projectId}", project.NewSystem(s.Container).GetProject)
+	mux.HandleFunc("PUT /project/{projectId}", project.NewSystem(s.Container).UpdateProject)
+	mux.HandleFunc("PUT /project/{projectId}/image", project.NewSystem(s.Container).UpdateProjectImage)
+	mux.HandleFunc("GET /project/{projectId}/limits", project.NewSystem(s.Container).GetLimits)
+	mux.HandleFunc("DELETE /project/{projectId}", project.NewSystem(s.Container).DeleteProject)
 
 	// Agents
-	mux.HandleFunc("GET /project/{projectId}/agents", agent.NewSystem(s.Config).GetProjectAgents)
-	mux.HandleFunc("POST /project/{projectId}/agent", agent.NewSystem(s.Config).CreateAgent)
-	mux.HandleFunc("GET /agents", agent.NewSystem(s.Config).GetAgentsRequest)
-	mux.HandleFunc("GET /agent/{agentId}", agent.NewSystem(s.Config).GetAgent)
-	mux.HandleFunc("PUT /agent/{agentId}", agent.NewSystem(s.Config).UpdateAgent)
-	mux.HandleFunc("DELETE /agent/{agentId}", agent.NewSystem(s.Config).DeleteAgent)
+	mux.HandleFunc("GET /project/{projectId}/agents", agent.NewSystem(s.Container).GetProjectAgents)
+	mux.HandleFunc("POST /project/{projectId}/agent", agent.NewSystem(s.Container).CreateAgent)
+	mux.HandleFunc("GET /agents", agent.NewSystem(s.Container).GetAgentsRequest)
+	mux.HandleFunc("GET /agent/{agentId}", agent.NewSystem(s.Container).GetAgent)
+	mux.HandleFunc("PUT /agent/{agentId}", agent.NewSystem(s.Container).UpdateAgent)
+	mux.HandleFunc("DELETE /agent/{agentId}", agent.NewSystem(s.Container).DeleteAgent)
 
 	// Environments
-	mux.HandleFunc("GET /agent/{agentId}/environments", environment.NewSystem(s.Config).GetAgentEnvironments)
-	mux.HandleFunc("POST /agent/{agentId}/environment", environment.NewSystem(s.Config).CreateAgentEnvironment)
-	mux.HandleFunc("POST /agent/{agentId}/{environmentId}", environment.NewSystem(s.Config).CloneAgentEnvironment)
-	mux.HandleFunc("GET /environment/{environmentId}", environment.NewSystem(s.Config).GetEnvironment)
-	mux.HandleFunc("PUT /environment/{environmentId}", environment.NewSystem(s.Config).UpdateEnvironment)
-	mux.HandleFunc("DELETE /environment/{environmentId}", environment.NewSystem(s.Config).DeleteEnvironment)
-	mux.HandleFunc("GET /environments", environment.NewSystem(s.Config).GetEnvironments)
+	mux.HandleFunc("GET /agent/{agentId}/environments", environment.NewSystem(s.Container).GetAgentEnvironments)
+	mux.HandleFunc("GET /agent/{agentId}/environments/diff", environment.NewSystem(s.Container).GetEnvironmentsDiff)
+	mux.HandleFunc("GET /agent/{agentId}/environments/drift", environment.NewSystem(s.Container).GetEnvironmentsDrift)
+	mux.HandleFunc("POST /agent/{agentId}/environment", environment.NewSystem(s.Container).CreateAgentEnvironment)
+	mux.HandleFunc("POST /agent/{agentId}/{environmentId}", environment.NewSystem(s.Container).CloneAgentEnvironment)
+	mux.HandleFunc("GET /environment/{environmentId}", environment.NewSystem(s.Container).GetEnvironment)
+	mux.HandleFunc("PUT /environment/{environmentId}", environment.NewSystem(s.Container).UpdateEnvironment)
+	mux.HandleFunc("DELETE /environment/{environmentId}", environment.NewSystem(s.Container).DeleteEnvironment)
+	mux.HandleFunc("PUT /environment/{environmentId}/approval", environment.NewSystem(s.Container).UpdateEnvironmentApproval)
+	mux.HandleFunc("POST /environment/{environmentId}/promote", flags.NewSystem(s.Container).PromoteEnvironment)
+	mux.HandleFunc("GET /environments", environment.NewSystem(s.Container).GetEnvironments)
 
 	// Flags
-	mux.HandleFunc("GET /environment/{environmentId}/flags", flags.NewSystem(s.Config).GetClientFlags) // used by the frontend
-	mux.HandleFunc("POST /flag", flags.NewSystem(s.Config).CreateFlags)
-	mux.HandleFunc("PATCH /flag/{flagId}", flags.NewSystem(s.Config).UpdateFlags)
-	mux.HandleFunc("PUT /flag/{flagId}", flags.NewSystem(s.Config).EditFlag)
-	mux.HandleFunc("DELETE /flag/{flagId}", flags.NewSystem(s.Config).DeleteFlags)
-	mux.HandleFunc("POST /flag/{flagId}/promote", flags.NewSystem(s.Config).PromoteFlag)
+	mux.HandleFunc("GET /environment/{environmentId}/flags", flags.NewSystem(s.Container).GetClientFlags) // used by the frontend
+	mux.HandleFunc("POST /flag", flags.NewSystem(s.Container).CreateFlags)
+	mux.HandleFunc("POST /flags/batch", flags.NewSystem(s.Container).BatchFlags)
+	mux.HandleFunc("GET /flags/stale", flags.NewSystem(s.Container).GetStaleFlags)
+	mux.HandleFunc("PATCH /flag/{flagId}", flags.NewSystem(s.Container).UpdateFlags)
+	mux.HandleFunc("PUT /flag/{flagId}", flags.NewSystem(s.Container).EditFlag)
+	mux.HandleFunc("DELETE /flag/{flagId}", flags.NewSystem(s.Container).DeleteFlags)
+	mux.HandleFunc("POST /flag/{flagId}/promote", flags.NewSystem(s.Container).PromoteFlag)
+	mux.HandleFunc("PUT /flag/{flagId}/targeting", flags.NewSystem(s.Container).UpdateTargeting)
+	mux.HandleFunc("PUT /flag/{flagId}/rollout", flags.NewSystem(s.Container).UpdateRollout)
+	mux.HandleFunc("PUT /flag/{flagId}/prerequisites", flags.NewSystem(s.Container).UpdatePrerequisites)
+	mux.HandleFunc("PUT /flag/{flagId}/metadata", flags.NewSystem(s.Container).UpdateMetadata)
+	mux.HandleFunc("GET /flag/{flagId}/history", flags.NewSystem(s.Container).GetFlagHistory)
+	mux.HandleFunc("POST /flag/{flagId}/rollback/{version}", flags.NewSystem(s.Container).RollbackFlag)
+	mux.HandleFunc("POST /flag/{flagId}/schedule", flags.NewSystem(s.Container).CreateSchedule)
+	mux.HandleFunc("GET /flag/{flagId}/schedules", flags.NewSystem(s.Container).GetSchedules)
+	mux.HandleFunc("DELETE /flag/{flagId}/schedule/{scheduleId}", flags.NewSystem(s.Container).CancelSchedule)
+
+	// Change requests
+	mux.HandleFunc("GET /change-requests", flags.NewSystem(s.Container).GetChangeRequests)
+	mux.HandleFunc("GET /change-request/{requestId}", flags.NewSystem(s.Container).GetChangeRequest)
+	mux.HandleFunc("POST /change-request/{requestId}/approve", flags.NewSystem(s.Container).ApproveChangeRequest)
+	mux.HandleFunc("POST /change-request/{requestId}/reject", flags.NewSystem(s.Container).RejectChangeRequest)
+
+	// Segments
+	mux.HandleFunc("GET /segments", segment.NewSystem(s.Container).GetSegments)
+	mux.HandleFunc("POST /segments", segment.NewSystem(s.Container).CreateSegment)
+	mux.HandleFunc("GET /segments/{segmentId}", segment.NewSystem(s.Container).GetSegment)
+	mux.HandleFunc("PUT /segments/{segmentId}", segment.NewSystem(s.Container).UpdateSegment)
+	mux.HandleFunc("DELETE /segments/{segmentId}", segment.NewSystem(s.Container).DeleteSegment)
 
 	// Client
-	mux.HandleFunc("POST /ofrep/v1/evaluate/flags/{key}", flags.NewOFREPSystem(s.Config).EvaluateSingleFlag)
-	mux.HandleFunc("POST /ofrep/v1/evaluate/flags", flags.NewOFREPSystem(s.Config).EvaluateBulkFlags)
-	mux.HandleFunc("GET /v1/flags", flags.NewSystem(s.Config).GetAgentFlags)
-	mux.HandleFunc("GET /flags", flags.NewSystem(s.Config).GetAgentFlags)
+	mux.HandleFunc("POST /ofrep/v1/evaluate/flags/{key}", flags.NewOFREPSystem(s.Container).EvaluateSingleFlag)
+	mux.HandleFunc("POST /ofrep/v1/evaluate/flags", flags.NewOFREPSystem(s.Container).EvaluateBulkFlags)
+	mux.HandleFunc("GET /ofrep/v1/configuration", flags.NewOFREPSystem(s.Container).GetConfiguration)
+	mux.HandleFunc("GET /v1/flags", flags.NewSystem(s.Container).GetAgentFlags)
+	mux.HandleFunc("GET /v1/flags/stream", flags.NewSystem(s.Container).StreamAgentFlags)
+	mux.HandleFunc("GET /flags", flags.NewSystem(s.Container).GetAgentFlags)
 
 	// API Key Management
-	mux.HandleFunc("POST /api-key/generate", flags.NewAPIKeyHTTPSystem(s.Config).GenerateAPIKeyHandler)
+	mux.HandleFunc("POST /api-key/generate", flags.NewAPIKeyHTTPSystem(s.Container).GenerateAPIKeyHandler)
+	mux.HandleFunc("GET /api-keys", flags.NewAPIKeyHTTPSystem(s.Container).GetAPIKeys)
+	mux.HandleFunc("DELETE /api-key/{keyId}", flags.NewAPIKeyHTTPSystem(s.Container).RevokeAPIKeyHandler)
+	mux.HandleFunc("POST /api-key/{keyId}/rotate", flags.NewAPIKeyHTTPSystem(s.Container).RotateAPIKeyHandler)
+	mux.HandleFunc("POST /api-key/legacy/rotate", flags.NewAPIKeyHTTPSystem(s.Container).RotateLegacyAPIKeysHandler)
+	mux.HandleFunc("GET /.well-known/jwks.json", flags.NewAPIKeyHTTPSystem(s.Container).GetJWKS)
 
 	// Secret Menu
-	mux.HandleFunc("GET /secret-menu/{menuId}", secretmenu.NewSystem(s.Config).GetSecretMenu)
-	mux.HandleFunc("POST /secret-menu/{environmentId}", secretmenu.NewSystem(s.Config).CreateSecretMenu)
-	mux.HandleFunc("PUT /secret-menu/{menuId}/sequence", secretmenu.NewSystem(s.Config).UpdateSecretMenuSequence)
-	mux.HandleFunc("PUT /secret-menu/{menuId}/state", secretmenu.NewSystem(s.Config).UpdateSecretMenuState)
-	mux.HandleFunc("PUT /secret-menu/{menuId}/style", secretmenu.NewSystem(s.Config).UpdateSecretMenuStyle)
-	mux.HandleFunc("GET /secret-menu/{menuId}/style", secretmenu.NewSystem(s.Config).GetSecretMenuStyle)
+	mux.HandleFunc("GET /secret-menu/{menuId}", secretmenu.NewSystem(s.Container).GetSecretMenu)
+	mux.HandleFunc("POST /secret-menu/{environmentId}", secretmenu.NewSystem(s.Container).CreateSecretMenu)
+	mux.HandleFunc("PUT /secret-menu/{menuId}/sequence", secretmenu.NewSystem(s.Container).UpdateSecretMenuSequence)
+	mux.HandleFunc("PUT /secret-menu/{menuId}/state", secretmenu.NewSystem(s.Container).UpdateSecretMenuState)
+	mux.HandleFunc("PUT /secret-menu/{menuId}/style", secretmenu.NewSystem(s.Container).UpdateSecretMenuStyle)
+	mux.HandleFunc("GET /secret-menu/{menuId}/style", secretmenu.NewSystem(s.Container).GetSecretMenuStyle)
 
 	// Stats
-	mux.HandleFunc("GET /stats/dashboard", dashboard.NewSystem(s.Config).GetSummary)
-	mux.HandleFunc("GET /stats/company", stats.NewSystem(s.Config).GetCompanyStats)
-	mux.HandleFunc("GET /stats/agent/{agentId}/environment/{environmentId}", stats.NewSystem(s.Config).GetEnvironmentStats)
-	mux.HandleFunc("GET /stats/project/{projectId}", stats.NewSystem(s.Config).GetProjectStats)
-	mux.HandleFunc("GET /stats/agent/{agentId}", stats.NewSystem(s.Config).GetAgentStats)
+	mux.HandleFunc("GET /stats/dashboard", dashboard.NewSystem(s.Container).GetSummary)
+	mux.HandleFunc("GET /stats/company", stats.NewSystem(s.Container).GetCompanyStats)
+	mux.HandleFunc("GET /stats/agent/{agentId}/environment/{environmentId}", stats.NewSystem(s.Container).GetEnvironmentStats)
+	mux.HandleFunc("GET /stats/project/{projectId}", stats.NewSystem(s.Container).GetProjectStats)
+	mux.HandleFunc("GET /stats/agent/{agentId}", stats.NewSystem(s.Container).GetAgentStats)
 
 	// User
-	mux.HandleFunc("POST /user", user.NewSystem(s.Config).CreateUser)
-	mux.HandleFunc("PUT /user", user.NewSystem(s.Config).UpdateUser)
-	mux.HandleFunc("GET /user", user.NewSystem(s.Config).GetUser)
-	mux.HandleFunc("DELETE /user", user.NewSystem(s.Config).DeleteUser)
-	mux.HandleFunc("PUT /user/image", user.NewSystem(s.Config).UpdateUserImage)
+	mux.HandleFunc("POST /user", user.NewSystem(s.Container).CreateUser)
+	mux.HandleFunc("PUT /user", user.NewSystem(s.Container).UpdateUser)
+	mux.HandleFunc("GET /user", user.NewSystem(s.Container).GetUser)
+	mux.HandleFunc("DELETE /user", user.NewSystem(s.Container).DeleteUser)
+	mux.HandleFunc("PUT /user/image", user.NewSystem(s.Container).UpdateUserImage)
 
 	// Notifications
-	mux.HandleFunc("GET /user/notifications", user.NewSystem(s.Config).GetUserNotifications)
-	mux.HandleFunc("PATCH /user/notification/{notificationId}", user.NewSystem(s.Config).UpdateUserNotification)
-	mux.HandleFunc("DELETE /user/notification/{notificationId}", user.NewSystem(s.Config).DeleteUserNotification)
+	mux.HandleFunc("GET /user/notifications", user.NewSystem(s.Container).GetUserNotifications)
+	mux.HandleFunc("PATCH /user/notification/{notificationId}", user.NewSystem(s.Container).UpdateUserNotification)
+	mux.HandleFunc("DELETE /user/notification/{notificationId}", user.NewSystem(s.Container).DeleteUserNotification)
 
 	// Company
-	mux.HandleFunc("GET /company", company.NewSystem(s.Config).GetCompany)
-	mux.HandleFunc("PUT /company", company.NewSystem(s.Config).UpdateCompany)
-	mux.HandleFunc("POST /company", company.NewSystem(s.Config).CreateCompany)
-	mux.HandleFunc("GET /company/limits", company.NewSystem(s.Config).GetCompanyLimits)
-	mux.HandleFunc("GET /company/pricing", pricing.NewSystem(s.Config).GetCompanyPricing)
-	mux.HandleFunc("PUT /company/user", company.NewSystem(s.Config).AttachUserToCompany)
-	mux.HandleFunc("GET /company/users", company.NewSystem(s.Config).GetCompanyUsers)
-	mux.HandleFunc("PUT /company/image", company.NewSystem(s.Config).UpdateCompanyImage)
-	mux.HandleFunc("POST /company/invite", company.NewSystem(s.Config).InviteUserToCompany)
-	mux.HandleFunc("PUT /company/upgrade", company.NewSystem(s.Config).UpgradeCompany)
+	mux.HandleFunc("GET /company", company.NewSystem(s.Container).GetCompany)
+	mux.HandleFunc("PUT /company", company.NewSystem(s.Container).UpdateCompany)
+	mux.HandleFunc("POST /company", company.NewSystem(s.Container).CreateCompany)
+	mux.HandleFunc("GET /company/limits", company.NewSystem(s.Container).GetCompanyLimits)
+	mux.HandleFunc("GET /company/pricing", pricing.NewSystem(s.Container).GetCompanyPricing)
+	mux.HandleFunc("PUT /company/user", company.NewSystem(s.Container).AttachUserToCompany)
+	mux.HandleFunc("GET /company/users", company.NewSystem(s.Container).GetCompanyUsers)
+	mux.HandleFunc("PUT /company/image", company.NewSystem(s.Container).UpdateCompanyImage)
+	mux.HandleFunc("POST /company/invite", company.NewSystem(s.Container).InviteUserToCompany)
+	mux.HandleFunc("PUT /company/upgrade", company.NewSystem(s.Container).UpgradeCompany)
 
 	// General
-	mux.HandleFunc(fmt.Sprintf("%s /health", http.MethodGet), healthcheck.HTTP)
+	mux.HandleFunc(fmt.Sprintf("%s /health", http.MethodGet), general.NewSystem(s.Container).Health)
 	mux.HandleFunc(fmt.Sprintf("%s /probe", http.MethodGet), probe.HTTP)
-	mux.HandleFunc("GET /pricing", pricing.NewSystem(s.Config).GetGeneralPricing)
-	mux.HandleFunc("/uploadthing", user.NewSystem(s.Config).UploadThing)
-	mux.HandleFunc("/events/keycloak", general.NewSystem(s.Config).KeycloakEvents)
+	mux.HandleFunc("GET /cache", flags.NewSystem(s.Container).GetCacheStats) // instance counters for operators, not tenant data
+	mux.HandleFunc("GET /pricing", pricing.NewSystem(s.Container).GetGeneralPricing)
+	mux.HandleFunc("/uploadthing", user.NewSystem(s.Container).UploadThing)
+	mux.HandleFunc("/events/keycloak", general.NewSystem(s.Container).KeycloakEvents)
 
 	// General Webhooks
-	mux.HandleFunc("/webhooks/stripe", general.NewSystem(s.Config).StripeEvents)
-	mux.HandleFunc("/v1/webhooks/stripe", general.NewSystem(s.Config).StripeEvents)
+	mux.HandleFunc("/webhooks/stripe", general.NewSystem(s.Container).StripeEvents)
+	mux.HandleFunc("/v1/webhooks/stripe", general.NewSystem(s.Container).StripeEvents)
 
 	// middlewares
 	mw := middleware.NewMiddleware()
@@ -2,7 +2,6 @@ package stats
 
 import (
 	"context"
-	"strings"
 )
 
 type RequestKind string
@@ -62,20 +61,7 @@ func (s *System) RecordEnvironmentRequest(ctx context.Context, projectId, agentI
 		return nil
 	}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
 		INSERT INTO public.environment_request_audit (
 			project_id,
 			agent_id,
@@ -100,20 +86,7 @@ func (s *System) RecordAPIKeyCreation(ctx context.Context, userSubject, projectI
 		return nil
 	}
 
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
 		INSERT INTO public.api_key_audit (
 			project_id,
 			agent_id,
@@ -132,24 +105,12 @@ func (s *System) RecordAPIKeyCreation(ctx context.Context, userSubject, projectI
 }
 
 func (s *System) GetCompanyOverview(ctx context.Context, companyId string) (*CompanyOverview, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
+	var err error
 	overview := &CompanyOverview{
 		EnvironmentRequests: make([]EnvironmentRequestSummary, 0),
 	}
 
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
 		SELECT
 			era.environment_id,
 			COALESCE(env.name, ''),
@@ -206,7 +167,7 @@ func (s *System) GetCompanyOverview(ctx context.Context, companyId string) (*Com
 	}
 
 	creator := &APIKeyCreator{}
-	err = client.QueryRow(ctx, `
+	err = s.DB.QueryRow(ctx, `
 		SELECT
 			aka.created_by_subject,
 			COALESCE(
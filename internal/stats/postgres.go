@@ -3,7 +3,6 @@ package stats
 import (
 	"context"
 	"errors"
-	"strings"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/jackc/pgx/v5"
@@ -29,21 +28,8 @@ func (s *System) GetNamesForData(ctx context.Context, data *AgentStat) (*AgentSt
 }
 
 func (s *System) GetAgentName(ctx context.Context, agentId string) (string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", nil
-		}
-		return "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var agentName string
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT agent.name AS AgentName
     FROM public.agent AS agent
     WHERE agent_id = $1`, agentId).Scan(&agentName); err != nil {
@@ -61,21 +47,8 @@ func (s *System) GetAgentName(ctx context.Context, agentId string) (string, erro
 }
 
 func (s *System) GetEnvironmentName(ctx context.Context, environmentId string) (string, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return "", nil
-		}
-		return "", s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	var envName string
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT env.name AS EnvName
     FROM public.environment AS env
     WHERE env_id = $1`, environmentId).Scan(&envName); err != nil {
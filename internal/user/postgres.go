@@ -3,7 +3,6 @@ package user
 import (
 	"context"
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -44,20 +43,7 @@ type Notifications struct {
 }
 
 func (s *System) CreateUserDetails(ctx context.Context, subject, knownAs, email, firstname, lastname, location string, userGroup int) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     INSERT INTO public.user (
         subject,
         email_address,
@@ -80,25 +66,12 @@ func (s *System) CreateUserDetails(ctx context.Context, subject, knownAs, email,
 }
 
 func (s *System) RetrieveUserDetailsDB(ctx context.Context, subject string) (*User, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
 	cName := ""
 	companyName := &cName
 
 	user := &User{}
 	ug := &Group{}
-	if err := client.QueryRow(ctx, `
+	if err := s.DB.QueryRow(ctx, `
     SELECT
 		u.id,
         u.known_as,
@@ -133,7 +106,7 @@ func (s *System) RetrieveUserDetailsDB(ctx context.Context, subject string) (*Us
 	if companyName != nil && user.Onboarded == false {
 		user.Onboarded = true
 
-		if _, err := client.Exec(ctx, `
+		if _, err := s.DB.Exec(ctx, `
     	UPDATE public.user
     	SET onboarded = true
     	WHERE subject = $1`, subject); err != nil {
@@ -145,20 +118,7 @@ func (s *System) RetrieveUserDetailsDB(ctx context.Context, subject string) (*Us
 }
 
 func (s *System) RetrieveUserNotifications(ctx context.Context, subject string) ([]Notification, error) {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil, nil
-		}
-		return nil, s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	rows, err := client.Query(ctx, `
+	rows, err := s.DB.Query(ctx, `
     SELECT
       un.id,
       un.subject,
@@ -194,20 +154,7 @@ func (s *System) RetrieveUserNotifications(ctx context.Context, subject string)
 }
 
 func (s *System) MarkNotificationAsRead(ctx context.Context, subject, notificationId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     UPDATE public.user_notifications AS un
     SET "read" = true
     FROM public.user AS u
@@ -221,20 +168,7 @@ func (s *System) MarkNotificationAsRead(ctx context.Context, subject, notificati
 }
 
 func (s *System) DeleteUserNotificationInDB(ctx context.Context, subject, notificationId string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
     UPDATE public.user_notifications AS un
     SET
       deleted = true,
@@ -250,20 +184,7 @@ func (s *System) DeleteUserNotificationInDB(ctx context.Context, subject, notifi
 }
 
 func (s *System) UpdateUserImageInDB(ctx context.Context, subject string, image string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `UPDATE public.user
+	if _, err := s.DB.Exec(ctx, `UPDATE public.user
 		SET avatar = $1
 		WHERE subject = $2`, image, subject); err != nil {
 		return s.Config.Bugfixes.Logger.Errorf("Failed to update user image: %v", err)
@@ -273,20 +194,7 @@ func (s *System) UpdateUserImageInDB(ctx context.Context, subject string, image
 }
 
 func (s *System) UpdateUserDetailsDB(ctx context.Context, subject, knownAs, email, firstname, lastname, location string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	_, err = client.Exec(ctx, `
+	_, err := s.DB.Exec(ctx, `
     UPDATE public.user
     SET
       known_as = $1,
@@ -303,20 +211,7 @@ func (s *System) UpdateUserDetailsDB(ctx context.Context, subject, knownAs, emai
 }
 
 func (s *System) DeleteUserInDB(ctx context.Context, subject string) error {
-	client, err := s.Config.Database.GetPGXClient(ctx)
-	if err != nil {
-		if strings.Contains(err.Error(), "operation was canceled") {
-			return nil
-		}
-		return s.Config.Bugfixes.Logger.Errorf("Failed to connect to database: %v", err)
-	}
-	defer func() {
-		if err := client.Close(ctx); err != nil {
-			_ = s.Config.Bugfixes.Logger.Errorf("Failed to close database connection: %v", err)
-		}
-	}()
-
-	if _, err := client.Exec(ctx, `
+	if _, err := s.DB.Exec(ctx, `
 	WITH deleted_user AS (
         DELETE FROM public.user 
         WHERE subject = $1
@@ -0,0 +1,8 @@
+ALTER TABLE public.flag
+    DROP CONSTRAINT IF EXISTS flag_type_check;
+
+ALTER TABLE public.flag
+    DROP COLUMN IF EXISTS off_variant,
+    DROP COLUMN IF EXISTS default_variant,
+    DROP COLUMN IF EXISTS variants,
+    DROP COLUMN IF EXISTS flag_type;
@@ -0,0 +1,9 @@
+-- Typed flags with named variants, stored per environment alongside the flag state
+ALTER TABLE public.flag
+    ADD COLUMN flag_type character varying(32) NOT NULL DEFAULT 'boolean',
+    ADD COLUMN variants jsonb NOT NULL DEFAULT '[]'::jsonb,
+    ADD COLUMN default_variant character varying(255) NULL,
+    ADD COLUMN off_variant character varying(255) NULL;
+
+ALTER TABLE public.flag
+    ADD CONSTRAINT flag_type_check CHECK (flag_type IN ('boolean', 'string', 'integer', 'float', 'object'));
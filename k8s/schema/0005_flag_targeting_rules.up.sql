@@ -0,0 +1,3 @@
+-- Ordered targeting rules evaluated against the OFREP evaluation context
+ALTER TABLE public.flag
+    ADD COLUMN targeting_rules jsonb NOT NULL DEFAULT '[]'::jsonb;
@@ -0,0 +1,2 @@
+ALTER TABLE public.flag
+    DROP COLUMN IF EXISTS rollout;
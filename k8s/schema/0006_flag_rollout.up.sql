@@ -0,0 +1,3 @@
+-- Percentage split of a flag's variants, bucketed on the targeting key
+ALTER TABLE public.flag
+    ADD COLUMN rollout jsonb NULL;
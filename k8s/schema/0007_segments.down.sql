@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.flag_targeting_rules_idx;
+DROP TABLE IF EXISTS public.segment;
@@ -0,0 +1,21 @@
+-- Company owned audiences that flag targeting refers to by segment_id
+CREATE TABLE public.segment (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    segment_id character varying(255) NOT NULL,
+    company_id integer NOT NULL REFERENCES public.company(id) ON DELETE CASCADE,
+    name character varying(255) NOT NULL,
+    description text NULL,
+    rules jsonb NOT NULL DEFAULT '[]'::jsonb,
+    included jsonb NOT NULL DEFAULT '[]'::jsonb,
+    excluded jsonb NOT NULL DEFAULT '[]'::jsonb,
+    CONSTRAINT segment_unique_segment_id UNIQUE (segment_id)
+);
+
+CREATE INDEX segment_company_idx
+    ON public.segment (company_id);
+
+-- finding the flags that refer to a segment before it is deleted
+CREATE INDEX flag_targeting_rules_idx
+    ON public.flag USING gin (targeting_rules jsonb_path_ops);
@@ -0,0 +1,26 @@
+-- Changes to a flag applied by the scheduler once run_at has passed
+CREATE TABLE public.flag_schedule (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    schedule_id character varying(255) NOT NULL,
+    flag_id integer NOT NULL REFERENCES public.flag(id) ON DELETE CASCADE,
+    run_at timestamp with time zone NOT NULL,
+    timezone character varying(255) NOT NULL DEFAULT 'Europe/London'::character varying,
+    enabled boolean NULL,
+    default_variant character varying(255) NULL,
+    rollout jsonb NULL,
+    clear_rollout boolean NOT NULL DEFAULT false,
+    status character varying(32) NOT NULL DEFAULT 'pending',
+    error text NULL,
+    created_by character varying(255) NULL,
+    claimed_at timestamp with time zone NULL,
+    applied_at timestamp with time zone NULL,
+    CONSTRAINT flag_schedule_unique_schedule_id UNIQUE (schedule_id)
+);
+
+CREATE INDEX flag_schedule_due_idx
+    ON public.flag_schedule (run_at)
+    WHERE status IN ('pending', 'running');
+
+CREATE INDEX flag_schedule_flag_idx
+    ON public.flag_schedule (flag_id);
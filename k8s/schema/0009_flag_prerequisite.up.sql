@@ -0,0 +1,14 @@
+-- Flags that have to be on before another flag in the same environment is evaluated
+CREATE TABLE public.flag_prerequisite (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    flag_id integer NOT NULL REFERENCES public.flag(id) ON DELETE CASCADE,
+    -- no cascade, a flag other flags depend on has to be released before it is deleted
+    prerequisite_flag_id integer NOT NULL REFERENCES public.flag(id),
+    variant character varying(255) NULL,
+    CONSTRAINT flag_prerequisite_unique UNIQUE (flag_id, prerequisite_flag_id),
+    CONSTRAINT flag_prerequisite_not_self CHECK (flag_id <> prerequisite_flag_id)
+);
+
+CREATE INDEX flag_prerequisite_prerequisite_idx
+    ON public.flag_prerequisite (prerequisite_flag_id);
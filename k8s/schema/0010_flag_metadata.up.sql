@@ -0,0 +1,21 @@
+-- Descriptive metadata for a flag, keyed by agent and flag name so every environment's copy shares it
+CREATE TABLE public.flag_metadata (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    agent_id integer NOT NULL REFERENCES public.agent(id) ON DELETE CASCADE,
+    flag_name character varying(255) NOT NULL,
+    description text NULL,
+    tags jsonb NOT NULL DEFAULT '[]'::jsonb,
+    owner_id integer NULL REFERENCES public."user"(id) ON DELETE SET NULL,
+    kind character varying(32) NULL,
+    links jsonb NOT NULL DEFAULT '[]'::jsonb,
+    CONSTRAINT flag_metadata_unique_agent_flag UNIQUE (agent_id, flag_name),
+    CONSTRAINT flag_metadata_kind CHECK (kind IN ('release', 'ops', 'experiment', 'permission'))
+);
+
+CREATE INDEX flag_metadata_tags_idx
+    ON public.flag_metadata USING gin (tags);
+
+CREATE INDEX flag_metadata_owner_idx
+    ON public.flag_metadata (owner_id);
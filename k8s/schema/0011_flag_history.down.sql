@@ -0,0 +1,3 @@
+DROP RULE IF EXISTS flag_history_no_delete ON public.flag_history;
+DROP RULE IF EXISTS flag_history_no_update ON public.flag_history;
+DROP TABLE IF EXISTS public.flag_history;
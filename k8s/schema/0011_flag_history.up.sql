@@ -0,0 +1,16 @@
+-- Append-only history of every change to a flag, kept after the flag itself is deleted
+CREATE TABLE public.flag_history (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    flag_id integer NOT NULL,
+    version integer NOT NULL,
+    actor character varying(255) NOT NULL,
+    source character varying(255) NOT NULL,
+    before jsonb NULL,
+    after jsonb NULL,
+    CONSTRAINT flag_history_unique_version UNIQUE (flag_id, version)
+);
+
+-- history is never rewritten
+CREATE RULE flag_history_no_update AS ON UPDATE TO public.flag_history DO INSTEAD NOTHING;
+CREATE RULE flag_history_no_delete AS ON DELETE TO public.flag_history DO INSTEAD NOTHING;
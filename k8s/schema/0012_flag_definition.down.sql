@@ -0,0 +1,58 @@
+CREATE TABLE public.flag_metadata (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    agent_id integer NOT NULL REFERENCES public.agent(id) ON DELETE CASCADE,
+    flag_name character varying(255) NOT NULL,
+    description text NULL,
+    tags jsonb NOT NULL DEFAULT '[]'::jsonb,
+    owner_id integer NULL REFERENCES public."user"(id) ON DELETE SET NULL,
+    kind character varying(32) NULL,
+    links jsonb NOT NULL DEFAULT '[]'::jsonb,
+    CONSTRAINT flag_metadata_unique_agent_flag UNIQUE (agent_id, flag_name),
+    CONSTRAINT flag_metadata_kind CHECK (kind IN ('release', 'ops', 'experiment', 'permission'))
+);
+
+CREATE INDEX flag_metadata_tags_idx
+    ON public.flag_metadata USING gin (tags);
+
+CREATE INDEX flag_metadata_owner_idx
+    ON public.flag_metadata (owner_id);
+
+INSERT INTO public.flag_metadata (agent_id, flag_name, description, tags, owner_id, kind, links, created_at, updated_at)
+SELECT agent_id, name, description, tags, owner_id, kind, links, created_at, updated_at
+FROM public.flag_definition
+WHERE description IS NOT NULL
+   OR tags <> '[]'::jsonb
+   OR owner_id IS NOT NULL
+   OR kind IS NOT NULL
+   OR links <> '[]'::jsonb;
+
+ALTER TABLE public.flag
+    ADD COLUMN name character varying(255) NULL,
+    ADD COLUMN flag_type character varying(32) NOT NULL DEFAULT 'boolean',
+    ADD COLUMN variants jsonb NOT NULL DEFAULT '[]'::jsonb;
+
+UPDATE public.flag f
+SET
+    name = d.name,
+    flag_type = d.flag_type,
+    variants = d.variants
+FROM public.flag_definition d
+WHERE d.id = f.definition_id;
+
+ALTER TABLE public.flag
+    ALTER COLUMN name SET NOT NULL;
+
+ALTER TABLE public.flag
+    ADD CONSTRAINT flag_type_check CHECK (flag_type IN ('boolean', 'string', 'integer', 'float', 'object'));
+
+ALTER TABLE public.flag
+    DROP CONSTRAINT IF EXISTS flag_unique_env_definition;
+ALTER TABLE public.flag
+    ADD CONSTRAINT flag_unique_env_name UNIQUE (environment_id, name);
+
+ALTER TABLE public.flag
+    DROP COLUMN definition_id;
+
+DROP TABLE IF EXISTS public.flag_definition;
@@ -0,0 +1,123 @@
+-- A flag key is defined once per agent, public.flag keeps one state row per environment
+CREATE TABLE public.flag_definition (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    agent_id integer NOT NULL REFERENCES public.agent(id) ON DELETE CASCADE,
+    name character varying(255) NOT NULL,
+    flag_type character varying(32) NOT NULL DEFAULT 'boolean',
+    variants jsonb NOT NULL DEFAULT '[]'::jsonb,
+    description text NULL,
+    tags jsonb NOT NULL DEFAULT '[]'::jsonb,
+    owner_id integer NULL REFERENCES public."user"(id) ON DELETE SET NULL,
+    kind character varying(32) NULL,
+    links jsonb NOT NULL DEFAULT '[]'::jsonb,
+    CONSTRAINT flag_definition_unique_agent_name UNIQUE (agent_id, name),
+    CONSTRAINT flag_definition_type_check CHECK (flag_type IN ('boolean', 'string', 'integer', 'float', 'object')),
+    CONSTRAINT flag_definition_kind_check CHECK (kind IN ('release', 'ops', 'experiment', 'permission'))
+);
+
+CREATE INDEX flag_definition_tags_idx
+    ON public.flag_definition USING gin (tags);
+
+CREATE INDEX flag_definition_owner_idx
+    ON public.flag_definition (owner_id);
+
+-- 0) Every environment's copy of a flag has to agree on what it is, nothing is picked for the operator
+DO $$
+DECLARE
+    unnamed bigint;
+    conflicts text;
+BEGIN
+    SELECT count(*) INTO unnamed
+    FROM public.flag
+    WHERE name IS NULL;
+    IF unnamed > 0 THEN
+        RAISE EXCEPTION '% flags have no name, name or remove them before migrating', unnamed;
+    END IF;
+
+    SELECT string_agg(format('agent %s flag %s', c.agent_id, c.name), ', ' ORDER BY c.agent_id, c.name) INTO conflicts
+    FROM (
+        SELECT f.agent_id, f.name
+        FROM public.flag f
+        GROUP BY f.agent_id, f.name
+        HAVING count(DISTINCT f.flag_type) > 1
+            OR count(DISTINCT f.variants) > 1
+    ) c;
+    IF conflicts IS NOT NULL THEN
+        RAISE EXCEPTION 'flags differ in type or variants between environments, make them match before migrating: %', conflicts;
+    END IF;
+END $$;
+
+-- 1) One definition per agent and name, the copies are identical so any of them will do
+INSERT INTO public.flag_definition (agent_id, name, flag_type, variants, created_at)
+SELECT f.agent_id, f.name, min(f.flag_type), (array_agg(f.variants))[1], min(f.created_at)
+FROM public.flag f
+GROUP BY f.agent_id, f.name;
+
+-- 2) Metadata was already stored per agent and name
+UPDATE public.flag_definition d
+SET
+    description = m.description,
+    tags = m.tags,
+    owner_id = m.owner_id,
+    kind = m.kind,
+    links = m.links,
+    updated_at = m.updated_at
+FROM public.flag_metadata m
+WHERE m.agent_id = d.agent_id
+  AND m.flag_name = d.name;
+
+-- 3) Point every environment's row at its definition
+ALTER TABLE public.flag
+    ADD COLUMN definition_id integer NULL REFERENCES public.flag_definition(id) ON DELETE CASCADE;
+
+UPDATE public.flag f
+SET definition_id = d.id
+FROM public.flag_definition d
+WHERE d.agent_id = f.agent_id
+  AND d.name = f.name;
+
+ALTER TABLE public.flag
+    ALTER COLUMN definition_id SET NOT NULL;
+
+-- 3b) The variants an environment serves have to exist on its definition, a boolean flag without any of its own
+-- still has the implicit enabled and disabled
+DO $$
+DECLARE
+    dangling text;
+BEGIN
+    SELECT string_agg(format('flag %s variant %s', r.id, r.variant), ', ' ORDER BY r.id, r.variant) INTO dangling
+    FROM (
+        SELECT f.id, v.variant, d.flag_type, d.variants
+        FROM public.flag f
+          JOIN public.flag_definition d ON d.id = f.definition_id
+          CROSS JOIN LATERAL (VALUES (f.default_variant), (f.off_variant)) AS v(variant)
+        WHERE v.variant IS NOT NULL
+    ) r
+    WHERE NOT EXISTS (
+        SELECT 1
+        FROM jsonb_array_elements(r.variants) AS e
+        WHERE e->>'name' = r.variant
+    )
+    AND NOT (r.flag_type = 'boolean' AND jsonb_array_length(r.variants) = 0 AND r.variant IN ('enabled', 'disabled'));
+    IF dangling IS NOT NULL THEN
+        RAISE EXCEPTION 'flags reference variants their definition does not have, fix them before migrating: %', dangling;
+    END IF;
+END $$;
+
+-- 4) The key is unique per environment through its definition
+ALTER TABLE public.flag
+    DROP CONSTRAINT IF EXISTS flag_unique_env_name;
+ALTER TABLE public.flag
+    ADD CONSTRAINT flag_unique_env_definition UNIQUE (environment_id, definition_id);
+
+-- 5) Drop what now lives on the definition
+ALTER TABLE public.flag
+    DROP CONSTRAINT IF EXISTS flag_type_check;
+ALTER TABLE public.flag
+    DROP COLUMN name,
+    DROP COLUMN flag_type,
+    DROP COLUMN variants;
+
+DROP TABLE public.flag_metadata;
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS public.flag_change_review;
+DROP TABLE IF EXISTS public.flag_change_request;
+
+ALTER TABLE public.environment
+    DROP CONSTRAINT IF EXISTS environment_required_approvals_check,
+    DROP COLUMN IF EXISTS required_approvals,
+    DROP COLUMN IF EXISTS requires_approval;
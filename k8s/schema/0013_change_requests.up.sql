@@ -0,0 +1,38 @@
+-- Environments that need changes reviewed before they reach their flags
+ALTER TABLE public.environment
+    ADD COLUMN requires_approval boolean NOT NULL DEFAULT false,
+    ADD COLUMN required_approvals smallint NOT NULL DEFAULT 1,
+    ADD CONSTRAINT environment_required_approvals_check CHECK (required_approvals >= 1);
+
+-- A change to a flag in a protected environment waiting on review
+CREATE TABLE public.flag_change_request (
+    id serial PRIMARY KEY,
+    request_id character varying(255) NOT NULL UNIQUE,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    flag_id integer NULL REFERENCES public.flag(id) ON DELETE SET NULL,
+    flag_name character varying(255) NOT NULL,
+    environment_id integer NOT NULL REFERENCES public.environment(id) ON DELETE CASCADE,
+    action character varying(32) NOT NULL,
+    payload jsonb NULL,
+    author_id integer NOT NULL REFERENCES public."user"(id) ON DELETE CASCADE,
+    required_approvals smallint NOT NULL DEFAULT 1,
+    status character varying(32) NOT NULL DEFAULT 'pending',
+    resolved_at timestamp without time zone NULL,
+    CONSTRAINT flag_change_request_action_check CHECK (action IN ('update', 'edit', 'delete', 'promote')),
+    CONSTRAINT flag_change_request_status_check CHECK (status IN ('pending', 'applied', 'rejected'))
+);
+
+CREATE INDEX flag_change_request_pending_idx
+    ON public.flag_change_request (environment_id)
+    WHERE status = 'pending';
+
+CREATE TABLE public.flag_change_review (
+    id serial PRIMARY KEY,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    change_request_id integer NOT NULL REFERENCES public.flag_change_request(id) ON DELETE CASCADE,
+    reviewer_id integer NOT NULL REFERENCES public."user"(id) ON DELETE CASCADE,
+    decision character varying(16) NOT NULL,
+    comment text NULL,
+    CONSTRAINT flag_change_review_unique_reviewer UNIQUE (change_request_id, reviewer_id),
+    CONSTRAINT flag_change_review_decision_check CHECK (decision IN ('approve', 'reject'))
+);
@@ -0,0 +1,8 @@
+-- Evaluation traffic per flag, single lookups evaluate a flag while bulk and sdk fetches only serve it
+CREATE TABLE public.flag_evaluation (
+    flag_id integer PRIMARY KEY REFERENCES public.flag(id) ON DELETE CASCADE,
+    evaluations bigint NOT NULL DEFAULT 0,
+    served bigint NOT NULL DEFAULT 0,
+    last_evaluated_at timestamp without time zone NULL,
+    last_served_at timestamp without time zone NULL
+);
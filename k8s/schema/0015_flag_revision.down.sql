@@ -0,0 +1,12 @@
+DROP TRIGGER IF EXISTS flag_definition_revision_delete ON public.flag_definition;
+DROP TRIGGER IF EXISTS flag_definition_revision_update ON public.flag_definition;
+DROP TRIGGER IF EXISTS flag_tombstone_delete ON public.flag;
+DROP TRIGGER IF EXISTS flag_revision_update ON public.flag;
+DROP TRIGGER IF EXISTS flag_revision_insert ON public.flag;
+DROP FUNCTION IF EXISTS public.flag_definition_revision();
+DROP FUNCTION IF EXISTS public.flag_tombstone();
+DROP FUNCTION IF EXISTS public.flag_revision();
+DROP FUNCTION IF EXISTS public.next_environment_revision(integer);
+DROP TABLE IF EXISTS public.flag_tombstone;
+ALTER TABLE public.flag DROP COLUMN IF EXISTS revision;
+ALTER TABLE public.environment DROP COLUMN IF EXISTS revision;
@@ -0,0 +1,101 @@
+-- Every change to an environment's flags moves it on a revision, sdks ask for what changed since the one they hold
+ALTER TABLE public.environment
+    ADD COLUMN revision bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE public.flag
+    ADD COLUMN revision bigint NOT NULL DEFAULT 0;
+
+-- Keys deleted from an environment, until they come back
+CREATE TABLE public.flag_tombstone (
+    environment_id integer NOT NULL REFERENCES public.environment(id) ON DELETE CASCADE,
+    name character varying(255) NOT NULL,
+    revision bigint NOT NULL,
+    deleted_at timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (environment_id, name)
+);
+
+CREATE FUNCTION public.next_environment_revision(env integer) RETURNS bigint AS $$
+    UPDATE public.environment SET revision = revision + 1 WHERE id = env RETURNING revision;
+$$ LANGUAGE sql;
+
+-- a written flag takes the environment's next revision, unless the write set one itself
+CREATE FUNCTION public.flag_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' OR NEW.revision IS NOT DISTINCT FROM OLD.revision THEN
+        NEW.revision := COALESCE(public.next_environment_revision(NEW.environment_id), 0);
+    END IF;
+
+    DELETE FROM public.flag_tombstone t
+    USING public.flag_definition d
+    WHERE d.id = NEW.definition_id
+      AND t.environment_id = NEW.environment_id
+      AND t.name = d.name;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- a flag deleted on its own leaves a tombstone, flags going with their definition are buried by it
+CREATE FUNCTION public.flag_tombstone() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO public.flag_tombstone (environment_id, name, revision)
+    SELECT env.id, d.name, public.next_environment_revision(env.id)
+    FROM public.flag_definition d
+      JOIN public.environment env ON env.id = OLD.environment_id
+    WHERE d.id = OLD.definition_id
+    ON CONFLICT (environment_id, name) DO UPDATE
+    SET
+      revision = EXCLUDED.revision,
+      deleted_at = now();
+
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+-- a definition change is a change to the key in every environment, a rename deletes the old key
+CREATE FUNCTION public.flag_definition_revision() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' OR OLD.name <> NEW.name THEN
+        INSERT INTO public.flag_tombstone (environment_id, name, revision)
+        SELECT env.id, OLD.name, public.next_environment_revision(env.id)
+        FROM public.flag f
+          JOIN public.environment env ON env.id = f.environment_id
+        WHERE f.definition_id = OLD.id
+        ON CONFLICT (environment_id, name) DO UPDATE
+        SET
+          revision = EXCLUDED.revision,
+          deleted_at = now();
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+
+    UPDATE public.flag
+    SET revision = public.next_environment_revision(environment_id)
+    WHERE definition_id = NEW.id;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER flag_revision_insert
+    BEFORE INSERT ON public.flag
+    FOR EACH ROW EXECUTE FUNCTION public.flag_revision();
+
+CREATE TRIGGER flag_revision_update
+    BEFORE UPDATE ON public.flag
+    FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*)
+    EXECUTE FUNCTION public.flag_revision();
+
+CREATE TRIGGER flag_tombstone_delete
+    AFTER DELETE ON public.flag
+    FOR EACH ROW EXECUTE FUNCTION public.flag_tombstone();
+
+CREATE TRIGGER flag_definition_revision_update
+    AFTER UPDATE ON public.flag_definition
+    FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*)
+    EXECUTE FUNCTION public.flag_definition_revision();
+
+CREATE TRIGGER flag_definition_revision_delete
+    BEFORE DELETE ON public.flag_definition
+    FOR EACH ROW EXECUTE FUNCTION public.flag_definition_revision();
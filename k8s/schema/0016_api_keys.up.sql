@@ -0,0 +1,19 @@
+-- API keys as issued, the key id is the jti of the token so a key can be revoked, rotated and seen being used
+CREATE TABLE public.api_key (
+    id serial PRIMARY KEY,
+    key_id character varying(255) NOT NULL UNIQUE,
+    name character varying(255) NOT NULL DEFAULT '',
+    agent_id integer NOT NULL REFERENCES public.agent(id) ON DELETE CASCADE,
+    environment_id integer NULL REFERENCES public.environment(id) ON DELETE CASCADE,
+    scopes text[] NOT NULL DEFAULT '{flags:read}',
+    created_by_subject character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at timestamp without time zone NOT NULL,
+    last_used_at timestamp without time zone NULL,
+    revoked boolean NOT NULL DEFAULT false,
+    revoked_at timestamp without time zone NULL,
+    replaced_by character varying(255) NULL
+);
+
+CREATE INDEX api_key_agent_idx
+    ON public.api_key (agent_id);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.api_key_legacy_retirement;
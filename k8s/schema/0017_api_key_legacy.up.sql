@@ -0,0 +1,9 @@
+-- Keys issued before keys were stored have no row of their own, they're retired per agent by an explicit rotation
+-- that issues the stored key replacing them
+CREATE TABLE public.api_key_legacy_retirement (
+    agent_id integer PRIMARY KEY REFERENCES public.agent(id) ON DELETE CASCADE,
+    retires_at timestamp without time zone NOT NULL,
+    replaced_by character varying(255) NOT NULL,
+    created_by_subject character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);